@@ -0,0 +1,398 @@
+/*
+Implements an in-memory B-tree keyed by strings. Trees can be cloned in
+constant time: a clone shares all nodes with the original and each side
+copies a node the first time it modifies it, so a clone is a stable
+point-in-time view that can be read without locks while the original
+keeps changing.
+*/
+package btree
+
+import (
+	"sort"
+)
+
+const DefaultDegree = 32
+
+type item[V any] struct {
+	key   string
+	value V
+}
+
+type items[V any] []item[V]
+
+/*
+Returns the index of the first item with a key greater than or equal to
+key, and whether that item's key equals key.
+*/
+func (s items[V]) find(key string) (int, bool) {
+	i := sort.Search(len(s), func(i int) bool {
+		return s[i].key >= key
+	})
+	return i, i < len(s) && s[i].key == key
+}
+
+func (s *items[V]) insertAt(index int, it item[V]) {
+	var zero item[V]
+	*s = append(*s, zero)
+	copy((*s)[index+1:], (*s)[index:])
+	(*s)[index] = it
+}
+
+func (s *items[V]) removeAt(index int) item[V] {
+	it := (*s)[index]
+	copy((*s)[index:], (*s)[index+1:])
+	var zero item[V]
+	(*s)[len(*s)-1] = zero
+	*s = (*s)[:len(*s)-1]
+	return it
+}
+
+func (s *items[V]) pop() item[V] {
+	return s.removeAt(len(*s) - 1)
+}
+
+type children[V any] []*node[V]
+
+func (s *children[V]) insertAt(index int, n *node[V]) {
+	*s = append(*s, nil)
+	copy((*s)[index+1:], (*s)[index:])
+	(*s)[index] = n
+}
+
+func (s *children[V]) removeAt(index int) *node[V] {
+	n := (*s)[index]
+	copy((*s)[index:], (*s)[index+1:])
+	(*s)[len(*s)-1] = nil
+	*s = (*s)[:len(*s)-1]
+	return n
+}
+
+func (s *children[V]) pop() *node[V] {
+	return s.removeAt(len(*s) - 1)
+}
+
+/*
+Identifies which tree may modify a node in place. A node belongs to the
+tree whose context it carries; any other tree must copy it first.
+*/
+type copyOnWriteContext struct {
+	_ byte
+}
+
+type node[V any] struct {
+	items    items[V]
+	children children[V]
+	cow      *copyOnWriteContext
+}
+
+func (n *node[V]) mutableFor(cow *copyOnWriteContext) *node[V] {
+	if n.cow == cow {
+		return n
+	}
+	out := &node[V]{cow: cow}
+	out.items = make(items[V], len(n.items), cap(n.items))
+	copy(out.items, n.items)
+	if len(n.children) > 0 {
+		out.children = make(children[V], len(n.children), cap(n.children))
+		copy(out.children, n.children)
+	}
+	return out
+}
+
+func (n *node[V]) mutableChild(i int) *node[V] {
+	c := n.children[i].mutableFor(n.cow)
+	n.children[i] = c
+	return c
+}
+
+/*
+Splits the node at index i. The item at i is returned together with a new
+node holding everything after it.
+*/
+func (n *node[V]) split(i int) (item[V], *node[V]) {
+	it := n.items[i]
+	next := &node[V]{cow: n.cow}
+	next.items = append(next.items, n.items[i+1:]...)
+	for j := i; j < len(n.items); j++ {
+		var zero item[V]
+		n.items[j] = zero
+	}
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		for j := i + 1; j < len(n.children); j++ {
+			n.children[j] = nil
+		}
+		n.children = n.children[:i+1]
+	}
+	return it, next
+}
+
+func (n *node[V]) maybeSplitChild(i, maxItems int) bool {
+	if len(n.children[i].items) < maxItems {
+		return false
+	}
+	first := n.mutableChild(i)
+	it, second := first.split(maxItems / 2)
+	n.items.insertAt(i, it)
+	n.children.insertAt(i+1, second)
+	return true
+}
+
+func (n *node[V]) insert(it item[V], maxItems int) (item[V], bool) {
+	i, found := n.items.find(it.key)
+	if found {
+		old := n.items[i]
+		n.items[i] = it
+		return old, true
+	}
+	if len(n.children) == 0 {
+		n.items.insertAt(i, it)
+		return item[V]{}, false
+	}
+	if n.maybeSplitChild(i, maxItems) {
+		switch inTree := n.items[i]; {
+		case it.key < inTree.key:
+		case it.key > inTree.key:
+			i++
+		default:
+			n.items[i] = it
+			return inTree, true
+		}
+	}
+	return n.mutableChild(i).insert(it, maxItems)
+}
+
+func (n *node[V]) get(key string) (item[V], bool) {
+	i, found := n.items.find(key)
+	if found {
+		return n.items[i], true
+	}
+	if len(n.children) > 0 {
+		return n.children[i].get(key)
+	}
+	return item[V]{}, false
+}
+
+type removeKind int
+
+const (
+	removeItem removeKind = iota
+	removeMax
+)
+
+/*
+Removes an item from the subtree rooted at n, making sure every child it
+descends into has more than the minimum number of items so that removing
+from it never leaves it underfull.
+*/
+func (n *node[V]) remove(key string, minItems int, kind removeKind) (item[V], bool) {
+	var i int
+	var found bool
+	switch kind {
+	case removeMax:
+		if len(n.children) == 0 {
+			return n.items.pop(), true
+		}
+		i = len(n.items)
+	case removeItem:
+		i, found = n.items.find(key)
+		if len(n.children) == 0 {
+			if found {
+				return n.items.removeAt(i), true
+			}
+			return item[V]{}, false
+		}
+	}
+
+	if len(n.children[i].items) <= minItems {
+		return n.growChildAndRemove(i, key, minItems, kind)
+	}
+	child := n.mutableChild(i)
+	if found {
+		// Replace the item with its predecessor, which the child can spare.
+		out := n.items[i]
+		n.items[i], _ = child.remove("", minItems, removeMax)
+		return out, true
+	}
+	return child.remove(key, minItems, kind)
+}
+
+/*
+Gives child i an extra item, by borrowing from a sibling or by merging it
+with one, and retries the removal.
+*/
+func (n *node[V]) growChildAndRemove(i int, key string, minItems int, kind removeKind) (item[V], bool) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > minItems:
+		child := n.mutableChild(i)
+		stealFrom := n.mutableChild(i - 1)
+		stolen := stealFrom.items.pop()
+		child.items.insertAt(0, n.items[i-1])
+		n.items[i-1] = stolen
+		if len(stealFrom.children) > 0 {
+			child.children.insertAt(0, stealFrom.children.pop())
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > minItems:
+		child := n.mutableChild(i)
+		stealFrom := n.mutableChild(i + 1)
+		stolen := stealFrom.items.removeAt(0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if len(stealFrom.children) > 0 {
+			child.children = append(child.children, stealFrom.children.removeAt(0))
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+		mergeItem := n.items.removeAt(i)
+		mergeChild := n.children.removeAt(i + 1)
+		child.items = append(child.items, mergeItem)
+		child.items = append(child.items, mergeChild.items...)
+		child.children = append(child.children, mergeChild.children...)
+	}
+	return n.remove(key, minItems, kind)
+}
+
+/*
+Calls fn for every item with start <= key < end in ascending order until fn
+returns false. It returns false if the iteration was stopped.
+*/
+func (n *node[V]) ascend(start, end string, hasEnd bool, fn func(key string, value V) bool) bool {
+	i, _ := n.items.find(start)
+	for ; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(start, end, hasEnd, fn) {
+			return false
+		}
+		if hasEnd && n.items[i].key >= end {
+			return false
+		}
+		if !fn(n.items[i].key, n.items[i].value) {
+			return false
+		}
+	}
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascend(start, end, hasEnd, fn)
+	}
+	return true
+}
+
+/*
+A B-tree mapping strings to values of type V. A BTree is not safe for
+concurrent modification, but a clone may be read while the tree it was
+cloned from is being modified.
+*/
+type BTree[V any] struct {
+	degree int
+	length int
+	root   *node[V]
+	cow    *copyOnWriteContext
+}
+
+/*
+Creates an empty tree whose nodes hold between degree-1 and 2*degree-1
+items.
+*/
+func New[V any](degree int) *BTree[V] {
+	if degree < 2 {
+		degree = 2
+	}
+	return &BTree[V]{degree: degree, cow: &copyOnWriteContext{}}
+}
+
+func (t *BTree[V]) maxItems() int {
+	return 2*t.degree - 1
+}
+
+func (t *BTree[V]) minItems() int {
+	return t.degree - 1
+}
+
+func (t *BTree[V]) Len() int {
+	return t.length
+}
+
+func (t *BTree[V]) Get(key string) (V, bool) {
+	if t.root == nil {
+		var zero V
+		return zero, false
+	}
+	it, ok := t.root.get(key)
+	return it.value, ok
+}
+
+/*
+Inserts or replaces the value for key. It returns the previous value and
+whether there was one.
+*/
+func (t *BTree[V]) Set(key string, value V) (V, bool) {
+	it := item[V]{key: key, value: value}
+	if t.root == nil {
+		t.root = &node[V]{cow: t.cow}
+		t.root.items = append(t.root.items, it)
+		t.length++
+		var zero V
+		return zero, false
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	if len(t.root.items) >= t.maxItems() {
+		middle, second := t.root.split(t.maxItems() / 2)
+		oldRoot := t.root
+		t.root = &node[V]{cow: t.cow}
+		t.root.items = append(t.root.items, middle)
+		t.root.children = append(t.root.children, oldRoot, second)
+	}
+
+	old, replaced := t.root.insert(it, t.maxItems())
+	if !replaced {
+		t.length++
+	}
+	return old.value, replaced
+}
+
+/*
+Removes key from the tree. It returns the removed value and whether the key
+was present.
+*/
+func (t *BTree[V]) Delete(key string) (V, bool) {
+	if t.root == nil || len(t.root.items) == 0 {
+		var zero V
+		return zero, false
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	out, ok := t.root.remove(key, t.minItems(), removeItem)
+	if len(t.root.items) == 0 && len(t.root.children) > 0 {
+		t.root = t.root.children[0]
+	}
+	if ok {
+		t.length--
+	}
+	return out.value, ok
+}
+
+/*
+Calls fn for every key in [start, end) in ascending order until fn returns
+false. An empty end means no upper bound.
+*/
+func (t *BTree[V]) Ascend(start, end string, fn func(key string, value V) bool) {
+	if t.root == nil {
+		return
+	}
+	t.root.ascend(start, end, end != "", fn)
+}
+
+/*
+Returns a copy of the tree in constant time. Both trees lazily copy shared
+nodes before modifying them, so neither observes changes made to the other.
+*/
+func (t *BTree[V]) Clone() *BTree[V] {
+	cow1, cow2 := *t.cow, *t.cow
+	out := *t
+	t.cow = &cow1
+	out.cow = &cow2
+	return &out
+}
@@ -0,0 +1,118 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func keys(t *BTree[int], start, end string) []string {
+	var out []string
+	t.Ascend(start, end, func(key string, _ int) bool {
+		out = append(out, key)
+		return true
+	})
+	return out
+}
+
+func assertKeys(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("key %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBTree(t *testing.T) {
+	t.Run("should match a map under random operations", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		tree := New[int](2)
+		model := make(map[string]int)
+
+		for i := 0; i < 20000; i++ {
+			key := fmt.Sprintf("%04d", rng.Intn(1000))
+			if rng.Intn(3) == 0 {
+				_, ok := tree.Delete(key)
+				_, want := model[key]
+				if ok != want {
+					t.Fatalf("delete %s: got %v, want %v", key, ok, want)
+				}
+				delete(model, key)
+			} else {
+				_, replaced := tree.Set(key, i)
+				_, want := model[key]
+				if replaced != want {
+					t.Fatalf("set %s: got replaced %v, want %v", key, replaced, want)
+				}
+				model[key] = i
+			}
+		}
+
+		if tree.Len() != len(model) {
+			t.Fatalf("got length %d, want %d", tree.Len(), len(model))
+		}
+		want := make([]string, 0, len(model))
+		for key, value := range model {
+			want = append(want, key)
+			if got, ok := tree.Get(key); !ok || got != value {
+				t.Fatalf("get %s: got %d, %v, want %d", key, got, ok, value)
+			}
+		}
+		sort.Strings(want)
+		assertKeys(t, keys(tree, "", ""), want)
+	})
+
+	t.Run("should iterate over a half-open range", func(t *testing.T) {
+		tree := New[int](2)
+		for i := 0; i < 100; i++ {
+			tree.Set(fmt.Sprintf("%02d", i), i)
+		}
+
+		var want []string
+		for i := 25; i < 50; i++ {
+			want = append(want, fmt.Sprintf("%02d", i))
+		}
+		assertKeys(t, keys(tree, "25", "50"), want)
+		assertKeys(t, keys(tree, "245", "255"), []string{"25"})
+		assertKeys(t, keys(tree, "98", ""), []string{"98", "99"})
+
+		var stopped []string
+		tree.Ascend("", "", func(key string, _ int) bool {
+			stopped = append(stopped, key)
+			return len(stopped) < 3
+		})
+		assertKeys(t, stopped, []string{"00", "01", "02"})
+	})
+
+	t.Run("should keep clones isolated", func(t *testing.T) {
+		tree := New[int](2)
+		for i := 0; i < 50; i++ {
+			tree.Set(fmt.Sprintf("%02d", i), i)
+		}
+		clone := tree.Clone()
+
+		for i := 0; i < 50; i += 2 {
+			tree.Delete(fmt.Sprintf("%02d", i))
+		}
+		tree.Set("11", -1)
+		clone.Set("99", 99)
+
+		if clone.Len() != 51 || tree.Len() != 25 {
+			t.Fatalf("got lengths %d and %d, want 51 and 25", clone.Len(), tree.Len())
+		}
+		if value, _ := clone.Get("11"); value != 11 {
+			t.Errorf("clone observed a write to the original")
+		}
+		if _, ok := tree.Get("99"); ok {
+			t.Errorf("original observed a write to the clone")
+		}
+		if _, ok := clone.Get("00"); !ok {
+			t.Errorf("clone observed a delete from the original")
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+const AdminPrefix = "/" + store.ReservedKeyPrefix + "admin/"
+
+type Admin interface {
+	Snapshot() (store.SnapshotInfo, error)
+	Stats() store.EngineStats
+}
+
+/*
+Serves operational endpoints that act on the local node only.
+*/
+type AdminHandler struct {
+	Store Admin
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, AdminPrefix) {
+	case "snapshot":
+		h.handleSnapshot(w, r)
+	case "stats":
+		h.handleStats(w, r)
+	default:
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+/*
+Triggers a snapshot of the local store and waits for it to complete.
+*/
+func (h *AdminHandler) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := h.Store.Snapshot()
+	switch {
+	case errors.Is(err, store.ErrSnapshotInProgress):
+		writeJSONError(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, store.ErrPersistenceDisabled), errors.Is(err, store.ErrSnapshotUnsupported):
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (h *AdminHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Store.Stats())
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+type MockAdmin struct {
+	err error
+}
+
+func (a *MockAdmin) Snapshot() (store.SnapshotInfo, error) {
+	if a.err != nil {
+		return store.SnapshotInfo{}, a.err
+	}
+	return store.SnapshotInfo{Seq: 42, Keys: 3}, nil
+}
+
+func (a *MockAdmin) Stats() store.EngineStats {
+	return store.EngineStats{Name: "memory", Keys: 3}
+}
+
+func TestAdminHandler_Snapshot(t *testing.T) {
+	tests := []struct {
+		desc       string
+		method     string
+		err        error
+		wantStatus int
+	}{
+		{desc: "successful snapshot", method: http.MethodPost, wantStatus: http.StatusOK},
+		{desc: "snapshot in progress", method: http.MethodPost, err: store.ErrSnapshotInProgress, wantStatus: http.StatusConflict},
+		{desc: "persistence disabled", method: http.MethodPost, err: store.ErrPersistenceDisabled, wantStatus: http.StatusBadRequest},
+		{desc: "wrong method", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := &AdminHandler{Store: &MockAdmin{err: tt.err}}
+			req, rr := setupRequestAndRecorder(tt.method, "/_/admin/snapshot", "")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, tt.wantStatus)
+
+			if tt.wantStatus == http.StatusOK {
+				var info store.SnapshotInfo
+				if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+					t.Fatalf("Failed to unmarshal response: %v", err)
+				}
+				if info.Seq != 42 {
+					t.Errorf("unexpected snapshot seq: got %d want 42", info.Seq)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminHandler_Stats(t *testing.T) {
+	h := &AdminHandler{Store: &MockAdmin{}}
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/_/admin/stats", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	var stats store.EngineStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	assertResponseBody(t, stats.Name, "memory")
+}
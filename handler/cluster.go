@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+const ClusterPrefix = "/" + store.ReservedKeyPrefix + "cluster/"
+
+type Cluster interface {
+	ClusterConfig() store.ClusterConfig
+	PendingHints() map[string]int
+	MerkleTree(peer string) (store.MerkleTree, error)
+	RangeKeys(ranges []uint32) (map[string]string, error)
+	AntiEntropy() (store.AntiEntropyReport, error)
+	LastAntiEntropy() store.AntiEntropyReport
+}
+
+/*
+Serves endpoints that describe the cluster as this node sees it.
+*/
+type ClusterHandler struct {
+	Store Cluster
+}
+
+func (h *ClusterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, ClusterPrefix) {
+	case "config":
+		h.handleConfig(w, r)
+	case "hints":
+		h.handleHints(w, r)
+	case "merkle":
+		h.handleMerkleTree(w, r)
+	case "merkle/keys":
+		h.handleRangeKeys(w, r)
+	case "anti-entropy":
+		h.handleAntiEntropy(w, r)
+	default:
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+/*
+Reports the replication factor, the read and write quorums and the ring
+members this node runs with.
+*/
+func (h *ClusterHandler) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Store.ClusterConfig())
+}
+
+/*
+Reports how many writes this node holds as hints for each node that was
+down when they were made.
+*/
+func (h *ClusterHandler) handleHints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pending": h.Store.PendingHints()})
+}
+
+/*
+Returns the Merkle tree of this node over the ranges it replicates together
+with the node named by the peer query parameter.
+*/
+func (h *ClusterHandler) handleMerkleTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peer := r.URL.Query().Get("peer")
+	if peer == "" {
+		writeJSONError(w, "peer is required", http.StatusBadRequest)
+		return
+	}
+
+	tree, err := h.Store.MerkleTree(peer)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
+/*
+Returns the digests of the keys this node holds in the ranges listed in the
+request body as {"ranges": [...]}.
+*/
+func (h *ClusterHandler) handleRangeKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Ranges []uint32 `json:"ranges"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	keys, err := h.Store.RangeKeys(request.Ranges)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+/*
+POST runs an anti-entropy round now and waits for its report; GET returns
+the report of the last round.
+*/
+func (h *ClusterHandler) handleAntiEntropy(w http.ResponseWriter, r *http.Request) {
+	var report store.AntiEntropyReport
+	switch r.Method {
+	case http.MethodGet:
+		report = h.Store.LastAntiEntropy()
+	case http.MethodPost:
+		var err error
+		report, err = h.Store.AntiEntropy()
+		if errors.Is(err, store.ErrAntiEntropyInProgress) {
+			writeJSONError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
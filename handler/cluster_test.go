@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+type MockCluster struct {
+	antiEntropyErr error
+	ranges         []uint32
+}
+
+func (c *MockCluster) ClusterConfig() store.ClusterConfig {
+	return store.ClusterConfig{Self: "node1", Nodes: []string{"node1", "node2", "node3"}, N: 3, R: 2, W: 2, Overlapping: true}
+}
+
+func (c *MockCluster) PendingHints() map[string]int {
+	return map[string]int{"node2": 4}
+}
+
+func (c *MockCluster) MerkleTree(peer string) (store.MerkleTree, error) {
+	return store.MerkleTree{Ranges: []uint32{7}, Levels: [][][]byte{{[]byte(peer)}}}, nil
+}
+
+func (c *MockCluster) RangeKeys(ranges []uint32) (map[string]string, error) {
+	c.ranges = ranges
+	return map[string]string{"a": "digest"}, nil
+}
+
+func (c *MockCluster) AntiEntropy() (store.AntiEntropyReport, error) {
+	if c.antiEntropyErr != nil {
+		return store.AntiEntropyReport{}, c.antiEntropyErr
+	}
+	return store.AntiEntropyReport{RangesCompared: 3, KeysRepaired: 1}, nil
+}
+
+func (c *MockCluster) LastAntiEntropy() store.AntiEntropyReport {
+	return store.AntiEntropyReport{RangesCompared: 2}
+}
+
+func TestClusterHandler_Config(t *testing.T) {
+	h := &ClusterHandler{Store: &MockCluster{}}
+
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/_/cluster/config", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	var config store.ClusterConfig
+	if err := json.Unmarshal(rr.Body.Bytes(), &config); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if config.N != 3 || config.R != 2 || config.W != 2 {
+		t.Errorf("unexpected config: got %+v", config)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/cluster/config", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusMethodNotAllowed)
+}
+
+func TestClusterHandler_Hints(t *testing.T) {
+	h := &ClusterHandler{Store: &MockCluster{}}
+
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/_/cluster/hints", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	var response struct {
+		Pending map[string]int `json:"pending"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if response.Pending["node2"] != 4 {
+		t.Errorf("unexpected pending hints: got %v", response.Pending)
+	}
+}
+
+func TestClusterHandler_Merkle(t *testing.T) {
+	mock := &MockCluster{}
+	h := &ClusterHandler{Store: mock}
+
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/_/cluster/merkle?peer=node2", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	var tree store.MerkleTree
+	if err := json.Unmarshal(rr.Body.Bytes(), &tree); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	assertResponseBody(t, string(tree.Levels[0][0]), "node2")
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/cluster/merkle", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/cluster/merkle/keys", `{"ranges": [7, 9]}`)
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	assertResponseBody(t, rr.Body.String(), `{"keys":{"a":"digest"}}`+"\n")
+	if len(mock.ranges) != 2 || mock.ranges[1] != 9 {
+		t.Errorf("unexpected ranges: got %v", mock.ranges)
+	}
+}
+
+func TestClusterHandler_AntiEntropy(t *testing.T) {
+	mock := &MockCluster{}
+	h := &ClusterHandler{Store: mock}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/cluster/anti-entropy", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	var report store.AntiEntropyReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if report.RangesCompared != 3 || report.KeysRepaired != 1 {
+		t.Errorf("unexpected report: got %+v", report)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/cluster/anti-entropy", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	mock.antiEntropyErr = store.ErrAntiEntropyInProgress
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/cluster/anti-entropy", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusConflict)
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+/*
+Adds the by query parameter, 1 if it is missing, to the integer held by the
+key, POST /{key}/incr, or subtracts it, POST /{key}/decr, and responds
+with the result: {"value": N}. A key that does not exist counts as zero,
+and one that holds anything but an integer is rejected with 422
+Unprocessable Entity. Requests from other nodes are increments forwarded
+to this node because it owns the key.
+*/
+func (h *Handler) handleIncrement(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSpace(r.URL.Path[1:])
+	key, op := path, ""
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		key, op = path[:i], path[i+1:]
+	}
+	if op != "incr" && op != "decr" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	by := int64(1)
+	if raw := r.URL.Query().Get("by"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeJSONError(w, "by must be an integer", http.StatusBadRequest)
+			return
+		}
+		by = n
+	}
+	if op == "decr" {
+		if by == -by && by != 0 {
+			writeJSONError(w, "by is out of range", http.StatusBadRequest)
+			return
+		}
+		by = -by
+	}
+	consistency, err := parseConsistency(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := store.WriteOptions{Consistency: consistency, Forwarded: r.Header.Get(store.ReplicationHeader) == "true"}
+
+	value, err := h.Store.Increment(key, by, opts)
+	switch {
+	case errors.Is(err, store.ErrNotInteger):
+		writeJSONError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, store.ErrKeyLocked), errors.Is(err, store.ErrPreconditionFailed):
+		writeJSONError(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, store.ErrOutOfMemory):
+		writeJSONError(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		writeJSONError(w, err.Error(), replicationStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.CounterValue{Value: value})
+}
@@ -2,9 +2,14 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Firaz-Ilhan/distributed-kvstore/store"
 )
@@ -19,64 +24,261 @@ func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(ErrorResponse{Error: message})
 }
 
+const (
+	TTLHeader = "X-TTL"
+	// The number of replicas that answered a read, including the node that
+	// coordinated it if it is one of them.
+	ReplicasAnsweredHeader = "X-Replicas-Answered"
+	// How a read repairs stale replicas: sync, or the probability of a
+	// repair in the background.
+	ReadRepairHeader = "X-Read-Repair"
+	// How many replicas a request waits for: ONE, QUORUM, ALL or LOCAL.
+	ConsistencyHeader = "X-Consistency"
+)
+
 type Storer interface {
-	Get(key string) (value string, ok bool)
-	Set(key, value string, skipReplication bool) error
-	Delete(key string, skipReplication bool) error
+	Open(key string) (item store.KeyValue, value io.ReadSeeker, ok bool)
+	OpenReplica(key string) (item store.KeyValue, value io.ReadSeeker, ok bool)
+	Read(key string, opts store.ReadOptions) (store.ReadResult, error)
+	SetStream(key string, value io.Reader, opts store.WriteOptions) (bool, error)
+	Delete(key string, opts store.WriteOptions) error
+	ScanReplica(start, end string, limit int) ([]store.KeyValue, error)
+	ScanCluster(start, end string, limit int) (store.ScanResult, error)
+	StoreHint(owner, method, key string, header http.Header, value io.Reader) error
+	Increment(key string, by int64, opts store.WriteOptions) (int64, error)
 }
 
 type Handler struct {
 	Store Storer
+	// The largest value a PUT may carry, in bytes. Zero means no limit.
+	MaxValueSize int64
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case http.MethodGet:
+	case http.MethodGet, http.MethodHead:
+		if r.URL.Path == "/" && r.Method == http.MethodGet {
+			h.handleScan(w, r)
+			return
+		}
 		h.handleGet(w, r)
-	case http.MethodPut:
-		h.handlePut(w, r)
-	case http.MethodDelete:
-		h.handleDelete(w, r)
+	case http.MethodPut, http.MethodDelete:
+		if owner := r.Header.Get(store.HintHeader); owner != "" && r.Header.Get(store.ReplicationHeader) == "true" {
+			h.handleHint(w, r, owner)
+			return
+		}
+		if r.Method == http.MethodPut {
+			h.handlePut(w, r)
+		} else {
+			h.handleDelete(w, r)
+		}
+	case http.MethodPost:
+		h.handleIncrement(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+/*
+Reads a key from the replicas that hold it. Requests from other nodes read
+only the local copy and also get the timestamps of the copy, which the
+coordinator compares, and the content type it was stored with. A key this node holds a tombstone for is not found
+either, but such requests are told that it was deleted, and when.
+*/
 func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimSpace(r.URL.Path[1:])
-	value, ok := h.Store.Get(key)
-	if !ok {
+	forwarded := r.Header.Get(store.ReplicationHeader) == "true"
+	var result store.ReadResult
+	if forwarded {
+		result.Item, result.Value, result.Found = h.Store.OpenReplica(key)
+	} else {
+		opts, err := parseReadOptions(r)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if result, err = h.Store.Read(key, opts); err != nil {
+			writeJSONError(w, err.Error(), replicationStatus(err))
+			return
+		}
+		w.Header().Set(ReplicasAnsweredHeader, strconv.Itoa(result.Answered))
+	}
+	if !result.Found {
 		writeJSONError(w, "Not found", http.StatusNotFound)
 		return
 	}
+	defer result.Close()
+	item, value := result.Item, result.Value
+	if forwarded {
+		w.Header().Set(store.TimestampHeader, strconv.FormatInt(item.Modified, 10))
+		if item.HLC.Node != "" {
+			w.Header().Set(store.HLCHeader, item.HLC.String())
+		}
+		if item.Expires != 0 {
+			w.Header().Set(store.ExpiresHeader, strconv.FormatInt(item.Expires, 10))
+		}
+		if item.ContentType != "" {
+			w.Header().Set(store.ContentTypeHeader, item.ContentType)
+		}
+	}
+	if item.Expires != 0 {
+		remaining := time.Until(time.Unix(0, item.Expires))
+		// Round up so that a key is never reported with a TTL of zero.
+		w.Header().Set(TTLHeader, strconv.FormatInt(int64((remaining+time.Second-1)/time.Second), 10))
+	}
+	if item.Version != 0 {
+		w.Header().Set("ETag", store.FormatETag(item.Version))
+	}
+	if len(item.Context) > 0 {
+		w.Header().Set(store.ContextHeader, item.Context.String())
+	}
+	if forwarded && item.AllDeleted() {
+		w.Header().Set(store.DeletedHeader, "true")
+		writeJSONError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	if len(item.Siblings) > 0 {
+		status = http.StatusMultipleChoices
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	// Ranges only make sense for the value as stored, and siblings have to
+	// be listed together.
+	if len(item.Siblings) == 0 && (acceptsRaw(r) || r.Header.Get("Range") != "") {
+		contentType := item.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", time.Unix(0, item.Modified), value)
+		return
+	}
+
+	raw, err := io.ReadAll(value)
+	if err != nil {
+		writeJSONError(w, "Failed to read value", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(item.Siblings) == 0 {
+		json.NewEncoder(w).Encode(newGetResponse(raw, item.ContentType))
+		return
+	}
+
+	response := SiblingsResponse{Siblings: []GetResponse{newGetResponse(raw, item.ContentType)}}
+	for _, sibling := range item.Siblings {
+		response.Siblings = append(response.Siblings, newGetResponse(sibling.Value, sibling.ContentType))
+	}
+	w.WriteHeader(http.StatusMultipleChoices)
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+The default representation of a value. JSON values are embedded as they
+are, other values are given as a string, in base64 if they are not valid
+UTF-8.
+*/
+type GetResponse struct {
+	Value       interface{} `json:"value"`
+	Encoding    string      `json:"encoding,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+}
 
-	var parsedValue interface{}
-	err := json.Unmarshal([]byte(value), &parsedValue)
-	if err == nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"value": parsedValue})
+func newGetResponse(value []byte, contentType string) GetResponse {
+	response := GetResponse{ContentType: contentType}
+	if isJSON(contentType) && json.Valid(value) {
+		response.Value = json.RawMessage(value)
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"value": value})
+		response.Value, response.Encoding = store.EncodeValue(value)
 	}
+	return response
 }
 
+/*
+The values of a key that were written concurrently, most recent first. A
+write carrying the X-Context header of the response replaces all of them.
+*/
+type SiblingsResponse struct {
+	Siblings []GetResponse `json:"siblings"`
+}
+
+/*
+Reports whether the client asked for the value as stored, without the JSON
+envelope. Values are then streamed and may be requested in ranges.
+*/
+func acceptsRaw(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(part)
+			if err == nil && mediaType == "application/octet-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+/*
+Writes the body of the request to the key. The size of the value is
+checked before the store is touched: a Content-Length above MaxValueSize
+is rejected right away, and a body without one is cut off once it exceeds
+it, before the store commits anything, so a rejected upload leaves the key
+as it was.
+*/
 func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimSpace(r.URL.Path[1:])
-	_, exists := h.Store.Get(key)
-
-	value, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
+
+	body := r.Body
+	if h.MaxValueSize > 0 {
+		if r.ContentLength > h.MaxValueSize {
+			h.writeTooLarge(w)
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, h.MaxValueSize)
+	}
+
+	opts, err := parseWriteOptions(r)
 	if err != nil {
-		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.ContentType = r.Header.Get("Content-Type")
+	if !opts.SkipReplication {
+		if opts.TTL, err = parseTTL(r); err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	exists, err := h.Store.SetStream(key, body, opts)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.writeTooLarge(w)
+		return
+	}
+	if errors.Is(err, store.ErrOutOfMemory) {
+		writeJSONError(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		writeJSONError(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, store.ErrKeyLocked) {
+		writeJSONError(w, err.Error(), http.StatusConflict)
 		return
 	}
-
-	trimmedValue := strings.TrimSpace(string(value))
-	skipReplication := r.Header.Get(store.ReplicationHeader) == "true"
-	err = h.Store.Set(key, trimmedValue, skipReplication)
 	if err != nil {
-		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		writeJSONError(w, err.Error(), replicationStatus(err))
 		return
 	}
 
@@ -87,12 +289,244 @@ func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+The status of a request that failed in the store: 503 if too few replicas
+answered for its consistency level, so that clients can retry it or lower
+the level, 400 if its key is reserved, and 500 otherwise.
+*/
+func replicationStatus(err error) int {
+	if errors.Is(err, store.ErrNotEnoughReplicas) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, store.ErrReservedKey) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+/*
+Reads the consistency level of a request from the consistency query
+parameter or the X-Consistency header. The store's default is used if
+neither is given.
+*/
+func parseConsistency(r *http.Request) (store.Consistency, error) {
+	raw := r.URL.Query().Get("consistency")
+	if raw == "" {
+		raw = r.Header.Get(ConsistencyHeader)
+	}
+	if raw == "" {
+		return "", nil
+	}
+	level, err := store.ParseConsistency(raw)
+	if err != nil {
+		return "", errors.New("Invalid consistency level")
+	}
+	return level, nil
+}
+
+/*
+Reads whether a read may be served by any replica from the stale query
+parameter, which must be ok if given.
+*/
+func parseStale(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("stale") {
+	case "":
+		return false, nil
+	case "ok":
+		return true, nil
+	}
+	return false, errors.New("stale must be ok")
+}
+
+/*
+Holds a write forwarded for a replica that is down until it can be handed
+off to it.
+*/
+func (h *Handler) handleHint(w http.ResponseWriter, r *http.Request, owner string) {
+	key := strings.TrimSpace(r.URL.Path[1:])
+	defer r.Body.Close()
+
+	body := r.Body
+	if h.MaxValueSize > 0 {
+		if r.ContentLength > h.MaxValueSize {
+			h.writeTooLarge(w)
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, h.MaxValueSize)
+	}
+
+	err := h.Store.StoreHint(owner, r.Method, key, r.Header, body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		h.writeTooLarge(w)
+	case errors.Is(err, store.ErrHintsFull):
+		writeJSONError(w, err.Error(), http.StatusInsufficientStorage)
+	case err != nil:
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (h *Handler) writeTooLarge(w http.ResponseWriter) {
+	writeJSONError(w, fmt.Sprintf("Value exceeds the maximum size of %d bytes", h.MaxValueSize), http.StatusRequestEntityTooLarge)
+}
+
+/*
+Reads the time to live of a write from the ttl query parameter or the X-TTL
+header, given either as a duration such as 30s or as a number of seconds.
+Zero means the value does not expire.
+*/
+func parseTTL(r *http.Request) (time.Duration, error) {
+	raw := r.URL.Query().Get("ttl")
+	if raw == "" {
+		raw = r.Header.Get(TTLHeader)
+	}
+	if raw == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(raw)
+	if err != nil {
+		seconds, convErr := strconv.ParseInt(raw, 10, 64)
+		if convErr != nil {
+			return 0, errors.New("invalid ttl")
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+	return ttl, nil
+}
+
+/*
+Reads the consistency level of a read, whether it may be stale, and how it
+repairs the replicas that hold a stale copy, from the read_repair query
+parameter or the X-Read-Repair header: sync to repair them before
+responding, or the probability of repairing them in the background.
+*/
+func parseReadOptions(r *http.Request) (store.ReadOptions, error) {
+	var opts store.ReadOptions
+	var err error
+	if opts.Consistency, err = parseConsistency(r); err != nil {
+		return opts, err
+	}
+	if opts.Stale, err = parseStale(r); err != nil {
+		return opts, err
+	}
+	raw := r.URL.Query().Get("read_repair")
+	if raw == "" {
+		raw = r.Header.Get(ReadRepairHeader)
+	}
+	switch raw {
+	case "":
+		return opts, nil
+	case "sync":
+		opts.SyncRepair = true
+		return opts, nil
+	}
+
+	chance, err := strconv.ParseFloat(raw, 64)
+	if err != nil || chance < 0 || chance > 1 {
+		return opts, errors.New("read repair must be sync or a probability between 0 and 1")
+	}
+	opts.RepairChance = chance
+	if chance == 0 {
+		opts.RepairChance = -1
+	}
+	return opts, nil
+}
+
+/*
+Reads the options shared by writes. Writes forwarded by a coordinator carry
+its metadata in headers; those from clients may carry conditions on the
+version of the key as If-Match or If-None-Match: *, and a consistency
+level, and may have been relayed by a node that is not a replica of the
+key. Both may carry the causal context the write is based on.
+*/
+func parseWriteOptions(r *http.Request) (store.WriteOptions, error) {
+	opts := store.WriteOptions{SkipReplication: r.Header.Get(store.ReplicationHeader) == "true"}
+	var err error
+	if opts.SkipReplication {
+		if opts.Timestamp, err = parseIntHeader(r, store.TimestampHeader); err != nil {
+			return opts, errors.New("Invalid timestamp")
+		}
+		if opts.Expires, err = parseIntHeader(r, store.ExpiresHeader); err != nil {
+			return opts, errors.New("Invalid expiry")
+		}
+		if raw := r.Header.Get(store.VersionHeader); raw != "" {
+			if opts.Version, err = strconv.ParseUint(raw, 10, 64); err != nil {
+				return opts, errors.New("Invalid version")
+			}
+		}
+		opts.Condition.IfOlder = r.Header.Get(store.ConditionalHeader) == "true"
+		if raw := r.Header.Get(store.DotHeader); raw != "" {
+			if opts.Dot, err = store.ParseDot(raw); err != nil {
+				return opts, errors.New("Invalid dot")
+			}
+		}
+		if raw := r.Header.Get(store.HLCHeader); raw != "" {
+			if opts.HLC, err = store.ParseHybridTime(raw); err != nil {
+				return opts, errors.New("Invalid hybrid timestamp")
+			}
+		}
+	}
+
+	if raw := r.Header.Get(store.ContextHeader); raw != "" {
+		if opts.Context, err = store.ParseVectorClock(raw); err != nil {
+			return opts, errors.New("Invalid causal context")
+		}
+	}
+	if opts.SkipReplication {
+		return opts, nil
+	}
+
+	opts.Forwarded = r.Header.Get(store.RelayHeader) != ""
+	if opts.Consistency, err = parseConsistency(r); err != nil {
+		return opts, err
+	}
+	if raw := r.Header.Get("If-Match"); raw != "" {
+		if opts.Condition.IfMatch, err = store.ParseETag(raw); err != nil {
+			return opts, errors.New("Invalid If-Match")
+		}
+	}
+	if raw := r.Header.Get("If-None-Match"); raw != "" {
+		if strings.TrimSpace(raw) != "*" {
+			return opts, errors.New("Only If-None-Match: * is supported")
+		}
+		opts.Condition.IfNoneMatch = true
+	}
+	return opts, nil
+}
+
+func parseIntHeader(r *http.Request, name string) (int64, error) {
+	raw := r.Header.Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(raw, 10, 64)
+}
+
 func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimSpace(r.URL.Path[1:])
-	skipReplication := r.Header.Get(store.ReplicationHeader) == "true"
-	err := h.Store.Delete(key, skipReplication)
+	opts, err := parseWriteOptions(r)
 	if err != nil {
-		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.Store.Delete(key, opts)
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		writeJSONError(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, store.ErrKeyLocked) {
+		writeJSONError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, err.Error(), replicationStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -3,33 +3,139 @@ package handler
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
 )
 
 type MockStore struct {
-	data map[string]string
+	data        map[string]store.KeyValue
+	opts        store.WriteOptions
+	setErr      error
+	unavailable []string
+	readErr     error
+	readOpts    store.ReadOptions
+	answered    int
+	hints       []string
 }
 
-func (s *MockStore) Get(key string) (value string, ok bool) {
-	value, ok = s.data[key]
-	return
+func (s *MockStore) Open(key string) (store.KeyValue, io.ReadSeeker, bool) {
+	item, ok := s.data[key]
+	return item, bytes.NewReader(item.Value), ok
 }
 
-func (s *MockStore) Set(key, value string, skipReplication bool) error {
-	s.data[key] = value
-	return nil
+func (s *MockStore) OpenReplica(key string) (store.KeyValue, io.ReadSeeker, bool) {
+	return s.Open(key)
+}
+
+func (s *MockStore) Read(key string, opts store.ReadOptions) (store.ReadResult, error) {
+	s.readOpts = opts
+	if s.readErr != nil {
+		return store.ReadResult{}, s.readErr
+	}
+	item, value, ok := s.Open(key)
+	return store.ReadResult{Item: item, Value: value, Found: ok, Answered: s.answered}, nil
+}
+
+func (s *MockStore) SetStream(key string, body io.Reader, opts store.WriteOptions) (bool, error) {
+	if s.setErr != nil {
+		return false, s.setErr
+	}
+	value, err := io.ReadAll(body)
+	if err != nil {
+		return false, err
+	}
+	_, exists := s.data[key]
+	item := store.KeyValue{Key: key, Value: value, ContentType: opts.ContentType}
+	if opts.TTL > 0 {
+		item.Expires = time.Now().Add(opts.TTL).UnixNano()
+	}
+	s.data[key] = item
+	s.opts = opts
+	return exists, nil
 }
 
-func (s *MockStore) Delete(key string, skipReplication bool) error {
+func (s *MockStore) Delete(key string, opts store.WriteOptions) error {
+	if s.setErr != nil {
+		return s.setErr
+	}
+	s.opts = opts
 	delete(s.data, key)
 	return nil
 }
 
+func (s *MockStore) Scan(start, end string, limit int) ([]store.KeyValue, error) {
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	items := make([]store.KeyValue, len(keys))
+	for i, key := range keys {
+		items[i] = s.data[key]
+	}
+	return items, nil
+}
+
+func (s *MockStore) ScanReplica(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.Scan(start, end, limit)
+}
+
+func (s *MockStore) ScanCluster(start, end string, limit int) (store.ScanResult, error) {
+	items, _ := s.Scan(start, end, limit+1)
+	result := store.ScanResult{Items: items, Unavailable: s.unavailable}
+	if len(items) > limit {
+		result.Items = items[:limit]
+		result.More = true
+		result.Last = items[limit-1].Key
+	}
+	return result, nil
+}
+
+func (s *MockStore) StoreHint(owner, method, key string, header http.Header, value io.Reader) error {
+	if s.setErr != nil {
+		return s.setErr
+	}
+	s.hints = append(s.hints, owner+" "+method+" "+key)
+	return nil
+}
+
+func (s *MockStore) Increment(key string, by int64, opts store.WriteOptions) (int64, error) {
+	if s.setErr != nil {
+		return 0, s.setErr
+	}
+	s.opts = opts
+	item := s.data[key]
+	var n int64
+	if len(item.Value) > 0 {
+		var err error
+		if n, err = strconv.ParseInt(string(item.Value), 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %s", store.ErrNotInteger, key)
+		}
+	}
+	n += by
+	item.Key, item.Value = key, []byte(strconv.FormatInt(n, 10))
+	s.data[key] = item
+	return n, nil
+}
+
 func NewMockStore() *MockStore {
 	return &MockStore{
-		data: make(map[string]string),
+		data: make(map[string]store.KeyValue),
 	}
 }
 
@@ -92,3 +198,656 @@ func TestHandler_ServeHTTP(t *testing.T) {
 	h.ServeHTTP(rr, req)
 	assertStatusCode(t, rr.Code, http.StatusMethodNotAllowed)
 }
+
+func TestHandler_Scan(t *testing.T) {
+	h := &Handler{Store: NewMockStore()}
+	for _, key := range []string{"a", "user:1", "user:2", "user:3", "user:4", "v"} {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/"+key, "value-"+key)
+		h.ServeHTTP(rr, req)
+	}
+
+	local := false
+	scan := func(query string) ScanResponse {
+		t.Helper()
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/?"+query, "")
+		if local {
+			req.Header.Set(store.ReplicationHeader, "true")
+		}
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+
+		var response ScanResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return response
+	}
+	keys := func(response ScanResponse) string {
+		var keys []string
+		for _, item := range response.Items {
+			keys = append(keys, item.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	response := scan("")
+	assertResponseBody(t, keys(response), "a,user:1,user:2,user:3,user:4,v")
+	assertResponseBody(t, string(response.Items[0].Value), "value-a")
+	assertResponseBody(t, response.NextCursor, "")
+
+	response = scan("start=user:2&end=v")
+	assertResponseBody(t, keys(response), "user:2,user:3,user:4")
+
+	for _, local = range []bool{false, true} {
+		var pages []string
+		query := "prefix=user:&limit=3"
+		for {
+			response = scan(query)
+			pages = append(pages, keys(response))
+			if response.NextCursor == "" {
+				break
+			}
+			query = "prefix=user:&limit=3&cursor=" + response.NextCursor
+		}
+		assertResponseBody(t, strings.Join(pages, "|"), "user:1,user:2,user:3|user:4")
+	}
+
+	local = false
+	h.Store.(*MockStore).unavailable = []string{"node2"}
+	response = scan("limit=1")
+	assertResponseBody(t, strings.Join(response.Unavailable, ","), "node2")
+
+	for _, query := range []string{"limit=0", "limit=abc", "limit=1001", "cursor=%25%25"} {
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/?"+query, "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandler_TTL(t *testing.T) {
+	mock := NewMockStore()
+	h := &Handler{Store: mock}
+
+	tests := []struct {
+		desc       string
+		path       string
+		header     string
+		wantStatus int
+		wantTTL    time.Duration
+	}{
+		{desc: "query parameter", path: "/a?ttl=30s", wantStatus: http.StatusCreated, wantTTL: 30 * time.Second},
+		{desc: "header in seconds", path: "/b", header: "90", wantStatus: http.StatusCreated, wantTTL: 90 * time.Second},
+		{desc: "no ttl", path: "/c", wantStatus: http.StatusCreated},
+		{desc: "invalid ttl", path: "/d?ttl=soon", wantStatus: http.StatusBadRequest},
+		{desc: "negative ttl", path: "/e?ttl=-1s", wantStatus: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			mock.opts = store.WriteOptions{}
+			req, rr := setupRequestAndRecorder(http.MethodPut, test.path, "value")
+			if test.header != "" {
+				req.Header.Set(TTLHeader, test.header)
+			}
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, test.wantStatus)
+			if mock.opts.TTL != test.wantTTL {
+				t.Errorf("got ttl %v, want %v", mock.opts.TTL, test.wantTTL)
+			}
+		})
+	}
+
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/a", "")
+	h.ServeHTTP(rr, req)
+	assertResponseBody(t, rr.Header().Get(TTLHeader), "30")
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/c", "")
+	h.ServeHTTP(rr, req)
+	assertResponseBody(t, rr.Header().Get(TTLHeader), "")
+
+	req, rr = setupRequestAndRecorder(http.MethodPut, "/f", "value")
+	req.Header.Set(store.ReplicationHeader, "true")
+	req.Header.Set(store.TimestampHeader, "100")
+	req.Header.Set(store.ExpiresHeader, "200")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusCreated)
+	if mock.opts.Timestamp != 100 || mock.opts.Expires != 200 {
+		t.Errorf("forwarded write lost its metadata: %+v", mock.opts)
+	}
+}
+
+func TestHandler_OutOfMemory(t *testing.T) {
+	mock := NewMockStore()
+	mock.setErr = fmt.Errorf("failed to write: %w", store.ErrOutOfMemory)
+	h := &Handler{Store: mock}
+
+	req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "value")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusInsufficientStorage)
+}
+
+func TestHandler_ReservedKeys(t *testing.T) {
+	s, err := store.NewStore(nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer s.Close()
+	h := &Handler{Store: s}
+
+	key := "/" + store.ReservedKeyPrefix + "key"
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, rr := setupRequestAndRecorder(method, key, "1")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusBadRequest)
+	}
+	req, rr := setupRequestAndRecorder(http.MethodPost, key+"/incr", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+}
+
+func TestHandler_BinaryValues(t *testing.T) {
+	h := &Handler{Store: NewMockStore()}
+	binary := string([]byte{0, 0xff, '\n', ' '})
+
+	put := func(key, body, contentType string) {
+		t.Helper()
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/"+key, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusCreated)
+	}
+	get := func(key, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/"+key, "")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		return rr
+	}
+
+	put("blob", binary, "image/png")
+	put("json", `{"a": 1}`, "application/json")
+	put("text", "  {\"a\": 1}\n", "text/plain")
+	put("empty", "", "")
+
+	rr := get("blob", "application/octet-stream")
+	assertResponseBody(t, rr.Body.String(), binary)
+	assertResponseBody(t, rr.Header().Get("Content-Type"), "image/png")
+
+	rr = get("empty", "text/html, application/octet-stream;q=0.5")
+	assertResponseBody(t, rr.Body.String(), "")
+	assertResponseBody(t, rr.Header().Get("Content-Type"), "application/octet-stream")
+
+	var response struct {
+		Value       json.RawMessage `json:"value"`
+		Encoding    string          `json:"encoding"`
+		ContentType string          `json:"content_type"`
+	}
+	decode := func(rr *httptest.ResponseRecorder) {
+		t.Helper()
+		response.Encoding = ""
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+	}
+
+	decode(get("json", ""))
+	assertResponseBody(t, string(response.Value), `{"a":1}`)
+	assertResponseBody(t, response.ContentType, "application/json")
+
+	decode(get("text", ""))
+	assertResponseBody(t, string(response.Value), `"  {\"a\": 1}\n"`)
+
+	decode(get("blob", ""))
+	assertResponseBody(t, response.Encoding, "base64")
+	assertResponseBody(t, string(response.Value), `"AP8KIA=="`)
+}
+
+func TestHandler_LargeValues(t *testing.T) {
+	h := &Handler{Store: NewMockStore(), MaxValueSize: 8}
+
+	t.Run("should reject values above the maximum size", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/big", "0123456789")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusRequestEntityTooLarge)
+
+		// Without a Content-Length the limit is enforced while reading.
+		req, rr = setupRequestAndRecorder(http.MethodPut, "/big", "")
+		req.Body = io.NopCloser(strings.NewReader("0123456789"))
+		req.ContentLength = -1
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusRequestEntityTooLarge)
+
+		if _, _, ok := h.Store.Open("big"); ok {
+			t.Errorf("expected the value not to be stored")
+		}
+	})
+
+	t.Run("should not store any chunk of a value above the maximum size", func(t *testing.T) {
+		s, err := store.NewStore(nil, 0)
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		defer s.Close()
+		h := &Handler{Store: s, MaxValueSize: 2 * store.DefaultChunkSize}
+
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/big", "")
+		req.Body = io.NopCloser(bytes.NewReader(make([]byte, 3*store.DefaultChunkSize)))
+		req.ContentLength = -1
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusRequestEntityTooLarge)
+		if _, _, ok := s.Open("big"); ok {
+			t.Errorf("expected the value not to be stored")
+		}
+		if keys := s.Stats().Keys; keys != 0 {
+			t.Errorf("expected no keys to be left, got %d", keys)
+		}
+	})
+
+	t.Run("should serve ranges of a value", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/small", "01234567")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusCreated)
+
+		req, rr = setupRequestAndRecorder(http.MethodGet, "/small", "")
+		req.Header.Set("Range", "bytes=2-4")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusPartialContent)
+		assertResponseBody(t, rr.Body.String(), "234")
+		assertResponseBody(t, rr.Header().Get("Content-Range"), "bytes 2-4/8")
+
+		req, rr = setupRequestAndRecorder(http.MethodGet, "/small", "")
+		req.Header.Set("Range", "bytes=20-")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusRequestedRangeNotSatisfiable)
+	})
+}
+
+func TestHandler_ConditionalWrites(t *testing.T) {
+	mock := NewMockStore()
+	mock.data["key"] = store.KeyValue{Key: "key", Value: []byte("value"), Version: 3}
+	h := &Handler{Store: mock}
+
+	t.Run("should return the version as an ETag", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, rr := setupRequestAndRecorder(method, "/key", "")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusOK)
+			assertResponseBody(t, rr.Header().Get("ETag"), `"3"`)
+		}
+	})
+
+	t.Run("should pass conditions to the store", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "new")
+		req.Header.Set("If-Match", `"3"`)
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		if mock.opts.Condition != (store.Condition{IfMatch: 3}) {
+			t.Errorf("unexpected condition %+v", mock.opts.Condition)
+		}
+
+		req, rr = setupRequestAndRecorder(http.MethodDelete, "/key", "")
+		req.Header.Set("If-None-Match", "*")
+		h.ServeHTTP(rr, req)
+		if mock.opts.Condition != (store.Condition{IfNoneMatch: true}) {
+			t.Errorf("unexpected condition %+v", mock.opts.Condition)
+		}
+	})
+
+	t.Run("should read the version of forwarded writes", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "new")
+		req.Header.Set(store.ReplicationHeader, "true")
+		req.Header.Set(store.VersionHeader, "7")
+		req.Header.Set(store.ConditionalHeader, "true")
+		h.ServeHTTP(rr, req)
+		assertResponseBody(t, fmt.Sprint(mock.opts.Version), "7")
+		if mock.opts.Condition != (store.Condition{IfOlder: true}) {
+			t.Errorf("unexpected condition %+v", mock.opts.Condition)
+		}
+	})
+
+	t.Run("should reject invalid conditions", func(t *testing.T) {
+		for header, value := range map[string]string{"If-Match": "3", "If-None-Match": `"3"`} {
+			req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "new")
+			req.Header.Set(header, value)
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("should answer failed conditions with 412", func(t *testing.T) {
+		mock.setErr = fmt.Errorf("failed to write: %w", store.ErrPreconditionFailed)
+		defer func() { mock.setErr = nil }()
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			req, rr := setupRequestAndRecorder(method, "/key", "new")
+			req.Header.Set("If-Match", `"2"`)
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusPreconditionFailed)
+		}
+	})
+
+	t.Run("should answer writes of locked keys with 409", func(t *testing.T) {
+		mock.setErr = fmt.Errorf("failed to write: %w", store.ErrKeyLocked)
+		defer func() { mock.setErr = nil }()
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			req, rr := setupRequestAndRecorder(method, "/key", "new")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusConflict)
+		}
+	})
+}
+
+func TestHandler_Siblings(t *testing.T) {
+	mock := NewMockStore()
+	context := store.VectorClock{"node1": 1, "node2": 1}
+	mock.data["key"] = store.KeyValue{
+		Key:         "key",
+		Value:       []byte(`{"a":1}`),
+		ContentType: "application/json",
+		Version:     2,
+		Context:     context,
+		Siblings:    []store.KeyValue{{Key: "key", Value: []byte("plain"), Version: 1}},
+	}
+	h := &Handler{Store: mock}
+
+	t.Run("should return every sibling with the causal context", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/key", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusMultipleChoices)
+		assertResponseBody(t, rr.Header().Get(store.ContextHeader), context.String())
+		assertResponseBody(t, strings.TrimSpace(rr.Body.String()), `{"siblings":[{"value":{"a":1},"content_type":"application/json"},{"value":"plain"}]}`)
+
+		req, rr = setupRequestAndRecorder(http.MethodGet, "/key", "")
+		req.Header.Set("Accept", "application/octet-stream")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusMultipleChoices)
+	})
+
+	t.Run("should pass the causal context to the store", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "merged")
+		req.Header.Set(store.ContextHeader, context.String())
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		assertResponseBody(t, mock.opts.Context.String(), context.String())
+	})
+
+	t.Run("should read the dot of forwarded writes", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "merged")
+		req.Header.Set(store.ReplicationHeader, "true")
+		req.Header.Set(store.DotHeader, "3@node1")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		if mock.opts.Dot != (store.Dot{Node: "node1", Counter: 3}) {
+			t.Errorf("unexpected dot %+v", mock.opts.Dot)
+		}
+	})
+
+	t.Run("should reject an invalid causal context", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "merged")
+		req.Header.Set(store.ContextHeader, "!")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusBadRequest)
+	})
+}
+
+func TestHandler_HybridTimestamps(t *testing.T) {
+	mock := NewMockStore()
+	h := &Handler{Store: mock}
+	stamp := store.HybridTime{Wall: 100, Logical: 2, Node: "node1"}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, rr := setupRequestAndRecorder(method, "/key", "value")
+		req.Header.Set(store.ReplicationHeader, "true")
+		req.Header.Set(store.HLCHeader, stamp.String())
+		h.ServeHTTP(rr, req)
+		if mock.opts.HLC != stamp {
+			t.Errorf("%s: unexpected timestamp %+v", method, mock.opts.HLC)
+		}
+	}
+
+	req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "value")
+	req.Header.Set(store.ReplicationHeader, "true")
+	req.Header.Set(store.HLCHeader, "later")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+}
+
+func TestHandler_QuorumReads(t *testing.T) {
+	mock := NewMockStore()
+	mock.data["key"] = store.KeyValue{Key: "key", Value: []byte("value"), Modified: 42, HLC: store.HybridTime{Wall: 42, Logical: 1, Node: "node1"}}
+	mock.answered = 2
+	h := &Handler{Store: mock}
+
+	t.Run("should report how many replicas answered", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/key", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		assertResponseBody(t, rr.Header().Get(ReplicasAnsweredHeader), "2")
+	})
+
+	t.Run("should report the timestamps of the local copy to other nodes", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodHead, "/key", "")
+		req.Header.Set(store.ReplicationHeader, "true")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		assertResponseBody(t, rr.Header().Get(store.TimestampHeader), "42")
+		assertResponseBody(t, rr.Header().Get(store.HLCHeader), "42.1@node1")
+		assertResponseBody(t, rr.Header().Get(ReplicasAnsweredHeader), "")
+	})
+
+	t.Run("should report the stored content type to other nodes", func(t *testing.T) {
+		mock.data["typed"] = store.KeyValue{Key: "typed", Value: []byte("value"), ContentType: "text/plain"}
+		for key, want := range map[string]string{"key": "", "typed": "text/plain"} {
+			req, rr := setupRequestAndRecorder(http.MethodGet, "/"+key, "")
+			req.Header.Set(store.ReplicationHeader, "true")
+			req.Header.Set("Accept", "application/octet-stream")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusOK)
+			assertResponseBody(t, rr.Header().Get(store.ContentTypeHeader), want)
+		}
+	})
+
+	t.Run("should pass the read repair setting to the store", func(t *testing.T) {
+		tests := []struct {
+			path, header string
+			want         store.ReadOptions
+		}{
+			{"/key", "", store.ReadOptions{}},
+			{"/key?read_repair=sync", "", store.ReadOptions{SyncRepair: true}},
+			{"/key", "0.25", store.ReadOptions{RepairChance: 0.25}},
+			{"/key?read_repair=0", "", store.ReadOptions{RepairChance: -1}},
+			{"/key?stale=ok", "", store.ReadOptions{Stale: true}},
+		}
+		for _, test := range tests {
+			req, rr := setupRequestAndRecorder(http.MethodGet, test.path, "")
+			if test.header != "" {
+				req.Header.Set(ReadRepairHeader, test.header)
+			}
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusOK)
+			if mock.readOpts != test.want {
+				t.Errorf("%s %s: unexpected read options %+v", test.path, test.header, mock.readOpts)
+			}
+		}
+
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/key?read_repair=2", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusBadRequest)
+
+		req, rr = setupRequestAndRecorder(http.MethodGet, "/key?stale=yes", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusBadRequest)
+	})
+
+	t.Run("should fail when too few replicas answer", func(t *testing.T) {
+		mock.readErr = fmt.Errorf("not enough replicas for read quorum: %d", 0)
+		defer func() { mock.readErr = nil }()
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/key", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusInternalServerError)
+	})
+}
+
+func TestHandler_Consistency(t *testing.T) {
+	mock := NewMockStore()
+	mock.data["key"] = store.KeyValue{Key: "key", Value: []byte("value")}
+	h := &Handler{Store: mock}
+
+	t.Run("should pass the consistency level to the store", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodGet, "/key?consistency=one", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		assertResponseBody(t, string(mock.readOpts.Consistency), "ONE")
+
+		req, rr = setupRequestAndRecorder(http.MethodPut, "/key", "value")
+		req.Header.Set(ConsistencyHeader, "ALL")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		assertResponseBody(t, string(mock.opts.Consistency), "ALL")
+
+		req, rr = setupRequestAndRecorder(http.MethodDelete, "/key", "")
+		req.Header.Set(ConsistencyHeader, "local")
+		h.ServeHTTP(rr, req)
+		assertResponseBody(t, string(mock.opts.Consistency), "LOCAL")
+	})
+
+	t.Run("should coordinate writes relayed by another node", func(t *testing.T) {
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "value")
+		req.Header.Set(store.RelayHeader, "node3")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusCreated)
+		if !mock.opts.Forwarded || mock.opts.SkipReplication {
+			t.Errorf("expected a relayed write to be coordinated here, got %+v", mock.opts)
+		}
+	})
+
+	t.Run("should reject unknown levels", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodPut} {
+			req, rr := setupRequestAndRecorder(method, "/key?consistency=some", "value")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("should answer unmet levels with 503", func(t *testing.T) {
+		err := fmt.Errorf("failed: %w", store.ErrNotEnoughReplicas)
+		mock.readErr, mock.setErr = err, err
+		defer func() { mock.readErr, mock.setErr = nil, nil }()
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			req, rr := setupRequestAndRecorder(method, "/key", "value")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func TestHandler_Hints(t *testing.T) {
+	mock := NewMockStore()
+	h := &Handler{Store: mock}
+
+	t.Run("should hold forwarded writes for another replica as hints", func(t *testing.T) {
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			req, rr := setupRequestAndRecorder(method, "/key", "value")
+			req.Header.Set(store.ReplicationHeader, "true")
+			req.Header.Set(store.HintHeader, "node2")
+			h.ServeHTTP(rr, req)
+			assertStatusCode(t, rr.Code, http.StatusAccepted)
+		}
+		assertResponseBody(t, strings.Join(mock.hints, ","), "node2 PUT key,node2 DELETE key")
+		if _, ok := mock.data["key"]; ok {
+			t.Error("expected the hint not to be applied")
+		}
+	})
+
+	t.Run("should answer with 507 when hints are full", func(t *testing.T) {
+		mock.setErr = store.ErrHintsFull
+		defer func() { mock.setErr = nil }()
+		req, rr := setupRequestAndRecorder(http.MethodPut, "/key", "value")
+		req.Header.Set(store.ReplicationHeader, "true")
+		req.Header.Set(store.HintHeader, "node2")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusInsufficientStorage)
+	})
+}
+
+func TestHandler_Tombstones(t *testing.T) {
+	mock := NewMockStore()
+	mock.data["gone"] = store.KeyValue{Key: "gone", Version: 3, Modified: 20, Deleted: true}
+	h := &Handler{Store: mock}
+
+	req, rr := setupRequestAndRecorder(http.MethodHead, "/gone", "")
+	req.Header.Set(store.ReplicationHeader, "true")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNotFound)
+	assertResponseBody(t, rr.Header().Get(store.DeletedHeader), "true")
+	assertResponseBody(t, rr.Header().Get("ETag"), store.FormatETag(3))
+	assertResponseBody(t, rr.Header().Get(store.TimestampHeader), "20")
+
+	req, rr = setupRequestAndRecorder(http.MethodHead, "/missing", "")
+	req.Header.Set(store.ReplicationHeader, "true")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNotFound)
+	assertResponseBody(t, rr.Header().Get(store.DeletedHeader), "")
+}
+
+func TestHandler_Counters(t *testing.T) {
+	mock := NewMockStore()
+	mock.data["text"] = store.KeyValue{Key: "text", Value: []byte("abc")}
+	h := &Handler{Store: mock}
+
+	increment := func(path string, want int64) {
+		t.Helper()
+		req, rr := setupRequestAndRecorder(http.MethodPost, path, "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, http.StatusOK)
+		var counter store.CounterValue
+		if err := json.Unmarshal(rr.Body.Bytes(), &counter); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if counter.Value != want {
+			t.Errorf("%s: got %d, want %d", path, counter.Value, want)
+		}
+	}
+	increment("/hits/incr", 1)
+	increment("/hits/incr?by=10", 11)
+	increment("/hits/decr?by=4", 7)
+	increment("/hits/decr", 6)
+	increment("/dir/hits/incr?by=-2", -2)
+	if _, ok := mock.data["dir/hits"]; !ok {
+		t.Errorf("key with slashes was not incremented")
+	}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/hits/incr?consistency=ALL", "")
+	req.Header.Set(store.ReplicationHeader, "true")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	if !mock.opts.Forwarded || mock.opts.Consistency != store.ConsistencyAll {
+		t.Errorf("unexpected options: got %+v", mock.opts)
+	}
+
+	for path, status := range map[string]int{
+		"/text/incr":                         http.StatusUnprocessableEntity,
+		"/hits/incr?by=x":                    http.StatusBadRequest,
+		"/hits/decr?by=-9223372036854775808": http.StatusBadRequest,
+		"/hits/incr?consistency=SOME":        http.StatusBadRequest,
+		"/hits/reset":                        http.StatusMethodNotAllowed,
+	} {
+		req, rr = setupRequestAndRecorder(http.MethodPost, path, "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, status)
+	}
+
+	for err, status := range map[error]int{
+		store.ErrKeyLocked:         http.StatusConflict,
+		store.ErrNotEnoughReplicas: http.StatusServiceUnavailable,
+		store.ErrOutOfMemory:       http.StatusInsufficientStorage,
+	} {
+		mock.setErr = err
+		req, rr = setupRequestAndRecorder(http.MethodPost, "/hits/incr", "")
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, status)
+	}
+}
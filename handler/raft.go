@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/raft"
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+const RaftPrefix = "/" + store.ReservedKeyPrefix + "raft/"
+
+type Raft interface {
+	StepRaft(msgs []raft.Message) error
+	ProposeRaft(group uint32, command []byte) error
+	ReadRaft(group uint32, key string, stale bool) (store.KeyValue, bool, error)
+	RaftLeader(group uint32) string
+	RaftStatus() []raft.Status
+	ChangeRaftMembers(change store.MembershipChange) (store.MembershipResult, error)
+}
+
+/*
+Serves the endpoints through which nodes in raft replication mode exchange
+messages and hand requests to the leaders of their groups, and those
+operators use to inspect and change the groups.
+*/
+type RaftHandler struct {
+	Store Raft
+}
+
+func (h *RaftHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, RaftPrefix) {
+	case "messages":
+		h.handleMessages(w, r)
+	case "propose":
+		h.handlePropose(w, r)
+	case "read":
+		h.handleRead(w, r)
+	case "status":
+		h.handleStatus(w, r)
+	case "members":
+		h.handleMembers(w, r)
+	default:
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+/*
+Takes a batch of messages from another node as a JSON array.
+*/
+func (h *RaftHandler) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var msgs []raft.Message
+	if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.Store.StepRaft(msgs); err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Proposes the write in the request body to the group named by the group
+query parameter and waits until it is applied. Nodes that do not lead the
+group answer 421 Misdirected Request, naming the leader they know of in
+the X-Raft-Leader header.
+*/
+func (h *RaftHandler) handlePropose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group, err := parseGroup(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.Store.ProposeRaft(group, command); err != nil {
+		h.writeRaftError(w, group, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Returns the key named by the key query parameter as held by the leader of
+the group named by the group query parameter, like an item of a scan. With
+stale=ok any node hosting the group returns its copy.
+*/
+func (h *RaftHandler) handleRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group, err := parseGroup(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stale, err := parseStale(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	item, found, err := h.Store.ReadRaft(group, r.URL.Query().Get("key"), stale)
+	if err != nil {
+		h.writeRaftError(w, group, err)
+		return
+	}
+	if !found {
+		writeJSONError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+/*
+Reports the state of every group this node hosts as {"groups": [...]}.
+*/
+func (h *RaftHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"groups": h.Store.RaftStatus()})
+}
+
+/*
+Adds a node to or removes it from the groups this node leads, as described
+by the request body: {"action": "add" or "remove", "node": ..., "groups":
+[...]}, where groups is optional.
+*/
+func (h *RaftHandler) handleMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var change store.MembershipChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	result, err := h.Store.ChangeRaftMembers(change)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *RaftHandler) writeRaftError(w http.ResponseWriter, group uint32, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotRaftLeader):
+		if leader := h.Store.RaftLeader(group); leader != "" {
+			w.Header().Set(store.RaftLeaderHeader, leader)
+		}
+		writeJSONError(w, err.Error(), http.StatusMisdirectedRequest)
+	case errors.Is(err, store.ErrPreconditionFailed):
+		writeJSONError(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, store.ErrOutOfMemory):
+		writeJSONError(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		writeJSONError(w, err.Error(), replicationStatus(err))
+	}
+}
+
+func parseGroup(r *http.Request) (uint32, error) {
+	group, err := strconv.ParseUint(r.URL.Query().Get("group"), 10, 32)
+	if err != nil {
+		return 0, errors.New("Invalid group")
+	}
+	return uint32(group), nil
+}
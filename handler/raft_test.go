@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/raft"
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+type MockRaft struct {
+	stepped  []raft.Message
+	proposed []byte
+	leading  bool
+	items    map[string]store.KeyValue
+}
+
+func (r *MockRaft) StepRaft(msgs []raft.Message) error {
+	r.stepped = append(r.stepped, msgs...)
+	return nil
+}
+
+func (r *MockRaft) ProposeRaft(group uint32, command []byte) error {
+	if !r.leading {
+		return store.ErrNotRaftLeader
+	}
+	if string(command) == "conflict" {
+		return store.ErrPreconditionFailed
+	}
+	r.proposed = command
+	return nil
+}
+
+func (r *MockRaft) ReadRaft(group uint32, key string, stale bool) (store.KeyValue, bool, error) {
+	if !r.leading && !stale {
+		return store.KeyValue{}, false, store.ErrNotRaftLeader
+	}
+	item, ok := r.items[key]
+	return item, ok, nil
+}
+
+func (r *MockRaft) RaftLeader(group uint32) string {
+	return "node2"
+}
+
+func (r *MockRaft) RaftStatus() []raft.Status {
+	return []raft.Status{{ID: "node1", Group: 7, State: raft.StateLeader, Term: 3}}
+}
+
+func (r *MockRaft) ChangeRaftMembers(change store.MembershipChange) (store.MembershipResult, error) {
+	return store.MembershipResult{Changed: []uint32{7}}, nil
+}
+
+func TestRaftHandler_Messages(t *testing.T) {
+	r := &MockRaft{}
+	h := &RaftHandler{Store: r}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/raft/messages", `[{"type":"append","group":7,"from":"node2","to":"node1","term":3}]`)
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	if len(r.stepped) != 1 || r.stepped[0].Group != 7 || r.stepped[0].From != "node2" {
+		t.Errorf("unexpected messages: got %+v", r.stepped)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/raft/messages", "not json")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/raft/messages", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusMethodNotAllowed)
+}
+
+func TestRaftHandler_Propose(t *testing.T) {
+	r := &MockRaft{}
+	h := &RaftHandler{Store: r}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/raft/propose?group=7", "command")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusMisdirectedRequest)
+	if leader := rr.Header().Get(store.RaftLeaderHeader); leader != "node2" {
+		t.Errorf("unexpected leader: got %q, want %q", leader, "node2")
+	}
+
+	r.leading = true
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/raft/propose?group=7", "command")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	if string(r.proposed) != "command" {
+		t.Errorf("unexpected proposal: got %q", r.proposed)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/raft/propose?group=7", "conflict")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusPreconditionFailed)
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/raft/propose?group=x", "command")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+}
+
+func TestRaftHandler_Read(t *testing.T) {
+	r := &MockRaft{items: map[string]store.KeyValue{"a": {Key: "a", Value: []byte("1"), Version: 4}}}
+	h := &RaftHandler{Store: r}
+
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/_/raft/read?group=7&key=a", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusMisdirectedRequest)
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/raft/read?group=7&key=a&stale=ok", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/raft/read?group=7&key=a&stale=yes", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+
+	r.leading = true
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/raft/read?group=7&key=a", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	var item store.KeyValue
+	if err := json.Unmarshal(rr.Body.Bytes(), &item); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if string(item.Value) != "1" || item.Version != 4 {
+		t.Errorf("unexpected item: got %+v", item)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/raft/read?group=7&key=b", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNotFound)
+}
+
+func TestRaftHandler_Status(t *testing.T) {
+	h := &RaftHandler{Store: &MockRaft{}}
+
+	req, rr := setupRequestAndRecorder(http.MethodGet, "/_/raft/status", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	var response struct {
+		Groups []raft.Status `json:"groups"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(response.Groups) != 1 || response.Groups[0].State != raft.StateLeader {
+		t.Errorf("unexpected groups: got %+v", response.Groups)
+	}
+}
+
+func TestRaftHandler_Members(t *testing.T) {
+	h := &RaftHandler{Store: &MockRaft{}}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/raft/members", `{"action":"add","node":"node4"}`)
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	var result store.MembershipResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(result.Changed) != 1 || result.Changed[0] != 7 {
+		t.Errorf("unexpected result: got %+v", result)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/raft/members", "not json")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+}
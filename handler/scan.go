@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+type ScanResponse struct {
+	Items       []store.KeyValue `json:"items"`
+	NextCursor  string           `json:"next_cursor,omitempty"`
+	Unavailable []string         `json:"unavailable,omitempty"`
+}
+
+/*
+Lists keys in ascending order. The range is narrowed by the prefix, start
+and end query parameters and at most limit items are returned. If more keys
+remain, the response carries a cursor that continues the scan when passed
+back with the same parameters. The cursor is the last key returned, so a
+scan can be resumed on any node even if nodes fail between pages.
+
+Requests from other nodes scan only the local keyspace and also get the
+tombstones of deleted keys; all others are scattered across the cluster.
+*/
+func (h *Handler) handleScan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	start := query.Get("start")
+	end := query.Get("end")
+
+	limit := DefaultScanLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > MaxScanLimit {
+			writeJSONError(w, "limit must be between 1 and "+strconv.Itoa(MaxScanLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	if prefix != "" {
+		if prefix > start {
+			start = prefix
+		}
+		if prefixEnd := store.PrefixEnd(prefix); prefixEnd != "" && (end == "" || prefixEnd < end) {
+			end = prefixEnd
+		}
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		last, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			writeJSONError(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		// The cursor is the last key returned, so continue just after it.
+		if next := string(last) + "\x00"; next > start {
+			start = next
+		}
+	}
+
+	var response ScanResponse
+	if r.Header.Get(store.ReplicationHeader) == "true" {
+		items, err := h.Store.ScanReplica(start, end, limit+1)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Items = items
+		if len(items) > limit {
+			response.Items = items[:limit]
+			response.NextCursor = encodeCursor(items[limit-1].Key)
+		}
+	} else {
+		result, err := h.Store.ScanCluster(start, end, limit)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Items = result.Items
+		response.Unavailable = result.Unavailable
+		if result.More && result.Last != "" {
+			response.NextCursor = encodeCursor(result.Last)
+		}
+	}
+	if response.Items == nil {
+		response.Items = []store.KeyValue{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+const TxnPrefix = "/" + store.ReservedKeyPrefix + "txn/"
+
+type Transactions interface {
+	Transact(ops []store.TxnOp) (store.TxnResult, error)
+	PrepareTxn(prepare store.TxnPrepare) error
+	CommitTxn(id string) error
+	AbortTxn(id string) error
+	TxnStatus(id string) (store.TxnStatus, error)
+	BeginTxn() (string, error)
+	ReadTxnKey(id, key string) (store.ReadResult, error)
+	BufferTxnWrite(id string, op store.TxnOp) error
+	CommitOptimisticTxn(id string) (store.TxnResult, error)
+	RollbackTxn(id string) error
+}
+
+/*
+Serves the endpoints clients run transactions through, and those the
+coordinator of a transaction uses to run two-phase commit with the nodes
+that own its keys.
+*/
+type TxnHandler struct {
+	Store Transactions
+	// The largest request a transaction may be sent in, in bytes. Zero
+	// means no limit.
+	MaxBodySize int64
+}
+
+func (h *TxnHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, TxnPrefix) {
+	case "":
+		h.handleTransact(w, r)
+	case "prepare":
+		h.handlePrepare(w, r)
+	case "commit":
+		h.handleDecision(w, r, h.Store.CommitTxn)
+	case "abort":
+		h.handleDecision(w, r, h.Store.AbortTxn)
+	case "status":
+		h.handleStatus(w, r)
+	case "begin":
+		h.handleBegin(w, r)
+	default:
+		h.handleSession(w, r)
+	}
+}
+
+/*
+A write or check of a transaction as sent by clients. Values are given like those
+of a GET: a string, in base64 if encoding says so, or any other JSON value,
+which is stored as is.
+*/
+type TxnOpRequest struct {
+	Op          string          `json:"op"`
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	Encoding    string          `json:"encoding,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	IfMatch     uint64          `json:"if_match,omitempty"`
+	IfNoneMatch bool            `json:"if_none_match,omitempty"`
+}
+
+func (op TxnOpRequest) toStore() (store.TxnOp, error) {
+	result := store.TxnOp{
+		Type:        store.TxnOpType(op.Op),
+		Key:         op.Key,
+		ContentType: op.ContentType,
+		Condition:   store.Condition{IfMatch: op.IfMatch, IfNoneMatch: op.IfNoneMatch},
+	}
+	if result.Type == store.TxnDelete || len(op.Value) == 0 {
+		return result, nil
+	}
+	var text string
+	if err := json.Unmarshal(op.Value, &text); err != nil {
+		result.Value = op.Value
+		return result, nil
+	}
+	switch op.Encoding {
+	case "":
+		result.Value = []byte(text)
+	case "base64":
+		value, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return store.TxnOp{}, fmt.Errorf("invalid base64 value for key %s", op.Key)
+		}
+		result.Value = value
+	default:
+		return store.TxnOp{}, fmt.Errorf("unknown encoding %q", op.Encoding)
+	}
+	return result, nil
+}
+
+/*
+Commits the writes in the request body, {"ops": [...]}, atomically and
+responds with the id of the transaction. A transaction that touches a key
+locked by another one is aborted with 409 Conflict, and one whose
+conditions do not hold with 412 Precondition Failed.
+*/
+func (h *TxnHandler) handleTransact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := r.Body
+	if h.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.MaxBodySize)
+	}
+	var request struct {
+		Ops []TxnOpRequest `json:"ops"`
+	}
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, fmt.Sprintf("Transaction exceeds the maximum size of %d bytes", h.MaxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ops := make([]store.TxnOp, len(request.Ops))
+	for i, op := range request.Ops {
+		var err error
+		if ops[i], err = op.toStore(); err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.Store.Transact(ops)
+	if err != nil {
+		writeTxnError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+Prepares the writes of a transaction in the request body, as sent by its
+coordinator.
+*/
+func (h *TxnHandler) handlePrepare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var prepare store.TxnPrepare
+	if err := json.NewDecoder(r.Body).Decode(&prepare); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.Store.PrepareTxn(prepare); err != nil {
+		writeTxnError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Commits or aborts the transaction named by the id query parameter.
+*/
+func (h *TxnHandler) handleDecision(w http.ResponseWriter, r *http.Request, decide func(id string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSONError(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+	if err := decide(id); err != nil {
+		writeTxnError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Reports how the transaction named by the id query parameter, which this
+node coordinates, ended: {"id": ..., "status": "pending", "committed" or
+"aborted"}.
+*/
+func (h *TxnHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSONError(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+	status, err := h.Store.TxnStatus(id)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.TxnResult{ID: id, Status: status})
+}
+
+/*
+Begins an optimistic transaction on this node, which the other requests of
+the transaction must be sent to, and responds with {"id": ...}.
+*/
+func (h *TxnHandler) handleBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := h.Store.BeginTxn()
+	if err != nil {
+		writeTxnError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+/*
+Serves the requests of an optimistic transaction: /_/txn/{id}/keys/{key}
+to read, write or delete a key within it, POST /_/txn/{id}/commit to commit
+it and DELETE /_/txn/{id} to roll it back.
+*/
+func (h *TxnHandler) handleSession(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, TxnPrefix), "/")
+	switch {
+	case id == "":
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	case rest == "":
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := h.Store.RollbackTxn(id); err != nil {
+			writeTxnError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case rest == "commit":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := h.Store.CommitOptimisticTxn(id)
+		if err != nil {
+			writeTxnError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	case strings.HasPrefix(rest, "keys/"):
+		h.handleSessionKey(w, r, id, strings.TrimPrefix(rest, "keys/"))
+	default:
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+/*
+Reads a key within a transaction like a GET, with its version as ETag, or
+buffers a write or delete of it like a PUT or DELETE would make.
+*/
+func (h *TxnHandler) handleSessionKey(w http.ResponseWriter, r *http.Request, id, key string) {
+	switch r.Method {
+	case http.MethodGet:
+		result, err := h.Store.ReadTxnKey(id, key)
+		if err != nil {
+			writeTxnError(w, err)
+			return
+		}
+		if !result.Found {
+			writeJSONError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		defer result.Close()
+		raw, err := io.ReadAll(result.Value)
+		if err != nil {
+			writeJSONError(w, "Failed to read value", http.StatusInternalServerError)
+			return
+		}
+		if result.Item.Version != 0 {
+			w.Header().Set("ETag", store.FormatETag(result.Item.Version))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newGetResponse(raw, result.Item.ContentType))
+	case http.MethodPut:
+		body := r.Body
+		if h.MaxBodySize > 0 {
+			body = http.MaxBytesReader(w, r.Body, h.MaxBodySize)
+		}
+		value, err := io.ReadAll(body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONError(w, fmt.Sprintf("Value exceeds the maximum size of %d bytes", h.MaxBodySize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			writeJSONError(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		op := store.TxnOp{Type: store.TxnPut, Key: key, Value: value, ContentType: r.Header.Get("Content-Type")}
+		if err := h.Store.BufferTxnWrite(id, op); err != nil {
+			writeTxnError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := h.Store.BufferTxnWrite(id, store.TxnOp{Type: store.TxnDelete, Key: key}); err != nil {
+			writeTxnError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeTxnError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrInvalidTxn):
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, store.ErrTxnNotFound):
+		writeJSONError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, store.ErrKeyLocked), errors.Is(err, store.ErrTxnConflict):
+		writeJSONError(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, store.ErrPreconditionFailed):
+		writeJSONError(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, store.ErrOutOfMemory):
+		writeJSONError(w, err.Error(), http.StatusInsufficientStorage)
+	case errors.Is(err, store.ErrTxnUnsupported):
+		writeJSONError(w, err.Error(), http.StatusNotImplemented)
+	default:
+		writeJSONError(w, err.Error(), replicationStatus(err))
+	}
+}
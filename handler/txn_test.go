@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/store"
+)
+
+type MockTxns struct {
+	ops      []store.TxnOp
+	err      error
+	prepared store.TxnPrepare
+	decided  []string
+	sessions map[string]map[string]store.TxnOp
+	items    map[string]store.KeyValue
+}
+
+func (m *MockTxns) Transact(ops []store.TxnOp) (store.TxnResult, error) {
+	if m.err != nil {
+		return store.TxnResult{}, m.err
+	}
+	m.ops = ops
+	return store.TxnResult{ID: "t1", Status: store.TxnCommitted}, nil
+}
+
+func (m *MockTxns) PrepareTxn(prepare store.TxnPrepare) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.prepared = prepare
+	return nil
+}
+
+func (m *MockTxns) CommitTxn(id string) error {
+	m.decided = append(m.decided, "commit "+id)
+	return nil
+}
+
+func (m *MockTxns) AbortTxn(id string) error {
+	m.decided = append(m.decided, "abort "+id)
+	return nil
+}
+
+func (m *MockTxns) TxnStatus(id string) (store.TxnStatus, error) {
+	return store.TxnPending, nil
+}
+
+func (m *MockTxns) BeginTxn() (string, error) {
+	if m.sessions == nil {
+		m.sessions = make(map[string]map[string]store.TxnOp)
+	}
+	m.sessions["s1"] = make(map[string]store.TxnOp)
+	return "s1", nil
+}
+
+func (m *MockTxns) ReadTxnKey(id, key string) (store.ReadResult, error) {
+	if _, ok := m.sessions[id]; !ok {
+		return store.ReadResult{}, store.ErrTxnNotFound
+	}
+	item, ok := m.items[key]
+	return store.ReadResult{Item: item, Value: bytes.NewReader(item.Value), Found: ok}, nil
+}
+
+func (m *MockTxns) BufferTxnWrite(id string, op store.TxnOp) error {
+	writes, ok := m.sessions[id]
+	if !ok {
+		return store.ErrTxnNotFound
+	}
+	writes[op.Key] = op
+	return nil
+}
+
+func (m *MockTxns) CommitOptimisticTxn(id string) (store.TxnResult, error) {
+	if _, ok := m.sessions[id]; !ok {
+		return store.TxnResult{}, store.ErrTxnNotFound
+	}
+	if m.err != nil {
+		return store.TxnResult{}, m.err
+	}
+	return store.TxnResult{ID: id, Status: store.TxnCommitted}, nil
+}
+
+func (m *MockTxns) RollbackTxn(id string) error {
+	if _, ok := m.sessions[id]; !ok {
+		return store.ErrTxnNotFound
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func TestTxnHandler_Transact(t *testing.T) {
+	m := &MockTxns{}
+	h := &TxnHandler{Store: m}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/txn/", `{"ops":[
+		{"op":"put","key":"a","value":"1","if_none_match":true},
+		{"op":"put","key":"b","value":"AAE=","encoding":"base64","if_match":3},
+		{"op":"put","key":"c","value":{"n":1},"content_type":"application/json"},
+		{"op":"delete","key":"d"}]}`)
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	var result store.TxnResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if result.ID != "t1" || result.Status != store.TxnCommitted {
+		t.Errorf("unexpected result: got %+v", result)
+	}
+	if len(m.ops) != 4 {
+		t.Fatalf("unexpected ops: got %+v", m.ops)
+	}
+	if string(m.ops[0].Value) != "1" || !m.ops[0].Condition.IfNoneMatch {
+		t.Errorf("unexpected first op: got %+v", m.ops[0])
+	}
+	if string(m.ops[1].Value) != "\x00\x01" || m.ops[1].Condition.IfMatch != 3 {
+		t.Errorf("unexpected second op: got %+v", m.ops[1])
+	}
+	if string(m.ops[2].Value) != `{"n":1}` || m.ops[2].ContentType != "application/json" {
+		t.Errorf("unexpected third op: got %+v", m.ops[2])
+	}
+	if m.ops[3].Type != store.TxnDelete || m.ops[3].Key != "d" {
+		t.Errorf("unexpected fourth op: got %+v", m.ops[3])
+	}
+
+	for body, status := range map[string]int{
+		"not json": http.StatusBadRequest,
+		`{"ops":[{"op":"put","key":"a","value":"!","encoding":"base64"}]}`: http.StatusBadRequest,
+		`{"ops":[{"op":"put","key":"a","value":"1","encoding":"hex"}]}`:    http.StatusBadRequest,
+	} {
+		req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/", body)
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, status)
+	}
+
+	for err, status := range map[error]int{
+		store.ErrKeyLocked:          http.StatusConflict,
+		store.ErrPreconditionFailed: http.StatusPreconditionFailed,
+		store.ErrInvalidTxn:         http.StatusBadRequest,
+		store.ErrTxnUnsupported:     http.StatusNotImplemented,
+		store.ErrNotEnoughReplicas:  http.StatusServiceUnavailable,
+	} {
+		m.err = err
+		req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/", `{"ops":[{"op":"put","key":"a","value":"1"}]}`)
+		h.ServeHTTP(rr, req)
+		assertStatusCode(t, rr.Code, status)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/txn/", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusMethodNotAllowed)
+}
+
+func TestTxnHandler_TwoPhaseCommit(t *testing.T) {
+	m := &MockTxns{}
+	h := &TxnHandler{Store: m}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/txn/prepare", `{"id":"t1","coordinator":"node1","ops":[{"op":"put","key":"a","value":"MQ=="}]}`)
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	if m.prepared.ID != "t1" || m.prepared.Coordinator != "node1" || string(m.prepared.Ops[0].Value) != "1" {
+		t.Errorf("unexpected prepare: got %+v", m.prepared)
+	}
+
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/commit?id=t1", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/abort?id=t2", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	if len(m.decided) != 2 || m.decided[0] != "commit t1" || m.decided[1] != "abort t2" {
+		t.Errorf("unexpected decisions: got %v", m.decided)
+	}
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/commit", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusBadRequest)
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/txn/status?id=t1", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	var result store.TxnResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if result.ID != "t1" || result.Status != store.TxnPending {
+		t.Errorf("unexpected status: got %+v", result)
+	}
+
+	m.err = store.ErrKeyLocked
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/prepare", `{"id":"t3","ops":[{"op":"put","key":"a"}]}`)
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusConflict)
+}
+
+func TestTxnHandler_Optimistic(t *testing.T) {
+	m := &MockTxns{items: map[string]store.KeyValue{"a": {Key: "a", Value: []byte("1"), Version: 4}}}
+	h := &TxnHandler{Store: m}
+
+	req, rr := setupRequestAndRecorder(http.MethodPost, "/_/txn/begin", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusCreated)
+	var begun struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &begun); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	assertResponseBody(t, begun.ID, "s1")
+
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/txn/s1/keys/a", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+	assertResponseBody(t, rr.Header().Get("ETag"), `"4"`)
+	var value GetResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &value); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if value.Value != "1" {
+		t.Errorf("unexpected value: got %v", value.Value)
+	}
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/txn/s1/keys/b", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNotFound)
+
+	req, rr = setupRequestAndRecorder(http.MethodPut, "/_/txn/s1/keys/dir/b", "2")
+	req.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	req, rr = setupRequestAndRecorder(http.MethodDelete, "/_/txn/s1/keys/a", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	if op := m.sessions["s1"]["dir/b"]; op.Type != store.TxnPut || string(op.Value) != "2" || op.ContentType != "text/plain" {
+		t.Errorf("unexpected write: got %+v", op)
+	}
+	if op := m.sessions["s1"]["a"]; op.Type != store.TxnDelete {
+		t.Errorf("unexpected delete: got %+v", op)
+	}
+
+	m.err = fmt.Errorf("aborted: %w", store.ErrTxnConflict)
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/s1/commit", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusConflict)
+	m.err = nil
+	req, rr = setupRequestAndRecorder(http.MethodPost, "/_/txn/s1/commit", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusOK)
+
+	req, rr = setupRequestAndRecorder(http.MethodDelete, "/_/txn/s1", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNoContent)
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/txn/s1/keys/a", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNotFound)
+	req, rr = setupRequestAndRecorder(http.MethodGet, "/_/txn/s1/other", "")
+	h.ServeHTTP(rr, req)
+	assertStatusCode(t, rr.Code, http.StatusNotFound)
+}
@@ -176,6 +176,20 @@ func (h *HashRingManager) GetNodeMapForRingIndex(index int) (NodeMap, error) {
 	return h.hashMap[hash], nil
 }
 
+/*
+Retrieves the hash at the given index in the hash ring, which ends the range
+of hashes that index covers.
+*/
+func (h *HashRingManager) GetHashForRingIndex(index int) (uint32, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if index < 0 || index >= len(h.ring) {
+		return 0, fmt.Errorf("index out of range")
+	}
+	return h.ring[index], nil
+}
+
 func (h *HashRingManager) Len() int {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
@@ -117,6 +117,24 @@ func TestGetNodeMapForRingIndex(t *testing.T) {
 	}
 }
 
+func TestGetHashForRingIndex(t *testing.T) {
+	hrm := NewHashRingManager([]string{"node1", "node2", "node3"})
+
+	hash, err := hrm.GetHashForRingIndex(5)
+	if err != nil {
+		t.Fatalf("Hash retrieval error for ring index 5: %v", err)
+	}
+	index, _ := hrm.GetRingIndex(hash)
+	if index != 5 {
+		t.Errorf("Expected the hash to map to index 5, got %d", index)
+	}
+
+	_, err = hrm.GetHashForRingIndex(hrm.Len())
+	if err == nil {
+		t.Errorf("Expected error for out-of-range index, received: nil")
+	}
+}
+
 func contains(s []string, str string) bool {
 	for _, v := range s {
 		if v == str {
@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"hash/fnv"
+)
+
+/*
+A bloom filter over the keys of one table. Lookups for keys the table does
+not contain can usually be answered without reading any data block.
+*/
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+func bloomHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+/*
+Builds a filter from key hashes using bitsPerKey bits per key. The number
+of probes is chosen to minimise the false positive rate for that size.
+*/
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+
+	f := bloomFilter{bits: make([]byte, nbytes), k: k}
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := uint8(0); i < k; i++ {
+			pos := h % uint32(nbits)
+			f.bits[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return f
+}
+
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f.bits) == 0 {
+		return true
+	}
+	nbits := uint32(len(f.bits) * 8)
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := uint8(0); i < f.k; i++ {
+		pos := h % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+func (f bloomFilter) encode() []byte {
+	return append(append([]byte(nil), f.bits...), f.k)
+}
+
+func decodeBloomFilter(buf []byte) bloomFilter {
+	if len(buf) == 0 {
+		return bloomFilter{}
+	}
+	return bloomFilter{bits: buf[:len(buf)-1], k: buf[len(buf)-1]}
+}
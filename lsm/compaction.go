@@ -0,0 +1,291 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var errCompactionAborted = errors.New("lsm: compaction aborted")
+
+type compaction struct {
+	level  int
+	inputs [2][]*table
+}
+
+func (db *DB) compactLoop() {
+	defer db.wg.Done()
+
+	for {
+		select {
+		case <-db.compactCh:
+			for {
+				c := db.pickCompaction()
+				if c == nil {
+					break
+				}
+				if err := db.runCompaction(c); err != nil {
+					if errors.Is(err, errCompactionAborted) {
+						return
+					}
+					db.stats.compactionErrors.Add(1)
+					log.Printf("lsm: compaction of level %d failed: %v", c.level, err)
+					break
+				}
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+func (db *DB) maxBytesForLevel(level int) uint64 {
+	size := db.opts.LevelBaseSize
+	for i := 1; i < level; i++ {
+		size *= db.opts.LevelMultiplier
+	}
+	return size
+}
+
+func levelSize(tables []*table) uint64 {
+	var size uint64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+/*
+Chooses the next compaction, or nil if the tree is in shape. Level 0 is
+compacted as a whole once it holds too many tables, since its tables
+overlap. Deeper levels are compacted one table at a time whenever they
+grow beyond their size budget, merging that table into the overlapping
+tables of the next level.
+*/
+func (db *DB) pickCompaction() *compaction {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	v := db.current
+
+	var c *compaction
+	if len(v.levels[0]) >= db.opts.L0CompactionTrigger {
+		c = &compaction{level: 0}
+		c.inputs[0] = append(c.inputs[0], v.levels[0]...)
+	} else {
+		for level := 1; level < len(v.levels)-1; level++ {
+			if levelSize(v.levels[level]) > db.maxBytesForLevel(level) {
+				c = &compaction{level: level}
+				c.inputs[0] = []*table{pickLargest(v.levels[level])}
+				break
+			}
+		}
+	}
+	if c == nil {
+		return nil
+	}
+
+	smallest, largest := keyRange(c.inputs[0])
+	for _, t := range v.levels[c.level+1] {
+		if t.overlaps(smallest, largest) {
+			c.inputs[1] = append(c.inputs[1], t)
+		}
+	}
+	return c
+}
+
+func pickLargest(tables []*table) *table {
+	largest := tables[0]
+	for _, t := range tables[1:] {
+		if t.size > largest.size {
+			largest = t
+		}
+	}
+	return largest
+}
+
+func keyRange(tables []*table) (string, string) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		if t.smallest < smallest {
+			smallest = t.smallest
+		}
+		if t.largest > largest {
+			largest = t.largest
+		}
+	}
+	return smallest, largest
+}
+
+/*
+Reports whether no level below the output level holds keys in the given
+range, in which case deletions no longer need to be kept.
+*/
+func (db *DB) isBottommost(c *compaction, smallest, largest string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, tables := range db.current.levels[c.level+2:] {
+		for _, t := range tables {
+			if t.overlaps(smallest, largest) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+Merges the input tables into new tables on the next level and swaps them
+into the tree. Tables being compacted remain readable until the new ones
+are installed, so reads are never blocked by the merge.
+*/
+func (db *DB) runCompaction(c *compaction) error {
+	all := append(append([]*table(nil), c.inputs[0]...), c.inputs[1]...)
+	smallest, largest := keyRange(all)
+	dropDeletes := db.isBottommost(c, smallest, largest)
+
+	// Level-0 inputs are ordered newest first already; the lower level is
+	// older than anything above it.
+	var sources []iterator
+	if c.level == 0 {
+		for _, t := range c.inputs[0] {
+			sources = append(sources, newTableIterator(t, ""))
+		}
+	} else {
+		sources = append(sources, newLevelIterator(c.inputs[0], ""))
+	}
+	if len(c.inputs[1]) > 0 {
+		sources = append(sources, newLevelIterator(c.inputs[1], ""))
+	}
+
+	var outputs []*table
+	var w *tableWriter
+	var num uint64
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.file.Close()
+			db.removeTable(t.num)
+		}
+	}
+
+	it := newMergeIterator(sources)
+	for ; it.valid(); it.next() {
+		select {
+		case <-db.done:
+			abort()
+			return errCompactionAborted
+		default:
+		}
+
+		e := it.current()
+		if e.deleted && dropDeletes {
+			continue
+		}
+
+		if w == nil {
+			db.mu.Lock()
+			num = db.allocFile()
+			db.mu.Unlock()
+
+			var err error
+			if w, err = newTableWriter(db.tablePath(num)+tempSuffix, &db.opts, db.limiter); err != nil {
+				abort()
+				return err
+			}
+		}
+		if err := w.add(e); err != nil {
+			abort()
+			return err
+		}
+
+		if w.estimatedSize() >= db.opts.TableSize {
+			t, err := db.finishTable(w, num)
+			w = nil
+			if err != nil {
+				abort()
+				return err
+			}
+			outputs = append(outputs, t)
+		}
+	}
+	if err := it.err(); err != nil {
+		abort()
+		return err
+	}
+	if w != nil {
+		t, err := db.finishTable(w, num)
+		w = nil
+		if err != nil {
+			abort()
+			return err
+		}
+		outputs = append(outputs, t)
+	}
+
+	edit := versionEdit{
+		added:   map[int][]*table{c.level + 1: outputs},
+		removed: make(map[uint64]bool),
+	}
+	var read, written uint64
+	for _, t := range all {
+		edit.removed[t.num] = true
+		read += t.size
+	}
+	for _, t := range outputs {
+		written += t.size
+	}
+
+	if err := db.install(edit, nil); err != nil {
+		abort()
+		return fmt.Errorf("failed to install compaction: %w", err)
+	}
+
+	db.stats.compactions.Add(1)
+	db.stats.compactionBytesRead.Add(read)
+	db.stats.compactionBytesWritten.Add(written)
+	return nil
+}
+
+func (db *DB) removeTable(num uint64) {
+	if err := removeFile(db.tablePath(num)); err != nil {
+		log.Printf("lsm: failed to remove table %d: %v", num, err)
+	}
+}
+
+/*
+Throttles compaction writes to a number of bytes per second so that
+compaction does not starve foreground reads of disk bandwidth.
+*/
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (r *rateLimiter) wait(n int) {
+	r.written += int64(n)
+	expected := time.Duration(float64(r.written) / float64(r.bytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(r.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+	// Forget old history so that an idle period does not allow a burst.
+	if elapsed := time.Since(r.start); elapsed > time.Second {
+		r.start = time.Now()
+		r.written = 0
+	}
+}
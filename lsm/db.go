@@ -0,0 +1,644 @@
+/*
+Implements a log-structured merge-tree. Writes go to an in-memory memtable
+which is flushed to immutable sorted tables (SSTables) on disk; background
+compaction merges tables into progressively larger levels so that reads
+only need to consult a few files. Every table carries a bloom filter and a
+block index so that lookups read at most one data block per table.
+
+The tree does not log writes itself: the caller is expected to keep a
+write-ahead log and replay it after a crash, using Flush to learn when
+buffered writes have reached disk.
+*/
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	kindDelete byte = 0
+	kindPut    byte = 1
+
+	tableSuffix = ".sst"
+	tempSuffix  = ".tmp"
+)
+
+var ErrClosed = errors.New("lsm: database is closed")
+
+type Options struct {
+	// Size at which the memtable is frozen and flushed.
+	MemtableSize int64
+	// Frozen memtables allowed to wait for a flush before writes stall.
+	MaxImmutableMemtables int
+	// Target size of a data block before compression of the index.
+	BlockSize int
+	// Target size of tables written by compaction.
+	TableSize uint64
+	// Number of level-0 tables that triggers a compaction into level 1.
+	L0CompactionTrigger int
+	// Maximum size of level 1; each further level is LevelMultiplier times larger.
+	LevelBaseSize   uint64
+	LevelMultiplier uint64
+	MaxLevels       int
+	BloomBitsPerKey int
+	// Bytes per second compaction may write; zero means unlimited.
+	CompactionRateLimit int64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MemtableSize:          4 << 20,
+		MaxImmutableMemtables: 2,
+		BlockSize:             4 << 10,
+		TableSize:             2 << 20,
+		L0CompactionTrigger:   4,
+		LevelBaseSize:         10 << 20,
+		LevelMultiplier:       10,
+		MaxLevels:             7,
+		BloomBitsPerKey:       10,
+		CompactionRateLimit:   32 << 20,
+	}
+}
+
+/*
+A consistent set of tables. Readers hold a reference to the version they
+started with, so tables replaced by compaction stay readable until the
+last reader is done.
+*/
+type version struct {
+	levels [][]*table
+	refs   int
+}
+
+type LevelStats struct {
+	Tables int    `json:"tables"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+type Stats struct {
+	MemtableBytes          int64        `json:"memtable_bytes"`
+	ImmutableMemtables     int          `json:"immutable_memtables"`
+	Entries                uint64       `json:"entries"`
+	Bytes                  uint64       `json:"bytes"`
+	Levels                 []LevelStats `json:"levels"`
+	Flushes                uint64       `json:"flushes"`
+	Compactions            uint64       `json:"compactions"`
+	CompactionBytesRead    uint64       `json:"compaction_bytes_read"`
+	CompactionBytesWritten uint64       `json:"compaction_bytes_written"`
+	CompactionErrors       uint64       `json:"compaction_errors"`
+	BloomNegatives         uint64       `json:"bloom_negatives"`
+	WriteStalls            uint64       `json:"write_stalls"`
+}
+
+type counters struct {
+	flushes                atomic.Uint64
+	compactions            atomic.Uint64
+	compactionBytesRead    atomic.Uint64
+	compactionBytesWritten atomic.Uint64
+	compactionErrors       atomic.Uint64
+	bloomNegatives         atomic.Uint64
+	writeStalls            atomic.Uint64
+}
+
+type DB struct {
+	dir       string
+	opts      Options
+	mu        sync.Mutex
+	cond      *sync.Cond
+	installMu sync.Mutex
+	mem       *memtable
+	imm       []*memtable
+	current   *version
+	nextFile  uint64
+	closed    bool
+	bgErr     error
+	flushCh   chan struct{}
+	compactCh chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	limiter   *rateLimiter
+	stats     counters
+}
+
+/*
+Opens the tree stored in dir, creating it if necessary, and starts the
+background flush and compaction workers.
+*/
+func Open(dir string, opts Options) (*DB, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create lsm directory: %w", err)
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dir:       dir,
+		opts:      opts,
+		mem:       newMemtable(),
+		nextFile:  m.NextFile,
+		flushCh:   make(chan struct{}, 1),
+		compactCh: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		limiter:   newRateLimiter(opts.CompactionRateLimit),
+	}
+	db.cond = sync.NewCond(&db.mu)
+
+	v := &version{levels: make([][]*table, opts.MaxLevels), refs: 1}
+	live := make(map[uint64]bool)
+	for level, nums := range m.Levels {
+		if level >= opts.MaxLevels {
+			closeTables(v)
+			return nil, fmt.Errorf("manifest has %d levels, more than the configured %d", len(m.Levels), opts.MaxLevels)
+		}
+		for _, num := range nums {
+			t, err := openTable(db.tablePath(num), num)
+			if err != nil {
+				closeTables(v)
+				return nil, err
+			}
+			t.refs = 1
+			v.levels[level] = append(v.levels[level], t)
+			live[num] = true
+		}
+	}
+	sortLevels(v)
+	db.current = v
+
+	db.removeOrphans(live)
+
+	db.wg.Add(2)
+	go db.flushLoop()
+	go db.compactLoop()
+	db.signal(db.compactCh)
+
+	return db, nil
+}
+
+func closeTables(v *version) {
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.file.Close()
+		}
+	}
+}
+
+func (db *DB) tablePath(num uint64) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d%s", num, tableSuffix))
+}
+
+/*
+Removes tables left behind by flushes or compactions that did not make it
+into the manifest before a crash.
+*/
+func (db *DB) removeOrphans(live map[uint64]bool) {
+	paths, _ := filepath.Glob(filepath.Join(db.dir, "*"+tableSuffix+"*"))
+	for _, path := range paths {
+		name := filepath.Base(path)
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, tableSuffix), 10, 64)
+		if err == nil && live[num] {
+			continue
+		}
+		log.Printf("Removing orphaned lsm file %s", path)
+		os.Remove(path)
+	}
+}
+
+func sortLevels(v *version) {
+	sort.Slice(v.levels[0], func(i, j int) bool {
+		return v.levels[0][i].num > v.levels[0][j].num
+	})
+	for _, tables := range v.levels[1:] {
+		sort.Slice(tables, func(i, j int) bool {
+			return tables[i].smallest < tables[j].smallest
+		})
+	}
+}
+
+func (db *DB) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) ref() *version {
+	db.current.refs++
+	return db.current
+}
+
+/*
+Drops a reference to a version. Tables that are no longer part of any
+version are closed, and deleted if compaction replaced them. The caller
+must hold db.mu.
+*/
+func (db *DB) unref(v *version) {
+	v.refs--
+	if v.refs > 0 {
+		return
+	}
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.refs--
+			if t.refs > 0 {
+				continue
+			}
+			t.file.Close()
+			if t.obsolete {
+				os.Remove(db.tablePath(t.num))
+			}
+		}
+	}
+}
+
+func (db *DB) Put(key string, value []byte) error {
+	return db.write(entry{key: key, value: value})
+}
+
+func (db *DB) Delete(key string) error {
+	return db.write(entry{key: key, deleted: true})
+}
+
+func (db *DB) write(e entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	if db.mem.approximateSize() >= db.opts.MemtableSize {
+		if err := db.rotateMemtable(); err != nil {
+			return err
+		}
+	}
+	db.mem.set(e)
+	return nil
+}
+
+/*
+Freezes the current memtable and hands it to the flush worker, waiting for
+room if too many frozen memtables are already queued. The caller must hold
+db.mu.
+*/
+func (db *DB) rotateMemtable() error {
+	if len(db.imm) >= db.opts.MaxImmutableMemtables {
+		db.stats.writeStalls.Add(1)
+	}
+	for len(db.imm) >= db.opts.MaxImmutableMemtables && db.bgErr == nil {
+		db.cond.Wait()
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	db.imm = append(db.imm, db.mem)
+	db.mem = newMemtable()
+	db.signal(db.flushCh)
+	return nil
+}
+
+/*
+Looks up key in the memtables and then level by level, newest data first.
+Tables whose key range or bloom filter rules the key out are skipped
+without any disk access.
+*/
+func (db *DB) Get(key string) ([]byte, bool, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, false, ErrClosed
+	}
+	mem := db.mem
+	imm := append([]*memtable(nil), db.imm...)
+	v := db.ref()
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		db.unref(v)
+		db.mu.Unlock()
+	}()
+
+	if e, ok := mem.get(key); ok {
+		return e.value, !e.deleted, nil
+	}
+	for i := len(imm) - 1; i >= 0; i-- {
+		if e, ok := imm[i].get(key); ok {
+			return e.value, !e.deleted, nil
+		}
+	}
+
+	for level, tables := range v.levels {
+		candidates := tables
+		if level > 0 {
+			i := sort.Search(len(tables), func(i int) bool {
+				return tables[i].largest >= key
+			})
+			candidates = tables[i:]
+			if len(candidates) > 1 {
+				candidates = candidates[:1]
+			}
+		}
+
+		for _, t := range candidates {
+			if key < t.smallest || key > t.largest {
+				continue
+			}
+			if !t.bloom.mayContain(key) {
+				db.stats.bloomNegatives.Add(1)
+				continue
+			}
+			e, ok, err := t.get(key)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				return e.value, !e.deleted, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+/*
+Calls fn for every live key in [start, end) in key order until it returns
+false. An empty end means no upper bound. The scan sees a consistent set of
+tables but may or may not observe writes made while it runs.
+*/
+func (db *DB) Scan(start, end string, fn func(key string, value []byte) bool) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	sources := []iterator{&sliceIterator{entries: db.mem.entries(start, end)}}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		sources = append(sources, &sliceIterator{entries: db.imm[i].entries(start, end)})
+	}
+	v := db.ref()
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		db.unref(v)
+		db.mu.Unlock()
+	}()
+
+	for _, t := range v.levels[0] {
+		sources = append(sources, newTableIterator(t, start))
+	}
+	for _, tables := range v.levels[1:] {
+		if len(tables) > 0 {
+			sources = append(sources, newLevelIterator(tables, start))
+		}
+	}
+
+	it := newMergeIterator(sources)
+	for ; it.valid(); it.next() {
+		e := it.current()
+		if end != "" && e.key >= end {
+			break
+		}
+		if e.deleted {
+			continue
+		}
+		if !fn(e.key, e.value) {
+			break
+		}
+	}
+	return it.err()
+}
+
+/*
+Flushes the memtable and waits until every buffered write is stored in a
+table on disk.
+*/
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.mem.len() > 0 {
+		if err := db.rotateMemtable(); err != nil {
+			return err
+		}
+	}
+	for len(db.imm) > 0 && db.bgErr == nil {
+		db.cond.Wait()
+	}
+	return db.bgErr
+}
+
+/*
+Flushes buffered writes, stops the background workers and closes all
+tables.
+*/
+func (db *DB) Close() error {
+	flushErr := db.Flush()
+	if errors.Is(flushErr, ErrClosed) {
+		return nil
+	}
+
+	db.mu.Lock()
+	db.closed = true
+	db.mu.Unlock()
+
+	close(db.done)
+	db.wg.Wait()
+
+	db.mu.Lock()
+	db.unref(db.current)
+	db.mu.Unlock()
+	return flushErr
+}
+
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+
+	for {
+		select {
+		case <-db.flushCh:
+			for db.flushOne() {
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+/*
+Writes the oldest frozen memtable to a new level-0 table. It returns false
+when there was nothing to flush or the flush failed.
+*/
+func (db *DB) flushOne() bool {
+	db.mu.Lock()
+	if len(db.imm) == 0 || db.bgErr != nil {
+		db.mu.Unlock()
+		return false
+	}
+	mem := db.imm[0]
+	num := db.allocFile()
+	db.mu.Unlock()
+
+	t, err := db.writeTable(num, mem.entries("", ""), nil)
+	if err == nil {
+		err = db.install(versionEdit{added: map[int][]*table{0: {t}}}, func() {
+			db.imm = db.imm[1:]
+		})
+	}
+
+	if err != nil {
+		db.mu.Lock()
+		db.bgErr = fmt.Errorf("lsm: flush failed: %w", err)
+		db.cond.Broadcast()
+		db.mu.Unlock()
+		log.Printf("%v", db.bgErr)
+		return false
+	}
+
+	db.stats.flushes.Add(1)
+	db.signal(db.compactCh)
+	return true
+}
+
+func (db *DB) allocFile() uint64 {
+	db.nextFile++
+	return db.nextFile
+}
+
+/*
+Writes sorted entries to a single new table.
+*/
+func (db *DB) writeTable(num uint64, entries []entry, limiter *rateLimiter) (*table, error) {
+	path := db.tablePath(num)
+	w, err := newTableWriter(path+tempSuffix, &db.opts, limiter)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := w.add(e); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return db.finishTable(w, num)
+}
+
+func (db *DB) finishTable(w *tableWriter, num uint64) (*table, error) {
+	path := db.tablePath(num)
+	if _, err := w.finish(); err != nil {
+		os.Remove(path + tempSuffix)
+		return nil, err
+	}
+	if err := os.Rename(path+tempSuffix, path); err != nil {
+		os.Remove(path + tempSuffix)
+		return nil, err
+	}
+	return openTable(path, num)
+}
+
+type versionEdit struct {
+	added   map[int][]*table
+	removed map[uint64]bool
+}
+
+/*
+Applies an edit to the current version, records the result in the manifest
+and makes it current. apply runs under db.mu together with the switch, so
+callers can update other state atomically with the new version.
+*/
+func (db *DB) install(edit versionEdit, apply func()) error {
+	db.installMu.Lock()
+	defer db.installMu.Unlock()
+
+	db.mu.Lock()
+	old := db.current
+	v := &version{levels: make([][]*table, len(old.levels)), refs: 1}
+	for level, tables := range old.levels {
+		for _, t := range tables {
+			if !edit.removed[t.num] {
+				v.levels[level] = append(v.levels[level], t)
+			}
+		}
+		v.levels[level] = append(v.levels[level], edit.added[level]...)
+	}
+	sortLevels(v)
+	nextFile := db.nextFile
+	db.mu.Unlock()
+
+	if err := writeManifest(db.dir, v, nextFile); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.refs++
+		}
+	}
+	for _, tables := range old.levels {
+		for _, t := range tables {
+			if edit.removed[t.num] {
+				t.obsolete = true
+			}
+		}
+	}
+	db.current = v
+	if apply != nil {
+		apply()
+	}
+	db.unref(old)
+	db.cond.Broadcast()
+	return nil
+}
+
+/*
+Returns statistics about memtables, levels and background work.
+*/
+func (db *DB) Stats() Stats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := Stats{
+		MemtableBytes:          db.mem.approximateSize(),
+		ImmutableMemtables:     len(db.imm),
+		Levels:                 make([]LevelStats, len(db.current.levels)),
+		Flushes:                db.stats.flushes.Load(),
+		Compactions:            db.stats.compactions.Load(),
+		CompactionBytesRead:    db.stats.compactionBytesRead.Load(),
+		CompactionBytesWritten: db.stats.compactionBytesWritten.Load(),
+		CompactionErrors:       db.stats.compactionErrors.Load(),
+		BloomNegatives:         db.stats.bloomNegatives.Load(),
+		WriteStalls:            db.stats.writeStalls.Load(),
+	}
+	s.Entries = uint64(db.mem.len())
+	for _, m := range db.imm {
+		s.Entries += uint64(m.len())
+		s.MemtableBytes += m.approximateSize()
+	}
+	for level, tables := range db.current.levels {
+		for _, t := range tables {
+			s.Levels[level].Tables++
+			s.Levels[level].Bytes += t.size
+			s.Entries += t.count
+			s.Bytes += t.size
+		}
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func smallOptions() Options {
+	opts := DefaultOptions()
+	opts.MemtableSize = 4 << 10
+	opts.BlockSize = 256
+	opts.TableSize = 8 << 10
+	opts.LevelBaseSize = 32 << 10
+	opts.CompactionRateLimit = 0
+	return opts
+}
+
+func openTestDB(t *testing.T, dir string, opts Options) *DB {
+	t.Helper()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	return db
+}
+
+func assertGet(t *testing.T, db *DB, key, want string, wantOK bool) {
+	t.Helper()
+	value, ok, err := db.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) returned error: %v", key, err)
+	}
+	if ok != wantOK {
+		t.Fatalf("Get(%q) found = %v, want %v", key, ok, wantOK)
+	}
+	if ok && string(value) != want {
+		t.Errorf("Get(%q) = %q, want %q", key, value, want)
+	}
+}
+
+func TestDB_GetPutDelete(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), smallOptions())
+	defer db.Close()
+
+	_ = db.Put("a", []byte("1"))
+	_ = db.Put("b", []byte("2"))
+	_ = db.Delete("a")
+
+	assertGet(t, db, "a", "", false)
+	assertGet(t, db, "b", "2", true)
+	assertGet(t, db, "c", "", false)
+}
+
+func TestDB_FlushAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, smallOptions())
+
+	for i := 0; i < 500; i++ {
+		_ = db.Put(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	for i := 0; i < 500; i += 2 {
+		_ = db.Delete(fmt.Sprintf("key%04d", i))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("expected no error on close, got %v", err)
+	}
+
+	db = openTestDB(t, dir, smallOptions())
+	defer db.Close()
+
+	assertGet(t, db, "key0000", "", false)
+	assertGet(t, db, "key0001", "value1", true)
+	assertGet(t, db, "key0499", "value499", true)
+
+	stats := db.Stats()
+	if stats.Flushes+uint64(stats.Levels[0].Tables) == 0 && stats.Levels[1].Tables == 0 {
+		t.Errorf("expected data to be stored in tables, got %+v", stats)
+	}
+}
+
+func TestDB_Compaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), smallOptions())
+	defer db.Close()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 400; i++ {
+			_ = db.Put(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d-%d", i, round)))
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("expected no error on flush, got %v", err)
+		}
+	}
+	_ = db.Delete("key0007")
+	_ = db.Flush()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := db.Stats()
+		if stats.Compactions > 0 && stats.Levels[0].Tables < db.opts.L0CompactionTrigger {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected level 0 to be compacted, got %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assertGet(t, db, "key0000", "value0-4", true)
+	assertGet(t, db, "key0399", "value399-4", true)
+	assertGet(t, db, "key0007", "", false)
+}
+
+func TestDB_Scan(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), smallOptions())
+	defer db.Close()
+
+	for i := 0; i < 300; i++ {
+		_ = db.Put(fmt.Sprintf("key%04d", i), []byte("old"))
+	}
+	_ = db.Flush()
+	for i := 100; i < 200; i++ {
+		_ = db.Put(fmt.Sprintf("key%04d", i), []byte("new"))
+	}
+	_ = db.Delete("key0150")
+
+	var keys []string
+	err := db.Scan("key0148", "key0153", func(key string, value []byte) bool {
+		if string(value) != "new" {
+			t.Errorf("expected newest value for %s, got %s", key, value)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	want := []string{"key0148", "key0149", "key0151", "key0152"}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("Scan returned %v, want %v", keys, want)
+	}
+
+	count := 0
+	_ = db.Scan("", "", func(string, []byte) bool {
+		count++
+		return true
+	})
+	if count != 299 {
+		t.Errorf("full scan returned %d keys, want 299", count)
+	}
+}
+
+func TestDB_BloomFilterSkipsTables(t *testing.T) {
+	db := openTestDB(t, t.TempDir(), smallOptions())
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		_ = db.Put(fmt.Sprintf("key%04d", i), []byte("v"))
+	}
+	_ = db.Flush()
+
+	for i := 0; i < 100; i++ {
+		assertGet(t, db, fmt.Sprintf("key%04d-missing", i), "", false)
+	}
+	if db.Stats().BloomNegatives == 0 {
+		t.Errorf("expected the bloom filter to rule out missing keys")
+	}
+}
@@ -0,0 +1,168 @@
+package lsm
+
+import (
+	"sort"
+)
+
+type iterator interface {
+	valid() bool
+	current() entry
+	next()
+	err() error
+}
+
+type sliceIterator struct {
+	entries []entry
+	pos     int
+}
+
+func (it *sliceIterator) valid() bool    { return it.pos < len(it.entries) }
+func (it *sliceIterator) current() entry { return it.entries[it.pos] }
+func (it *sliceIterator) next()          { it.pos++ }
+func (it *sliceIterator) err() error     { return nil }
+
+/*
+Iterates over one table in key order, reading one block at a time.
+*/
+type tableIterator struct {
+	t       *table
+	block   int
+	entries []entry
+	pos     int
+	e       error
+}
+
+func newTableIterator(t *table, start string) *tableIterator {
+	it := &tableIterator{t: t, block: t.findBlock(start)}
+	it.load()
+	for it.valid() && it.current().key < start {
+		it.next()
+	}
+	return it
+}
+
+func (it *tableIterator) load() {
+	it.entries, it.pos = nil, 0
+	for it.block < len(it.t.index) && len(it.entries) == 0 {
+		entries, err := it.t.readBlock(it.t.index[it.block])
+		if err != nil {
+			it.e = err
+			it.block = len(it.t.index)
+			return
+		}
+		it.entries = entries
+		if len(entries) == 0 {
+			it.block++
+		}
+	}
+}
+
+func (it *tableIterator) valid() bool    { return it.e == nil && it.pos < len(it.entries) }
+func (it *tableIterator) current() entry { return it.entries[it.pos] }
+func (it *tableIterator) err() error     { return it.e }
+
+func (it *tableIterator) next() {
+	it.pos++
+	if it.pos >= len(it.entries) {
+		it.block++
+		it.load()
+	}
+}
+
+/*
+Iterates over the non-overlapping, sorted tables of one level as if they
+were a single table.
+*/
+type levelIterator struct {
+	tables []*table
+	idx    int
+	cur    *tableIterator
+}
+
+func newLevelIterator(tables []*table, start string) *levelIterator {
+	idx := sort.Search(len(tables), func(i int) bool {
+		return tables[i].largest >= start
+	})
+	it := &levelIterator{tables: tables, idx: idx}
+	if idx < len(tables) {
+		it.cur = newTableIterator(tables[idx], start)
+		it.skipExhausted()
+	}
+	return it
+}
+
+func (it *levelIterator) skipExhausted() {
+	for it.cur != nil && !it.cur.valid() && it.cur.err() == nil {
+		it.idx++
+		if it.idx >= len(it.tables) {
+			it.cur = nil
+			return
+		}
+		it.cur = newTableIterator(it.tables[it.idx], "")
+	}
+}
+
+func (it *levelIterator) valid() bool    { return it.cur != nil && it.cur.valid() }
+func (it *levelIterator) current() entry { return it.cur.current() }
+
+func (it *levelIterator) next() {
+	it.cur.next()
+	it.skipExhausted()
+}
+
+func (it *levelIterator) err() error {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.err()
+}
+
+/*
+Merges several sorted iterators into one. Sources are ordered from newest
+to oldest; when several sources hold the same key, only the newest entry
+is returned.
+*/
+type mergeIterator struct {
+	sources []iterator
+	cur     int
+}
+
+func newMergeIterator(sources []iterator) *mergeIterator {
+	m := &mergeIterator{sources: sources}
+	m.pick()
+	return m
+}
+
+func (m *mergeIterator) pick() {
+	m.cur = -1
+	for i, src := range m.sources {
+		if !src.valid() {
+			continue
+		}
+		if m.cur == -1 || src.current().key < m.sources[m.cur].current().key {
+			m.cur = i
+		}
+	}
+}
+
+func (m *mergeIterator) valid() bool    { return m.cur >= 0 }
+func (m *mergeIterator) current() entry { return m.sources[m.cur].current() }
+
+func (m *mergeIterator) next() {
+	key := m.current().key
+	for _, src := range m.sources {
+		for src.valid() && src.current().key == key {
+			src.next()
+		}
+	}
+	m.pick()
+}
+
+func (m *mergeIterator) err() error {
+	for _, src := range m.sources {
+		if err := src.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const manifestFileName = "MANIFEST"
+
+/*
+The manifest lists the tables of every level. It is rewritten atomically
+whenever a flush or compaction changes the set of tables, so it always
+describes a consistent tree.
+*/
+type manifest struct {
+	NextFile uint64     `json:"next_file"`
+	Levels   [][]uint64 `json:"levels"`
+}
+
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+func writeManifest(dir string, v *version, nextFile uint64) error {
+	m := manifest{NextFile: nextFile, Levels: make([][]uint64, len(v.levels))}
+	for level, tables := range v.levels {
+		m.Levels[level] = make([]uint64, 0, len(tables))
+		for _, t := range tables {
+			m.Levels[level] = append(m.Levels[level], t.num)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, manifestFileName)
+	file, err := os.OpenFile(path+tempSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tempSuffix, path); err != nil {
+		return fmt.Errorf("failed to rename manifest: %w", err)
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
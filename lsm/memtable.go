@@ -0,0 +1,142 @@
+package lsm
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	maxSkipLevel  = 12
+	entryOverhead = 32
+)
+
+type entry struct {
+	key     string
+	value   []byte
+	deleted bool
+}
+
+type skipNode struct {
+	entry
+	next []*skipNode
+}
+
+/*
+The in-memory write buffer: a skiplist ordered by key holding the latest
+write for each key, including deletions. Once full it is frozen and
+flushed to an SSTable.
+*/
+type memtable struct {
+	mu    sync.RWMutex
+	head  *skipNode
+	level int
+	size  int64
+	count int
+	rnd   *rand.Rand
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &skipNode{next: make([]*skipNode, maxSkipLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (m *memtable) randomLevel() int {
+	level := 1
+	for level < maxSkipLevel && m.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+/*
+Returns the first node with a key greater than or equal to key. If prev is
+given, it is filled with the rightmost node before that position on every
+level.
+*/
+func (m *memtable) findGreaterOrEqual(key string, prev []*skipNode) *skipNode {
+	x := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (m *memtable) set(e entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := make([]*skipNode, maxSkipLevel)
+	node := m.findGreaterOrEqual(e.key, prev)
+	if node != nil && node.key == e.key {
+		m.size += int64(len(e.value) - len(node.value))
+		node.entry = e
+		return
+	}
+
+	level := m.randomLevel()
+	if level > m.level {
+		for i := m.level; i < level; i++ {
+			prev[i] = m.head
+		}
+		m.level = level
+	}
+
+	node = &skipNode{entry: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	m.size += int64(len(e.key) + len(e.value) + entryOverhead)
+	m.count++
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node := m.findGreaterOrEqual(key, nil)
+	if node != nil && node.key == key {
+		return node.entry, true
+	}
+	return entry{}, false
+}
+
+/*
+Copies the entries in [start, end) in key order. An empty end means no upper
+bound. Copying keeps iterators from holding the lock while callers consume
+them.
+*/
+func (m *memtable) entries(start, end string) []entry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []entry
+	for node := m.findGreaterOrEqual(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		result = append(result, node.entry)
+	}
+	return result
+}
+
+func (m *memtable) approximateSize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+func (m *memtable) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.count
+}
@@ -0,0 +1,356 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+const (
+	tableMagic = 0x4c534d31
+	footerSize = 48
+)
+
+var (
+	crcTable      = crc32.MakeTable(crc32.Castagnoli)
+	errCorruptSST = errors.New("corrupt sstable")
+)
+
+type blockHandle struct {
+	lastKey string
+	offset  uint64
+	length  uint64
+}
+
+/*
+Writes an immutable sorted table. Entries must be added in strictly
+increasing key order.
+
+Layout:
+
+	| data block | ... | index | bloom filter | footer |
+
+A data block is a run of entries followed by a crc32 of the block. Each
+entry is | key length | key | kind | value length | value | with uvarint
+lengths. The index holds the smallest key of the table and, for every
+block, its last key and position. The footer locates the index and the
+filter and carries a checksum over both.
+*/
+type tableWriter struct {
+	file     *os.File
+	writer   *bufio.Writer
+	offset   uint64
+	block    []byte
+	firstKey string
+	lastKey  string
+	index    []blockHandle
+	hashes   []uint32
+	count    uint64
+	opts     *Options
+	limiter  *rateLimiter
+}
+
+func newTableWriter(path string, opts *Options, limiter *rateLimiter) (*tableWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sstable: %w", err)
+	}
+	return &tableWriter{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		opts:    opts,
+		limiter: limiter,
+	}, nil
+}
+
+func (w *tableWriter) add(e entry) error {
+	if w.count == 0 {
+		w.firstKey = e.key
+	}
+	w.lastKey = e.key
+	w.count++
+	w.hashes = append(w.hashes, bloomHash(e.key))
+
+	w.block = binary.AppendUvarint(w.block, uint64(len(e.key)))
+	w.block = append(w.block, e.key...)
+	if e.deleted {
+		w.block = append(w.block, kindDelete)
+	} else {
+		w.block = append(w.block, kindPut)
+	}
+	w.block = binary.AppendUvarint(w.block, uint64(len(e.value)))
+	w.block = append(w.block, e.value...)
+
+	if len(w.block) >= w.opts.BlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.block = binary.LittleEndian.AppendUint32(w.block, crc32.Checksum(w.block, crcTable))
+	if _, err := w.writer.Write(w.block); err != nil {
+		return fmt.Errorf("failed to write sstable block: %w", err)
+	}
+
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: w.offset, length: uint64(len(w.block))})
+	w.offset += uint64(len(w.block))
+	if w.limiter != nil {
+		w.limiter.wait(len(w.block))
+	}
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *tableWriter) estimatedSize() uint64 {
+	return w.offset + uint64(len(w.block))
+}
+
+/*
+Writes the index, filter and footer and syncs the file. It returns the
+final size of the table.
+*/
+func (w *tableWriter) finish() (uint64, error) {
+	if err := w.flushBlock(); err != nil {
+		w.file.Close()
+		return 0, err
+	}
+
+	var index []byte
+	index = binary.AppendUvarint(index, uint64(len(w.firstKey)))
+	index = append(index, w.firstKey...)
+	index = binary.AppendUvarint(index, uint64(len(w.index)))
+	for _, h := range w.index {
+		index = binary.AppendUvarint(index, uint64(len(h.lastKey)))
+		index = append(index, h.lastKey...)
+		index = binary.AppendUvarint(index, h.offset)
+		index = binary.AppendUvarint(index, h.length)
+	}
+	bloom := newBloomFilter(w.hashes, w.opts.BloomBitsPerKey).encode()
+
+	checksum := crc32.Update(crc32.Checksum(index, crcTable), crcTable, bloom)
+	footer := make([]byte, 0, footerSize)
+	footer = binary.LittleEndian.AppendUint64(footer, w.offset)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(index)))
+	footer = binary.LittleEndian.AppendUint64(footer, w.offset+uint64(len(index)))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(bloom)))
+	footer = binary.LittleEndian.AppendUint64(footer, w.count)
+	footer = binary.LittleEndian.AppendUint32(footer, checksum)
+	footer = binary.LittleEndian.AppendUint32(footer, tableMagic)
+
+	for _, section := range [][]byte{index, bloom, footer} {
+		if _, err := w.writer.Write(section); err != nil {
+			w.file.Close()
+			return 0, fmt.Errorf("failed to write sstable: %w", err)
+		}
+	}
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return 0, fmt.Errorf("failed to write sstable: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return 0, fmt.Errorf("failed to sync sstable: %w", err)
+	}
+	size := w.offset + uint64(len(index)+len(bloom)+len(footer))
+	return size, w.file.Close()
+}
+
+func (w *tableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+/*
+An open SSTable. The index and bloom filter are kept in memory; data
+blocks are read from the file on demand.
+*/
+type table struct {
+	num      uint64
+	file     *os.File
+	size     uint64
+	count    uint64
+	smallest string
+	largest  string
+	index    []blockHandle
+	bloom    bloomFilter
+	refs     int
+	obsolete bool
+}
+
+func openTable(path string, num uint64) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(file, num)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open sstable %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func readTable(file *os.File, num uint64) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(info.Size())
+	if size < footerSize {
+		return nil, errCorruptSST
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, int64(size-footerSize)); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[44:48]) != tableMagic {
+		return nil, errCorruptSST
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	indexLen := binary.LittleEndian.Uint64(footer[8:16])
+	bloomOffset := binary.LittleEndian.Uint64(footer[16:24])
+	bloomLen := binary.LittleEndian.Uint64(footer[24:32])
+	if bloomOffset != indexOffset+indexLen || bloomOffset+bloomLen != size-footerSize {
+		return nil, errCorruptSST
+	}
+
+	meta := make([]byte, indexLen+bloomLen)
+	if _, err := file.ReadAt(meta, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(meta, crcTable) != binary.LittleEndian.Uint32(footer[40:44]) {
+		return nil, errCorruptSST
+	}
+
+	t := &table{
+		num:   num,
+		file:  file,
+		size:  size,
+		count: binary.LittleEndian.Uint64(footer[32:40]),
+		bloom: decodeBloomFilter(meta[indexLen:]),
+	}
+
+	buf := meta[:indexLen]
+	smallest, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	t.smallest = string(smallest)
+
+	blocks, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errCorruptSST
+	}
+	buf = buf[n:]
+	for i := uint64(0); i < blocks; i++ {
+		var key []byte
+		if key, buf, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		offset, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errCorruptSST
+		}
+		buf = buf[n:]
+		length, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errCorruptSST
+		}
+		buf = buf[n:]
+		t.index = append(t.index, blockHandle{lastKey: string(key), offset: offset, length: length})
+	}
+	if len(t.index) > 0 {
+		t.largest = t.index[len(t.index)-1].lastKey
+	}
+	return t, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, errCorruptSST
+	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], nil
+}
+
+/*
+Reads and decodes a data block after verifying its checksum.
+*/
+func (t *table) readBlock(h blockHandle) ([]entry, error) {
+	if h.length < 4 {
+		return nil, errCorruptSST
+	}
+	buf := make([]byte, h.length)
+	if _, err := t.file.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, fmt.Errorf("failed to read sstable block: %w", err)
+	}
+	data := buf[:len(buf)-4]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, errCorruptSST
+	}
+
+	var entries []entry
+	for len(data) > 0 {
+		key, rest, err := readBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return nil, errCorruptSST
+		}
+		kind := rest[0]
+		value, rest, err := readBytes(rest[1:])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: string(key), value: value, deleted: kind == kindDelete})
+		data = rest
+	}
+	return entries, nil
+}
+
+/*
+Returns the index of the first block that may contain key, or len(index)
+if key is beyond the end of the table.
+*/
+func (t *table) findBlock(key string) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].lastKey >= key
+	})
+}
+
+/*
+Looks up the entry for key. The bloom filter is not consulted here so that
+callers can account for filter hits themselves.
+*/
+func (t *table) get(key string) (entry, bool, error) {
+	i := t.findBlock(key)
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+	entries, err := t.readBlock(t.index[i])
+	if err != nil {
+		return entry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool {
+		return entries[j].key >= key
+	})
+	if j < len(entries) && entries[j].key == key {
+		return entries[j], true, nil
+	}
+	return entry{}, false, nil
+}
+
+func (t *table) overlaps(start, end string) bool {
+	return t.largest >= start && t.smallest <= end
+}
@@ -0,0 +1,110 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestTable(t *testing.T, entries []entry) *table {
+	t.Helper()
+	opts := smallOptions()
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := newTableWriter(path, &opts, nil)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for _, e := range entries {
+		if err := w.add(e); err != nil {
+			t.Fatalf("failed to add entry: %v", err)
+		}
+	}
+	if _, err := w.finish(); err != nil {
+		t.Fatalf("failed to finish table: %v", err)
+	}
+	tbl, err := openTable(path, 1)
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	t.Cleanup(func() { tbl.file.Close() })
+	return tbl
+}
+
+func TestTable_RoundTrip(t *testing.T) {
+	var entries []entry
+	for i := 0; i < 200; i++ {
+		entries = append(entries, entry{key: fmt.Sprintf("key%04d", i), value: []byte(fmt.Sprintf("value%d", i)), deleted: i%10 == 0})
+	}
+	tbl := writeTestTable(t, entries)
+
+	if tbl.smallest != "key0000" || tbl.largest != "key0199" {
+		t.Errorf("unexpected key range [%s, %s]", tbl.smallest, tbl.largest)
+	}
+	if len(tbl.index) < 2 {
+		t.Errorf("expected several blocks, got %d", len(tbl.index))
+	}
+
+	e, ok, err := tbl.get("key0042")
+	if err != nil || !ok || string(e.value) != "value42" {
+		t.Errorf("get(key0042) = %v, %v, %v", e, ok, err)
+	}
+	e, ok, _ = tbl.get("key0040")
+	if !ok || !e.deleted {
+		t.Errorf("expected a deletion for key0040, got %v, %v", e, ok)
+	}
+	_, ok, _ = tbl.get("key0042a")
+	if ok {
+		t.Errorf("expected key0042a to be missing")
+	}
+
+	count := 0
+	for it := newTableIterator(tbl, "key0100"); it.valid(); it.next() {
+		count++
+	}
+	if count != 100 {
+		t.Errorf("iterator from key0100 returned %d entries, want 100", count)
+	}
+}
+
+func TestTable_DetectsCorruption(t *testing.T) {
+	tbl := writeTestTable(t, []entry{{key: "a", value: []byte("1")}, {key: "b", value: []byte("2")}})
+	path := tbl.file.Name()
+
+	data, _ := os.ReadFile(path)
+	data[1] ^= 0xff
+	_ = os.WriteFile(path, data, 0o644)
+
+	corrupt, err := openTable(path, 1)
+	if err != nil {
+		t.Fatalf("expected the table to open, got %v", err)
+	}
+	defer corrupt.file.Close()
+	if _, _, err := corrupt.get("a"); err == nil {
+		t.Errorf("expected a checksum error reading a corrupt block")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var hashes []uint32
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash(fmt.Sprintf("key%d", i)))
+	}
+	f := decodeBloomFilter(newBloomFilter(hashes, 10).encode())
+
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("bloom filter is missing key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("false positive rate too high: %d/10000", falsePositives)
+	}
+}
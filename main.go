@@ -20,23 +20,143 @@ func main() {
 	var port int
 	var nodesStr string
 	var replicationFactor int
+	var readQuorum int
+	var writeQuorum int
+	var advertise string
+	var hintMaxAge time.Duration
+	var hintMaxSize string
+	var antiEntropyInterval time.Duration
+	var antiEntropyRate int
+	var tombstoneGracePeriod time.Duration
+	var replicationMode string
+	var raftJoin bool
+	var raftTick time.Duration
+	var dataDir string
+	var fsync string
+	var snapshotInterval time.Duration
+	var engine string
+	var maxMemory string
+	var evictionPolicy string
+	var maxValueSize string
+	var nodeID string
+	var conflictResolution string
+	var readRepairChance float64
 	flag.IntVar(&port, "port", 8080, "Port to listen on")
 	flag.StringVar(&nodesStr, "nodes", "", "Comma-separated list of other nodes")
-	flag.IntVar(&replicationFactor, "replicationFactor", 2, "Replication factor")
+	flag.StringVar(&advertise, "advertise", "", "Address other nodes reach this node at, exactly as listed in their -nodes (required with -nodes)")
+	flag.IntVar(&replicationFactor, "n", 2, "Replication factor: how many nodes, this one included, hold each key")
+	flag.IntVar(&replicationFactor, "replicationFactor", 2, "Deprecated alias of -n")
+	flag.IntVar(&readQuorum, "r", 0, "How many replicas a read waits for (0 means a majority of -n)")
+	flag.IntVar(&writeQuorum, "w", 0, "How many replicas a write waits for (0 means a majority of -n)")
+	flag.DurationVar(&hintMaxAge, "hint-max-age", store.DefaultHintMaxAge, "How long writes for a node that is down are kept as hints")
+	flag.StringVar(&hintMaxSize, "hint-max-size", "64MB", "How much this node holds in hints for nodes that are down, such as 64MB")
+	flag.DurationVar(&antiEntropyInterval, "anti-entropy-interval", store.DefaultAntiEntropyInterval, "How often replicas compare their keys with Merkle trees (0 disables)")
+	flag.IntVar(&antiEntropyRate, "anti-entropy-rate", store.DefaultAntiEntropyRate, "How many differing keys anti-entropy reconciles per second (0 means no limit)")
+	flag.DurationVar(&tombstoneGracePeriod, "tombstone-grace-period", store.DefaultTombstoneGracePeriod, "How long deleted keys are kept as tombstones before they are purged")
+	flag.StringVar(&replicationMode, "replication-mode", string(store.EventualReplication), "How replicas agree on values: eventual, or raft for a Raft group per partition")
+	flag.BoolVar(&raftJoin, "raft-join", false, "In raft mode, wait to be added to the groups of a running cluster instead of starting them")
+	flag.DurationVar(&raftTick, "raft-tick", store.DefaultRaftTickInterval, "Length of a Raft tick: leaders send heartbeats every tick, elections start after 10 to 20")
+	flag.StringVar(&dataDir, "data-dir", "", "Directory for the write-ahead log (empty keeps data in memory only)")
+	flag.StringVar(&fsync, "fsync", "100ms", "WAL fsync policy: always, never or an interval such as 100ms")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 5*time.Minute, "How often to snapshot the store and compact the WAL (0 disables)")
+	flag.StringVar(&engine, "engine", store.DefaultEngine, fmt.Sprintf("Storage engine (%s)", strings.Join(store.Engines(), ", ")))
+	flag.StringVar(&maxMemory, "max-memory", "0", "Memory budget for keys and values, such as 512MB (0 means no limit)")
+	flag.StringVar(&evictionPolicy, "eviction-policy", string(store.NoEviction), "What to do when -max-memory is reached: noeviction, allkeys-lru, allkeys-lfu or volatile-ttl")
+	flag.StringVar(&maxValueSize, "max-value-size", "64MB", "Largest value a PUT may carry, such as 64MB (0 means no limit)")
+	flag.StringVar(&nodeID, "node-id", "", "Stable ID of this node in vector clocks (defaults to hostname:port)")
+	flag.StringVar(&conflictResolution, "conflict-resolution", string(store.KeepSiblings), "How concurrent writes are settled: siblings or lww (last write wins by hybrid logical clock)")
+	flag.Float64Var(&readRepairChance, "read-repair-chance", 1, "Probability that a read repairs replicas holding a stale copy in the background (0 disables)")
 	flag.Parse()
 
-	store := store.NewStore(strings.Split(nodesStr, ","), replicationFactor)
+	fsyncPolicy, err := store.ParseFsyncPolicy(fsync)
+	if err != nil {
+		log.Fatalf("Invalid -fsync: %v", err)
+	}
+
+	maxMemoryBytes, err := store.ParseMemorySize(maxMemory)
+	if err != nil {
+		log.Fatalf("Invalid -max-memory: %v", err)
+	}
+	policy, err := store.ParseEvictionPolicy(evictionPolicy)
+	if err != nil {
+		log.Fatalf("Invalid -eviction-policy: %v", err)
+	}
+
+	maxValueBytes, err := store.ParseMemorySize(maxValueSize)
+	if err != nil {
+		log.Fatalf("Invalid -max-value-size: %v", err)
+	}
+
+	hintMaxBytes, err := store.ParseMemorySize(hintMaxSize)
+	if err != nil {
+		log.Fatalf("Invalid -hint-max-size: %v", err)
+	}
+
+	resolution, err := store.ParseConflictResolution(conflictResolution)
+	if err != nil {
+		log.Fatalf("Invalid -conflict-resolution: %v", err)
+	}
+
+	mode, err := store.ParseReplicationMode(replicationMode)
+	if err != nil {
+		log.Fatalf("Invalid -replication-mode: %v", err)
+	}
+
+	if nodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Could not determine the node ID: %v", err)
+		}
+		nodeID = fmt.Sprintf("%s:%d", hostname, port)
+	}
+
+	// Nodes place themselves on the ring under this name, so one their peers
+	// do not know them by would make them disagree on who owns which keys.
+	if strings.TrimSpace(nodesStr) != "" && advertise == "" {
+		log.Fatalf("-advertise is required with -nodes: set it to the address the other nodes list this node under")
+	}
+
+	store, err := store.NewStore(
+		strings.Split(nodesStr, ","),
+		replicationFactor,
+		store.WithEngine(engine),
+		store.WithDataDir(dataDir),
+		store.WithFsyncPolicy(fsyncPolicy),
+		store.WithSnapshotInterval(snapshotInterval),
+		store.WithMaxMemory(maxMemoryBytes, policy),
+		store.WithNodeID(nodeID),
+		store.WithConflictResolution(resolution),
+		store.WithReadRepairChance(readRepairChance),
+		store.WithAdvertiseAddr(advertise),
+		store.WithQuorums(readQuorum, writeQuorum),
+		store.WithHintLimits(hintMaxAge, hintMaxBytes),
+		store.WithAntiEntropy(antiEntropyInterval, antiEntropyRate),
+		store.WithTombstoneGracePeriod(tombstoneGracePeriod),
+		store.WithReplicationMode(mode),
+		store.WithRaftJoin(raftJoin),
+		store.WithRaftTickInterval(raftTick),
+	)
+	if err != nil {
+		log.Fatalf("Could not open store: %v", err)
+	}
 
 	go store.HealthCheck()
 
 	h := &handler.Handler{
-		Store: store,
+		Store:        store,
+		MaxValueSize: maxValueBytes,
 	}
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "OK")
 	})
 
+	http.Handle(handler.ClusterPrefix, handler.LoggingMiddleware(&handler.ClusterHandler{Store: store}))
+	http.Handle(handler.AdminPrefix, handler.LoggingMiddleware(&handler.AdminHandler{Store: store}))
+	// A transaction carries at most as much as a single PUT.
+	http.Handle(handler.TxnPrefix, handler.LoggingMiddleware(&handler.TxnHandler{Store: store, MaxBodySize: maxValueBytes}))
+	// Raft messages are exchanged every tick, so they are not logged.
+	http.Handle(handler.RaftPrefix, &handler.RaftHandler{Store: store})
 	http.Handle("/", handler.LoggingMiddleware(h))
 
 	server := &http.Server{
@@ -62,5 +182,9 @@ func main() {
 		log.Fatalf("Could not gracefully shutdown the server: %v\n", err)
 	}
 
+	if err := store.Close(); err != nil {
+		log.Printf("Could not close the store: %v", err)
+	}
+
 	log.Printf("Server stopped.")
 }
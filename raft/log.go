@@ -0,0 +1,112 @@
+package raft
+
+/*
+The entries of a node's log that follow its last snapshot, held in memory.
+entries[0] stands in for the last entry covered by the snapshot, so that the
+term of the entry preceding the first one can still be looked up.
+*/
+type raftLog struct {
+	entries   []Entry
+	committed uint64
+	applied   uint64
+}
+
+func newLog(snapshotIndex, snapshotTerm uint64, entries []Entry) *raftLog {
+	l := &raftLog{entries: []Entry{{Index: snapshotIndex, Term: snapshotTerm}}}
+	for _, e := range entries {
+		if e.Index == l.lastIndex()+1 {
+			l.entries = append(l.entries, e)
+		}
+	}
+	l.committed, l.applied = snapshotIndex, snapshotIndex
+	return l
+}
+
+func (l *raftLog) snapshotIndex() uint64 {
+	return l.entries[0].Index
+}
+
+func (l *raftLog) firstIndex() uint64 {
+	return l.snapshotIndex() + 1
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.entries[len(l.entries)-1].Index
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	return l.entries[len(l.entries)-1].Term
+}
+
+/*
+Returns the term of the entry at index, or false if the entry is not held:
+it is beyond the end of the log or was compacted into the snapshot.
+*/
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index < l.snapshotIndex() || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapshotIndex()].Term, true
+}
+
+func (l *raftLog) matchTerm(index, term uint64) bool {
+	t, ok := l.term(index)
+	return ok && t == term
+}
+
+/*
+Returns a copy of the entries in [lo, hi), which must be held.
+*/
+func (l *raftLog) slice(lo, hi uint64) []Entry {
+	if lo >= hi {
+		return nil
+	}
+	offset := l.snapshotIndex()
+	entries := make([]Entry, hi-lo)
+	copy(entries, l.entries[lo-offset:hi-offset])
+	return entries
+}
+
+/*
+Adds entries received from the leader, which follow an entry the log
+holds. Entries the log already holds are skipped; from the first one that
+conflicts with a held entry on, the held entries are replaced. Returns the
+entries that were written, which have to be persisted.
+*/
+func (l *raftLog) merge(entries []Entry) []Entry {
+	for i, e := range entries {
+		if e.Index <= l.snapshotIndex() || l.matchTerm(e.Index, e.Term) {
+			continue
+		}
+		if e.Index <= l.lastIndex() {
+			l.entries = l.entries[:e.Index-l.snapshotIndex()]
+		}
+		l.entries = append(l.entries, entries[i:]...)
+		return entries[i:]
+	}
+	return nil
+}
+
+/*
+Reports whether a log ending with an entry at index in term is at least as
+up to date as this one, which a candidate's log must be to get a vote.
+*/
+func (l *raftLog) upToDate(index, term uint64) bool {
+	return term > l.lastTerm() || (term == l.lastTerm() && index >= l.lastIndex())
+}
+
+/*
+Drops the entries up to index, which a snapshot now covers.
+*/
+func (l *raftLog) compact(index, term uint64) {
+	kept := l.slice(index+1, l.lastIndex()+1)
+	l.entries = append([]Entry{{Index: index, Term: term}}, kept...)
+}
+
+/*
+Replaces the log with a snapshot received from the leader.
+*/
+func (l *raftLog) restore(index, term uint64) {
+	l.entries = []Entry{{Index: index, Term: term}}
+	l.committed = index
+}
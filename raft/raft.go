@@ -0,0 +1,919 @@
+/*
+Implements the Raft consensus algorithm: a group of nodes elects a leader,
+which appends the commands proposed to it to a log and replicates that log
+to the others. An entry is committed once a majority of the group holds it,
+and every node applies the committed entries in log order. Nodes compact
+their log into snapshots of the state the entries built, which the leader
+sends to nodes too far behind to catch up from its log, and the group
+changes its members one node at a time through the log itself.
+
+A Node holds the state of one node of one group and does no I/O besides
+persisting that state: the host drives it with Tick and Step, delivers the
+messages it returns from Ready to the other nodes, and applies the entries
+Ready returns as committed.
+*/
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+type MessageType string
+
+const (
+	MsgVote           MessageType = "vote"
+	MsgVoteResponse   MessageType = "vote_response"
+	MsgAppend         MessageType = "append"
+	MsgAppendResponse MessageType = "append_response"
+	MsgSnapshot       MessageType = "snapshot"
+)
+
+/*
+A message between the nodes of a group. Index and LogTerm are the index
+and term of the last entry of a candidate's log in a vote request, and of
+the entry preceding Entries in an append. In an append response, Index is
+the last entry the follower holds up to, or with Reject the index of the
+append it could not match, in which case Hint is the last index it may.
+*/
+type Message struct {
+	Type     MessageType `json:"type"`
+	Group    uint32      `json:"group"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Term     uint64      `json:"term"`
+	Index    uint64      `json:"index,omitempty"`
+	LogTerm  uint64      `json:"log_term,omitempty"`
+	Entries  []Entry     `json:"entries,omitempty"`
+	Commit   uint64      `json:"commit,omitempty"`
+	Reject   bool        `json:"reject,omitempty"`
+	Hint     uint64      `json:"hint,omitempty"`
+	Snapshot *Snapshot   `json:"snapshot,omitempty"`
+	// The last read the leader asked to confirm when it sent an append,
+	// which the response carries back.
+	Context uint64 `json:"context,omitempty"`
+}
+
+type EntryType uint8
+
+const (
+	// A command proposed by the host. Leaders append one without data when
+	// they are elected.
+	EntryNormal EntryType = iota
+	// A change of the group's members, whose data is the JSON list of the
+	// voters from then on.
+	EntryConfig
+)
+
+type Entry struct {
+	Term  uint64    `json:"term"`
+	Index uint64    `json:"index"`
+	Type  EntryType `json:"type,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+/*
+The state built by the entries up to Index, which were in effect with the
+voters in Voters. Data is opaque to the group.
+*/
+type Snapshot struct {
+	Index  uint64   `json:"index"`
+	Term   uint64   `json:"term"`
+	Voters []string `json:"voters"`
+	Data   []byte   `json:"data,omitempty"`
+}
+
+type ConfChangeType string
+
+const (
+	AddVoter    ConfChangeType = "add"
+	RemoveVoter ConfChangeType = "remove"
+)
+
+type ConfChange struct {
+	Type ConfChangeType `json:"type"`
+	Node string         `json:"node"`
+}
+
+const (
+	DefaultElectionTicks  = 10
+	DefaultHeartbeatTicks = 1
+	// The most entries an append carries.
+	maxAppendEntries = 128
+)
+
+type Config struct {
+	// The ID of this node, under which the others send it messages.
+	ID    string
+	Group uint32
+	// The voters a new group starts with. A node whose storage is empty
+	// and that is given no peers joins an existing group and waits to be
+	// added to it.
+	Peers []string
+	// A follower that has not heard from a leader for ElectionTicks to
+	// twice as many ticks starts an election. Leaders send heartbeats
+	// every HeartbeatTicks.
+	ElectionTicks  int
+	HeartbeatTicks int
+	Storage        Storage
+}
+
+var (
+	ErrNotLeader         = errors.New("raft: not the leader")
+	ErrConfChangePending = errors.New("raft: a membership change is in progress")
+	ErrNoConfChange      = errors.New("raft: membership change has no effect")
+)
+
+type StateType string
+
+const (
+	StateFollower  StateType = "follower"
+	StateCandidate StateType = "candidate"
+	StateLeader    StateType = "leader"
+)
+
+/*
+What the host has to do next: send Messages, restore Snapshot if there is
+one and then apply the Committed entries, in order. ReadStates lists the
+reads the leader confirmed.
+*/
+type Ready struct {
+	Messages   []Message
+	Snapshot   *Snapshot
+	Committed  []Entry
+	ReadStates []ReadState
+}
+
+/*
+A read confirmed by a leader: once the host has applied the entries up to
+Index, its state reflects every write committed before the read was
+requested.
+*/
+type ReadState struct {
+	ID    uint64
+	Index uint64
+}
+
+/*
+A read a leader has yet to confirm, with the voters that acknowledged its
+leadership since.
+*/
+type readRequest struct {
+	id   uint64
+	acks map[string]bool
+}
+
+type Status struct {
+	ID            string    `json:"id"`
+	Group         uint32    `json:"group"`
+	State         StateType `json:"state"`
+	Term          uint64    `json:"term"`
+	Leader        string    `json:"leader,omitempty"`
+	Voters        []string  `json:"voters"`
+	Commit        uint64    `json:"commit"`
+	Applied       uint64    `json:"applied"`
+	LastIndex     uint64    `json:"last_index"`
+	SnapshotIndex uint64    `json:"snapshot_index"`
+}
+
+/*
+What a leader knows about a follower: the last entry known to match its
+log and the next one to send it. active records whether it answered since
+the leader last checked it still reaches a majority.
+*/
+type progress struct {
+	match  uint64
+	next   uint64
+	active bool
+}
+
+type Node struct {
+	mu      sync.Mutex
+	id      string
+	group   uint32
+	storage Storage
+
+	electionTicks    int
+	heartbeatTicks   int
+	electionTimeout  int
+	electionElapsed  int
+	heartbeatElapsed int
+	state            StateType
+	term             uint64
+	vote             string
+	leader           string
+	votes            map[string]bool
+	progress         map[string]*progress
+	log              *raftLog
+	snapshot         Snapshot
+	voters           []string
+	configIndex      uint64
+	hard             HardState
+	msgs             []Message
+	restoreSnapshot  *Snapshot
+	readSeq          uint64
+	reads            []readRequest
+	readStates       []ReadState
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = DefaultElectionTicks
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = DefaultHeartbeatTicks
+	}
+
+	hard, snapshot, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	if hard.Term == 0 && snapshot.Index == 0 && len(entries) == 0 && len(cfg.Peers) > 0 {
+		snapshot = Snapshot{Voters: sortedVoters(cfg.Peers)}
+		if err := cfg.Storage.SaveSnapshot(snapshot, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	n := &Node{
+		id:             cfg.ID,
+		group:          cfg.Group,
+		storage:        cfg.Storage,
+		electionTicks:  cfg.ElectionTicks,
+		heartbeatTicks: cfg.HeartbeatTicks,
+		state:          StateFollower,
+		term:           hard.Term,
+		vote:           hard.Vote,
+		log:            newLog(snapshot.Index, snapshot.Term, entries),
+		snapshot:       snapshot,
+		hard:           hard,
+	}
+	if hard.Commit > n.log.committed {
+		n.log.committed = minIndex(hard.Commit, n.log.lastIndex())
+	}
+	if snapshot.Index > 0 {
+		n.restoreSnapshot = &snapshot
+	}
+	n.updateConfig()
+	n.resetElectionTimeout()
+	return n, nil
+}
+
+func (n *Node) Close() error {
+	return n.storage.Close()
+}
+
+/*
+Advances the node's clock by one tick: a follower that has not heard from
+a leader for too long starts an election, and a leader sends heartbeats
+and steps down if it no longer hears from a majority.
+*/
+func (n *Node) Tick() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.electionElapsed++
+	if n.state == StateLeader {
+		n.heartbeatElapsed++
+		if n.electionElapsed >= n.electionTicks {
+			n.electionElapsed = 0
+			if !n.checkQuorum() {
+				n.becomeFollower(n.term, "")
+				return n.persist()
+			}
+		}
+		if n.heartbeatElapsed >= n.heartbeatTicks {
+			n.heartbeatElapsed = 0
+			for _, pr := range n.progress {
+				// Resend everything not yet acknowledged, in case it was lost.
+				pr.next = pr.match + 1
+			}
+			n.broadcastAppend()
+		}
+		return n.persist()
+	}
+
+	if n.electionElapsed >= n.electionTimeout && n.isVoter(n.id) {
+		n.campaign()
+	}
+	return n.persist()
+}
+
+/*
+Handles a message from another node of the group.
+*/
+func (n *Node) Step(m Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch {
+	case m.Term > n.term:
+		if m.Type == MsgVote && n.leader != "" && n.electionElapsed < n.electionTicks {
+			// A leader was heard from recently, so the candidate is
+			// most likely cut off from it: do not let it disrupt the group.
+			return nil
+		}
+		leader := ""
+		if m.Type == MsgAppend || m.Type == MsgSnapshot {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	case m.Term < n.term:
+		// Tell a stale leader or candidate about the newer term.
+		switch m.Type {
+		case MsgAppend, MsgSnapshot:
+			n.send(Message{Type: MsgAppendResponse, To: m.From, Reject: true, Index: m.Index, Hint: n.log.lastIndex()})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResponse, To: m.From, Reject: true})
+		}
+		return n.persist()
+	}
+
+	switch m.Type {
+	case MsgVote:
+		n.handleVote(m)
+	case MsgVoteResponse:
+		n.handleVoteResponse(m)
+	case MsgAppend:
+		if n.state != StateFollower {
+			n.becomeFollower(m.Term, m.From)
+		}
+		if err := n.handleAppend(m); err != nil {
+			return err
+		}
+	case MsgAppendResponse:
+		n.handleAppendResponse(m)
+	case MsgSnapshot:
+		if n.state != StateFollower {
+			n.becomeFollower(m.Term, m.From)
+		}
+		if err := n.handleSnapshot(m); err != nil {
+			return err
+		}
+	}
+	return n.persist()
+}
+
+/*
+Appends data to the log to be replicated and committed. Returns the index
+and term of its entry; the proposal succeeded if the entry committed at
+that index has that term.
+*/
+func (n *Node) Propose(data []byte) (uint64, uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != StateLeader {
+		return 0, 0, ErrNotLeader
+	}
+	e, err := n.appendEntry(Entry{Type: EntryNormal, Data: data})
+	if err != nil {
+		return 0, 0, err
+	}
+	n.broadcastAppend()
+	return e.Index, e.Term, n.persist()
+}
+
+/*
+Adds a voter to or removes one from the group. The change takes effect
+on every node as soon as it is appended to its log, and only one change
+may be in progress at a time, so that the majorities of the old and the
+new voters always overlap.
+*/
+func (n *Node) ProposeConfChange(cc ConfChange) (uint64, uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != StateLeader {
+		return 0, 0, ErrNotLeader
+	}
+	if n.configIndex > n.log.committed {
+		return 0, 0, ErrConfChangePending
+	}
+
+	var voters []string
+	switch cc.Type {
+	case AddVoter:
+		if n.isVoter(cc.Node) {
+			return 0, 0, ErrNoConfChange
+		}
+		voters = append(append(voters, n.voters...), cc.Node)
+	case RemoveVoter:
+		if !n.isVoter(cc.Node) || len(n.voters) == 1 {
+			return 0, 0, ErrNoConfChange
+		}
+		for _, v := range n.voters {
+			if v != cc.Node {
+				voters = append(voters, v)
+			}
+		}
+	default:
+		return 0, 0, errors.New("raft: unknown membership change " + string(cc.Type))
+	}
+
+	data, err := json.Marshal(sortedVoters(voters))
+	if err != nil {
+		return 0, 0, err
+	}
+	e, err := n.appendEntry(Entry{Type: EntryConfig, Data: data})
+	if err != nil {
+		return 0, 0, err
+	}
+	n.broadcastAppend()
+	return e.Index, e.Term, n.persist()
+}
+
+/*
+Asks the leader to confirm that it still leads the group, so that a read of
+the host's state is linearizable. Returns the ID of the read, which a later
+Ready lists among its ReadStates once a majority of the voters acknowledged
+the leader after the read was requested and the leader committed an entry
+of its term. Reads that are not confirmed before the leader steps down are
+dropped.
+*/
+func (n *Node) ReadIndex() (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != StateLeader {
+		return 0, ErrNotLeader
+	}
+	n.readSeq++
+	n.reads = append(n.reads, readRequest{id: n.readSeq, acks: map[string]bool{n.id: true}})
+	n.confirmReads()
+	if len(n.reads) > 0 {
+		n.broadcastAppend()
+	}
+	return n.readSeq, nil
+}
+
+/*
+Returns what the host has to do since the last call: the messages to send,
+and the snapshot and entries to apply, which are then considered applied.
+*/
+func (n *Node) Ready() Ready {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	rd := Ready{Messages: n.msgs, Snapshot: n.restoreSnapshot, ReadStates: n.readStates}
+	n.msgs, n.restoreSnapshot, n.readStates = nil, nil, nil
+	if n.log.committed > n.log.applied {
+		rd.Committed = n.log.slice(n.log.applied+1, n.log.committed+1)
+		n.log.applied = n.log.committed
+	}
+	return rd
+}
+
+/*
+Replaces the log up to index, which the host has applied, with a snapshot
+of the state the entries built.
+*/
+func (n *Node) Compact(index uint64, data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.log.snapshotIndex() {
+		return nil
+	}
+	if index > n.log.applied {
+		return errors.New("raft: cannot compact entries that were not applied")
+	}
+	term, _ := n.log.term(index)
+	snapshot := Snapshot{Index: index, Term: term, Voters: n.votersAt(index), Data: data}
+	if err := n.storage.SaveSnapshot(snapshot, n.log.slice(index+1, n.log.lastIndex()+1)); err != nil {
+		return err
+	}
+	n.log.compact(index, term)
+	n.snapshot = snapshot
+	return nil
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		Group:         n.group,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		Voters:        append([]string(nil), n.voters...),
+		Commit:        n.log.committed,
+		Applied:       n.log.applied,
+		LastIndex:     n.log.lastIndex(),
+		SnapshotIndex: n.log.snapshotIndex(),
+	}
+}
+
+/*
+Returns the leader this node knows of, if any.
+*/
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == StateLeader
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+	}
+	n.state = StateFollower
+	n.leader = leader
+	n.votes = nil
+	n.progress = nil
+	n.reads = nil
+	n.electionElapsed = 0
+	n.resetElectionTimeout()
+}
+
+func (n *Node) campaign() {
+	n.state = StateCandidate
+	n.term++
+	n.vote = n.id
+	n.leader = ""
+	n.votes = map[string]bool{n.id: true}
+	n.electionElapsed = 0
+	n.resetElectionTimeout()
+	if n.quorum() <= 1 {
+		n.becomeLeader()
+		return
+	}
+	for _, v := range n.voters {
+		if v != n.id {
+			n.send(Message{Type: MsgVote, To: v, Index: n.log.lastIndex(), LogTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.state = StateLeader
+	n.leader = n.id
+	n.votes = nil
+	n.electionElapsed, n.heartbeatElapsed = 0, 0
+	n.progress = make(map[string]*progress)
+	for _, v := range n.voters {
+		if v != n.id {
+			n.progress[v] = &progress{next: n.log.lastIndex() + 1, active: true}
+		}
+	}
+	// Entries of earlier terms only commit along with one of the leader's
+	// own, so it appends one right away.
+	if _, err := n.appendEntry(Entry{Type: EntryNormal}); err != nil {
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.broadcastAppend()
+}
+
+func (n *Node) handleVote(m Message) {
+	grant := (n.vote == "" || n.vote == m.From) && n.leader == "" && n.log.upToDate(m.Index, m.LogTerm)
+	if grant {
+		n.vote = m.From
+		n.electionElapsed = 0
+	}
+	n.send(Message{Type: MsgVoteResponse, To: m.From, Reject: !grant})
+}
+
+func (n *Node) handleVoteResponse(m Message) {
+	if n.state != StateCandidate {
+		return
+	}
+	n.votes[m.From] = !m.Reject
+	granted, rejected := 0, 0
+	for _, v := range n.voters {
+		if vote, ok := n.votes[v]; ok && vote {
+			granted++
+		} else if ok {
+			rejected++
+		}
+	}
+	if granted >= n.quorum() {
+		n.becomeLeader()
+	} else if rejected >= n.quorum() {
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) handleAppend(m Message) error {
+	n.leader = m.From
+	n.electionElapsed = 0
+	if m.Index < n.log.committed {
+		n.send(Message{Type: MsgAppendResponse, To: m.From, Index: n.log.committed, Context: m.Context})
+		return nil
+	}
+	if !n.log.matchTerm(m.Index, m.LogTerm) {
+		hint := minIndex(m.Index-1, n.log.lastIndex())
+		n.send(Message{Type: MsgAppendResponse, To: m.From, Reject: true, Index: m.Index, Hint: hint, Context: m.Context})
+		return nil
+	}
+
+	if written := n.log.merge(m.Entries); len(written) > 0 {
+		if err := n.storage.Append(written); err != nil {
+			return err
+		}
+		n.updateConfig()
+	}
+	last := m.Index + uint64(len(m.Entries))
+	if commit := minIndex(m.Commit, last); commit > n.log.committed {
+		n.log.committed = commit
+	}
+	n.send(Message{Type: MsgAppendResponse, To: m.From, Index: last, Context: m.Context})
+	return nil
+}
+
+func (n *Node) handleSnapshot(m Message) error {
+	n.leader = m.From
+	n.electionElapsed = 0
+	s := m.Snapshot
+	if s == nil || s.Index <= n.log.committed {
+		n.send(Message{Type: MsgAppendResponse, To: m.From, Index: n.log.committed, Context: m.Context})
+		return nil
+	}
+	if err := n.storage.SaveSnapshot(*s, nil); err != nil {
+		return err
+	}
+	n.log.restore(s.Index, s.Term)
+	n.log.applied = s.Index
+	n.snapshot = *s
+	n.restoreSnapshot = s
+	n.updateConfig()
+	n.send(Message{Type: MsgAppendResponse, To: m.From, Index: s.Index, Context: m.Context})
+	return nil
+}
+
+func (n *Node) handleAppendResponse(m Message) {
+	if n.state != StateLeader {
+		return
+	}
+	pr, ok := n.progress[m.From]
+	if !ok {
+		return
+	}
+	pr.active = true
+	// Even a rejection acknowledges the leader's term.
+	n.ackReads(m.From, m.Context)
+	if m.Reject {
+		next := m.Hint + 1
+		if next >= pr.next && pr.next > 1 {
+			next = pr.next - 1
+		}
+		if next <= pr.match {
+			next = pr.match + 1
+		}
+		pr.next = next
+		n.sendAppend(m.From, pr)
+		return
+	}
+
+	if m.Index > pr.match {
+		pr.match = m.Index
+	}
+	if m.Index+1 > pr.next {
+		pr.next = m.Index + 1
+	}
+	if n.maybeCommit() {
+		n.confirmReads()
+		n.broadcastAppend()
+	} else if pr.next <= n.log.lastIndex() {
+		n.sendAppend(m.From, pr)
+	}
+}
+
+/*
+Commits the entries a majority of the voters hold, if one of them is from
+the current term. Returns whether the commit index advanced.
+*/
+func (n *Node) maybeCommit() bool {
+	var matches []uint64
+	for _, v := range n.voters {
+		if v == n.id {
+			matches = append(matches, n.log.lastIndex())
+		} else if pr, ok := n.progress[v]; ok {
+			matches = append(matches, pr.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return false
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	if index <= n.log.committed || !n.log.matchTerm(index, n.term) {
+		return false
+	}
+	n.log.committed = index
+	if !n.isVoter(n.id) && n.configIndex <= n.log.committed {
+		// The leader was removed from the group; let the others elect a
+		// new one once they learn of the commit.
+		n.broadcastAppend()
+		n.becomeFollower(n.term, "")
+		return false
+	}
+	return true
+}
+
+/*
+Reports whether the leader heard from a majority of the voters since the
+last check, and starts a new check.
+*/
+func (n *Node) checkQuorum() bool {
+	active := 0
+	for _, v := range n.voters {
+		if v == n.id {
+			active++
+		} else if pr, ok := n.progress[v]; ok && pr.active {
+			active++
+		}
+	}
+	for _, pr := range n.progress {
+		pr.active = false
+	}
+	return active >= n.quorum()
+}
+
+/*
+Records that voter acknowledged the leader after the reads up to context
+were requested, and confirms those a majority acknowledged.
+*/
+func (n *Node) ackReads(voter string, context uint64) {
+	for _, r := range n.reads {
+		if r.id > context {
+			break
+		}
+		r.acks[voter] = true
+	}
+	n.confirmReads()
+}
+
+/*
+Confirms, in order, the reads a majority of the voters acknowledged, once
+the leader knows every entry committed before its term. They are then
+served at the current commit index.
+*/
+func (n *Node) confirmReads() {
+	if !n.log.matchTerm(n.log.committed, n.term) {
+		return
+	}
+	confirmed := 0
+	for _, r := range n.reads {
+		acks := 0
+		for _, v := range n.voters {
+			if r.acks[v] {
+				acks++
+			}
+		}
+		if acks < n.quorum() {
+			break
+		}
+		n.readStates = append(n.readStates, ReadState{ID: r.id, Index: n.log.committed})
+		confirmed++
+	}
+	n.reads = n.reads[confirmed:]
+}
+
+func (n *Node) broadcastAppend() {
+	for v, pr := range n.progress {
+		n.sendAppend(v, pr)
+	}
+}
+
+/*
+Sends a follower the entries from the next one it needs, or the snapshot if
+that entry was compacted, and assumes it will take them.
+*/
+func (n *Node) sendAppend(to string, pr *progress) {
+	prevTerm, ok := n.log.term(pr.next - 1)
+	if !ok {
+		snapshot := n.snapshot
+		n.send(Message{Type: MsgSnapshot, To: to, Snapshot: &snapshot, Context: n.readSeq})
+		pr.next = snapshot.Index + 1
+		return
+	}
+	last := minIndex(n.log.lastIndex(), pr.next+maxAppendEntries-1)
+	entries := n.log.slice(pr.next, last+1)
+	n.send(Message{Type: MsgAppend, To: to, Index: pr.next - 1, LogTerm: prevTerm, Entries: entries, Commit: n.log.committed, Context: n.readSeq})
+	pr.next = last + 1
+}
+
+func (n *Node) appendEntry(e Entry) (Entry, error) {
+	e.Term = n.term
+	e.Index = n.log.lastIndex() + 1
+	if err := n.storage.Append([]Entry{e}); err != nil {
+		return Entry{}, err
+	}
+	n.log.entries = append(n.log.entries, e)
+	if e.Type == EntryConfig {
+		n.updateConfig()
+	}
+	if n.maybeCommit() {
+		n.confirmReads()
+	}
+	return e, nil
+}
+
+/*
+Sets the voters to those of the last membership change in the log, and a
+leader's followers to match.
+*/
+func (n *Node) updateConfig() {
+	n.voters, n.configIndex = n.snapshot.Voters, n.log.snapshotIndex()
+	for i := len(n.log.entries) - 1; i > 0; i-- {
+		if e := n.log.entries[i]; e.Type == EntryConfig {
+			var voters []string
+			if json.Unmarshal(e.Data, &voters) == nil {
+				n.voters, n.configIndex = voters, e.Index
+				break
+			}
+		}
+	}
+	if n.state != StateLeader {
+		return
+	}
+	for v := range n.progress {
+		if !n.isVoter(v) {
+			delete(n.progress, v)
+		}
+	}
+	for _, v := range n.voters {
+		if _, ok := n.progress[v]; !ok && v != n.id {
+			n.progress[v] = &progress{next: n.log.lastIndex() + 1, active: true}
+		}
+	}
+}
+
+/*
+Returns the voters in effect at index, which the log holds.
+*/
+func (n *Node) votersAt(index uint64) []string {
+	for i := index - n.log.snapshotIndex(); i > 0; i-- {
+		if e := n.log.entries[i]; e.Type == EntryConfig {
+			var voters []string
+			if json.Unmarshal(e.Data, &voters) == nil {
+				return voters
+			}
+		}
+	}
+	return n.snapshot.Voters
+}
+
+func (n *Node) isVoter(id string) bool {
+	for _, v := range n.voters {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) quorum() int {
+	return len(n.voters)/2 + 1
+}
+
+func (n *Node) send(m Message) {
+	m.Group, m.From, m.Term = n.group, n.id, n.term
+	n.msgs = append(n.msgs, m)
+}
+
+/*
+Persists the term, the vote and the commit index if they changed. Called
+before the host gets to send the messages that depend on them.
+*/
+func (n *Node) persist() error {
+	hard := HardState{Term: n.term, Vote: n.vote, Commit: n.log.committed}
+	if hard == n.hard {
+		return nil
+	}
+	if err := n.storage.SaveHardState(hard); err != nil {
+		return err
+	}
+	n.hard = hard
+	return nil
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionTimeout = n.electionTicks + rand.Intn(n.electionTicks)
+}
+
+func sortedVoters(voters []string) []string {
+	sorted := append([]string(nil), voters...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func minIndex(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
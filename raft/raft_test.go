@@ -0,0 +1,346 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+Connects the nodes of a group in memory. Messages to or from nodes in down
+are dropped. Each node's state machine is the list of the data it applied.
+*/
+type network struct {
+	t       *testing.T
+	nodes   map[string]*Node
+	down    map[string]bool
+	applied map[string][]string
+	reads   map[string][]ReadState
+}
+
+func newNetwork(t *testing.T, ids ...string) *network {
+	nw := &network{t: t, nodes: make(map[string]*Node), down: make(map[string]bool), applied: make(map[string][]string), reads: make(map[string][]ReadState)}
+	for _, id := range ids {
+		nw.add(id, ids, NewMemoryStorage())
+	}
+	return nw
+}
+
+func (nw *network) add(id string, peers []string, storage Storage) *Node {
+	nw.t.Helper()
+	n, err := NewNode(Config{ID: id, Group: 1, Peers: peers, Storage: storage})
+	if err != nil {
+		nw.t.Fatalf("NewNode: %v", err)
+	}
+	nw.nodes[id] = n
+	return n
+}
+
+/*
+Delivers messages and applies committed entries until no node has anything
+left to do.
+*/
+func (nw *network) deliver() {
+	nw.t.Helper()
+	for busy := true; busy; {
+		busy = false
+		for id, n := range nw.nodes {
+			rd := n.Ready()
+			if rd.Snapshot != nil {
+				var applied []string
+				_ = json.Unmarshal(rd.Snapshot.Data, &applied)
+				nw.applied[id] = applied
+			}
+			for _, e := range rd.Committed {
+				if e.Type == EntryNormal && e.Data != nil {
+					nw.applied[id] = append(nw.applied[id], string(e.Data))
+				}
+			}
+			nw.reads[id] = append(nw.reads[id], rd.ReadStates...)
+			for _, m := range rd.Messages {
+				busy = true
+				to, ok := nw.nodes[m.To]
+				if !ok || nw.down[m.From] || nw.down[m.To] {
+					continue
+				}
+				if err := to.Step(m); err != nil {
+					nw.t.Fatalf("Step: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (nw *network) tick(rounds int) {
+	nw.t.Helper()
+	for i := 0; i < rounds; i++ {
+		for id, n := range nw.nodes {
+			if nw.down[id] {
+				continue
+			}
+			if err := n.Tick(); err != nil {
+				nw.t.Fatalf("Tick: %v", err)
+			}
+		}
+		nw.deliver()
+	}
+}
+
+/*
+Ticks until exactly one node that is not down leads the group, and returns
+it.
+*/
+func (nw *network) leader() string {
+	nw.t.Helper()
+	for i := 0; i < 100; i++ {
+		var leaders []string
+		for id, n := range nw.nodes {
+			if !nw.down[id] && n.IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		nw.tick(1)
+	}
+	nw.t.Fatalf("no leader was elected")
+	return ""
+}
+
+func (nw *network) propose(data string) {
+	nw.t.Helper()
+	if _, _, err := nw.nodes[nw.leader()].Propose([]byte(data)); err != nil {
+		nw.t.Fatalf("Propose: %v", err)
+	}
+	nw.deliver()
+}
+
+func assertEqual(t *testing.T, got, want interface{}, what string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func TestRaft(t *testing.T) {
+	t.Run("should elect a single leader", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		leader := nw.leader()
+		nw.tick(30)
+		assertEqual(t, nw.leader(), leader, "leader after more ticks")
+		for id, n := range nw.nodes {
+			assertEqual(t, n.Leader(), leader, "leader known to "+id)
+		}
+	})
+
+	t.Run("should apply proposals on every node in order", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		for i := 0; i < 5; i++ {
+			nw.propose(fmt.Sprint(i))
+		}
+		nw.tick(1)
+		want := []string{"0", "1", "2", "3", "4"}
+		for id := range nw.nodes {
+			assertEqual(t, nw.applied[id], want, "applied on "+id)
+		}
+	})
+
+	t.Run("should reject proposals to followers", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		leader := nw.leader()
+		for id, n := range nw.nodes {
+			if id != leader {
+				_, _, err := n.Propose([]byte("x"))
+				assertEqual(t, err, ErrNotLeader, "proposal to a follower")
+			}
+		}
+	})
+
+	t.Run("should not commit without a majority", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		leader := nw.leader()
+		for id := range nw.nodes {
+			if id != leader {
+				nw.down[id] = true
+			}
+		}
+		_, _, _ = nw.nodes[leader].Propose([]byte("x"))
+		nw.deliver()
+		assertEqual(t, len(nw.applied[leader]), 0, "entries applied without a majority")
+		nw.tick(2 * DefaultElectionTicks)
+		assertEqual(t, nw.nodes[leader].IsLeader(), false, "leadership without a majority")
+	})
+
+	t.Run("should elect a new leader and repair the log of the old one", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		nw.propose("committed")
+		old := nw.leader()
+
+		nw.down[old] = true
+		// Never committed, as the old leader is cut off.
+		_, _, _ = nw.nodes[old].Propose([]byte("lost"))
+		nw.deliver()
+		leader := nw.leader()
+		if leader == old {
+			t.Fatalf("the isolated leader kept leading")
+		}
+		nw.propose("after failover")
+
+		nw.down[old] = false
+		nw.tick(5)
+		want := []string{"committed", "after failover"}
+		for id := range nw.nodes {
+			assertEqual(t, nw.applied[id], want, "applied on "+id)
+		}
+		assertEqual(t, nw.nodes[old].Status().LastIndex, nw.nodes[leader].Status().LastIndex, "last index of the old leader")
+	})
+
+	t.Run("should catch up a follower from a snapshot", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		leader := nw.leader()
+		var behind string
+		for id := range nw.nodes {
+			if id != leader {
+				behind = id
+				break
+			}
+		}
+		nw.down[behind] = true
+		for i := 0; i < 5; i++ {
+			nw.propose(fmt.Sprint(i))
+		}
+		status := nw.nodes[leader].Status()
+		data, _ := json.Marshal(nw.applied[leader])
+		if err := nw.nodes[leader].Compact(status.Applied, data); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+
+		nw.down[behind] = false
+		nw.propose("5")
+		nw.tick(2)
+		assertEqual(t, nw.applied[behind], []string{"0", "1", "2", "3", "4", "5"}, "applied after the snapshot")
+		assertEqual(t, nw.nodes[behind].Status().SnapshotIndex, status.Applied, "snapshot index of the follower")
+	})
+
+	t.Run("should confirm reads with a majority", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		nw.propose("x")
+		leader := nw.leader()
+		for id, n := range nw.nodes {
+			if id != leader {
+				_, err := n.ReadIndex()
+				assertEqual(t, err, ErrNotLeader, "read on a follower")
+			}
+		}
+
+		id, err := nw.nodes[leader].ReadIndex()
+		if err != nil {
+			t.Fatalf("ReadIndex: %v", err)
+		}
+		nw.deliver()
+		commit := nw.nodes[leader].Status().Commit
+		assertEqual(t, nw.reads[leader], []ReadState{{ID: id, Index: commit}}, "confirmed reads")
+
+		// A leader cut off from the others cannot tell whether a new one
+		// was elected, so it confirms no reads.
+		nw.reads[leader] = nil
+		for other := range nw.nodes {
+			if other != leader {
+				nw.down[other] = true
+			}
+		}
+		if _, err := nw.nodes[leader].ReadIndex(); err != nil {
+			t.Fatalf("ReadIndex: %v", err)
+		}
+		nw.tick(2 * DefaultElectionTicks)
+		assertEqual(t, len(nw.reads[leader]), 0, "reads confirmed without a majority")
+		assertEqual(t, nw.nodes[leader].IsLeader(), false, "leadership without a majority")
+	})
+
+	t.Run("should confirm reads of a single voter right away", func(t *testing.T) {
+		nw := newNetwork(t, "a")
+		n := nw.nodes["a"]
+		nw.leader()
+		id, err := n.ReadIndex()
+		if err != nil {
+			t.Fatalf("ReadIndex: %v", err)
+		}
+		nw.deliver()
+		assertEqual(t, nw.reads["a"], []ReadState{{ID: id, Index: n.Status().Commit}}, "confirmed reads of a single voter")
+	})
+
+	t.Run("should add and remove voters", func(t *testing.T) {
+		nw := newNetwork(t, "a", "b", "c")
+		nw.propose("before")
+		leader := nw.leader()
+
+		// A new node starts without peers and waits to be added.
+		nw.add("d", nil, NewMemoryStorage())
+		nw.tick(3 * DefaultElectionTicks)
+		assertEqual(t, nw.nodes["d"].IsLeader(), false, "leadership of a node not yet added")
+
+		if _, _, err := nw.nodes[leader].ProposeConfChange(ConfChange{Type: AddVoter, Node: "d"}); err != nil {
+			t.Fatalf("ProposeConfChange: %v", err)
+		}
+		_, _, err := nw.nodes[leader].ProposeConfChange(ConfChange{Type: RemoveVoter, Node: "b"})
+		assertEqual(t, err, ErrConfChangePending, "second change while the first is pending")
+		nw.tick(2)
+		assertEqual(t, nw.nodes["d"].Status().Voters, []string{"a", "b", "c", "d"}, "voters known to the new node")
+		assertEqual(t, nw.applied["d"], []string{"before"}, "applied on the new node")
+
+		if _, _, err := nw.nodes[leader].ProposeConfChange(ConfChange{Type: RemoveVoter, Node: leader}); err != nil {
+			t.Fatalf("ProposeConfChange: %v", err)
+		}
+		nw.tick(1)
+		assertEqual(t, nw.nodes[leader].IsLeader(), false, "leadership of the removed leader")
+		nw.down[leader] = true
+		nw.propose("after")
+		for id := range nw.nodes {
+			if id != leader {
+				assertEqual(t, nw.applied[id], []string{"before", "after"}, "applied on "+id)
+			}
+		}
+	})
+
+	t.Run("should restart from its storage", func(t *testing.T) {
+		dir := t.TempDir()
+		storage, err := NewFileStorage(dir)
+		if err != nil {
+			t.Fatalf("NewFileStorage: %v", err)
+		}
+		nw := &network{t: t, nodes: make(map[string]*Node), down: make(map[string]bool), applied: make(map[string][]string), reads: make(map[string][]ReadState)}
+		nw.add("a", []string{"a"}, storage)
+		nw.propose("0")
+		nw.propose("1")
+		data, _ := json.Marshal(nw.applied["a"])
+		_ = nw.nodes["a"].Compact(nw.nodes["a"].Status().Applied, data)
+		nw.propose("2")
+		before := nw.nodes["a"].Status()
+		_ = nw.nodes["a"].Close()
+
+		// A torn entry at the end of the log is dropped.
+		f, _ := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0o644)
+		_, _ = f.WriteString(`{"term":1,"ind`)
+		_ = f.Close()
+
+		storage, err = NewFileStorage(dir)
+		if err != nil {
+			t.Fatalf("NewFileStorage: %v", err)
+		}
+		nw.applied["a"] = nil
+		n := nw.add("a", []string{"a"}, storage)
+		after := n.Status()
+		assertEqual(t, after.Term, before.Term, "term after the restart")
+		assertEqual(t, after.LastIndex, before.LastIndex, "last index after the restart")
+		assertEqual(t, after.SnapshotIndex, before.SnapshotIndex, "snapshot index after the restart")
+		nw.deliver()
+		assertEqual(t, nw.applied["a"], []string{"0", "1", "2"}, "applied after the restart")
+
+		nw.propose("3")
+		assertEqual(t, nw.applied["a"], []string{"0", "1", "2", "3"}, "applied after a new proposal")
+	})
+}
@@ -0,0 +1,307 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+The state a node must not forget across restarts: the latest term it has
+seen, the candidate it voted for in that term and how far its log is known
+to be committed.
+*/
+type HardState struct {
+	Term   uint64 `json:"term"`
+	Vote   string `json:"vote,omitempty"`
+	Commit uint64 `json:"commit"`
+}
+
+/*
+Persists the state of a node. Every method returns only once the state is
+durable, since a node acts on it right away: it answers votes and
+acknowledges entries only after they are persisted.
+*/
+type Storage interface {
+	// Returns the persisted state, snapshot and the entries that follow
+	// the snapshot.
+	Load() (HardState, Snapshot, []Entry, error)
+	SaveHardState(HardState) error
+	// Appends entries, replacing those persisted at or after the index of
+	// the first one.
+	Append(entries []Entry) error
+	// Replaces the snapshot and the log with s followed by entries.
+	SaveSnapshot(s Snapshot, entries []Entry) error
+	Close() error
+}
+
+/*
+Keeps the state of a node in memory, for nodes whose data does not survive
+a restart anyway and for tests.
+*/
+type MemoryStorage struct {
+	mu       sync.Mutex
+	state    HardState
+	snapshot Snapshot
+	entries  []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (m *MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.snapshot, append([]Entry(nil), m.entries...), nil
+}
+
+func (m *MemoryStorage) SaveHardState(state HardState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+	return nil
+}
+
+func (m *MemoryStorage) Append(entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = truncateAppend(m.entries, entries)
+	return nil
+}
+
+func (m *MemoryStorage) SaveSnapshot(s Snapshot, entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshot = s
+	m.entries = append([]Entry(nil), entries...)
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+/*
+Appends entries to a log, dropping the entries of the log at or after the
+index of the first one.
+*/
+func truncateAppend(log, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return log
+	}
+	for len(log) > 0 && log[len(log)-1].Index >= entries[0].Index {
+		log = log[:len(log)-1]
+	}
+	return append(log, entries...)
+}
+
+const (
+	stateFile    = "state"
+	snapshotFile = "snapshot"
+	logFile      = "log"
+	tempExt      = ".tmp"
+)
+
+/*
+Keeps the state of a node in a directory: its hard state and snapshot in
+files of their own, replaced atomically, and its log as a file of JSON
+entries, one per line, that is only appended to. An entry replaces the
+entries before it with the same or a higher index, so that a follower's
+conflicting entries are overwritten without rewriting the file; the file is
+rewritten whenever a snapshot is saved. A torn entry at the end of the file
+is dropped when it is loaded.
+*/
+type FileStorage struct {
+	mu  sync.Mutex
+	dir string
+	log *os.File
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (f *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var state HardState
+	if err := readJSON(filepath.Join(f.dir, stateFile), &state); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	var snapshot Snapshot
+	if err := readJSON(filepath.Join(f.dir, snapshotFile), &snapshot); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+
+	path := filepath.Join(f.dir, logFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	var entries []Entry
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return HardState{}, Snapshot{}, nil, err
+		}
+		var e Entry
+		if json.Unmarshal(line, &e) != nil {
+			break
+		}
+		valid += int64(len(line))
+		if e.Index > snapshot.Index {
+			entries = truncateAppend(entries, []Entry{e})
+		}
+	}
+	// Drop a torn entry, so that appends follow the last complete one.
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return HardState{}, Snapshot{}, nil, err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return HardState{}, Snapshot{}, nil, err
+	}
+	if f.log != nil {
+		f.log.Close()
+	}
+	f.log = file
+	return state, snapshot, entries, nil
+}
+
+func (f *FileStorage) SaveHardState(state HardState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return writeJSON(filepath.Join(f.dir, stateFile), state)
+}
+
+func (f *FileStorage) Append(entries []Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.log == nil {
+		return errors.New("raft: storage is not loaded")
+	}
+	buf, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := f.log.Write(buf); err != nil {
+		return err
+	}
+	return f.log.Sync()
+}
+
+func (f *FileStorage) SaveSnapshot(s Snapshot, entries []Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := writeJSON(filepath.Join(f.dir, snapshotFile), s); err != nil {
+		return err
+	}
+
+	buf, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(f.dir, logFile)
+	if err := writeFile(path, buf); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if f.log != nil {
+		f.log.Close()
+	}
+	f.log = file
+	return nil
+}
+
+func (f *FileStorage) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.log == nil {
+		return nil
+	}
+	err := f.log.Close()
+	f.log = nil
+	return err
+}
+
+func encodeEntries(entries []Entry) ([]byte, error) {
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	return buf, nil
+}
+
+/*
+Reads the JSON file at path into v, leaving v alone if there is no such
+file.
+*/
+func readJSON(path string, v interface{}) error {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("raft: corrupt %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, buf)
+}
+
+/*
+Replaces the file at path with buf atomically: buf is written and synced
+to a temporary file that is then renamed over path.
+*/
+func writeFile(path string, buf []byte) error {
+	temp := path + tempExt
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
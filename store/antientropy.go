@@ -0,0 +1,489 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	// How often replicas compare what they hold.
+	DefaultAntiEntropyInterval = 10 * time.Minute
+	// How many differing keys a round reconciles per second.
+	DefaultAntiEntropyRate = 100
+)
+
+var ErrAntiEntropyInProgress = errors.New("anti-entropy is already running")
+
+/*
+A range of the ring: the keys whose hash is above Start and at most End,
+wrapping around if Start is not below End. The keys of a range are held by
+the replicas that follow End on the ring.
+*/
+type RingRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+/*
+A range in which this node and Peer held different keys or values, and the
+number of keys that differed.
+*/
+type DivergentRange struct {
+	RingRange
+	Peer string `json:"peer"`
+	Keys int    `json:"keys"`
+}
+
+/*
+What an anti-entropy round compared and repaired.
+*/
+type AntiEntropyReport struct {
+	Started        time.Time        `json:"started"`
+	Finished       time.Time        `json:"finished"`
+	Peers          []string         `json:"peers"`
+	RangesCompared int              `json:"ranges_compared"`
+	Divergent      []DivergentRange `json:"divergent"`
+	KeysRepaired   int              `json:"keys_repaired"`
+	Errors         []string         `json:"errors,omitempty"`
+}
+
+/*
+The Merkle tree of a node over the ranges it replicates together with a
+peer. Each leaf hashes the keys of one range, in ring order, and each node
+above hashes its two children; a node without a sibling is carried up as
+is. The first level holds the leaves and the last one the root.
+*/
+type MerkleTree struct {
+	// The end of the range of each leaf.
+	Ranges []uint32   `json:"ranges"`
+	Levels [][][]byte `json:"levels"`
+}
+
+func newMerkleTree(ranges []uint32, leaves [][]byte) MerkleTree {
+	t := MerkleTree{Ranges: ranges, Levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		var parents [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				parents = append(parents, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			parents = append(parents, h.Sum(nil))
+		}
+		t.Levels = append(t.Levels, parents)
+		level = parents
+	}
+	return t
+}
+
+/*
+Returns the indexes of the leaves in which t and other differ, descending
+only into the subtrees whose hashes differ. Both trees must cover the same
+ranges.
+*/
+func (t MerkleTree) diff(other MerkleTree) []int {
+	if len(t.Ranges) == 0 {
+		return nil
+	}
+	var leaves []int
+	var walk func(level, i int)
+	walk = func(level, i int) {
+		if bytes.Equal(t.Levels[level][i], other.Levels[level][i]) {
+			return
+		}
+		if level == 0 {
+			leaves = append(leaves, i)
+			return
+		}
+		for child := 2 * i; child <= 2*i+1 && child < len(t.Levels[level-1]); child++ {
+			walk(level-1, child)
+		}
+	}
+	walk(len(t.Levels)-1, 0)
+	return leaves
+}
+
+func (t MerkleTree) sameShape(other MerkleTree) bool {
+	if len(t.Ranges) != len(other.Ranges) || len(t.Levels) != len(other.Levels) {
+		return false
+	}
+	for i := range t.Ranges {
+		if t.Ranges[i] != other.Ranges[i] {
+			return false
+		}
+	}
+	for i := range t.Levels {
+		if len(t.Levels[i]) != len(other.Levels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Identifies the values of e: replicas that hold the same writes of a key
+have the same digest, whatever version they numbered them with.
+*/
+func (e entry) digest() string {
+	return e.clock().String() + " " + e.latest().String()
+}
+
+/*
+Returns the ring indexes of the ranges that this node and peer both
+replicate, in ring order. A node that is not on the ring replicates none.
+*/
+func (s *Store) sharedRanges(peer string) ([]int, error) {
+	if s.replicationFactor == 0 || s.self == "" || peer == s.self {
+		return nil, nil
+	}
+	var shared []int
+	for i := 0; i < s.ownerRing.Len(); i++ {
+		nodes, err := s.walkFrom(i, s.replicationFactor)
+		if err != nil {
+			return nil, err
+		}
+		self, other := false, false
+		for _, node := range nodes {
+			self = self || node == s.self
+			other = other || node == peer
+		}
+		if self && other {
+			shared = append(shared, i)
+		}
+	}
+	return shared, nil
+}
+
+/*
+Calls fn with the ring index and digest of every key in the ranges with the
+given indexes, in key order. Deleted keys are included with their
+tombstones, so that deletes are reconciled like writes.
+*/
+func (s *Store) eachKeyIn(indexes map[int]bool, fn func(index int, key, digest string)) error {
+	now := s.now().UnixNano()
+	return s.engine.Iterate(PrefixEnd(internalKeyPrefix), "", func(key string, buf []byte) bool {
+		index, err := s.ownerRing.GetRingIndex(s.ownerRing.HashStr(key))
+		if err != nil || !indexes[index] {
+			return true
+		}
+		e, err := decodeEntry(buf)
+		if err != nil {
+			return true
+		}
+		if e, ok := e.unexpired(now); ok {
+			fn(index, key, e.digest())
+		}
+		return true
+	})
+}
+
+/*
+Builds the Merkle tree of this node over the ranges it replicates together
+with peer.
+*/
+func (s *Store) MerkleTree(peer string) (MerkleTree, error) {
+	shared, err := s.sharedRanges(peer)
+	if err != nil {
+		return MerkleTree{}, err
+	}
+	indexes := make(map[int]bool, len(shared))
+	for _, i := range shared {
+		indexes[i] = true
+	}
+
+	hashers := make(map[int]hash.Hash)
+	err = s.eachKeyIn(indexes, func(index int, key, digest string) {
+		h, ok := hashers[index]
+		if !ok {
+			h = sha256.New()
+			hashers[index] = h
+		}
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(digest))
+		h.Write([]byte{0})
+	})
+	if err != nil {
+		return MerkleTree{}, err
+	}
+
+	ranges := make([]uint32, len(shared))
+	leaves := make([][]byte, len(shared))
+	for j, i := range shared {
+		if ranges[j], err = s.ownerRing.GetHashForRingIndex(i); err != nil {
+			return MerkleTree{}, err
+		}
+		h, ok := hashers[i]
+		if !ok {
+			h = sha256.New()
+		}
+		leaves[j] = h.Sum(nil)
+	}
+	return newMerkleTree(ranges, leaves), nil
+}
+
+/*
+Returns the digests of the keys, deleted ones included, this node holds in
+the ranges ending at the given hashes.
+*/
+func (s *Store) RangeKeys(ranges []uint32) (map[string]string, error) {
+	indexes := make(map[int]bool, len(ranges))
+	for _, end := range ranges {
+		index, err := s.ownerRing.GetRingIndex(end)
+		if err != nil {
+			return nil, err
+		}
+		indexes[index] = true
+	}
+	keys := make(map[string]string)
+	err := s.eachKeyIn(indexes, func(_ int, key, digest string) {
+		keys[key] = digest
+	})
+	return keys, err
+}
+
+/*
+Returns the range of the ring that ends at the given index.
+*/
+func (s *Store) ringRange(index int) (RingRange, error) {
+	end, err := s.ownerRing.GetHashForRingIndex(index)
+	if err != nil {
+		return RingRange{}, err
+	}
+	previous := index - 1
+	if previous < 0 {
+		previous = s.ownerRing.Len() - 1
+	}
+	start, err := s.ownerRing.GetHashForRingIndex(previous)
+	if err != nil {
+		return RingRange{}, err
+	}
+	return RingRange{Start: start, End: end}, nil
+}
+
+/*
+Runs an anti-entropy round: compares the Merkle tree of this node with the
+one of every other live node over the ranges they both replicate, and for
+the ranges that differ exchanges the digests of their keys and reconciles
+the keys that differ, at most at the configured rate. Fails with
+ErrAntiEntropyInProgress if a round is already running.
+*/
+func (s *Store) AntiEntropy() (AntiEntropyReport, error) {
+	if !s.antiEntropyMu.TryLock() {
+		return AntiEntropyReport{}, ErrAntiEntropyInProgress
+	}
+	defer s.antiEntropyMu.Unlock()
+
+	report := AntiEntropyReport{Started: s.now(), Peers: []string{}, Divergent: []DivergentRange{}}
+	for _, peer := range s.nodes {
+		if !s.alive(peer) {
+			continue
+		}
+		if err := s.syncWith(peer, &report); err != nil {
+			log.Printf("Anti-entropy with %s failed: %v", peer, err)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", peer, err))
+		}
+	}
+	report.Finished = s.now()
+
+	s.antiEntropyRounds.Add(1)
+	s.divergentRanges.Add(uint64(len(report.Divergent)))
+	s.reportMu.Lock()
+	s.lastAntiEntropy = report
+	s.reportMu.Unlock()
+	return report, nil
+}
+
+/*
+Returns the report of the last anti-entropy round.
+*/
+func (s *Store) LastAntiEntropy() AntiEntropyReport {
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+	return s.lastAntiEntropy
+}
+
+func (s *Store) syncWith(peer string, report *AntiEntropyReport) error {
+	local, err := s.MerkleTree(peer)
+	if err != nil || len(local.Ranges) == 0 {
+		return err
+	}
+	report.Peers = append(report.Peers, peer)
+	remote, err := s.fetchMerkleTree(peer)
+	if err != nil {
+		return err
+	}
+	if !local.sameShape(remote) {
+		return errors.New("the ring differs; check that both nodes are started with the same nodes")
+	}
+	report.RangesCompared += len(local.Ranges)
+
+	leaves := local.diff(remote)
+	if len(leaves) == 0 {
+		return nil
+	}
+	ranges := make([]uint32, len(leaves))
+	for i, leaf := range leaves {
+		ranges[i] = local.Ranges[leaf]
+	}
+	remoteKeys, err := s.fetchRangeKeys(peer, ranges)
+	if err != nil {
+		return err
+	}
+	localKeys, err := s.RangeKeys(ranges)
+	if err != nil {
+		return err
+	}
+
+	var differing []string
+	for key, digest := range localKeys {
+		if remoteKeys[key] != digest {
+			differing = append(differing, key)
+		}
+	}
+	for key := range remoteKeys {
+		if _, ok := localKeys[key]; !ok {
+			differing = append(differing, key)
+		}
+	}
+	sort.Strings(differing)
+
+	counts := make(map[int]int)
+	for _, key := range differing {
+		index, _ := s.ownerRing.GetRingIndex(s.ownerRing.HashStr(key))
+		counts[index]++
+	}
+	for _, end := range ranges {
+		index, _ := s.ownerRing.GetRingIndex(end)
+		r, err := s.ringRange(index)
+		if err != nil {
+			return err
+		}
+		report.Divergent = append(report.Divergent, DivergentRange{RingRange: r, Peer: peer, Keys: counts[index]})
+	}
+
+	for _, key := range differing {
+		if !s.pace() {
+			return errors.New("stopped")
+		}
+		if err := s.reconcile(peer, key); err != nil {
+			return fmt.Errorf("failed to reconcile key %s: %w", key, err)
+		}
+		report.KeysRepaired++
+		s.antiEntropyRepairs.Add(1)
+	}
+	return nil
+}
+
+/*
+Waits long enough to keep reconciliation within the configured rate.
+Reports false if the store is closed in the meantime.
+*/
+func (s *Store) pace() bool {
+	if s.antiEntropyRate <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(time.Second / time.Duration(s.antiEntropyRate)):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+/*
+Makes this node and peer hold the same values of key by sending each the
+values the other holds, which they merge like any replicated write.
+*/
+func (s *Store) reconcile(peer, key string) error {
+	remote, found, err := s.fetchItem(peer, key)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := s.repairCopy("", key, append([]KeyValue{remote}, remote.Siblings...)); err != nil {
+			return err
+		}
+	}
+	local, ok := s.lookupReplica(key)
+	if !ok {
+		return nil
+	}
+	return s.repairCopy(peer, key, append([]KeyValue{local}, local.Siblings...))
+}
+
+func (s *Store) fetchMerkleTree(peer string) (MerkleTree, error) {
+	resp, err := s.client.Get(fmt.Sprintf("http://%s/_/cluster/merkle?peer=%s", peer, url.QueryEscape(s.self)))
+	if err != nil {
+		return MerkleTree{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return MerkleTree{}, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	var tree MerkleTree
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		return MerkleTree{}, fmt.Errorf("invalid Merkle tree: %w", err)
+	}
+	return tree, nil
+}
+
+func (s *Store) fetchRangeKeys(peer string, ranges []uint32) (map[string]string, error) {
+	body, err := json.Marshal(map[string][]uint32{"ranges": ranges})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/_/cluster/merkle/keys", peer), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	var keys struct {
+		Keys map[string]string `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("invalid key digests: %w", err)
+	}
+	return keys.Keys, nil
+}
+
+func (s *Store) antiEntropyLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, err := s.AntiEntropy()
+			if err != nil {
+				log.Printf("Skipping anti-entropy: %v", err)
+			} else if len(report.Divergent) > 0 {
+				log.Printf("Anti-entropy found %d divergent ranges and repaired %d keys", len(report.Divergent), report.KeysRepaired)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
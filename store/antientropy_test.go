@@ -0,0 +1,187 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+Routes the requests a node sends to peer during anti-entropy to peer
+itself: Merkle trees, key digests, scans of a single key and forwarded
+writes and deletes.
+*/
+func peerClient(t *testing.T, peer *Store) *MockHttpClient {
+	respond := func(status int, body interface{}) *http.Response {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode response: %v", err)
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(buf))}
+	}
+	return &MockHttpClient{
+		getFunc: func(url string) (*http.Response, error) {
+			tree, err := peer.MerkleTree(peer.nodes[0])
+			if err != nil {
+				return respond(http.StatusInternalServerError, err.Error()), nil
+			}
+			return respond(http.StatusOK, tree), nil
+		},
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			switch {
+			case req.URL.Path == "/_/cluster/merkle/keys":
+				var request struct {
+					Ranges []uint32 `json:"ranges"`
+				}
+				_ = json.NewDecoder(req.Body).Decode(&request)
+				keys, _ := peer.RangeKeys(request.Ranges)
+				return respond(http.StatusOK, map[string]interface{}{"keys": keys}), nil
+			case req.Method == http.MethodGet:
+				query := req.URL.Query()
+				items, _ := peer.ScanReplica(query.Get("start"), query.Get("end"), 1)
+				return respond(http.StatusOK, scanPage{Items: items}), nil
+			case req.Method == http.MethodPut || req.Method == http.MethodDelete:
+				opts := WriteOptions{SkipReplication: true, ContentType: req.Header.Get("Content-Type")}
+				opts.Timestamp, _ = strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+				opts.Version, _ = strconv.ParseUint(req.Header.Get(VersionHeader), 10, 64)
+				opts.Dot, _ = ParseDot(req.Header.Get(DotHeader))
+				opts.Context, _ = ParseVectorClock(req.Header.Get(ContextHeader))
+				key := strings.TrimPrefix(req.URL.Path, "/")
+				var err error
+				if req.Method == http.MethodDelete {
+					err = peer.Delete(key, opts)
+				} else {
+					value, _ := io.ReadAll(req.Body)
+					err = peer.Set(key, value, opts)
+				}
+				if err != nil {
+					return respond(http.StatusInternalServerError, err.Error()), nil
+				}
+				return respond(http.StatusOK, nil), nil
+			}
+			return respond(http.StatusNotFound, nil), nil
+		},
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	leaf := func(s string) []byte { return []byte(s) }
+
+	t.Run("should find the leaves that differ", func(t *testing.T) {
+		ranges := []uint32{1, 2, 3, 4, 5}
+		a := newMerkleTree(ranges, [][]byte{leaf("a"), leaf("b"), leaf("c"), leaf("d"), leaf("e")})
+		b := newMerkleTree(ranges, [][]byte{leaf("a"), leaf("x"), leaf("c"), leaf("d"), leaf("y")})
+
+		assertEqual(t, len(a.Levels), 4, "levels")
+		assertEqual(t, a.sameShape(b), true, "same shape")
+		diff := a.diff(b)
+		assertEqual(t, len(diff), 2, "differing leaves")
+		assertEqual(t, diff[0], 1, "first differing leaf")
+		assertEqual(t, diff[1], 4, "second differing leaf")
+		assertEqual(t, len(a.diff(a)), 0, "differences to itself")
+	})
+
+	t.Run("should handle empty trees", func(t *testing.T) {
+		empty := newMerkleTree(nil, nil)
+		assertEqual(t, len(empty.diff(empty)), 0, "differing leaves")
+	})
+}
+
+func TestAntiEntropy(t *testing.T) {
+	newPair := func(t *testing.T, rate int) (*Store, *Store) {
+		a := newTestStore(t, []string{"b"}, 2, WithAdvertiseAddr("a"), WithAntiEntropy(0, rate))
+		b := newTestStore(t, []string{"a"}, 2, WithAdvertiseAddr("b"), WithAntiEntropy(0, rate))
+		a.client = peerClient(t, b)
+		b.client = peerClient(t, a)
+		return a, b
+	}
+	local := func(timestamp int64) WriteOptions {
+		return WriteOptions{SkipReplication: true, Timestamp: timestamp}
+	}
+
+	t.Run("should agree on replicas holding the same keys", func(t *testing.T) {
+		a, b := newPair(t, 0)
+		for _, s := range []*Store{a, b} {
+			_ = s.Set("x", []byte("1"), local(10))
+			_ = s.Set("y", []byte("2"), local(20))
+		}
+
+		treeA, _ := a.MerkleTree("b")
+		treeB, _ := b.MerkleTree("a")
+		assertEqual(t, len(treeA.Ranges) > 0, true, "shared ranges")
+		assertEqual(t, len(treeA.diff(treeB)), 0, "differing ranges")
+
+		report, err := a.AntiEntropy()
+		assertEqual(t, err, nil, "anti-entropy error")
+		assertEqual(t, report.RangesCompared, len(treeA.Ranges), "ranges compared")
+		assertEqual(t, len(report.Divergent), 0, "divergent ranges")
+	})
+
+	t.Run("should reconcile differing keys in both directions", func(t *testing.T) {
+		a, b := newPair(t, 1000)
+		_ = a.Set("x", []byte("1"), local(10))
+		_ = b.Set("x", []byte("1"), local(10))
+		_ = a.Set("y", []byte("2"), local(20))
+		_ = b.Set("z", []byte("3"), local(30))
+
+		report, err := a.AntiEntropy()
+		assertEqual(t, err, nil, "anti-entropy error")
+		assertEqual(t, len(report.Errors), 0, "errors")
+		assertEqual(t, report.KeysRepaired, 2, "keys repaired")
+		keys := 0
+		for _, r := range report.Divergent {
+			assertEqual(t, r.Peer, "b", "peer")
+			keys += r.Keys
+		}
+		assertEqual(t, keys, 2, "divergent keys")
+
+		value, _ := b.Get("y")
+		assertEqual(t, string(value), "2", "key repaired on the peer")
+		value, _ = a.Get("z")
+		assertEqual(t, string(value), "3", "key repaired locally")
+
+		report, _ = a.AntiEntropy()
+		assertEqual(t, len(report.Divergent), 0, "divergent ranges after repair")
+		assertEqual(t, a.LastAntiEntropy().RangesCompared, report.RangesCompared, "last report")
+		assertEqual(t, a.Stats().Metrics["anti_entropy_repaired_keys"], int64(2), "repaired keys metric")
+	})
+
+	t.Run("should settle differing values of a key", func(t *testing.T) {
+		a, b := newPair(t, 0)
+		_ = a.Set("x", []byte("old"), WriteOptions{SkipReplication: true, Timestamp: 10, Dot: Dot{Node: "n1", Counter: 1}})
+		_ = b.Set("x", []byte("new"), WriteOptions{SkipReplication: true, Timestamp: 20, Dot: Dot{Node: "n1", Counter: 2}, Context: VectorClock{"n1": 1}})
+
+		_, _ = a.AntiEntropy()
+		value, _ := a.Get("x")
+		assertEqual(t, string(value), "new", "value")
+		treeA, _ := a.MerkleTree("b")
+		treeB, _ := b.MerkleTree("a")
+		assertEqual(t, len(treeA.diff(treeB)), 0, "differing ranges")
+	})
+
+	t.Run("should spread deletes instead of bringing keys back", func(t *testing.T) {
+		a, b := newPair(t, 0)
+		for _, s := range []*Store{a, b} {
+			_ = s.Set("x", []byte("1"), WriteOptions{SkipReplication: true, Timestamp: 10, Dot: Dot{Node: "n1", Counter: 1}})
+		}
+		_ = a.Delete("x", WriteOptions{SkipReplication: true, Timestamp: 20, Dot: Dot{Node: "n1", Counter: 2}, Context: VectorClock{"n1": 1}})
+
+		report, _ := b.AntiEntropy()
+		assertEqual(t, report.KeysRepaired, 1, "keys repaired")
+		_, ok := a.Get("x")
+		assertEqual(t, ok, false, "key deleted locally")
+		_, ok = b.Get("x")
+		assertEqual(t, ok, false, "key deleted on the peer")
+	})
+
+	t.Run("should not share ranges without an address", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAntiEntropy(0, 0))
+		tree, err := s.MerkleTree("node1")
+		assertEqual(t, err, nil, "tree error")
+		assertEqual(t, len(tree.Ranges), 0, "shared ranges")
+	})
+}
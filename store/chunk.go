@@ -0,0 +1,372 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Values larger than this are split into chunks of this size, each stored
+under its own key, so that neither writing nor reading them requires the
+whole value in memory.
+*/
+const DefaultChunkSize = 1 << 20
+
+/*
+Keys starting with internalKeyPrefix belong to the store itself and cannot
+be written by clients. They sort before every client key.
+*/
+const (
+	internalKeyPrefix = "\x00"
+	chunkKeyPrefix    = internalKeyPrefix + "chunk\x00"
+)
+
+/*
+How long chunks that no entry refers to are kept before they are deleted.
+Chunks of an overwritten or deleted value become unreferenced immediately,
+but a reader that opened the value before may still be streaming them.
+*/
+const chunkGracePeriod = time.Minute
+
+/*
+Describes the chunks holding a value. Every write of a chunked value uses a
+fresh random id, so a new value never overwrites the chunks of the value it
+replaces.
+*/
+type chunkRef struct {
+	id        uint64
+	size      int64
+	chunkSize int64
+}
+
+func (r chunkRef) chunked() bool {
+	return r.chunkSize > 0
+}
+
+func (r chunkRef) count() int64 {
+	if !r.chunked() {
+		return 0
+	}
+	return (r.size + r.chunkSize - 1) / r.chunkSize
+}
+
+/*
+The memory taken by the chunks, for the memory limiter.
+*/
+func (r chunkRef) storedSize() int64 {
+	return r.size + r.count()*entryOverhead
+}
+
+/*
+Keys starting with ReservedKeyPrefix name the endpoints nodes serve besides
+the keys, such as /_/cluster/config, and cannot be written by clients.
+*/
+const ReservedKeyPrefix = "_/"
+
+var ErrReservedKey = errors.New("key is reserved")
+
+func validateKey(key string) error {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+	if strings.HasPrefix(key, internalKeyPrefix) {
+		return errors.New("key cannot start with a NUL byte")
+	}
+	if strings.HasPrefix(key, ReservedKeyPrefix) {
+		return fmt.Errorf("%w: keys starting with %s are used by the endpoints of the nodes", ErrReservedKey, ReservedKeyPrefix)
+	}
+	return nil
+}
+
+/*
+The common prefix of the chunk keys of one write of key. Chunk keys are the
+prefix followed by the chunk index in fixed-width hex, so they sort in
+order.
+*/
+func chunkPrefix(key string, id uint64) string {
+	return fmt.Sprintf("%s%s\x00%016x\x00", chunkKeyPrefix, key, id)
+}
+
+func chunkKey(key string, id uint64, index int64) string {
+	return fmt.Sprintf("%s%08x", chunkPrefix(key, id), index)
+}
+
+/*
+Returns the write a chunk key belongs to.
+*/
+func parseChunkKey(chunk string) (chunkOwner, bool) {
+	if !strings.HasPrefix(chunk, chunkKeyPrefix) {
+		return chunkOwner{}, false
+	}
+	rest := chunk[len(chunkKeyPrefix):]
+	i := strings.LastIndexByte(rest, 0)
+	if i < 0 {
+		return chunkOwner{}, false
+	}
+	rest = rest[:i]
+	i = strings.LastIndexByte(rest, 0)
+	if i < 0 {
+		return chunkOwner{}, false
+	}
+	id, err := strconv.ParseUint(rest[i+1:], 16, 64)
+	if err != nil {
+		return chunkOwner{}, false
+	}
+	return chunkOwner{key: rest[:i], id: id}, true
+}
+
+/*
+Like Set, but reads the value from body. Values up to the chunk size are
+stored as usual; larger ones are written to the engine and streamed to the
+replicas chunk by chunk. Reports whether the key existed on the replicas
+before the write.
+*/
+func (s *Store) SetStream(key string, body io.Reader, opts WriteOptions) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+	if s.replicationMode == RaftReplication && !opts.SkipReplication {
+		// Values travel through the Raft log, which holds them whole.
+		value, err := io.ReadAll(body)
+		if err != nil {
+			return false, err
+		}
+		held, err := s.readRaft(key, false)
+		if err != nil {
+			return false, err
+		}
+		held.Close()
+		return held.Found, s.setRaft(key, value, opts)
+	}
+	if relayed, existed, err := s.relayWrite(http.MethodPut, key, body, opts); relayed {
+		return existed, err
+	}
+	existed, err := s.resolveWrite(key, &opts)
+	if err != nil {
+		return false, err
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, int64(s.chunkSize)+1))
+	if err != nil {
+		return false, err
+	}
+	if len(head) <= s.chunkSize {
+		return existed, s.setResolved(key, head, opts)
+	}
+	return existed, s.setChunked(key, io.MultiReader(bytes.NewReader(head), body), opts)
+}
+
+/*
+Writes the chunks of a value read from body, then the entry referring to
+them. Readers keep seeing the previous value until the entry is written.
+If anything fails, the chunks written so far are deleted again.
+*/
+func (s *Store) setChunked(key string, body io.Reader, opts WriteOptions) error {
+	e, err := s.newEntry(opts)
+	if err != nil {
+		return err
+	}
+	e.chunks = chunkRef{id: rand.Uint64(), chunkSize: int64(s.chunkSize)}
+	prefix := chunkPrefix(key, e.chunks.id)
+
+	s.beginUpload(prefix)
+	defer s.endUpload(prefix)
+
+	buf := make([]byte, s.chunkSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(body, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if last {
+			err = nil
+		}
+		if err == nil && n > 0 {
+			s.mu.Lock()
+			err = s.commit(walOpSet, chunkKey(key, e.chunks.id, index), string(buf[:n]))
+			s.mu.Unlock()
+			e.chunks.size += int64(n)
+		}
+		if err != nil {
+			s.dropChunks(prefix)
+			return err
+		}
+		if last {
+			break
+		}
+	}
+
+	e, applied, undo, err := s.put(key, e, opts)
+	if err == nil && !applied {
+		// A replica that already holds a newer value keeps it.
+		s.dropChunks(prefix)
+		return nil
+	}
+	if err != nil {
+		s.dropChunks(prefix)
+		return err
+	}
+
+	ref := e.chunks
+	source := func() (io.Reader, int64) {
+		return s.newChunkReader(key, ref), ref.size
+	}
+	return s.replicateWrite(opts, "PUT", key, source, e, undo)
+}
+
+func (s *Store) beginUpload(prefix string) {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	s.uploads[prefix] = struct{}{}
+}
+
+func (s *Store) endUpload(prefix string) {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	delete(s.uploads, prefix)
+}
+
+func (s *Store) uploading(prefix string) bool {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	_, ok := s.uploads[prefix]
+	return ok
+}
+
+/*
+Deletes every chunk key starting with prefix.
+*/
+func (s *Store) dropChunks(prefix string) {
+	var keys []string
+	err := s.engine.Iterate(prefix, PrefixEnd(prefix), func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to list chunks %q: %v", prefix, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if err := s.commit(walOpDelete, key, ""); err != nil {
+			log.Printf("Failed to delete chunk %q: %v", key, err)
+			return
+		}
+	}
+}
+
+/*
+Returns the whole value of e, reading its chunks if it has any.
+*/
+func (s *Store) loadValue(key string, e entry) ([]byte, error) {
+	if !e.chunks.chunked() {
+		return e.value, nil
+	}
+	value := make([]byte, e.chunks.size)
+	if _, err := io.ReadFull(s.newChunkReader(key, e.chunks), value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+/*
+Reads a chunked value one chunk at a time.
+*/
+type chunkReader struct {
+	store  *Store
+	key    string
+	ref    chunkRef
+	offset int64
+	index  int64
+	chunk  []byte
+}
+
+func (s *Store) newChunkReader(key string, ref chunkRef) *chunkReader {
+	return &chunkReader{store: s, key: key, ref: ref, index: -1}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.ref.size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / r.ref.chunkSize
+	if index != r.index {
+		chunk, ok, err := r.store.engine.Get(chunkKey(r.key, r.ref.id, index))
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("chunk %d of %s is missing", index, r.key)
+		}
+		r.index, r.chunk = index, chunk
+	}
+
+	start := r.offset - index*r.ref.chunkSize
+	if start >= int64(len(r.chunk)) {
+		return 0, fmt.Errorf("chunk %d of %s is truncated", index, r.key)
+	}
+	n := copy(p, r.chunk[start:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.ref.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+/*
+A write of a chunked value, as identified by its chunk keys.
+*/
+type chunkOwner struct {
+	key string
+	id  uint64
+}
+
+/*
+Handles the chunked writes whose chunks the reaper met. Chunks that no
+entry refers to and that are not being written are deleted once they have
+been seen unreferenced for the grace period.
+*/
+func (s *Store) reapChunks(owners []chunkOwner, now time.Time) {
+	for _, owner := range owners {
+		prefix := chunkPrefix(owner.key, owner.id)
+		if s.uploading(prefix) {
+			continue
+		}
+		if e, ok := s.loadEntry(owner.key); ok && e.refersTo(owner.id) {
+			delete(s.orphans, prefix)
+			continue
+		}
+
+		since, seen := s.orphans[prefix]
+		switch {
+		case !seen:
+			s.orphans[prefix] = now
+		case now.Sub(since) >= chunkGracePeriod:
+			s.dropChunks(prefix)
+			delete(s.orphans, prefix)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func chunkKeys(t *testing.T, s *Store) []string {
+	t.Helper()
+	var keys []string
+	err := s.engine.Iterate(chunkKeyPrefix, PrefixEnd(chunkKeyPrefix), func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("failed to list chunks: %v", err)
+	}
+	return keys
+}
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestChunkedValues(t *testing.T) {
+	local := WriteOptions{SkipReplication: true}
+	value := "0123456789"
+
+	for _, engine := range Engines() {
+		t.Run("should store large values in chunks with the "+engine+" engine", func(t *testing.T) {
+			dir := t.TempDir()
+			s, _ := NewStore([]string{"node1"}, 1, WithEngine(engine), WithDataDir(dir), WithReapInterval(0))
+			s.chunkSize = 4
+			if _, err := s.SetStream("big", strings.NewReader(value), WriteOptions{SkipReplication: true, ContentType: "text/plain"}); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			_ = s.Set("small", []byte("0123"), local)
+			assertEqual(t, len(chunkKeys(t, s)), 3, "chunks")
+
+			item, ok := s.Lookup("big")
+			assertEqual(t, ok, true, "key existence check")
+			assertEqual(t, string(item.Value), value, "value")
+			assertEqual(t, item.Size, int64(len(value)), "size")
+			assertEqual(t, item.ContentType, "text/plain", "content type")
+
+			items, _ := s.Scan("", "", 0)
+			assertEqual(t, scannedKeys(items), "big,small", "scanned keys")
+			assertEqual(t, string(items[0].Value), value, "scanned value")
+			s.Close()
+
+			s = newTestStore(t, []string{"node1"}, 1, WithEngine(engine), WithDataDir(dir), WithReapInterval(0))
+			restored, _ := s.Get("big")
+			assertEqual(t, string(restored), value, "value after restart")
+		})
+	}
+
+	t.Run("should read chunked values from any offset", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		s.chunkSize = 4
+		_ = s.Set("big", []byte(value), local)
+
+		_, r, _ := s.Open("big")
+		if _, err := r.Seek(3, io.SeekStart); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, string(buf), "345678", "read after seek")
+
+		end, _ := r.Seek(0, io.SeekEnd)
+		assertEqual(t, end, int64(len(value)), "end offset")
+		if _, err := r.Read(buf); err != io.EOF {
+			t.Errorf("expected EOF at the end, got %v", err)
+		}
+	})
+
+	t.Run("should reclaim chunks of overwritten values after the grace period", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1, WithReapInterval(0))
+		s.chunkSize = 4
+		now := time.Unix(1000, 0)
+		s.now = func() time.Time { return now }
+
+		_ = s.Set("big", []byte(value), local)
+		_ = s.Set("big", []byte("abcdefghi"), local)
+		_ = s.Set("gone", []byte(value), local)
+		_ = s.Delete("gone", WriteOptions{SkipReplication: true})
+		assertEqual(t, len(chunkKeys(t, s)), 9, "chunks before reaping")
+
+		s.reapExpired()
+		assertEqual(t, len(chunkKeys(t, s)), 9, "chunks within the grace period")
+
+		now = now.Add(chunkGracePeriod)
+		s.reapExpired()
+		assertEqual(t, len(chunkKeys(t, s)), 3, "chunks after the grace period")
+		current, _ := s.Get("big")
+		assertEqual(t, string(current), "abcdefghi", "current value")
+	})
+
+	t.Run("should drop the chunks of a failed upload", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		s.chunkSize = 4
+		_ = s.Set("big", []byte(value), local)
+
+		_, err := s.SetStream("big", &failingReader{strings.NewReader("abcdefghi")}, local)
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		assertEqual(t, len(chunkKeys(t, s)), 3, "chunks")
+		current, _ := s.Get("big")
+		assertEqual(t, string(current), value, "value after the failed upload")
+	})
+
+	t.Run("should stream chunked values to replicas", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		s.chunkSize = 4
+		var bodies []string
+		var lengths []int64
+		var mu sync.Mutex
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodHead {
+					return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+				}
+				body, _ := io.ReadAll(req.Body)
+				mu.Lock()
+				bodies = append(bodies, string(body))
+				lengths = append(lengths, req.ContentLength)
+				mu.Unlock()
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+			},
+		}
+
+		if _, err := s.SetStream("big", strings.NewReader(value), WriteOptions{}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, len(bodies), 2, "replicated writes")
+		for i := range bodies {
+			assertEqual(t, bodies[i], value, "replicated value")
+			assertEqual(t, lengths[i], int64(len(value)), "replicated content length")
+		}
+	})
+
+	t.Run("should reject internal keys", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		if err := s.Set(chunkKey("big", 1, 0), []byte(value), local); err == nil {
+			t.Errorf("expected an error for an internal key")
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+The replication settings a store runs with: every key is held by N
+replicas, reads wait for R of them and writes for W. Nodes are the members
+of the ring, this node included if it is one of them.
+*/
+type ClusterConfig struct {
+	Self  string   `json:"self,omitempty"`
+	Nodes []string `json:"nodes"`
+	N     int      `json:"n"`
+	R     int      `json:"r"`
+	W     int      `json:"w"`
+	// Whether every read quorum overlaps every write quorum, so that reads
+	// see the latest acknowledged write.
+	Overlapping bool `json:"overlapping"`
+	// Set when the store runs without replicas and holds every key alone.
+	Standalone bool `json:"standalone,omitempty"`
+	// How the replicas of a key agree on its value.
+	Replication ReplicationMode `json:"replication"`
+}
+
+/*
+Returns the effective replication settings of the store.
+*/
+func (s *Store) ClusterConfig() ClusterConfig {
+	if s.replicationFactor == 0 {
+		return ClusterConfig{Self: s.self, Nodes: []string{}, N: 1, R: 1, W: 1, Overlapping: true, Standalone: true, Replication: s.replicationMode}
+	}
+	return ClusterConfig{
+		Self:        s.self,
+		Nodes:       s.members,
+		N:           s.replicationFactor,
+		R:           s.readQuorum,
+		W:           s.writeQuorum,
+		Overlapping: s.readQuorum+s.writeQuorum > s.replicationFactor,
+		Replication: s.replicationMode,
+	}
+}
+
+/*
+Checks the replication factor n against the number of ring members and
+fills in the read and write quorums r and w, which default to a majority
+of n. Quorums that do not overlap are allowed, but reads may then miss
+acknowledged writes, which is logged.
+*/
+func quorums(n, r, w, members int) (int, int, error) {
+	if n < 1 {
+		return 0, 0, fmt.Errorf("replication factor must be at least 1, got %d", n)
+	}
+	if n > members {
+		return 0, 0, fmt.Errorf("replication factor %d exceeds the %d nodes of the cluster", n, members)
+	}
+	if r == 0 {
+		r = n/2 + 1
+	}
+	if w == 0 {
+		w = n/2 + 1
+	}
+	if r < 1 || r > n {
+		return 0, 0, fmt.Errorf("read quorum must be between 1 and the replication factor %d, got %d", n, r)
+	}
+	if w < 1 || w > n {
+		return 0, 0, fmt.Errorf("write quorum must be between 1 and the replication factor %d, got %d", n, w)
+	}
+	if r+w <= n {
+		log.Printf("Warning: read quorum %d and write quorum %d do not overlap with replication factor %d, reads may miss acknowledged writes", r, w, n)
+	}
+	return r, w, nil
+}
+
+/*
+Returns the replicas of key: whether this node is one of them, and the
+others, which requests about the key are sent to.
+*/
+func (s *Store) replicas(key string) (bool, []string, error) {
+	nodes, err := s.preferenceList(key)
+	if err != nil {
+		return false, nil, err
+	}
+	local := false
+	others := nodes[:0:0]
+	for _, node := range nodes {
+		if s.self != "" && node == s.self {
+			local = true
+			continue
+		}
+		others = append(others, node)
+	}
+	return local, others, nil
+}
+
+/*
+Returns the distinct nodes in list without empty names and without self.
+*/
+func otherNodes(list []string, self string) []string {
+	seen := make(map[string]struct{})
+	var nodes []string
+	for _, node := range list {
+		if _, ok := seen[node]; ok || node == "" || node == self {
+			continue
+		}
+		seen[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClusterConfig(t *testing.T) {
+	t.Run("should use explicit quorums", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 3, WithQuorums(1, 3))
+		config := s.ClusterConfig()
+		assertEqual(t, config.N, 3, "N")
+		assertEqual(t, config.R, 1, "R")
+		assertEqual(t, config.W, 3, "W")
+		assertEqual(t, config.Overlapping, true, "overlapping quorums")
+	})
+
+	t.Run("should accept quorums that do not overlap", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 3, WithQuorums(1, 1))
+		assertEqual(t, s.ClusterConfig().Overlapping, false, "overlapping quorums")
+	})
+
+	t.Run("should reject invalid settings", func(t *testing.T) {
+		for _, test := range []struct {
+			name    string
+			n, r, w int
+		}{
+			{name: "N above the cluster size", n: 3},
+			{name: "zero N", n: 0},
+			{name: "R above N", n: 2, r: 3},
+			{name: "W above N", n: 2, w: 3},
+			{name: "negative W", n: 2, w: -1},
+		} {
+			s, err := NewStore([]string{"node1", "node2"}, test.n, WithQuorums(test.r, test.w))
+			if err == nil {
+				s.Close()
+				t.Errorf("%s: expected an error", test.name)
+			}
+		}
+	})
+
+	t.Run("should count this node towards the cluster size", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		assertEqual(t, s.ClusterConfig().N, 3, "N")
+	})
+
+	t.Run("should put this node on the ring", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "self", "", "node2"}, 2, WithAdvertiseAddr("self"))
+		config := s.ClusterConfig()
+		assertEqual(t, strings.Join(config.Nodes, ","), "self,node1,node2", "ring members")
+		assertEqual(t, strings.Join(s.nodes, ","), "node1,node2", "other nodes")
+	})
+
+	t.Run("should report standalone stores", func(t *testing.T) {
+		s := newTestStore(t, []string{""}, 2, WithAdvertiseAddr("self"))
+		config := s.ClusterConfig()
+		assertEqual(t, config.Standalone, true, "standalone")
+		assertEqual(t, config.N, 1, "N")
+	})
+}
+
+/*
+Returns a key that s is a replica of, or one that it is not.
+*/
+func keyFor(t *testing.T, s *Store, replica bool) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		local, _, err := s.replicas(key)
+		if err == nil && local == replica {
+			return key
+		}
+	}
+	t.Fatal("no key found")
+	return ""
+}
+
+func TestLocalReplica(t *testing.T) {
+	// Finds a key this node is a replica of, or one it is not.
+	failing := func(s *Store) *atomic.Int64 {
+		var requests atomic.Int64
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				requests.Add(1)
+				return nil, fmt.Errorf("connection refused")
+			},
+		}
+		return &requests
+	}
+
+	t.Run("should count the local copy towards the write quorum", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("self"), WithQuorums(1, 1))
+		failing(s)
+
+		assertEqual(t, s.Set(keyFor(t, s, true), []byte("1"), WriteOptions{}), nil, "write with this node as replica")
+		if err := s.Set(keyFor(t, s, false), []byte("1"), WriteOptions{}); err == nil {
+			t.Error("expected the write to fail without replicas")
+		}
+	})
+
+	t.Run("should send writes to the other replicas only", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("self"))
+		var hosts []string
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodHead {
+					return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+				}
+				hosts = append(hosts, req.URL.Host)
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+			},
+		}
+
+		assertEqual(t, s.Set(keyFor(t, s, true), []byte("1"), WriteOptions{}), nil, "write error")
+		assertEqual(t, len(hosts), 1, "replicas written to")
+		assertEqual(t, hosts[0] != "self", true, "this node is not written to remotely")
+	})
+
+	t.Run("should count the local copy towards the read quorum", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		requests := failing(s)
+		key := keyFor(t, s, true)
+		_ = s.Set(key, []byte("1"), WriteOptions{SkipReplication: true})
+
+		result, err := s.Read(key, ReadOptions{Consistency: ConsistencyOne})
+		assertEqual(t, err, nil, "read at ONE")
+		assertEqual(t, result.Answered, 1, "replicas answered")
+		assertEqual(t, requests.Load(), int64(0), "replicas asked")
+
+		if _, err := s.Read(key, ReadOptions{}); err == nil {
+			t.Error("expected a quorum read to fail with the other replicas down")
+		}
+	})
+}
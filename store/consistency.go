@@ -0,0 +1,66 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+How many replicas a request waits for before it succeeds.
+*/
+type Consistency string
+
+const (
+	// The default: the read or write quorum of replicas.
+	ConsistencyQuorum Consistency = "QUORUM"
+	// A single replica.
+	ConsistencyOne Consistency = "ONE"
+	// Every replica in the preference list of the key.
+	ConsistencyAll Consistency = "ALL"
+	// This node only. Writes are replicated in the background, and reads
+	// return the local copy.
+	ConsistencyLocal Consistency = "LOCAL"
+)
+
+/*
+Returned when fewer replicas answer a request than its consistency level
+requires.
+*/
+var ErrNotEnoughReplicas = errors.New("not enough replicas")
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch level := Consistency(strings.ToUpper(s)); level {
+	case ConsistencyQuorum, ConsistencyOne, ConsistencyAll, ConsistencyLocal:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %q (available: %s, %s, %s, %s)", s, ConsistencyOne, ConsistencyQuorum, ConsistencyAll, ConsistencyLocal)
+}
+
+/*
+The number of replicas out of nodes that must answer a request at level,
+where quorum is the quorum for the kind of request. An empty level is
+ConsistencyQuorum.
+*/
+func (level Consistency) required(nodes, quorum int) int {
+	switch level {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyAll:
+		return nodes
+	case ConsistencyLocal:
+		return 0
+	}
+	return quorum
+}
+
+/*
+Describes a failure to reach level, for the kind of request named by
+operation.
+*/
+func (level Consistency) unmet(operation string, answered int) error {
+	if level == "" || level == ConsistencyQuorum {
+		return fmt.Errorf("%w for %s quorum: %d", ErrNotEnoughReplicas, operation, answered)
+	}
+	return fmt.Errorf("%w for consistency level %s: %d", ErrNotEnoughReplicas, level, answered)
+}
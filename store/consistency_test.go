@@ -0,0 +1,106 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseConsistency(t *testing.T) {
+	level, err := ParseConsistency("quorum")
+	assertEqual(t, err, nil, "parse error")
+	assertEqual(t, level, ConsistencyQuorum, "parsed level")
+
+	if _, err := ParseConsistency("TWO"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+func TestConsistencyLevels(t *testing.T) {
+	nodes := []string{"node1", "node2", "node3"}
+	// Replicas other than those listed in up fail; the others hold no copy.
+	clusterWith := func(s *Store, up ...string) *atomic.Int64 {
+		var requests atomic.Int64
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				requests.Add(1)
+				for _, node := range up {
+					if req.URL.Host == node {
+						return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader(""))}, nil
+					}
+				}
+				return nil, fmt.Errorf("connection refused")
+			},
+		}
+		return &requests
+	}
+	// Replicas other than those listed in up fail; the others accept writes.
+	clusterUp := func(s *Store, up ...string) {
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				for _, node := range up {
+					if req.URL.Host == node {
+						return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+					}
+				}
+				return nil, fmt.Errorf("connection refused")
+			},
+		}
+	}
+
+	t.Run("should acknowledge writes at the requested level", func(t *testing.T) {
+		s := newTestStore(t, nodes, 3, WithAdvertiseAddr("node1"))
+		clusterUp(s)
+
+		assertEqual(t, s.Set("a", []byte("1"), WriteOptions{Consistency: ConsistencyOne}), nil, "write at ONE")
+		err := s.Set("a", []byte("2"), WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrNotEnoughReplicas), true, "write at QUORUM")
+		err = s.Set("a", []byte("3"), WriteOptions{Consistency: ConsistencyAll})
+		assertEqual(t, errors.Is(err, ErrNotEnoughReplicas), true, "write at ALL")
+		err = s.Delete("a", WriteOptions{Consistency: ConsistencyAll})
+		assertEqual(t, errors.Is(err, ErrNotEnoughReplicas), true, "delete at ALL")
+	})
+
+	t.Run("should acknowledge local writes without waiting for replicas", func(t *testing.T) {
+		s := newTestStore(t, nodes, 3, WithAdvertiseAddr("node1"))
+		requests := clusterWith(s)
+
+		assertEqual(t, s.Set("a", []byte("1"), WriteOptions{Consistency: ConsistencyLocal}), nil, "write at LOCAL")
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "1", "local value")
+
+		// The write is still sent to the replicas.
+		deadline := time.Now().Add(time.Second)
+		for requests.Load() < 2 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assertEqual(t, requests.Load(), int64(2), "replicated writes")
+	})
+
+	t.Run("should read at the requested level", func(t *testing.T) {
+		s := newTestStore(t, nodes, 3, WithAdvertiseAddr("node1"))
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		requests := clusterWith(s, "node2")
+		noRepair := ReadOptions{RepairChance: -1}
+
+		noRepair.Consistency = ConsistencyLocal
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read at LOCAL")
+		assertEqual(t, result.Answered, 0, "replicas answered at LOCAL")
+		assertEqual(t, requests.Load(), int64(0), "requests at LOCAL")
+
+		noRepair.Consistency = ConsistencyOne
+		result, err = s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read at ONE")
+		assertEqual(t, result.Answered, 1, "replicas answered at ONE")
+
+		noRepair.Consistency = ConsistencyAll
+		_, err = s.Read("a", noRepair)
+		assertEqual(t, errors.Is(err, ErrNotEnoughReplicas), true, "read at ALL")
+	})
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// How often an increment with RaftReplication is retried when the key
+// changes between reading it and committing the new value.
+const incrementRetries = 16
+
+// Returned for increments of keys whose value is not a decimal 64-bit
+// integer, or would no longer be one afterwards.
+var ErrNotInteger = errors.New("value is not a 64-bit integer")
+
+/*
+The value of a counter after an increment, as nodes forward it to each
+other and clients are sent it.
+*/
+type CounterValue struct {
+	Value int64 `json:"value"`
+}
+
+/*
+Adds by to the integer held by key, which may be negative, and returns the
+result. A key that does not exist counts as zero. The value is stored as
+decimal text and keeps the content type and expiry it had. Fails with
+ErrNotInteger if the value held is not an integer or the result overflows.
+
+Increments are never merged, so to keep concurrent ones from overwriting
+each other they are all applied by the same node. With eventual
+replication that is the node that owns the key: other coordinators forward
+increments to it, and it reads the key from its replicas, applies the
+increment to the newest copy holding s.mu and replicates the result like a
+PUT. An increment fails with ErrNotEnoughReplicas rather than being
+applied elsewhere while the owner is unreachable. With RaftReplication the
+new value is committed to the log on condition that the key still holds
+the version it was computed from, and computed again if it does not.
+*/
+func (s *Store) Increment(key string, by int64, opts WriteOptions) (int64, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+	if s.replicationMode == RaftReplication {
+		return s.incrementRaft(key, by)
+	}
+	if !opts.Forwarded {
+		nodes, err := s.preferenceList(key)
+		if err != nil {
+			return 0, err
+		}
+		if len(nodes) > 0 && (s.self == "" || nodes[0] != s.self) {
+			return s.forwardIncrement(nodes[0], key, by, opts)
+		}
+	}
+
+	if s.replicationFactor > 0 {
+		// Bring the local copy up to date before adding to it.
+		result, err := s.Read(key, ReadOptions{SyncRepair: true, Consistency: opts.Consistency})
+		if err != nil {
+			return 0, err
+		}
+		result.Close()
+	}
+	opts = WriteOptions{Consistency: opts.Consistency}
+	e, err := s.newEntry(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	var current int64
+	held, ok := s.conditionEntry(key)
+	if ok {
+		e.contentType, e.expires = held.contentType, held.expires
+		if held.chunks.chunked() {
+			err = fmt.Errorf("%w: key %s holds %d bytes", ErrNotInteger, key, held.chunks.size)
+		} else {
+			current, err = parseCounter(key, held.value)
+		}
+	}
+	var next int64
+	if err == nil {
+		next, err = addCounter(key, current, by)
+	}
+	if err == nil {
+		e.value = []byte(strconv.FormatInt(next, 10))
+		e, _, err = s.putLocked(key, e, opts)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.handleReplication(opts, "PUT", key, bytesSource(e.value), replicationHeader(e, opts)); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+func parseCounter(key string, value []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(bytes.TrimSpace(value)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: key %s holds %q", ErrNotInteger, key, value)
+	}
+	return n, nil
+}
+
+func addCounter(key string, n, by int64) (int64, error) {
+	sum := n + by
+	if (by > 0 && sum < n) || (by < 0 && sum > n) {
+		return 0, fmt.Errorf("%w: adding %d to %d of key %s overflows", ErrNotInteger, by, n, key)
+	}
+	return sum, nil
+}
+
+/*
+Sends an increment to node, the owner of key, to apply.
+*/
+func (s *Store) forwardIncrement(node, key string, by int64, opts WriteOptions) (int64, error) {
+	query := url.Values{"by": {strconv.FormatInt(by, 10)}}
+	if opts.Consistency != "" {
+		query.Set("consistency", string(opts.Consistency))
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/%s/incr?%s", node, key, query.Encode()), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(ReplicationHeader, "true")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: owner %s of key %s is unreachable: %v", ErrNotEnoughReplicas, node, key, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var counter CounterValue
+		if err := json.NewDecoder(resp.Body).Decode(&counter); err != nil {
+			return 0, fmt.Errorf("invalid response from %s: %w", node, err)
+		}
+		return counter.Value, nil
+	case http.StatusConflict:
+		return 0, fmt.Errorf("%w: %s", ErrKeyLocked, key)
+	case http.StatusInsufficientStorage:
+		return 0, ErrOutOfMemory
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusUnprocessableEntity:
+		return 0, fmt.Errorf("%w: %s answered %s", ErrNotInteger, node, bytes.TrimSpace(message))
+	case http.StatusServiceUnavailable:
+		return 0, fmt.Errorf("%w: %s answered %s", ErrNotEnoughReplicas, node, bytes.TrimSpace(message))
+	}
+	return 0, fmt.Errorf("%s answered with status code %d: %s", node, resp.StatusCode, bytes.TrimSpace(message))
+}
+
+/*
+Reads key from the leader of its group and commits the incremented value
+on condition that the key still holds the version read, retrying up to
+incrementRetries times while other writes get in between.
+*/
+func (s *Store) incrementRaft(key string, by int64) (int64, error) {
+	var err error
+	for attempt := 0; attempt <= incrementRetries; attempt++ {
+		var next int64
+		if next, err = s.tryIncrementRaft(key, by); !errors.Is(err, ErrPreconditionFailed) {
+			return next, err
+		}
+	}
+	return 0, fmt.Errorf("key %s kept changing during the increment: %w", key, err)
+}
+
+func (s *Store) tryIncrementRaft(key string, by int64) (int64, error) {
+	result, err := s.readRaft(key, false)
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	cmd := raftCommand{Op: raftOpSet, Key: key, Modified: s.now().UnixNano(), Condition: Condition{IfNoneMatch: true}}
+	if result.Found {
+		value, err := io.ReadAll(io.LimitReader(result.Value, 64))
+		if err != nil {
+			return 0, err
+		}
+		if current, err = parseCounter(key, value); err != nil {
+			return 0, err
+		}
+		cmd.ContentType, cmd.Expires = result.Item.ContentType, result.Item.Expires
+		cmd.Condition = Condition{IfMatch: result.Item.Version}
+	}
+	next, err := addCounter(key, current, by)
+	if err != nil {
+		return 0, err
+	}
+	cmd.Value = []byte(strconv.FormatInt(next, 10))
+	if err := s.writeRaft(key, cmd); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
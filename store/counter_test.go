@@ -0,0 +1,143 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	increment := func(t *testing.T, s *Store, key string, by, want int64) {
+		t.Helper()
+		got, err := s.Increment(key, by, WriteOptions{})
+		if err != nil {
+			t.Fatalf("failed to increment %s by %d: %v", key, by, err)
+		}
+		assertEqual(t, got, want, "value of "+key)
+	}
+
+	t.Run("should add to integers and count missing keys as zero", func(t *testing.T) {
+		s := newTestStore(t, nil, 0)
+		increment(t, s, "hits", 1, 1)
+		increment(t, s, "hits", 41, 42)
+		increment(t, s, "hits", -50, -8)
+		value, _ := s.Get("hits")
+		assertEqual(t, string(value), "-8", "stored value")
+
+		_ = s.Set("spaced", []byte(" 7\n"), WriteOptions{})
+		increment(t, s, "spaced", 1, 8)
+	})
+
+	t.Run("should keep the content type and expiry of the value", func(t *testing.T) {
+		s := newTestStore(t, nil, 0)
+		_ = s.Set("hits", []byte("1"), WriteOptions{ContentType: "text/plain", TTL: time.Hour})
+		before, _ := s.Lookup("hits")
+		increment(t, s, "hits", 1, 2)
+		after, _ := s.Lookup("hits")
+		assertEqual(t, after.ContentType, "text/plain", "content type")
+		assertEqual(t, after.Expires, before.Expires, "expiry")
+		assertEqual(t, after.Version > before.Version, true, "version grew")
+	})
+
+	t.Run("should reject values that are not integers", func(t *testing.T) {
+		s := newTestStore(t, nil, 0)
+		_ = s.Set("name", []byte("abc"), WriteOptions{})
+		_, err := s.Increment("name", 1, WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrNotInteger), true, "text rejected")
+		value, _ := s.Get("name")
+		assertEqual(t, string(value), "abc", "value after the rejected increment")
+
+		_ = s.Set("big", []byte(strconv.FormatInt(math.MaxInt64, 10)), WriteOptions{})
+		_, err = s.Increment("big", 1, WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrNotInteger), true, "overflow rejected")
+		_ = s.Set("small", []byte(strconv.FormatInt(math.MinInt64, 10)), WriteOptions{})
+		_, err = s.Increment("small", -1, WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrNotInteger), true, "underflow rejected")
+	})
+
+	t.Run("should not lose concurrent increments", func(t *testing.T) {
+		s := newTestStore(t, nil, 0)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := s.Increment("hits", 2, WriteOptions{}); err != nil {
+					t.Errorf("failed to increment: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		value, _ := s.Get("hits")
+		assertEqual(t, string(value), "100", "value after concurrent increments")
+	})
+
+	t.Run("should apply increments from every coordinator on the owner", func(t *testing.T) {
+		c := newTxnCluster(t)
+		key := c.keyOn("node2", "hits")
+		seen := make(map[int64]bool)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, node := range []string{"node1", "node2", "node3"} {
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(s *Store) {
+					defer wg.Done()
+					value, err := s.Increment(key, 1, WriteOptions{})
+					if err != nil {
+						t.Errorf("failed to increment: %v", err)
+						return
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if seen[value] {
+						t.Errorf("two increments returned %d", value)
+					}
+					seen[value] = true
+				}(c.stores[node])
+			}
+		}
+		wg.Wait()
+		c.assertValue("node2", key, "30")
+		c.assertValue("node1", key, "")
+
+		_ = c.stores["node2"].Set(key, []byte("abc"), WriteOptions{})
+		_, err := c.stores["node1"].Increment(key, 1, WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrNotInteger), true, "forwarded increment of text rejected")
+
+		c.setDown("node2", true)
+		_, err = c.stores["node1"].Increment(key, 1, WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrNotEnoughReplicas), true, "increment without the owner failed")
+	})
+
+	t.Run("should not increment keys locked by a transaction", func(t *testing.T) {
+		s := newTestStore(t, nil, 0)
+		if err := s.PrepareTxn(TxnPrepare{ID: "t1", Ops: []TxnOp{{Type: TxnPut, Key: "hits", Value: []byte("5")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+		_, err := s.Increment("hits", 1, WriteOptions{})
+		assertEqual(t, errors.Is(err, ErrKeyLocked), true, "locked key rejected")
+	})
+
+	t.Run("should not lose concurrent increments with raft replication", func(t *testing.T) {
+		c := newRaftCluster(t)
+		c.leader("hits")
+		var wg sync.WaitGroup
+		for _, node := range c.nodes {
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(s *Store) {
+					defer wg.Done()
+					if _, err := s.Increment("hits", 1, WriteOptions{}); err != nil {
+						t.Errorf("failed to increment: %v", err)
+					}
+				}(c.stores[node])
+			}
+		}
+		wg.Wait()
+		c.awaitValue("hits", []byte("9"))
+	})
+}
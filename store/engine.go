@@ -0,0 +1,122 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultEngine  = "memory"
+	engineFileName = "ENGINE"
+)
+
+var ErrSnapshotUnsupported = errors.New("engine does not support snapshots")
+
+/*
+A storage engine holds the local keyspace of a node. Store serializes all
+mutations and logs them before they reach the engine, but engines must
+still be safe for concurrent use since reads are not serialized.
+Iterate visits the keys in [start, end) in ascending order; an empty end
+means no upper bound.
+*/
+type Engine interface {
+	Get(key string) ([]byte, bool, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Iterate(start, end string, fn func(key string, value []byte) bool) error
+	Close() error
+	Stats() EngineStats
+}
+
+type EngineStats struct {
+	Name    string           `json:"name"`
+	Keys    int64            `json:"keys"`
+	Bytes   int64            `json:"bytes"`
+	Metrics map[string]int64 `json:"metrics,omitempty"`
+}
+
+/*
+Implemented by engines that can hand out a consistent, read-only view of
+their contents without blocking writers for as long as the view is open.
+*/
+type Snapshotter interface {
+	Snapshot() (EngineSnapshot, error)
+}
+
+/*
+Implemented by engines that keep their own files. Instead of writing a copy
+of the keyspace, a snapshot of such an engine flushes its buffered writes
+so that the write-ahead log up to that point is no longer needed.
+*/
+type Flusher interface {
+	Flush() error
+}
+
+type EngineSnapshot interface {
+	Len() int
+	Iterate(fn func(key string, value []byte) bool) error
+	Release()
+}
+
+type engineFactory func(dir string) (Engine, error)
+
+var engines = map[string]engineFactory{
+	"memory": func(string) (Engine, error) { return newMemoryEngine(), nil },
+	"lsm":    newLSMEngine,
+}
+
+/*
+Returns the names of all available engines, sorted.
+*/
+func Engines() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Creates the named engine. Engines that keep files of their own store them
+below dir.
+*/
+func newEngine(name, dir string) (Engine, error) {
+	factory, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %q (available: %s)", name, strings.Join(Engines(), ", "))
+	}
+	return factory(dir)
+}
+
+/*
+Records which engine a data directory was created with and refuses to open
+it with a different one, since the files written by one engine are
+meaningless to another.
+*/
+func checkEngineFile(dir, name string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(dir, engineFileName)
+	existing, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if err := os.WriteFile(path, []byte(name+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to record engine: %w", err)
+		}
+		return syncDir(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read engine file: %w", err)
+	}
+
+	if recorded := strings.TrimSpace(string(existing)); recorded != name {
+		return fmt.Errorf("data directory %s was created with engine %q, not %q", dir, recorded, name)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Runs the behaviour every engine must share against a fresh engine.
+*/
+func testEngine(t *testing.T, newEngine func(t *testing.T) Engine) {
+	t.Run("should put, get and delete keys", func(t *testing.T) {
+		e := newEngine(t)
+		defer e.Close()
+
+		_ = e.Put("a", []byte("1"))
+		_ = e.Put("b", []byte("2"))
+		_ = e.Put("a", []byte("3"))
+
+		value, ok, err := e.Get("a")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, ok, true, "key existence")
+		assertEqual(t, string(value), "3", "overwritten value")
+
+		_ = e.Delete("a")
+		_, ok, _ = e.Get("a")
+		assertEqual(t, ok, false, "deleted key")
+	})
+
+	t.Run("should iterate over keys in order", func(t *testing.T) {
+		e := newEngine(t)
+		defer e.Close()
+
+		for _, key := range []string{"d", "c", "a", "b"} {
+			_ = e.Put(key, []byte(strings.ToUpper(key)))
+		}
+		_ = e.Delete("b")
+
+		iterate := func(start, end string) string {
+			var keys []string
+			err := e.Iterate(start, end, func(key string, value []byte) bool {
+				assertEqual(t, string(value), strings.ToUpper(key), "iterated value")
+				keys = append(keys, key)
+				return true
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			return strings.Join(keys, ",")
+		}
+		assertEqual(t, iterate("", ""), "a,c,d", "all keys")
+		assertEqual(t, iterate("b", "d"), "c", "bounded range")
+		assertEqual(t, iterate("c", ""), "c,d", "open-ended range")
+	})
+
+	t.Run("should keep snapshots isolated from later writes", func(t *testing.T) {
+		e := newEngine(t)
+		defer e.Close()
+
+		snapshotter, ok := e.(Snapshotter)
+		if !ok {
+			t.Skip("engine does not support snapshots")
+		}
+
+		_ = e.Put("a", []byte("1"))
+		_ = e.Put("b", []byte("2"))
+		snap, err := snapshotter.Snapshot()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		_ = e.Put("a", []byte("3"))
+		_ = e.Delete("b")
+		_ = e.Put("c", []byte("4"))
+
+		value, _, _ := e.Get("a")
+		assertEqual(t, string(value), "3", "live value during snapshot")
+		_, ok, _ = e.Get("b")
+		assertEqual(t, ok, false, "live delete during snapshot")
+
+		seen := make(map[string]string)
+		_ = snap.Iterate(func(key string, value []byte) bool {
+			seen[key] = string(value)
+			return true
+		})
+		assertEqual(t, snap.Len(), 2, "snapshot length")
+		assertEqual(t, seen["a"], "1", "snapshot value")
+		assertEqual(t, seen["b"], "2", "snapshot keeps deleted key")
+		snap.Release()
+
+		value, _, _ = e.Get("c")
+		assertEqual(t, string(value), "4", "value written during snapshot")
+		assertEqual(t, e.Stats().Keys, int64(2), "key count after release")
+	})
+}
+
+func TestMemoryEngine(t *testing.T) {
+	testEngine(t, func(t *testing.T) Engine {
+		return newMemoryEngine()
+	})
+
+	t.Run("should account for keys and bytes", func(t *testing.T) {
+		e := newMemoryEngine()
+		_ = e.Put("a", []byte("1"))
+		_ = e.Put("bb", []byte("22"))
+		_ = e.Put("a", []byte("333"))
+		_ = e.Delete("bb")
+		_ = e.Delete("missing")
+
+		stats := e.Stats()
+		assertEqual(t, stats.Keys, int64(1), "key count")
+		assertEqual(t, stats.Bytes, int64(4), "byte count")
+	})
+}
+
+func TestLSMEngine(t *testing.T) {
+	testEngine(t, func(t *testing.T) Engine {
+		e, err := newLSMEngine(t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to open lsm engine: %v", err)
+		}
+		return e
+	})
+
+	t.Run("should require a data directory", func(t *testing.T) {
+		if _, err := newLSMEngine(""); err == nil {
+			t.Errorf("expected an error without a data directory")
+		}
+	})
+}
+
+func TestNewEngine(t *testing.T) {
+	t.Run("should reject an unknown engine", func(t *testing.T) {
+		_, err := NewStore([]string{"node1"}, 1, WithEngine("papyrus"))
+		if err == nil || !strings.Contains(err.Error(), "unknown engine") {
+			t.Errorf("expected an unknown engine error, got %v", err)
+		}
+	})
+
+	t.Run("should refuse a data directory created by another engine", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := checkEngineFile(dir, "memory"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := checkEngineFile(dir, "other"); err == nil {
+			t.Errorf("expected an error when reopening with another engine")
+		}
+	})
+}
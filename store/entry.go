@@ -0,0 +1,252 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	entryHasExpiry byte = 1 << iota
+	entryHasContentType
+	entryChunked
+	entryHasVersion
+	entryHasClock
+	entryHasSiblings
+	entryHasStamp
+	entryTombstone
+)
+
+var errCorruptEntry = errors.New("corrupt entry")
+
+/*
+A value together with the metadata of the write that produced it. Entries
+are what the store logs and hands to the engine.
+
+Layout:
+
+	| flags (1 byte) | modified (uvarint) | [version (uvarint)] | [expires (uvarint)] | [content type] | [stamp] | [clock] | [siblings] | [chunks] | value |
+
+modified is the time of the write in Unix nanoseconds as seen by the node
+that coordinated it. version counts the writes of the key and is what
+conditional writes are checked against. expires, present if its flag is set, is the time at
+which the entry stops being visible. The content type, present if its flag
+is set, is the media type the value was written with, prefixed by its
+length as a uvarint. The stamp, present if its flag is set, completes
+modified to the hybrid logical clock timestamp of the write with its
+logical counter and the length-prefixed ID of its node. The clock, present if its flag is set, is the causal
+context the write was based on followed by the dot that identifies the
+write. Values written concurrently with this one are kept as siblings,
+encoded as a count followed by each sibling as a length-prefixed entry.
+Large values are stored in chunks under separate keys;
+their entries carry the id, total size and chunk size of the chunks as
+uvarints instead of a value. A tombstone, flagged as such, records a delete
+with the metadata of a write and no value.
+*/
+type entry struct {
+	value       []byte
+	contentType string
+	modified    int64
+	logical     uint32
+	origin      string
+	expires     int64
+	version     uint64
+	context     VectorClock
+	dot         Dot
+	siblings    []entry
+	chunks      chunkRef
+	tombstone   bool
+}
+
+func (e entry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+/*
+The size of the value, whether it is stored inline or in chunks.
+*/
+func (e entry) size() int64 {
+	if e.chunks.chunked() {
+		return e.chunks.size
+	}
+	return int64(len(e.value))
+}
+
+func (e entry) encode() []byte {
+	buf := make([]byte, 0, 1+9*binary.MaxVarintLen64+len(e.contentType)+len(e.origin)+len(e.value))
+	var flags byte
+	if e.expires != 0 {
+		flags |= entryHasExpiry
+	}
+	if e.contentType != "" {
+		flags |= entryHasContentType
+	}
+	if e.chunks.chunked() {
+		flags |= entryChunked
+	}
+	if e.version != 0 {
+		flags |= entryHasVersion
+	}
+	if e.origin != "" {
+		flags |= entryHasStamp
+	}
+	if e.dot.Counter != 0 {
+		flags |= entryHasClock
+	}
+	if len(e.siblings) > 0 {
+		flags |= entryHasSiblings
+	}
+	if e.tombstone {
+		flags |= entryTombstone
+	}
+	buf = append(buf, flags)
+	buf = binary.AppendUvarint(buf, uint64(e.modified))
+	if e.version != 0 {
+		buf = binary.AppendUvarint(buf, e.version)
+	}
+	if e.expires != 0 {
+		buf = binary.AppendUvarint(buf, uint64(e.expires))
+	}
+	if e.contentType != "" {
+		buf = binary.AppendUvarint(buf, uint64(len(e.contentType)))
+		buf = append(buf, e.contentType...)
+	}
+	if e.origin != "" {
+		buf = binary.AppendUvarint(buf, uint64(e.logical))
+		buf = binary.AppendUvarint(buf, uint64(len(e.origin)))
+		buf = append(buf, e.origin...)
+	}
+	if e.dot.Counter != 0 {
+		buf = appendClock(buf, e.context)
+		buf = binary.AppendUvarint(buf, uint64(len(e.dot.Node)))
+		buf = append(buf, e.dot.Node...)
+		buf = binary.AppendUvarint(buf, e.dot.Counter)
+	}
+	if len(e.siblings) > 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(e.siblings)))
+		for _, sibling := range e.siblings {
+			encoded := sibling.encode()
+			buf = binary.AppendUvarint(buf, uint64(len(encoded)))
+			buf = append(buf, encoded...)
+		}
+	}
+	if e.chunks.chunked() {
+		buf = binary.AppendUvarint(buf, e.chunks.id)
+		buf = binary.AppendUvarint(buf, uint64(e.chunks.size))
+		buf = binary.AppendUvarint(buf, uint64(e.chunks.chunkSize))
+		return buf
+	}
+	return append(buf, e.value...)
+}
+
+/*
+Decodes an entry. The value aliases buf.
+*/
+func decodeEntry(buf []byte) (entry, error) {
+	if len(buf) < 2 {
+		return entry{}, errCorruptEntry
+	}
+	flags := buf[0]
+	buf = buf[1:]
+
+	e := entry{tombstone: flags&entryTombstone != 0}
+	modified, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return entry{}, errCorruptEntry
+	}
+	e.modified = int64(modified)
+	buf = buf[n:]
+
+	if flags&entryHasVersion != 0 {
+		version, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return entry{}, errCorruptEntry
+		}
+		e.version = version
+		buf = buf[n:]
+	}
+
+	if flags&entryHasExpiry != 0 {
+		expires, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return entry{}, errCorruptEntry
+		}
+		e.expires = int64(expires)
+		buf = buf[n:]
+	}
+	if flags&entryHasContentType != 0 {
+		length, n := binary.Uvarint(buf)
+		if n <= 0 || length > uint64(len(buf)-n) {
+			return entry{}, errCorruptEntry
+		}
+		e.contentType = string(buf[n : n+int(length)])
+		buf = buf[n+int(length):]
+	}
+	if flags&entryHasStamp != 0 {
+		logical, n := binary.Uvarint(buf)
+		if n <= 0 || logical > 1<<32-1 {
+			return entry{}, errCorruptEntry
+		}
+		e.logical = uint32(logical)
+		buf = buf[n:]
+		length, n := binary.Uvarint(buf)
+		if n <= 0 || length > uint64(len(buf)-n) {
+			return entry{}, errCorruptEntry
+		}
+		e.origin = string(buf[n : n+int(length)])
+		buf = buf[n+int(length):]
+	}
+	if flags&entryHasClock != 0 {
+		var err error
+		if e.context, buf, err = decodeClock(buf); err != nil {
+			return entry{}, err
+		}
+		length, n := binary.Uvarint(buf)
+		if n <= 0 || length > uint64(len(buf)-n) {
+			return entry{}, errCorruptEntry
+		}
+		e.dot.Node = string(buf[n : n+int(length)])
+		buf = buf[n+int(length):]
+		if e.dot.Counter, n = binary.Uvarint(buf); n <= 0 {
+			return entry{}, errCorruptEntry
+		}
+		buf = buf[n:]
+	}
+	if flags&entryHasSiblings != 0 {
+		count, n := binary.Uvarint(buf)
+		if n <= 0 || count > uint64(len(buf)) {
+			return entry{}, errCorruptEntry
+		}
+		buf = buf[n:]
+		e.siblings = make([]entry, count)
+		for i := range e.siblings {
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || length > uint64(len(buf)-n) {
+				return entry{}, errCorruptEntry
+			}
+			sibling, err := decodeEntry(buf[n : n+int(length)])
+			if err != nil {
+				return entry{}, err
+			}
+			e.siblings[i] = sibling
+			buf = buf[n+int(length):]
+		}
+	}
+	if flags&entryChunked != 0 {
+		var fields [3]uint64
+		for i := range fields {
+			field, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return entry{}, errCorruptEntry
+			}
+			fields[i] = field
+			buf = buf[n:]
+		}
+		e.chunks = chunkRef{id: fields[0], size: int64(fields[1]), chunkSize: int64(fields[2])}
+		if e.chunks.chunkSize <= 0 {
+			return entry{}, errCorruptEntry
+		}
+		return e, nil
+	}
+	e.value = buf
+	return e, nil
+}
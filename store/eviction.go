@@ -0,0 +1,363 @@
+package store
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type EvictionPolicy string
+
+const (
+	// Rejects writes that would exceed the memory limit.
+	NoEviction EvictionPolicy = "noeviction"
+	// Evicts the least recently used key.
+	AllKeysLRU EvictionPolicy = "allkeys-lru"
+	// Evicts the least frequently used key.
+	AllKeysLFU EvictionPolicy = "allkeys-lfu"
+	// Evicts the key with a TTL that expires soonest.
+	VolatileTTL EvictionPolicy = "volatile-ttl"
+)
+
+/*
+Estimated memory used per key beyond its key and encoded entry: the engine's
+node or map slot plus the bookkeeping of the limiter itself.
+*/
+const entryOverhead = 96
+
+var ErrOutOfMemory = errors.New("memory limit reached")
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(s); policy {
+	case NoEviction, AllKeysLRU, AllKeysLFU, VolatileTTL:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown eviction policy %q (available: %s, %s, %s, %s)", s, NoEviction, AllKeysLRU, AllKeysLFU, VolatileTTL)
+}
+
+/*
+Parses a memory size such as 512MB or 2GB into bytes. Units are powers of
+1024; a plain number is a number of bytes.
+*/
+func ParseMemorySize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+func entrySize(key string, encoded int) int64 {
+	return int64(len(key) + encoded + entryOverhead)
+}
+
+type trackedKey struct {
+	key     string
+	size    int64
+	expires int64
+	hits    uint64
+	lastHit uint64
+	elem    *list.Element
+	index   int
+}
+
+/*
+Orders the tracked keys by how good a candidate for eviction they are.
+*/
+type evictionIndex interface {
+	add(k *trackedKey)
+	update(k *trackedKey)
+	remove(k *trackedKey)
+	victim() *trackedKey
+}
+
+/*
+Keeps the size of every key and enforces a budget on their total by
+picking keys to evict according to the configured policy. Store holds s.mu
+while it changes the set of keys; reads only record accesses.
+*/
+type memoryLimiter struct {
+	mu     sync.Mutex
+	max    int64
+	used   int64
+	policy EvictionPolicy
+	keys   map[string]*trackedKey
+	index  evictionIndex
+	clock  uint64
+}
+
+func newMemoryLimiter(max int64, policy EvictionPolicy) *memoryLimiter {
+	l := &memoryLimiter{
+		max:    max,
+		policy: policy,
+		keys:   make(map[string]*trackedKey),
+	}
+	switch policy {
+	case AllKeysLRU:
+		l.index = &lruIndex{list: list.New()}
+	case AllKeysLFU:
+		l.index = &heapIndex{less: func(a, b *trackedKey) bool {
+			if a.hits != b.hits {
+				return a.hits < b.hits
+			}
+			return a.lastHit < b.lastHit
+		}}
+	case VolatileTTL:
+		l.index = &heapIndex{less: func(a, b *trackedKey) bool {
+			return a.expires < b.expires
+		}}
+	}
+	return l
+}
+
+/*
+Reports whether the policy considers k for eviction at all.
+*/
+func (l *memoryLimiter) indexed(k *trackedKey) bool {
+	return l.index != nil && (l.policy != VolatileTTL || k.expires != 0)
+}
+
+/*
+Records that key now holds an entry of the given size.
+*/
+func (l *memoryLimiter) track(key string, size, expires int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k, ok := l.keys[key]
+	if !ok {
+		k = &trackedKey{key: key, index: -1}
+		l.keys[key] = k
+	}
+	wasIndexed := ok && l.indexed(k)
+
+	l.clock++
+	l.used += size - k.size
+	k.size = size
+	k.expires = expires
+	k.hits++
+	k.lastHit = l.clock
+
+	switch isIndexed := l.indexed(k); {
+	case wasIndexed && isIndexed:
+		l.index.update(k)
+	case wasIndexed:
+		l.index.remove(k)
+	case isIndexed:
+		l.index.add(k)
+	}
+}
+
+func (l *memoryLimiter) untrack(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k, ok := l.keys[key]
+	if !ok {
+		return
+	}
+	l.used -= k.size
+	delete(l.keys, key)
+	if l.indexed(k) {
+		l.index.remove(k)
+	}
+}
+
+/*
+Records a read of key.
+*/
+func (l *memoryLimiter) touch(key string) {
+	if l == nil || (l.policy != AllKeysLRU && l.policy != AllKeysLFU) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if k, ok := l.keys[key]; ok {
+		l.clock++
+		k.hits++
+		k.lastHit = l.clock
+		l.index.update(k)
+	}
+}
+
+/*
+Reports whether writing an entry of the given size to key fits into the
+budget, and if not, which key should be evicted to make room. An error is
+returned if nothing can be evicted.
+*/
+func (l *memoryLimiter) makeRoom(key string, size int64) (string, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if size > l.max {
+		return "", false, ErrOutOfMemory
+	}
+	used := l.used + size
+	if k, ok := l.keys[key]; ok {
+		used -= k.size
+	}
+	if used <= l.max {
+		return "", true, nil
+	}
+	if l.index == nil {
+		return "", false, ErrOutOfMemory
+	}
+	victim := l.index.victim()
+	if victim == nil {
+		return "", false, ErrOutOfMemory
+	}
+	return victim.key, false, nil
+}
+
+func (l *memoryLimiter) stats(metrics map[string]int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	metrics["max_memory"] = l.max
+	metrics["used_memory"] = l.used
+}
+
+/*
+Starts enforcing a memory limit, accounting for the keys already in the
+engine.
+*/
+func (s *Store) startLimiter(max int64, policy EvictionPolicy) error {
+	l := newMemoryLimiter(max, policy)
+	err := s.engine.Iterate(PrefixEnd(internalKeyPrefix), "", func(key string, buf []byte) bool {
+		if e, err := decodeEntry(buf); err == nil {
+			l.track(key, entrySize(key, len(buf))+e.chunkedSize(), e.lastExpiry())
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to account for existing keys: %w", err)
+	}
+	s.limiter = l
+	return nil
+}
+
+/*
+Evicts keys until an entry of the given size can be written to key. The
+caller must hold s.mu. Evictions are local to this node and are not
+replicated.
+*/
+func (s *Store) makeRoom(key string, size int64) error {
+	if s.limiter == nil {
+		return nil
+	}
+	for {
+		victim, fits, err := s.limiter.makeRoom(key, size)
+		if err != nil || fits {
+			return err
+		}
+		if err := s.remove(victim); err != nil {
+			return err
+		}
+		s.evictedKeys.Add(1)
+	}
+}
+
+type lruIndex struct {
+	list *list.List
+}
+
+func (i *lruIndex) add(k *trackedKey) {
+	k.elem = i.list.PushFront(k)
+}
+
+func (i *lruIndex) update(k *trackedKey) {
+	i.list.MoveToFront(k.elem)
+}
+
+func (i *lruIndex) remove(k *trackedKey) {
+	i.list.Remove(k.elem)
+	k.elem = nil
+}
+
+func (i *lruIndex) victim() *trackedKey {
+	if back := i.list.Back(); back != nil {
+		return back.Value.(*trackedKey)
+	}
+	return nil
+}
+
+/*
+A min-heap of keys under an arbitrary order, used for the policies that
+evict by access count or expiry.
+*/
+type heapIndex struct {
+	keys []*trackedKey
+	less func(a, b *trackedKey) bool
+}
+
+func (h *heapIndex) Len() int           { return len(h.keys) }
+func (h *heapIndex) Less(i, j int) bool { return h.less(h.keys[i], h.keys[j]) }
+
+func (h *heapIndex) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.keys[i].index = i
+	h.keys[j].index = j
+}
+
+func (h *heapIndex) Push(x any) {
+	k := x.(*trackedKey)
+	k.index = len(h.keys)
+	h.keys = append(h.keys, k)
+}
+
+func (h *heapIndex) Pop() any {
+	k := h.keys[len(h.keys)-1]
+	h.keys[len(h.keys)-1] = nil
+	h.keys = h.keys[:len(h.keys)-1]
+	k.index = -1
+	return k
+}
+
+func (h *heapIndex) add(k *trackedKey) {
+	heap.Push(h, k)
+}
+
+func (h *heapIndex) update(k *trackedKey) {
+	heap.Fix(h, k.index)
+}
+
+func (h *heapIndex) remove(k *trackedKey) {
+	heap.Remove(h, k.index)
+}
+
+func (h *heapIndex) victim() *trackedKey {
+	if len(h.keys) == 0 {
+		return nil
+	}
+	return h.keys[0]
+}
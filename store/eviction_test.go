@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEviction(t *testing.T) {
+	// Every entry written below takes 101 bytes: a one-byte key, a four-byte
+	// encoded entry and the fixed overhead.
+	write := WriteOptions{SkipReplication: true, Timestamp: 1}
+	const budget = 303
+
+	newLimitedStore := func(t *testing.T, policy EvictionPolicy) *Store {
+		s := newTestStore(t, []string{"node1"}, 1, WithMaxMemory(budget, policy), WithReapInterval(0))
+		for _, key := range []string{"a", "b", "c"} {
+			if err := s.Set(key, []byte("1"), write); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return s
+	}
+	exists := func(s *Store, key string) bool {
+		_, ok, err := s.engine.Get(key)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return ok
+	}
+
+	t.Run("should account for every entry", func(t *testing.T) {
+		s := newLimitedStore(t, NoEviction)
+		assertEqual(t, s.Stats().Metrics["used_memory"], int64(303), "used memory")
+
+		_ = s.Set("a", []byte("22"), write)
+		assertEqual(t, s.Stats().Metrics["used_memory"], int64(303), "used memory after a rejected overwrite")
+		_ = s.Delete("b", WriteOptions{SkipReplication: true})
+		_ = s.Set("a", []byte("22"), write)
+		assertEqual(t, s.Stats().Metrics["used_memory"], int64(203), "used memory after delete and overwrite")
+	})
+
+	t.Run("should reject writes without eviction", func(t *testing.T) {
+		s := newLimitedStore(t, NoEviction)
+		err := s.Set("d", []byte("1"), write)
+		assertEqual(t, errors.Is(err, ErrOutOfMemory), true, "out of memory error")
+		assertEqual(t, exists(s, "d"), false, "rejected key")
+
+		// Overwriting with a value of the same size still fits.
+		assertEqual(t, s.Set("a", []byte("2"), write), nil, "overwrite")
+	})
+
+	t.Run("should evict the least recently used key", func(t *testing.T) {
+		s := newLimitedStore(t, AllKeysLRU)
+		s.Get("a")
+		_ = s.Set("d", []byte("1"), write)
+		assertEqual(t, exists(s, "b"), false, "least recently used key")
+		assertEqual(t, exists(s, "a"), true, "recently read key")
+		assertEqual(t, s.Stats().Metrics["evicted_keys"], int64(1), "evicted keys")
+	})
+
+	t.Run("should evict the least frequently used key", func(t *testing.T) {
+		s := newLimitedStore(t, AllKeysLFU)
+		s.Get("a")
+		s.Get("a")
+		s.Get("b")
+		s.Get("c")
+		s.Get("c")
+		_ = s.Set("d", []byte("1"), write)
+		assertEqual(t, exists(s, "b"), false, "least frequently used key")
+		assertEqual(t, exists(s, "a") && exists(s, "c"), true, "frequently used keys")
+	})
+
+	t.Run("should evict the key that expires first", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1, WithMaxMemory(budget, VolatileTTL), WithReapInterval(0))
+		_ = s.Set("a", []byte("1"), write)
+		_ = s.Set("c", []byte("1"), WriteOptions{SkipReplication: true, Timestamp: 1, Expires: 2})
+		assertEqual(t, exists(s, "c"), true, "expiring key")
+
+		// The expiry takes one more byte, so the next key does not fit.
+		err := s.Set("b", []byte("1"), write)
+		assertEqual(t, err, nil, "write after evicting the expiring key")
+		assertEqual(t, exists(s, "c"), false, "evicted expiring key")
+
+		_ = s.Set("d", []byte("1"), write)
+		err = s.Set("e", []byte("1"), write)
+		assertEqual(t, errors.Is(err, ErrOutOfMemory), true, "nothing left to evict")
+	})
+
+	t.Run("should reject values larger than the budget", func(t *testing.T) {
+		s := newLimitedStore(t, AllKeysLRU)
+		err := s.Set("big", make([]byte, budget), write)
+		assertEqual(t, errors.Is(err, ErrOutOfMemory), true, "oversized value")
+		assertEqual(t, exists(s, "a"), true, "nothing evicted for an oversized value")
+	})
+
+	t.Run("should account for recovered keys", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithDataDir(dir))
+		_ = s.Set("a", []byte("1"), write)
+		_ = s.Set("b", []byte("1"), write)
+		s.Close()
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir), WithMaxMemory(budget, NoEviction))
+		assertEqual(t, s.Stats().Metrics["used_memory"], int64(202), "used memory after restart")
+	})
+}
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "0", want: 0},
+		{input: "1024", want: 1024},
+		{input: "64KB", want: 64 << 10},
+		{input: "512mb", want: 512 << 20},
+		{input: "2 GB", want: 2 << 30},
+		{input: "lots", wantErr: true},
+		{input: "-1MB", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseMemorySize(test.input)
+		assertEqual(t, err != nil, test.wantErr, "error for "+test.input)
+		assertEqual(t, got, test.want, "size of "+test.input)
+	}
+
+	if _, err := ParseEvictionPolicy("random"); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+}
@@ -51,6 +51,7 @@ func (s *Store) checkNode(node string, wg *sync.WaitGroup) {
 		if !s.ringManager.HasNode(node) {
 			s.ringManager.AddNode(node)
 			log.Printf("Node %s has recovered and is added again", node)
+			s.notifyHandoff(node)
 		} else {
 			log.Printf("Node %s is up", node)
 		}
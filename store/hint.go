@@ -0,0 +1,337 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Hints are kept under their own internal keys, grouped by the node they are
+meant for and ordered by the time they were stored.
+*/
+const hintKeyPrefix = internalKeyPrefix + "hint\x00"
+
+const (
+	// How long a hint is kept for a node that does not come back. Older
+	// hints are dropped; the node catches up through read repair.
+	DefaultHintMaxAge = 3 * time.Hour
+	// How many bytes of hints a node holds for all other nodes together.
+	DefaultHintMaxSize = 64 << 20
+	// How often hints are handed off to nodes that are up.
+	hintInterval = 10 * time.Second
+)
+
+/*
+Returned when a node is asked to hold a hint it has no room for.
+*/
+var ErrHintsFull = errors.New("hint storage is full")
+
+/*
+The headers of a forwarded write that are kept with a hint and sent along
+when it is handed off.
+*/
+var hintHeaders = []string{
+	VersionHeader, ConditionalHeader, ContextHeader, DotHeader, HLCHeader,
+	TimestampHeader, ExpiresHeader, "Content-Type",
+}
+
+/*
+A write held by this node for a replica that could not take it.
+*/
+type hint struct {
+	method string
+	header http.Header
+	value  []byte
+}
+
+var hintSeq atomic.Uint64
+
+func hintKey(owner string, created int64, key string) string {
+	return fmt.Sprintf("%s%s\x00%016x%016x\x00%s", hintKeyPrefix, owner, created, hintSeq.Add(1), key)
+}
+
+func hintOwnerPrefix(owner string) string {
+	return hintKeyPrefix + owner + "\x00"
+}
+
+/*
+Returns the node a hint is meant for, when it was stored and the key it
+writes.
+*/
+func parseHintKey(k string) (owner string, created int64, key string, ok bool) {
+	if !strings.HasPrefix(k, hintKeyPrefix) {
+		return "", 0, "", false
+	}
+	owner, rest, ok := strings.Cut(k[len(hintKeyPrefix):], "\x00")
+	if !ok || len(rest) < 33 || rest[32] != 0 {
+		return "", 0, "", false
+	}
+	stamp, err := strconv.ParseUint(rest[:16], 16, 64)
+	if err != nil {
+		return "", 0, "", false
+	}
+	return owner, int64(stamp), rest[33:], true
+}
+
+/*
+Encodes a hint as | method | header count | (name, value)... | value |,
+where strings are prefixed with their length.
+*/
+func (h hint) encode() []byte {
+	buf := appendString(nil, h.method)
+	var names []string
+	for _, name := range hintHeaders {
+		if h.header.Get(name) != "" {
+			names = append(names, name)
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = appendString(buf, name)
+		buf = appendString(buf, h.header.Get(name))
+	}
+	return append(buf, h.value...)
+}
+
+func decodeHint(buf []byte) (hint, error) {
+	h := hint{header: http.Header{}}
+	var ok bool
+	if h.method, buf, ok = readString(buf); !ok {
+		return hint{}, errors.New("invalid hint method")
+	}
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return hint{}, errors.New("invalid hint header count")
+	}
+	buf = buf[n:]
+	for i := uint64(0); i < count; i++ {
+		var name, value string
+		if name, buf, ok = readString(buf); !ok {
+			return hint{}, errors.New("invalid hint header")
+		}
+		if value, buf, ok = readString(buf); !ok {
+			return hint{}, errors.New("invalid hint header")
+		}
+		h.header.Set(name, value)
+	}
+	h.value = buf
+	return h, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return "", nil, false
+	}
+	buf = buf[n:]
+	return string(buf[:length]), buf[length:], true
+}
+
+/*
+Keeps a write of key that was meant for owner, to hand it off once owner is
+reachable again. header carries the metadata of the write as forwarded by
+its coordinator. Fails with ErrHintsFull if the hints held by this node
+would exceed their size limit.
+*/
+func (s *Store) StoreHint(owner, method, key string, header http.Header, value io.Reader) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if owner == "" || strings.Contains(owner, "\x00") {
+		return fmt.Errorf("invalid hint owner %q", owner)
+	}
+	if method != http.MethodPut && method != http.MethodDelete {
+		return fmt.Errorf("cannot hold a hint for %s", method)
+	}
+	h := hint{method: method, header: header}
+	if value != nil {
+		var err error
+		if h.value, err = io.ReadAll(io.LimitReader(value, s.hintMaxSize+1)); err != nil {
+			return err
+		}
+	}
+
+	k := hintKey(owner, s.now().UnixNano(), key)
+	encoded := h.encode()
+	size := entrySize(k, len(encoded))
+	if !s.reserveHint(owner, size) {
+		s.hintsDropped.Add(1)
+		return fmt.Errorf("%w: cannot hold %d more bytes", ErrHintsFull, size)
+	}
+
+	s.mu.Lock()
+	err := s.commit(walOpSet, k, string(encoded))
+	s.mu.Unlock()
+	if err != nil {
+		s.releaseHint(owner, size)
+		return err
+	}
+	s.hintsStored.Add(1)
+	return nil
+}
+
+func (s *Store) reserveHint(owner string, size int64) bool {
+	s.hintsMu.Lock()
+	defer s.hintsMu.Unlock()
+	if s.hintBytes+size > s.hintMaxSize {
+		return false
+	}
+	s.hintBytes += size
+	s.pendingHints[owner]++
+	return true
+}
+
+func (s *Store) releaseHint(owner string, size int64) {
+	s.hintsMu.Lock()
+	defer s.hintsMu.Unlock()
+	s.hintBytes -= size
+	if s.pendingHints[owner]--; s.pendingHints[owner] <= 0 {
+		delete(s.pendingHints, owner)
+	}
+}
+
+/*
+Returns the number of hints this node holds for each other node.
+*/
+func (s *Store) PendingHints() map[string]int {
+	s.hintsMu.Lock()
+	defer s.hintsMu.Unlock()
+	pending := make(map[string]int, len(s.pendingHints))
+	for owner, count := range s.pendingHints {
+		pending[owner] = count
+	}
+	return pending
+}
+
+/*
+Accounts for the hints found in the engine on startup.
+*/
+func (s *Store) loadHints() error {
+	return s.engine.Iterate(hintKeyPrefix, PrefixEnd(hintKeyPrefix), func(k string, buf []byte) bool {
+		if owner, _, _, ok := parseHintKey(k); ok {
+			s.hintBytes += entrySize(k, len(buf))
+			s.pendingHints[owner]++
+		}
+		return true
+	})
+}
+
+func (s *Store) handoffLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(hintInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case owner := <-s.handoff:
+			s.handOff(owner, true)
+		case <-ticker.C:
+			for owner := range s.PendingHints() {
+				s.handOff(owner, s.alive(owner))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+/*
+Asks the handoff worker to deliver the hints held for node, which has come
+back.
+*/
+func (s *Store) notifyHandoff(node string) {
+	select {
+	case s.handoff <- node:
+	default:
+		// The worker is busy; the next tick delivers them.
+	}
+}
+
+/*
+Drops the hints held for owner that have outlived their maximum age and, if
+deliver is set, sends the others to owner in the order they were stored.
+Delivery stops at the first hint owner does not take; hints owner rejects
+because it already holds a newer version are dropped.
+*/
+func (s *Store) handOff(owner string, deliver bool) {
+	prefix := hintOwnerPrefix(owner)
+	var keys []string
+	err := s.engine.Iterate(prefix, PrefixEnd(prefix), func(k string, _ []byte) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to list hints for %s: %v", owner, err)
+		return
+	}
+
+	oldest := s.now().Add(-s.hintMaxAge).UnixNano()
+	delivered := 0
+	for _, k := range keys {
+		_, created, key, ok := parseHintKey(k)
+		buf, found, err := s.engine.Get(k)
+		if err != nil || !found || !ok {
+			continue
+		}
+		if created < oldest {
+			s.dropHint(owner, k, len(buf))
+			s.hintsDropped.Add(1)
+			continue
+		}
+		if !deliver {
+			continue
+		}
+
+		h, err := decodeHint(buf)
+		if err != nil {
+			log.Printf("Dropping unreadable hint for key %s: %v", key, err)
+			s.dropHint(owner, k, len(buf))
+			s.hintsDropped.Add(1)
+			continue
+		}
+		var value valueSource
+		if h.method == http.MethodPut {
+			value = bytesSource(h.value)
+		}
+		err = s.sendWrite(owner, h.method, key, value, h.header)
+		switch {
+		case err == nil:
+			delivered++
+			s.hintsDelivered.Add(1)
+		case errors.Is(err, ErrPreconditionFailed):
+			s.hintsDropped.Add(1)
+		default:
+			log.Printf("Failed to hand off hint for key %s to %s: %v", key, owner, err)
+			return
+		}
+		s.dropHint(owner, k, len(buf))
+	}
+	if delivered > 0 {
+		log.Printf("Handed off %d hints to %s", delivered, owner)
+	}
+}
+
+func (s *Store) dropHint(owner, k string, length int) {
+	s.mu.Lock()
+	err := s.commit(walOpDelete, k, "")
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to delete hint %q: %v", k, err)
+		return
+	}
+	s.releaseHint(owner, entrySize(k, length))
+}
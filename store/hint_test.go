@@ -0,0 +1,225 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Records the writes sent to each node, which hold no copies. Nodes in down
+fail.
+*/
+type writeRecorder struct {
+	mu     sync.Mutex
+	down   map[string]bool
+	writes []string
+}
+
+func (r *writeRecorder) client() *MockHttpClient {
+	return &MockHttpClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.down[req.URL.Host] {
+				return nil, fmt.Errorf("connection refused")
+			}
+			if req.Method == http.MethodHead {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+			}
+			var body []byte
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body)
+			}
+			write := fmt.Sprintf("%s %s %s=%s", req.URL.Host, req.Method, req.URL.Path[1:], body)
+			if owner := req.Header.Get(HintHeader); owner != "" {
+				write += " for " + owner
+			}
+			r.writes = append(r.writes, write)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+		},
+		getFunc: func(url string) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("OK"))}, nil
+		},
+	}
+}
+
+func (r *writeRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.writes...)
+}
+
+func TestSloppyQuorum(t *testing.T) {
+	nodes := []string{"node1", "node2", "node3"}
+	// Returns a key this node is a replica of, its other replicas and the
+	// node that stands in for them.
+	placement := func(t *testing.T, s *Store) (string, []string, string) {
+		t.Helper()
+		key := keyFor(t, s, true)
+		_, owners, err := s.replicas(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := s.standIns(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		standIn, _ := f.next()
+		return key, owners, standIn
+	}
+
+	t.Run("should leave a hint on the next node for a replica that is down", func(t *testing.T) {
+		s := newTestStore(t, nodes, 3, WithAdvertiseAddr("self"))
+		key, owners, standIn := placement(t, s)
+		s.ringManager.RemoveNode(owners[0])
+		recorder := &writeRecorder{}
+		s.client = recorder.client()
+
+		assertEqual(t, s.Set(key, []byte("1"), WriteOptions{}), nil, "write error")
+		writes := recorder.recorded()
+		assertEqual(t, len(writes), 2, "writes sent")
+		for _, want := range []string{owners[1] + " PUT " + key + "=1", standIn + " PUT " + key + "=1 for " + owners[0]} {
+			if !strings.Contains(strings.Join(writes, "\n"), want) {
+				t.Errorf("expected write %q, got %v", want, writes)
+			}
+		}
+	})
+
+	t.Run("should leave a hint for a replica that fails", func(t *testing.T) {
+		s := newTestStore(t, nodes, 3, WithAdvertiseAddr("self"))
+		key, owners, standIn := placement(t, s)
+		recorder := &writeRecorder{down: map[string]bool{owners[1]: true}}
+		s.client = recorder.client()
+
+		assertEqual(t, s.Set(key, []byte("1"), WriteOptions{}), nil, "write error")
+		if !strings.Contains(strings.Join(recorder.recorded(), "\n"), standIn+" PUT "+key+"=1 for "+owners[1]) {
+			t.Errorf("expected a hint on %s, got %v", standIn, recorder.recorded())
+		}
+	})
+
+	t.Run("should not count hints towards ALL", func(t *testing.T) {
+		s := newTestStore(t, nodes, 3, WithAdvertiseAddr("self"))
+		key, owners, _ := placement(t, s)
+		s.ringManager.RemoveNode(owners[0])
+		recorder := &writeRecorder{}
+		s.client = recorder.client()
+
+		err := s.Set(key, []byte("1"), WriteOptions{Consistency: ConsistencyAll})
+		assertEqual(t, errors.Is(err, ErrNotEnoughReplicas), true, "write at ALL")
+		assertEqual(t, len(recorder.recorded()), 1, "writes sent")
+	})
+}
+
+func TestHintedHandoff(t *testing.T) {
+	header := headers(VersionHeader, "3", TimestampHeader, "42", "Content-Type", "text/plain", "Authorization", "secret")
+
+	t.Run("should hand off hints in order and forget them", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2)
+		assertEqual(t, s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader("1")), nil, "hint error")
+		assertEqual(t, s.StoreHint("node2", http.MethodDelete, "a", header, nil), nil, "hint error")
+		assertEqual(t, s.PendingHints()["node2"], 2, "pending hints")
+		assertEqual(t, s.Stats().Metrics["hints_pending"], int64(2), "pending hints metric")
+		if _, ok := s.Get("a"); ok {
+			t.Error("expected hints not to be applied locally")
+		}
+
+		var sent []*http.Request
+		s.client = &MockHttpClient{doFunc: func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}}
+		s.handOff("node2", true)
+
+		assertEqual(t, len(sent), 2, "hints sent")
+		assertEqual(t, sent[0].Method+" "+sent[1].Method, "PUT DELETE", "order")
+		assertEqual(t, sent[0].Header.Get(VersionHeader), "3", "version")
+		assertEqual(t, sent[0].Header.Get("Content-Type"), "text/plain", "content type")
+		assertEqual(t, sent[0].Header.Get("Authorization"), "", "unrelated header")
+		assertEqual(t, sent[0].Header.Get(ReplicationHeader), "true", "forwarded")
+		body, _ := io.ReadAll(sent[0].Body)
+		assertEqual(t, string(body), "1", "value")
+		assertEqual(t, len(s.PendingHints()), 0, "pending hints")
+		assertEqual(t, s.Stats().Metrics["hints_delivered"], int64(2), "delivered hints")
+		assertEqual(t, s.Stats().Metrics["hints_pending_bytes"], int64(0), "pending hint bytes")
+	})
+
+	t.Run("should keep hints the owner does not take", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2)
+		_ = s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader("1"))
+		s.client = (&writeRecorder{down: map[string]bool{"node2": true}}).client()
+
+		s.handOff("node2", true)
+		assertEqual(t, s.PendingHints()["node2"], 1, "pending hints")
+	})
+
+	t.Run("should drop hints past their maximum age", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithHintLimits(time.Minute, DefaultHintMaxSize))
+		_ = s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader("1"))
+
+		s.handOff("node2", false)
+		assertEqual(t, s.PendingHints()["node2"], 1, "pending hints")
+
+		s.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		s.handOff("node2", false)
+		assertEqual(t, len(s.PendingHints()), 0, "pending hints")
+		assertEqual(t, s.Stats().Metrics["hints_dropped"], int64(1), "dropped hints")
+	})
+
+	t.Run("should refuse hints beyond the size limit", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithHintLimits(time.Hour, 200))
+		err := s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader(strings.Repeat("x", 200)))
+		assertEqual(t, errors.Is(err, ErrHintsFull), true, "hints full")
+		assertEqual(t, s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader("1")), nil, "small hint")
+	})
+
+	t.Run("should keep hints across restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStore([]string{"node1", "node2"}, 2, WithDataDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader("1"))
+		s.Close()
+
+		s = newTestStore(t, []string{"node1", "node2"}, 2, WithDataDir(dir))
+		assertEqual(t, s.PendingHints()["node2"], 1, "pending hints")
+		keys, _ := s.Scan("", "", 10)
+		assertEqual(t, len(keys), 0, "keys listed")
+	})
+
+	t.Run("should hand off hints when the owner comes back", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2)
+		_ = s.StoreHint("node2", http.MethodPut, "a", header, strings.NewReader("1"))
+		recorder := &writeRecorder{}
+		s.client = recorder.client()
+		s.ringManager.RemoveNode("node2")
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		s.checkNode("node2", &wg)
+
+		deadline := time.Now().Add(time.Second)
+		for len(s.PendingHints()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assertEqual(t, strings.Join(recorder.recorded(), ","), "node2 PUT a=1", "writes handed off")
+	})
+}
+
+func TestParseHintKey(t *testing.T) {
+	owner, created, key, ok := parseHintKey(hintKey("node2:8080", 42, "a\x00b"))
+	assertEqual(t, ok, true, "parsed")
+	assertEqual(t, owner, "node2:8080", "owner")
+	assertEqual(t, created, int64(42), "created")
+	assertEqual(t, key, "a\x00b", "key")
+
+	if _, _, _, ok := parseHintKey(chunkKey("a", 1, 0)); ok {
+		t.Error("expected chunk keys not to parse as hints")
+	}
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+How replicas settle writes of the same key that were made concurrently.
+*/
+type ConflictResolution string
+
+const (
+	// Keeps concurrent writes as siblings until a client replaces them.
+	KeepSiblings ConflictResolution = "siblings"
+	// Keeps the write with the newest hybrid logical clock timestamp.
+	LastWriteWins ConflictResolution = "lww"
+)
+
+func ParseConflictResolution(s string) (ConflictResolution, error) {
+	switch mode := ConflictResolution(s); mode {
+	case KeepSiblings, LastWriteWins:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown conflict resolution %q (available: %s, %s)", s, KeepSiblings, LastWriteWins)
+}
+
+/*
+A hybrid logical clock timestamp: the physical time of a write in Unix
+nanoseconds, a counter that orders writes the clock could not tell apart,
+and the node that coordinated it, which breaks the remaining ties. Every
+node orders timestamps the same way, so replicas that apply only newer
+writes agree on the last one.
+*/
+type HybridTime struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+/*
+Reports whether t was taken before other.
+*/
+func (t HybridTime) Before(other HybridTime) bool {
+	if t.Wall != other.Wall {
+		return t.Wall < other.Wall
+	}
+	if t.Logical != other.Logical {
+		return t.Logical < other.Logical
+	}
+	return t.Node < other.Node
+}
+
+func (t HybridTime) IsZero() bool {
+	return t == HybridTime{}
+}
+
+/*
+Formats the timestamp as wall.logical@node.
+*/
+func (t HybridTime) String() string {
+	return strconv.FormatInt(t.Wall, 10) + "." + strconv.FormatUint(uint64(t.Logical), 10) + "@" + t.Node
+}
+
+func ParseHybridTime(s string) (HybridTime, error) {
+	stamp, node, ok := strings.Cut(s, "@")
+	if !ok {
+		return HybridTime{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	wall, logical, ok := strings.Cut(stamp, ".")
+	if !ok {
+		return HybridTime{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	t := HybridTime{Node: node}
+	var err error
+	if t.Wall, err = strconv.ParseInt(wall, 10, 64); err != nil || t.Wall <= 0 {
+		return HybridTime{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	counter, err := strconv.ParseUint(logical, 10, 32)
+	if err != nil {
+		return HybridTime{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	t.Logical = uint32(counter)
+	return t, nil
+}
+
+/*
+Issues the timestamps of the writes a node coordinates. They never go
+backwards, even if the physical clock does, and are later than every
+timestamp the node has received.
+*/
+type hybridClock struct {
+	mu   sync.Mutex
+	last HybridTime
+}
+
+/*
+Returns a new timestamp for node at physical time now.
+*/
+func (c *hybridClock) tick(now int64, node string) HybridTime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now > c.last.Wall {
+		c.last = HybridTime{Wall: now}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Node = node
+	return c.last
+}
+
+/*
+Moves the clock past a timestamp received from another node.
+*/
+func (c *hybridClock) observe(t HybridTime) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last.Before(t) {
+		c.last.Wall, c.last.Logical = t.Wall, t.Logical
+	}
+}
+
+/*
+The timestamp of the write that produced e. Entries written without a
+hybrid clock are ordered by their modification time alone.
+*/
+func (e entry) stamp() HybridTime {
+	return HybridTime{Wall: e.modified, Logical: e.logical, Node: e.origin}
+}
+
+/*
+The timestamp of the newest value of e.
+*/
+func (e entry) latest() HybridTime {
+	var latest HybridTime
+	for _, value := range e.all() {
+		if latest.Before(value.stamp()) {
+			latest = value.stamp()
+		}
+	}
+	return latest
+}
+
+/*
+Returns the timestamp of a write coordinated by this node, or the one a
+forwarded write carries. Forwarded writes from nodes that do not send one
+are stamped with their modification time alone.
+*/
+func (s *Store) writeTime(opts WriteOptions) HybridTime {
+	switch {
+	case !opts.HLC.IsZero():
+		s.hlc.observe(opts.HLC)
+		return opts.HLC
+	case opts.Timestamp != 0:
+		return HybridTime{Wall: opts.Timestamp}
+	}
+	return s.hlc.tick(s.now().UnixNano(), s.nodeID)
+}
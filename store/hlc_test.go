@@ -0,0 +1,130 @@
+package store
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHybridClock(t *testing.T) {
+	t.Run("should never go backwards", func(t *testing.T) {
+		var c hybridClock
+		first := c.tick(100, "a")
+		second := c.tick(90, "a")
+		third := c.tick(100, "a")
+		assertEqual(t, first.Before(second), true, "tick after the clock went back")
+		assertEqual(t, second.Before(third), true, "tick at the same time")
+		assertEqual(t, third, HybridTime{Wall: 100, Logical: 2, Node: "a"}, "third timestamp")
+	})
+
+	t.Run("should move past received timestamps", func(t *testing.T) {
+		var c hybridClock
+		c.observe(HybridTime{Wall: 200, Logical: 5, Node: "b"})
+		next := c.tick(100, "a")
+		assertEqual(t, next, HybridTime{Wall: 200, Logical: 6, Node: "a"}, "timestamp after a received one")
+	})
+
+	t.Run("should break ties by node", func(t *testing.T) {
+		a := HybridTime{Wall: 100, Logical: 1, Node: "a"}
+		b := HybridTime{Wall: 100, Logical: 1, Node: "b"}
+		assertEqual(t, a.Before(b), true, "a before b")
+		assertEqual(t, b.Before(a), false, "b before a")
+	})
+}
+
+func TestParseHybridTime(t *testing.T) {
+	stamp := HybridTime{Wall: 1700000000000000000, Logical: 3, Node: "node1:8080"}
+	parsed, err := ParseHybridTime(stamp.String())
+	assertEqual(t, err, nil, "parse error")
+	assertEqual(t, parsed, stamp, "parsed timestamp")
+
+	for _, raw := range []string{"", "1@a", "x.1@a", "1.x@a", "0.1@a", "1.4294967296@a"} {
+		if _, err := ParseHybridTime(raw); err == nil {
+			t.Errorf("expected an error for %q", raw)
+		}
+	}
+}
+
+func TestLastWriteWins(t *testing.T) {
+	forwarded := func(wall int64, logical uint32, node string) WriteOptions {
+		return WriteOptions{SkipReplication: true, HLC: HybridTime{Wall: wall, Logical: logical, Node: node}}
+	}
+	newLWWStore := func(t *testing.T, nodes []string, replicationFactor int, opts ...Option) *Store {
+		return newTestStore(t, nodes, replicationFactor, append(opts, WithConflictResolution(LastWriteWins))...)
+	}
+
+	t.Run("should ignore writes older than the value held", func(t *testing.T) {
+		s := newLWWStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("new"), forwarded(200, 0, "n1"))
+		_ = s.Set("a", []byte("old"), forwarded(100, 0, "n2"))
+		_ = s.Set("a", []byte("tie"), forwarded(200, 0, "n0"))
+
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "new", "value after delayed writes")
+		_ = s.Set("a", []byte("newer"), forwarded(200, 1, "n0"))
+		value, _ = s.Get("a")
+		assertEqual(t, string(value), "newer", "value after a newer write")
+	})
+
+	t.Run("should keep values written after a delete", func(t *testing.T) {
+		s := newLWWStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("1"), forwarded(200, 0, "n1"))
+		_ = s.Delete("a", forwarded(100, 0, "n2"))
+		_, ok := s.Get("a")
+		assertEqual(t, ok, true, "key after a delayed delete")
+
+		_ = s.Delete("a", forwarded(300, 0, "n2"))
+		_, ok = s.Get("a")
+		assertEqual(t, ok, false, "key after a newer delete")
+	})
+
+	t.Run("should order local writes after received ones", func(t *testing.T) {
+		s := newLWWStore(t, []string{"node1"}, 1)
+		s.now = func() time.Time { return time.Unix(0, 100) }
+		_ = s.Set("a", []byte("remote"), forwarded(500, 0, "n1"))
+		_ = s.Set("a", []byte("local"), WriteOptions{SkipReplication: true})
+
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "local", "value written after a received one")
+	})
+
+	t.Run("should keep the timestamp across a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStore([]string{"node1"}, 1, WithDataDir(dir), WithConflictResolution(LastWriteWins))
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		_ = s.Set("a", []byte("new"), forwarded(200, 7, "n1"))
+		s.Close()
+
+		s = newLWWStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		_ = s.Set("a", []byte("old"), forwarded(200, 6, "n9"))
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "new", "value after a restart and a delayed write")
+	})
+
+	t.Run("should send the timestamp to replicas", func(t *testing.T) {
+		s := newLWWStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"), WithNodeID("self"))
+		s.now = func() time.Time { return time.Unix(0, 100) }
+		var mu sync.Mutex
+		var stamps []string
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodHead {
+					return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+				}
+				mu.Lock()
+				stamps = append(stamps, req.Method+" "+req.Header.Get(HLCHeader))
+				mu.Unlock()
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+			},
+		}
+
+		_ = s.Set("a", []byte("1"), WriteOptions{})
+		_ = s.Delete("a", WriteOptions{})
+		assertEqual(t, strings.Join(stamps, ","), "PUT 100.0@self,PUT 100.0@self,DELETE 100.1@self,DELETE 100.1@self", "replicated timestamps")
+	})
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/lsm"
+)
+
+const lsmDirName = "lsm"
+
+/*
+Adapts the log-structured merge-tree to the Engine interface. The tree does
+not log writes itself; it relies on the store's write-ahead log, and
+snapshots of the store flush the tree instead of copying the keyspace.
+*/
+type lsmEngine struct {
+	db *lsm.DB
+}
+
+func newLSMEngine(dir string) (Engine, error) {
+	if dir == "" {
+		return nil, errors.New("the lsm engine requires a data directory")
+	}
+	db, err := lsm.Open(filepath.Join(dir, lsmDirName), lsm.DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+	return &lsmEngine{db: db}, nil
+}
+
+func (e *lsmEngine) Get(key string) ([]byte, bool, error) {
+	return e.db.Get(key)
+}
+
+func (e *lsmEngine) Put(key string, value []byte) error {
+	return e.db.Put(key, value)
+}
+
+func (e *lsmEngine) Delete(key string) error {
+	return e.db.Delete(key)
+}
+
+func (e *lsmEngine) Iterate(start, end string, fn func(key string, value []byte) bool) error {
+	return e.db.Scan(start, end, fn)
+}
+
+func (e *lsmEngine) Flush() error {
+	return e.db.Flush()
+}
+
+func (e *lsmEngine) Close() error {
+	return e.db.Close()
+}
+
+/*
+Reports the tree's statistics. The key count is an upper bound since it
+includes overwritten and deleted entries that compaction has not yet
+dropped.
+*/
+func (e *lsmEngine) Stats() EngineStats {
+	s := e.db.Stats()
+	metrics := map[string]int64{
+		"memtable_bytes":           s.MemtableBytes,
+		"immutable_memtables":      int64(s.ImmutableMemtables),
+		"flushes":                  int64(s.Flushes),
+		"compactions":              int64(s.Compactions),
+		"compaction_bytes_read":    int64(s.CompactionBytesRead),
+		"compaction_bytes_written": int64(s.CompactionBytesWritten),
+		"compaction_errors":        int64(s.CompactionErrors),
+		"bloom_negatives":          int64(s.BloomNegatives),
+		"write_stalls":             int64(s.WriteStalls),
+	}
+	for level, l := range s.Levels {
+		if l.Tables == 0 {
+			continue
+		}
+		metrics[fmt.Sprintf("level_%d_tables", level)] = int64(l.Tables)
+		metrics[fmt.Sprintf("level_%d_bytes", level)] = int64(l.Bytes)
+	}
+	return EngineStats{
+		Name:    "lsm",
+		Keys:    int64(s.Entries),
+		Bytes:   int64(s.Bytes) + s.MemtableBytes,
+		Metrics: metrics,
+	}
+}
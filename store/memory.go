@@ -0,0 +1,100 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/btree"
+)
+
+/*
+Keeps the keyspace in an ordered in-memory B-tree. Snapshots and range
+iterations work on a constant-time clone of the tree, so they never hold
+the lock while they read.
+*/
+type memoryEngine struct {
+	mu    sync.RWMutex
+	tree  *btree.BTree[[]byte]
+	bytes int64
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{
+		tree: btree.New[[]byte](btree.DefaultDegree),
+	}
+}
+
+func (e *memoryEngine) Get(key string) ([]byte, bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	value, ok := e.tree.Get(key)
+	return value, ok, nil
+}
+
+func (e *memoryEngine) Put(key string, value []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if old, ok := e.tree.Set(key, value); ok {
+		e.bytes -= int64(len(key) + len(old))
+	}
+	e.bytes += int64(len(key) + len(value))
+	return nil
+}
+
+func (e *memoryEngine) Delete(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if old, ok := e.tree.Delete(key); ok {
+		e.bytes -= int64(len(key) + len(old))
+	}
+	return nil
+}
+
+func (e *memoryEngine) clone() *btree.BTree[[]byte] {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tree.Clone()
+}
+
+/*
+Calls fn for every key in [start, end) in ascending order until it returns
+false. The iteration sees the keyspace as it was when it started.
+*/
+func (e *memoryEngine) Iterate(start, end string, fn func(key string, value []byte) bool) error {
+	e.clone().Ascend(start, end, fn)
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+func (e *memoryEngine) Stats() EngineStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return EngineStats{
+		Name:  "memory",
+		Keys:  int64(e.tree.Len()),
+		Bytes: e.bytes,
+	}
+}
+
+func (e *memoryEngine) Snapshot() (EngineSnapshot, error) {
+	return memorySnapshot{tree: e.clone()}, nil
+}
+
+type memorySnapshot struct {
+	tree *btree.BTree[[]byte]
+}
+
+func (s memorySnapshot) Len() int {
+	return s.tree.Len()
+}
+
+func (s memorySnapshot) Iterate(fn func(key string, value []byte) bool) error {
+	s.tree.Ascend("", "", fn)
+	return nil
+}
+
+func (s memorySnapshot) Release() {}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How long an optimistic transaction may go unused before it is rolled
+// back.
+const txnSessionTimeout = time.Minute
+
+var (
+	// Returned for optimistic transactions this node does not know of,
+	// because they were begun on another node, committed, rolled back or
+	// unused for too long.
+	ErrTxnNotFound = errors.New("transaction not found")
+	// Returned when an optimistic transaction read a key that has changed
+	// since; the transaction is then aborted.
+	ErrTxnConflict = errors.New("transaction conflict")
+)
+
+/*
+An optimistic transaction begun on this node: the versions of the keys it
+read, zero for keys that did not exist, and the writes it buffered, in the
+order they were made.
+*/
+type txnSession struct {
+	reads  map[string]uint64
+	writes map[string]TxnOp
+	order  []string
+	used   time.Time
+}
+
+/*
+Reports whether the transaction may touch key without holding more than
+MaxTxnOps keys.
+*/
+func (t *txnSession) admits(key string) bool {
+	_, read := t.reads[key]
+	_, written := t.writes[key]
+	return read || written || len(t.keys()) < MaxTxnOps
+}
+
+/*
+Returns the keys the transaction read or wrote, in the order they were
+first written, followed by those it only read.
+*/
+func (t *txnSession) keys() []string {
+	keys := append([]string(nil), t.order...)
+	for key := range t.reads {
+		if _, ok := t.writes[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+/*
+Begins an optimistic transaction on this node and returns its id. Nothing
+is locked until it commits; reads record the version they saw, and writes
+are buffered.
+*/
+func (s *Store) BeginTxn() (string, error) {
+	if s.replicationMode == RaftReplication {
+		return "", ErrTxnUnsupported
+	}
+	id := newTxnID(s.now())
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	s.txnSessions[id] = &txnSession{reads: make(map[string]uint64), writes: make(map[string]TxnOp), used: s.now()}
+	return id, nil
+}
+
+/*
+Runs fn on the transaction named by id, holding txnMu.
+*/
+func (s *Store) withSession(id string, fn func(t *txnSession) error) error {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	t, ok := s.txnSessions[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTxnNotFound, id)
+	}
+	t.used = s.now()
+	return fn(t)
+}
+
+/*
+Reads key within a transaction. A key the transaction wrote is returned as
+it was written, and a key it deleted is not found. Other keys are read
+like Read does, and their version is recorded so that the commit fails if
+the key changes in the meantime; if a key read before has changed already,
+the read fails with ErrTxnConflict.
+*/
+func (s *Store) ReadTxnKey(id, key string) (ReadResult, error) {
+	if err := validateKey(key); err != nil {
+		return ReadResult{}, err
+	}
+	var buffered *TxnOp
+	err := s.withSession(id, func(t *txnSession) error {
+		if op, ok := t.writes[key]; ok {
+			buffered = &op
+			return nil
+		}
+		if !t.admits(key) {
+			return fmt.Errorf("%w: touches more than %d keys", ErrInvalidTxn, MaxTxnOps)
+		}
+		return nil
+	})
+	if err != nil {
+		return ReadResult{}, err
+	}
+	if buffered != nil {
+		if buffered.Type == TxnDelete {
+			return ReadResult{}, nil
+		}
+		item := KeyValue{Key: key, ContentType: buffered.ContentType, Modified: s.now().UnixNano()}
+		return ReadResult{Item: item, Value: bytes.NewReader(buffered.Value), Found: true}, nil
+	}
+
+	result, err := s.Read(key, ReadOptions{})
+	if err != nil {
+		return ReadResult{}, err
+	}
+	var version uint64
+	if result.Found {
+		version = result.Item.Version
+	}
+	err = s.withSession(id, func(t *txnSession) error {
+		if seen, ok := t.reads[key]; ok && seen != version {
+			return fmt.Errorf("%w: key %s changed from version %d to %d", ErrTxnConflict, key, seen, version)
+		}
+		t.reads[key] = version
+		return nil
+	})
+	if err != nil {
+		result.Close()
+		return ReadResult{}, err
+	}
+	return result, nil
+}
+
+/*
+Buffers a write or delete of a key within a transaction; it is applied
+when the transaction commits. A later write of the same key replaces it.
+*/
+func (s *Store) BufferTxnWrite(id string, op TxnOp) error {
+	if op.Type != TxnPut && op.Type != TxnDelete {
+		return fmt.Errorf("%w: cannot buffer %q", ErrInvalidTxn, op.Type)
+	}
+	if err := validateKey(op.Key); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTxn, err)
+	}
+	op.Condition, op.Version = Condition{}, 0
+	return s.withSession(id, func(t *txnSession) error {
+		if !t.admits(op.Key) {
+			return fmt.Errorf("%w: touches more than %d keys", ErrInvalidTxn, MaxTxnOps)
+		}
+		if _, ok := t.writes[op.Key]; !ok {
+			t.order = append(t.order, op.Key)
+		}
+		t.writes[op.Key] = op
+		return nil
+	})
+}
+
+/*
+Commits a transaction: its writes are applied with two-phase commit like
+those of Transact, on condition that every key it read still holds the
+version it read, which the owners of the keys validate while they hold
+the locks. Keys it only read are checked the same way. Fails with
+ErrTxnConflict if one of them has changed. The transaction is gone
+afterwards, whether it committed or not.
+*/
+func (s *Store) CommitOptimisticTxn(id string) (TxnResult, error) {
+	s.txnMu.Lock()
+	t, ok := s.txnSessions[id]
+	delete(s.txnSessions, id)
+	s.txnMu.Unlock()
+	if !ok {
+		return TxnResult{}, fmt.Errorf("%w: %s", ErrTxnNotFound, id)
+	}
+
+	var ops []TxnOp
+	for _, key := range t.keys() {
+		op, written := t.writes[key]
+		if !written {
+			op = TxnOp{Type: TxnCheck, Key: key}
+		}
+		if version, read := t.reads[key]; read {
+			op.Condition = Condition{IfMatch: version, IfNoneMatch: version == 0}
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return TxnResult{ID: id, Status: TxnCommitted}, nil
+	}
+
+	result, err := s.transact(id, ops)
+	if errors.Is(err, ErrPreconditionFailed) {
+		return TxnResult{}, fmt.Errorf("%w: %v", ErrTxnConflict, err)
+	}
+	return result, err
+}
+
+/*
+Discards a transaction and the writes it buffered.
+*/
+func (s *Store) RollbackTxn(id string) error {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	if _, ok := s.txnSessions[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrTxnNotFound, id)
+	}
+	delete(s.txnSessions, id)
+	return nil
+}
+
+/*
+Rolls back the optimistic transactions that have not been used for longer
+than txnSessionTimeout.
+*/
+func (s *Store) expireTxnSessions() {
+	cutoff := s.now().Add(-txnSessionTimeout)
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	for id, t := range s.txnSessions {
+		if t.used.Before(cutoff) {
+			delete(s.txnSessions, id)
+			log.Printf("Rolled back transaction %s after %v without use", id, txnSessionTimeout)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestOptimisticTransactions(t *testing.T) {
+	read := func(t *testing.T, s *Store, id, key string) (string, bool) {
+		t.Helper()
+		result, err := s.ReadTxnKey(id, key)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", key, err)
+		}
+		if !result.Found {
+			return "", false
+		}
+		value, _ := io.ReadAll(result.Value)
+		return string(value), true
+	}
+	begin := func(t *testing.T, s *Store) string {
+		t.Helper()
+		id, err := s.BeginTxn()
+		if err != nil {
+			t.Fatalf("failed to begin: %v", err)
+		}
+		return id
+	}
+	buffer := func(t *testing.T, s *Store, id string, op TxnOp) {
+		t.Helper()
+		if err := s.BufferTxnWrite(id, op); err != nil {
+			t.Fatalf("failed to buffer %+v: %v", op, err)
+		}
+	}
+
+	t.Run("should commit writes based on the keys it read", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b, d := c.keyOn("node2", "a"), c.keyOn("node1", "b"), c.keyOn("node3", "d")
+		if err := c.stores["node2"].Set(a, []byte("1"), WriteOptions{}); err != nil {
+			t.Fatalf("failed to set %s: %v", a, err)
+		}
+		s := c.stores["node1"]
+		id := begin(t, s)
+
+		value, _ := read(t, s, id, a)
+		assertEqual(t, value, "1", "value read")
+		_, found := read(t, s, id, d)
+		assertEqual(t, found, false, "missing key found")
+		buffer(t, s, id, TxnOp{Type: TxnPut, Key: a, Value: []byte("2")})
+		buffer(t, s, id, TxnOp{Type: TxnPut, Key: b, Value: []byte("x")})
+		value, _ = read(t, s, id, a)
+		assertEqual(t, value, "2", "value written within the transaction")
+		c.assertValue("node2", a, "1")
+
+		result, err := s.CommitOptimisticTxn(id)
+		if err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		assertEqual(t, result.Status, TxnCommitted, "status")
+		c.assertValue("node2", a, "2")
+		c.assertValue("node1", b, "x")
+		c.assertValue("node3", d, "")
+		c.assertUnlocked()
+		if _, err := s.ReadTxnKey(id, a); !errors.Is(err, ErrTxnNotFound) {
+			t.Errorf("expected ErrTxnNotFound after the commit, got %v", err)
+		}
+	})
+
+	t.Run("should abort if a key it wrote changed since it was read", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b := c.keyOn("node2", "a"), c.keyOn("node1", "b")
+		if err := c.stores["node2"].Set(a, []byte("1"), WriteOptions{}); err != nil {
+			t.Fatalf("failed to set %s: %v", a, err)
+		}
+		s := c.stores["node1"]
+		id := begin(t, s)
+		read(t, s, id, a)
+		buffer(t, s, id, TxnOp{Type: TxnPut, Key: a, Value: []byte("2")})
+		buffer(t, s, id, TxnOp{Type: TxnPut, Key: b, Value: []byte("x")})
+		if err := c.stores["node2"].Set(a, []byte("other"), WriteOptions{}); err != nil {
+			t.Fatalf("failed to set %s: %v", a, err)
+		}
+
+		if _, err := s.CommitOptimisticTxn(id); !errors.Is(err, ErrTxnConflict) {
+			t.Fatalf("expected ErrTxnConflict, got %v", err)
+		}
+		c.assertValue("node2", a, "other")
+		c.assertValue("node1", b, "")
+		c.assertUnlocked()
+	})
+
+	t.Run("should abort if a key it only read was created since", func(t *testing.T) {
+		c := newTxnCluster(t)
+		b, d := c.keyOn("node1", "b"), c.keyOn("node3", "d")
+		s := c.stores["node1"]
+		id := begin(t, s)
+		read(t, s, id, d)
+		buffer(t, s, id, TxnOp{Type: TxnDelete, Key: b})
+		if err := c.stores["node3"].Set(d, []byte("new"), WriteOptions{}); err != nil {
+			t.Fatalf("failed to set %s: %v", d, err)
+		}
+
+		if _, err := s.ReadTxnKey(id, d); !errors.Is(err, ErrTxnConflict) {
+			t.Errorf("expected ErrTxnConflict reading the key again, got %v", err)
+		}
+		if _, err := s.CommitOptimisticTxn(id); !errors.Is(err, ErrTxnConflict) {
+			t.Fatalf("expected ErrTxnConflict, got %v", err)
+		}
+		c.assertUnlocked()
+	})
+
+	t.Run("should forget transactions rolled back or left unused", func(t *testing.T) {
+		c := newTxnCluster(t)
+		s := c.stores["node1"]
+		id := begin(t, s)
+		if err := s.RollbackTxn(id); err != nil {
+			t.Fatalf("failed to roll back: %v", err)
+		}
+		if err := s.BufferTxnWrite(id, TxnOp{Type: TxnPut, Key: "a"}); !errors.Is(err, ErrTxnNotFound) {
+			t.Errorf("expected ErrTxnNotFound, got %v", err)
+		}
+
+		id = begin(t, s)
+		s.now = func() time.Time { return time.Now().Add(2 * txnSessionTimeout) }
+		s.expireTxnSessions()
+		if _, err := s.CommitOptimisticTxn(id); !errors.Is(err, ErrTxnNotFound) {
+			t.Errorf("expected ErrTxnNotFound, got %v", err)
+		}
+		assertEqual(t, s.Stats().Metrics["txn_open"], int64(0), "open transactions")
+	})
+}
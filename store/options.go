@@ -0,0 +1,233 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type options struct {
+	engine              string
+	dataDir             string
+	fsyncPolicy         FsyncPolicy
+	snapshotInterval    time.Duration
+	reapInterval        time.Duration
+	maxMemory           int64
+	evictionPolicy      EvictionPolicy
+	nodeID              string
+	conflictResolution  ConflictResolution
+	readRepairChance    float64
+	self                string
+	readQuorum          int
+	writeQuorum         int
+	hintMaxAge          time.Duration
+	hintMaxSize         int64
+	antiEntropyInterval time.Duration
+	antiEntropyRate     int
+	tombstoneGrace      time.Duration
+	replicationMode     ReplicationMode
+	raftJoin            bool
+	raftTick            time.Duration
+}
+
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		engine:              DefaultEngine,
+		fsyncPolicy:         FsyncPolicy{Mode: FsyncInterval, Interval: walDefaultFsync},
+		snapshotInterval:    5 * time.Minute,
+		reapInterval:        time.Second,
+		evictionPolicy:      NoEviction,
+		nodeID:              randomNodeID(),
+		conflictResolution:  KeepSiblings,
+		readRepairChance:    1,
+		hintMaxAge:          DefaultHintMaxAge,
+		hintMaxSize:         DefaultHintMaxSize,
+		antiEntropyInterval: DefaultAntiEntropyInterval,
+		antiEntropyRate:     DefaultAntiEntropyRate,
+		tombstoneGrace:      DefaultTombstoneGracePeriod,
+		replicationMode:     EventualReplication,
+		raftTick:            DefaultRaftTickInterval,
+	}
+}
+
+/*
+Persists every mutation to a write-ahead log in dir. An empty dir keeps the
+store purely in memory.
+*/
+func WithDataDir(dir string) Option {
+	return func(o *options) {
+		o.dataDir = dir
+	}
+}
+
+/*
+Controls how often the write-ahead log is synced to disk.
+*/
+func WithFsyncPolicy(policy FsyncPolicy) Option {
+	return func(o *options) {
+		o.fsyncPolicy = policy
+	}
+}
+
+/*
+Sets how often a snapshot of the keyspace is written in the background.
+Zero disables periodic snapshots; they can still be triggered manually.
+*/
+func WithSnapshotInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.snapshotInterval = interval
+	}
+}
+
+/*
+Selects the storage engine that holds the local keyspace.
+*/
+func WithEngine(name string) Option {
+	return func(o *options) {
+		o.engine = name
+	}
+}
+
+/*
+Sets how often the background reaper looks for expired keys. Zero disables
+the reaper; expired keys are then hidden but never reclaimed.
+*/
+func WithReapInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.reapInterval = interval
+	}
+}
+
+/*
+Limits the memory used by keys and values to maxMemory bytes, evicting keys
+according to policy when a write would exceed it. Zero means no limit.
+*/
+func WithMaxMemory(maxMemory int64, policy EvictionPolicy) Option {
+	return func(o *options) {
+		o.maxMemory = maxMemory
+		o.evictionPolicy = policy
+	}
+}
+
+/*
+Names this node in the vector clocks of the writes it coordinates. Every
+node needs its own, stable ID; by default a random one is chosen on start.
+*/
+func WithNodeID(id string) Option {
+	return func(o *options) {
+		o.nodeID = id
+	}
+}
+
+/*
+Selects how concurrent writes of a key are settled. Every node of a cluster
+must use the same mode.
+*/
+func WithConflictResolution(mode ConflictResolution) Option {
+	return func(o *options) {
+		o.conflictResolution = mode
+	}
+}
+
+/*
+Sets the probability that a read repairs the replicas it found to hold a
+stale copy of the key, in the background. Reads may ask for another one.
+*/
+func WithReadRepairChance(chance float64) Option {
+	return func(o *options) {
+		o.readRepairChance = chance
+	}
+}
+
+/*
+Sets the address other nodes reach this node at, as it appears in their
+node lists. With it, this node joins the ring and holds its share of the
+keys as a replica; without it, it only coordinates.
+*/
+func WithAdvertiseAddr(addr string) Option {
+	return func(o *options) {
+		o.self = addr
+	}
+}
+
+/*
+Sets how many replicas of a key reads and writes wait for. Zero means a
+majority of the replication factor.
+*/
+func WithQuorums(read, write int) Option {
+	return func(o *options) {
+		o.readQuorum = read
+		o.writeQuorum = write
+	}
+}
+
+/*
+Limits the hints this node holds for replicas that are down: hints older
+than maxAge are dropped, and no more are taken while they add up to
+maxSize bytes.
+*/
+func WithHintLimits(maxAge time.Duration, maxSize int64) Option {
+	return func(o *options) {
+		o.hintMaxAge = maxAge
+		o.hintMaxSize = maxSize
+	}
+}
+
+/*
+Sets how often this node compares the keys it replicates with the other
+replicas and how many differing keys per second it reconciles. A zero
+interval disables background rounds, and a zero rate does not limit them.
+*/
+func WithAntiEntropy(interval time.Duration, rate int) Option {
+	return func(o *options) {
+		o.antiEntropyInterval = interval
+		o.antiEntropyRate = rate
+	}
+}
+
+/*
+Sets how long the tombstones of deleted keys are kept before they are
+purged. Replicas that missed a delete must be repaired within it.
+*/
+func WithTombstoneGracePeriod(grace time.Duration) Option {
+	return func(o *options) {
+		o.tombstoneGrace = grace
+	}
+}
+
+/*
+Selects how the replicas of a key agree on its value. Every node of a
+cluster must use the same mode.
+*/
+func WithReplicationMode(mode ReplicationMode) Option {
+	return func(o *options) {
+		o.replicationMode = mode
+	}
+}
+
+/*
+Makes a node without Raft state wait to be added to the groups of its
+partitions instead of starting them, as a node that joins or replaces one
+of a running cluster must.
+*/
+func WithRaftJoin(join bool) Option {
+	return func(o *options) {
+		o.raftJoin = join
+	}
+}
+
+/*
+Sets the length of a Raft tick. Leaders send heartbeats every tick, and
+followers start an election after 10 to 20 ticks without one.
+*/
+func WithRaftTickInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.raftTick = interval
+	}
+}
+
+func randomNodeID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
@@ -0,0 +1,1127 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/raft"
+)
+
+/*
+How the replicas of a key agree on its value. Every node of a cluster must
+use the same mode.
+*/
+type ReplicationMode string
+
+const (
+	// The default: any replica takes writes, which reach the others
+	// through quorums, hints, read repair and anti-entropy.
+	EventualReplication ReplicationMode = "eventual"
+	// The partitions of the ring held by the same replicas form a Raft
+	// group, whose leader orders every write and serves every read.
+	RaftReplication ReplicationMode = "raft"
+)
+
+func ParseReplicationMode(s string) (ReplicationMode, error) {
+	switch mode := ReplicationMode(strings.ToLower(s)); mode {
+	case EventualReplication, RaftReplication:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown replication mode %q (available: %s, %s)", s, EventualReplication, RaftReplication)
+}
+
+const (
+	// How long a Raft tick lasts. Leaders send heartbeats every tick, and
+	// followers start an election after 10 to 20 ticks without one.
+	DefaultRaftTickInterval = 100 * time.Millisecond
+	// The header a node that does not lead a group names the leader it
+	// knows of in.
+	RaftLeaderHeader = "X-Raft-Leader"
+	// How many entries a group applies before it compacts its log into a
+	// snapshot of its partition.
+	raftSnapshotEntries = 1000
+	// How long a write or read waits for the leader of its group to be
+	// found and, for writes, to commit it.
+	raftRequestTimeout = 5 * time.Second
+	// How many batches of messages wait to be sent to a node before further
+	// ones are dropped.
+	raftOutboxSize = 64
+)
+
+/*
+Returned when a request for a Raft group reaches a node that does not lead
+it.
+*/
+var ErrNotRaftLeader = errors.New("not the raft leader")
+
+// Marks failures to reach a node, after which requests try another one.
+var errRaftUnreachable = errors.New("node unreachable")
+
+// Marks requests a group did not complete in time.
+var errRaftTimeout = errors.New("raft request timed out")
+
+/*
+The partitions of the ring held by one set of replicas, replicated by Raft,
+as hosted by this node. mu serializes applying the group's committed
+entries, waiters holds the proposals of this node that wait for theirs, by
+index, and reads the reads that wait to be confirmed, by ID.
+*/
+type raftGroup struct {
+	id       uint32
+	node     *raft.Node
+	mu       sync.Mutex
+	waiters  map[uint64]raftWaiter
+	reads    map[uint64]*raftRead
+	applied  uint64
+	snapshot uint64
+}
+
+type raftWaiter struct {
+	term uint64
+	done chan error
+}
+
+/*
+A read on the leader of a group, which may proceed once the leader
+confirmed it and applied the entries up to index.
+*/
+type raftRead struct {
+	index     uint64
+	confirmed bool
+	done      chan error
+}
+
+type raftOp string
+
+const (
+	raftOpSet    raftOp = "set"
+	raftOpDelete raftOp = "delete"
+)
+
+/*
+A write as proposed to the log of a group. Everything that is not given by
+the log itself is fixed when it is proposed, so that every replica applies
+it alike. Conditions are checked when it is applied.
+*/
+type raftCommand struct {
+	Op          raftOp    `json:"op"`
+	Key         string    `json:"key"`
+	Value       []byte    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Modified    int64     `json:"modified"`
+	Expires     int64     `json:"expires,omitempty"`
+	Condition   Condition `json:"condition"`
+}
+
+/*
+Adds a node to or removes it from Raft groups. Without Groups, the change
+applies to every group this node leads.
+*/
+type MembershipChange struct {
+	Action raft.ConfChangeType `json:"action"`
+	Node   string              `json:"node"`
+	Groups []uint32            `json:"groups,omitempty"`
+}
+
+/*
+The groups a membership change was committed in, and why it failed in
+others.
+*/
+type MembershipResult struct {
+	Changed []uint32          `json:"changed"`
+	Errors  map[uint32]string `json:"errors,omitempty"`
+}
+
+/*
+Hosts a Raft group for every set of replicas this node belongs to, unless
+it joins the cluster, in which case it waits to be added to groups.
+
+Every key this node held when it started is deleted, from the WAL and
+snapshots too: in raft mode the keyspace is only ever written by applying
+the logs of the groups, so it is rebuilt from their snapshots and logs,
+which are kept under the data directory, or in memory without one. Keys
+written in eventual mode are therefore lost when a node is switched to
+raft mode.
+*/
+func (s *Store) startRaft(o options) error {
+	s.raftGroups = make(map[uint32]*raftGroup)
+	s.raftOutbox = make(map[string]chan []raft.Message)
+	if s.dataDir == "" {
+		log.Printf("Warning: raft state is kept in memory without a data directory; a restarted node must be removed from its groups and added back")
+	}
+	if err := s.planRaftGroups(); err != nil {
+		return err
+	}
+
+	var keys []string
+	err := s.engine.Iterate(PrefixEnd(internalKeyPrefix), "", func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		log.Printf("Dropping %d local keys to rebuild them from the raft groups", len(keys))
+	}
+	s.mu.Lock()
+	for _, key := range keys {
+		if err := s.remove(key); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.raftKeys = make(map[uint32]map[string]struct{})
+	s.mu.Unlock()
+
+	ids := make([]uint32, 0, len(s.raftReplicas))
+	for id, voters := range s.raftReplicas {
+		if contains(voters, s.self) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		var voters []string
+		if !o.raftJoin {
+			voters = s.raftReplicas[id]
+		}
+		s.raftMu.Lock()
+		g, err := s.openRaftGroup(id, voters)
+		s.raftMu.Unlock()
+		if err != nil {
+			return err
+		}
+		s.processRaft(g)
+	}
+
+	s.wg.Add(1)
+	go s.raftLoop(s.raftTick)
+	return nil
+}
+
+/*
+Assigns every partition of the ring to the group of its replicas. The
+partitions held by the same nodes share one group, whose ID is the hash of
+their sorted addresses, so that a node hosts one group for each set of
+nodes it shares keys with rather than one for each virtual node.
+*/
+func (s *Store) planRaftGroups() error {
+	s.raftPartitions = make([]uint32, s.ownerRing.Len())
+	s.raftReplicas = make(map[uint32][]string)
+	for i := range s.raftPartitions {
+		voters, err := s.walkFrom(i, s.replicationFactor)
+		if err != nil {
+			return err
+		}
+		voters = append([]string(nil), voters...)
+		sort.Strings(voters)
+		name := strings.Join(voters, ",")
+		id := s.ownerRing.HashStr(name)
+		if held, ok := s.raftReplicas[id]; ok && strings.Join(held, ",") != name {
+			return fmt.Errorf("raft groups of %s and %s have the same ID %d", strings.Join(held, ","), name, id)
+		}
+		s.raftReplicas[id] = voters
+		s.raftPartitions[i] = id
+	}
+	return nil
+}
+
+/*
+Opens the group with the given ID, which starts with voters if it has no
+state yet. The caller must hold s.raftMu.
+*/
+func (s *Store) openRaftGroup(id uint32, voters []string) (*raftGroup, error) {
+	var storage raft.Storage = raft.NewMemoryStorage()
+	if s.dataDir != "" {
+		var err error
+		if storage, err = raft.NewFileStorage(filepath.Join(s.dataDir, "raft", strconv.FormatUint(uint64(id), 10))); err != nil {
+			return nil, err
+		}
+	}
+	node, err := raft.NewNode(raft.Config{ID: s.self, Group: id, Peers: voters, Storage: storage})
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to open raft group %d: %w", id, err)
+	}
+	g := &raftGroup{id: id, node: node, waiters: make(map[uint64]raftWaiter), reads: make(map[uint64]*raftRead)}
+	status := node.Status()
+	g.applied, g.snapshot = status.Applied, status.SnapshotIndex
+	s.raftGroups[id] = g
+	return g, nil
+}
+
+/*
+Returns the group with the given ID, or nil if this node does not host it.
+With create set, the group is opened if the ring has it: a node that is
+sent messages for a group it does not host was added to it.
+*/
+func (s *Store) raftGroup(id uint32, create bool) (*raftGroup, error) {
+	s.raftMu.Lock()
+	defer s.raftMu.Unlock()
+	if g, ok := s.raftGroups[id]; ok || !create {
+		return g, nil
+	}
+	if _, ok := s.raftReplicas[id]; !ok {
+		return nil, fmt.Errorf("no raft group %d", id)
+	}
+	return s.openRaftGroup(id, nil)
+}
+
+func (s *Store) raftGroupList() []*raftGroup {
+	s.raftMu.Lock()
+	defer s.raftMu.Unlock()
+	groups := make([]*raftGroup, 0, len(s.raftGroups))
+	for _, g := range s.raftGroups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].id < groups[j].id })
+	return groups
+}
+
+/*
+Returns the ID of the group that replicates key: the group of the
+replicas of its partition.
+*/
+func (s *Store) raftGroupOf(key string) (uint32, error) {
+	idx, err := s.ownerRing.GetRingIndex(s.ownerRing.HashStr(key))
+	if err != nil {
+		return 0, err
+	}
+	if idx >= len(s.raftPartitions) {
+		return 0, fmt.Errorf("no raft group for key %s", key)
+	}
+	return s.raftPartitions[idx], nil
+}
+
+/*
+Records that key is held by its group, so that snapshots of the group
+read only its keys. The caller must hold s.mu.
+*/
+func (s *Store) indexRaftKey(key string) {
+	id, err := s.raftGroupOf(key)
+	if err != nil || s.raftKeys == nil {
+		return
+	}
+	keys, ok := s.raftKeys[id]
+	if !ok {
+		keys = make(map[string]struct{})
+		s.raftKeys[id] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+/*
+Drops key from the index of its group. The caller must hold s.mu.
+*/
+func (s *Store) unindexRaftKey(key string) {
+	if s.raftKeys == nil {
+		return
+	}
+	if id, err := s.raftGroupOf(key); err == nil {
+		delete(s.raftKeys[id], key)
+	}
+}
+
+func (s *Store) raftLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.tickRaft()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+/*
+Advances the clock of every group. Their messages go out together, so that
+each node gets one request per tick.
+*/
+func (s *Store) tickRaft() {
+	var msgs []raft.Message
+	for _, g := range s.raftGroupList() {
+		if err := g.node.Tick(); err != nil {
+			log.Printf("Raft group %d failed to tick: %v", g.id, err)
+		}
+		msgs = append(msgs, s.readyRaft(g)...)
+	}
+	s.sendRaft(msgs)
+}
+
+/*
+Applies what the group has committed, compacts its log if it has grown
+enough and sends its messages.
+*/
+func (s *Store) processRaft(g *raftGroup) {
+	s.sendRaft(s.readyRaft(g))
+}
+
+/*
+Like processRaft, but returns the messages of the group instead of sending
+them.
+*/
+func (s *Store) readyRaft(g *raftGroup) []raft.Message {
+	g.mu.Lock()
+	rd := g.node.Ready()
+	if rd.Snapshot != nil {
+		if err := s.restorePartition(g.id, rd.Snapshot.Data); err != nil {
+			log.Printf("Raft group %d failed to restore its snapshot: %v", g.id, err)
+		}
+		g.applied, g.snapshot = rd.Snapshot.Index, rd.Snapshot.Index
+	}
+	for _, e := range rd.Committed {
+		err := s.applyRaftEntry(e)
+		if w, ok := g.waiters[e.Index]; ok {
+			if w.term != e.Term {
+				// Another leader replaced the proposal.
+				err = ErrNotRaftLeader
+			}
+			w.done <- err
+			delete(g.waiters, e.Index)
+		} else if err != nil && !errors.Is(err, ErrPreconditionFailed) {
+			log.Printf("Raft group %d failed to apply entry %d: %v", g.id, e.Index, err)
+		}
+		g.applied = e.Index
+	}
+	s.releaseReads(g, rd.ReadStates)
+	if g.applied-g.snapshot >= raftSnapshotEntries {
+		if err := g.node.Compact(g.applied, s.partitionData(g.id)); err != nil {
+			log.Printf("Raft group %d failed to compact its log: %v", g.id, err)
+		} else {
+			g.snapshot = g.applied
+		}
+	}
+	g.mu.Unlock()
+	return rd.Messages
+}
+
+/*
+Lets the reads of the group proceed that are confirmed and whose entries
+are applied, and fails those that can no longer be confirmed because this
+node stopped leading the group. The caller must hold g.mu.
+*/
+func (s *Store) releaseReads(g *raftGroup, states []raft.ReadState) {
+	for _, rs := range states {
+		if r, ok := g.reads[rs.ID]; ok {
+			r.index, r.confirmed = rs.Index, true
+		}
+	}
+	if len(g.reads) == 0 {
+		return
+	}
+	leading := g.node.IsLeader()
+	for id, r := range g.reads {
+		switch {
+		case r.confirmed && r.index <= g.applied:
+			r.done <- nil
+		case !r.confirmed && !leading:
+			r.done <- ErrNotRaftLeader
+		default:
+			continue
+		}
+		delete(g.reads, id)
+	}
+}
+
+/*
+Applies a committed write to the local keyspace. The version of the key
+becomes the index of the entry, which only grows. Fails with
+ErrPreconditionFailed if the condition of the write does not hold.
+*/
+func (s *Store) applyRaftEntry(e raft.Entry) error {
+	if e.Type != raft.EntryNormal || len(e.Data) == 0 {
+		return nil
+	}
+	var cmd raftCommand
+	if err := json.Unmarshal(e.Data, &cmd); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held, ok := s.conditionEntry(cmd.Key)
+	if err := cmd.Condition.check(held, ok, e.Index); err != nil {
+		return err
+	}
+	if cmd.Op == raftOpDelete {
+		if _, exists := s.loadEntry(cmd.Key); !exists {
+			return nil
+		}
+		return s.remove(cmd.Key)
+	}
+
+	record := entry{value: cmd.Value, contentType: cmd.ContentType, modified: cmd.Modified, expires: cmd.Expires, version: e.Index}
+	return s.putRecord(cmd.Key, record)
+}
+
+/*
+Writes record to key, making room for it first if memory is limited. The
+caller must hold s.mu.
+*/
+func (s *Store) putRecord(key string, record entry) error {
+	encoded := record.encode()
+	size := entrySize(key, len(encoded))
+	if err := s.makeRoom(key, size); err != nil {
+		return err
+	}
+	if err := s.commit(walOpSet, key, string(encoded)); err != nil {
+		return err
+	}
+	s.limiter.track(key, size, record.lastExpiry())
+	s.indexRaftKey(key)
+	return nil
+}
+
+/*
+Encodes the keys held by group id, in order, each as its length-prefixed
+name followed by its length-prefixed entry.
+*/
+func (s *Store) partitionData(id uint32) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.raftKeys[id]))
+	for key := range s.raftKeys[id] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var data []byte
+	for _, key := range keys {
+		buf, ok, err := s.engine.Get(key)
+		if err != nil {
+			log.Printf("Failed to read key %s of raft group %d: %v", key, id, err)
+			continue
+		}
+		if ok {
+			data = appendString(data, key)
+			data = appendString(data, string(buf))
+		}
+	}
+	return data
+}
+
+/*
+Replaces the keys held by group id with those encoded in data by
+partitionData.
+*/
+func (s *Store) restorePartition(id uint32, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.raftKeys[id] {
+		if err := s.remove(key); err != nil {
+			return err
+		}
+	}
+	for len(data) > 0 {
+		key, rest, ok := readString(data)
+		if !ok {
+			return errCorruptEntry
+		}
+		buf, rest, ok := readString(rest)
+		if !ok {
+			return errCorruptEntry
+		}
+		data = rest
+		record, err := decodeEntry([]byte(buf))
+		if err != nil {
+			return err
+		}
+		if err := s.putRecord(key, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Queues messages for the nodes they are addressed to. Each node has a
+sender of its own, so that a slow node does not hold up the others;
+messages for a node whose queue is full are dropped, which Raft recovers
+from.
+*/
+func (s *Store) sendRaft(msgs []raft.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	byNode := make(map[string][]raft.Message)
+	for _, m := range msgs {
+		byNode[m.To] = append(byNode[m.To], m)
+	}
+
+	s.raftMu.Lock()
+	defer s.raftMu.Unlock()
+	for node, batch := range byNode {
+		outbox, ok := s.raftOutbox[node]
+		if !ok {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			outbox = make(chan []raft.Message, raftOutboxSize)
+			s.raftOutbox[node] = outbox
+			s.wg.Add(1)
+			go s.raftSender(node, outbox)
+		}
+		select {
+		case outbox <- batch:
+		default:
+		}
+	}
+}
+
+/*
+Sends the messages queued for node, combining the batches that queued up
+while the previous request was in flight.
+*/
+func (s *Store) raftSender(node string, outbox chan []raft.Message) {
+	defer s.wg.Done()
+	for {
+		var msgs []raft.Message
+		select {
+		case msgs = <-outbox:
+		case <-s.done:
+			return
+		}
+		for more := true; more; {
+			select {
+			case batch := <-outbox:
+				msgs = append(msgs, batch...)
+			default:
+				more = false
+			}
+		}
+		if err := s.postRaftMessages(node, msgs); err != nil {
+			log.Printf("Failed to send raft messages to %s: %v", node, err)
+		}
+	}
+}
+
+func (s *Store) postRaftMessages(node string, msgs []raft.Message) error {
+	body, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/_/raft/messages", node), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/*
+Hands messages sent by other nodes to the groups they are for.
+*/
+func (s *Store) StepRaft(msgs []raft.Message) error {
+	if s.raftGroups == nil {
+		return errors.New("raft replication is not enabled")
+	}
+	touched := make(map[uint32]*raftGroup)
+	for _, m := range msgs {
+		g, err := s.raftGroup(m.Group, true)
+		if err != nil {
+			return err
+		}
+		if err := g.node.Step(m); err != nil {
+			return err
+		}
+		touched[m.Group] = g
+	}
+	var out []raft.Message
+	for _, g := range touched {
+		out = append(out, s.readyRaft(g)...)
+	}
+	s.sendRaft(out)
+	return nil
+}
+
+/*
+Proposes a write encoded by a raftCommand to group id, which this node
+must lead, and waits until it is applied.
+*/
+func (s *Store) ProposeRaft(id uint32, command []byte) error {
+	g, err := s.raftGroup(id, false)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		return ErrNotRaftLeader
+	}
+	return s.proposeRaft(g, command)
+}
+
+func (s *Store) proposeRaft(g *raftGroup, command []byte) error {
+	g.mu.Lock()
+	index, term, err := g.node.Propose(command)
+	if err != nil {
+		g.mu.Unlock()
+		if errors.Is(err, raft.ErrNotLeader) {
+			return ErrNotRaftLeader
+		}
+		return err
+	}
+	done := make(chan error, 1)
+	g.waiters[index] = raftWaiter{term: term, done: done}
+	g.mu.Unlock()
+	return s.awaitRaft(g, index, done)
+}
+
+/*
+Processes the group and waits for the entry at index to be applied.
+*/
+func (s *Store) awaitRaft(g *raftGroup, index uint64, done chan error) error {
+	if err := s.awaitGroup(g, done); err != errRaftTimeout {
+		return err
+	}
+	g.mu.Lock()
+	delete(g.waiters, index)
+	g.mu.Unlock()
+	return fmt.Errorf("%w: raft group %d did not commit entry %d in time", ErrNotEnoughReplicas, g.id, index)
+}
+
+/*
+Waits until this node, which must lead the group, has confirmed that it
+still does and applied every entry committed before, so that what it
+holds for the keys of the group reflects every write acknowledged so far.
+*/
+func (s *Store) confirmRead(g *raftGroup) error {
+	g.mu.Lock()
+	id, err := g.node.ReadIndex()
+	if err != nil {
+		g.mu.Unlock()
+		if errors.Is(err, raft.ErrNotLeader) {
+			return ErrNotRaftLeader
+		}
+		return err
+	}
+	done := make(chan error, 1)
+	g.reads[id] = &raftRead{done: done}
+	g.mu.Unlock()
+	if err := s.awaitGroup(g, done); err != errRaftTimeout {
+		return err
+	}
+	g.mu.Lock()
+	delete(g.reads, id)
+	g.mu.Unlock()
+	return fmt.Errorf("%w: raft group %d did not confirm a read in time", ErrNotEnoughReplicas, g.id)
+}
+
+/*
+Processes the group and returns what done yields, or errRaftTimeout if the
+request times out or the store is closed first.
+*/
+func (s *Store) awaitGroup(g *raftGroup, done chan error) error {
+	s.processRaft(g)
+	timer := time.NewTimer(raftRequestTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	case <-s.done:
+	}
+	return errRaftTimeout
+}
+
+/*
+Returns the copy of key held by this node if it leads group id, once it
+confirmed that it still does. With stale set, any node hosting the group
+returns its copy right away, which may miss the latest writes.
+*/
+func (s *Store) ReadRaft(id uint32, key string, stale bool) (KeyValue, bool, error) {
+	g, err := s.raftGroup(id, false)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	if g == nil {
+		return KeyValue{}, false, ErrNotRaftLeader
+	}
+	if !stale {
+		if err := s.confirmRead(g); err != nil {
+			return KeyValue{}, false, err
+		}
+	}
+	item, ok := s.Lookup(key)
+	return item, ok, nil
+}
+
+/*
+Returns the leader of group id as far as this node knows.
+*/
+func (s *Store) RaftLeader(id uint32) string {
+	g, err := s.raftGroup(id, false)
+	if err != nil || g == nil {
+		return ""
+	}
+	return g.node.Leader()
+}
+
+/*
+Returns the state of every group this node hosts.
+*/
+func (s *Store) RaftStatus() []raft.Status {
+	groups := s.raftGroupList()
+	statuses := make([]raft.Status, len(groups))
+	for i, g := range groups {
+		statuses[i] = g.node.Status()
+	}
+	return statuses
+}
+
+/*
+Proposes a membership change to the groups this node leads, one after the
+other, and waits for each to commit.
+*/
+func (s *Store) ChangeRaftMembers(change MembershipChange) (MembershipResult, error) {
+	if s.raftGroups == nil {
+		return MembershipResult{}, errors.New("raft replication is not enabled")
+	}
+	if change.Node == "" {
+		return MembershipResult{}, errors.New("node is required")
+	}
+	if change.Action != raft.AddVoter && change.Action != raft.RemoveVoter {
+		return MembershipResult{}, fmt.Errorf("unknown action %q (available: %s, %s)", change.Action, raft.AddVoter, raft.RemoveVoter)
+	}
+	var groups []*raftGroup
+	if len(change.Groups) == 0 {
+		groups = s.raftGroupList()
+	} else {
+		for _, id := range change.Groups {
+			g, err := s.raftGroup(id, false)
+			if err != nil {
+				return MembershipResult{}, err
+			}
+			if g == nil {
+				return MembershipResult{}, fmt.Errorf("raft group %d is not hosted by this node", id)
+			}
+			groups = append(groups, g)
+		}
+	}
+
+	result := MembershipResult{Changed: []uint32{}, Errors: make(map[uint32]string)}
+	for _, g := range groups {
+		if !g.node.IsLeader() {
+			if len(change.Groups) > 0 {
+				result.Errors[g.id] = ErrNotRaftLeader.Error()
+			}
+			continue
+		}
+		g.mu.Lock()
+		index, term, err := g.node.ProposeConfChange(raft.ConfChange{Type: change.Action, Node: change.Node})
+		if errors.Is(err, raft.ErrNoConfChange) {
+			g.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			g.mu.Unlock()
+			result.Errors[g.id] = err.Error()
+			continue
+		}
+		done := make(chan error, 1)
+		g.waiters[index] = raftWaiter{term: term, done: done}
+		g.mu.Unlock()
+		if err := s.awaitRaft(g, index, done); err != nil {
+			result.Errors[g.id] = err.Error()
+			continue
+		}
+		result.Changed = append(result.Changed, g.id)
+	}
+	return result, nil
+}
+
+/*
+Writes key through the leader of its group and waits until the write is
+applied there.
+*/
+func (s *Store) writeRaft(key string, cmd raftCommand) error {
+	id, err := s.raftGroupOf(key)
+	if err != nil {
+		return err
+	}
+	command, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return s.onRaftLeader(id,
+		func(g *raftGroup) error { return s.proposeRaft(g, command) },
+		func(node string) (string, error) { return s.forwardProposal(node, id, command) })
+}
+
+func (s *Store) setRaft(key string, value []byte, opts WriteOptions) error {
+	if opts.TTL < 0 {
+		return errors.New("ttl cannot be negative")
+	}
+	cmd := raftCommand{Op: raftOpSet, Key: key, Value: value, ContentType: opts.ContentType, Modified: s.now().UnixNano(), Condition: opts.Condition}
+	if opts.TTL > 0 {
+		cmd.Expires = cmd.Modified + int64(opts.TTL)
+	}
+	return s.writeRaft(key, cmd)
+}
+
+func (s *Store) deleteRaft(key string, opts WriteOptions) error {
+	return s.writeRaft(key, raftCommand{Op: raftOpDelete, Key: key, Modified: s.now().UnixNano(), Condition: opts.Condition})
+}
+
+/*
+Reads key from the leader of its group, which confirms that it still leads
+it first, so that the read sees every write acknowledged before it. A
+stale read is served by this node if it hosts the group, or else by the
+first of its voters that answers.
+*/
+func (s *Store) readRaft(key string, stale bool) (ReadResult, error) {
+	id, err := s.raftGroupOf(key)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	result := ReadResult{Answered: 1}
+	remote := func(node string) (string, error) {
+		item, found, leader, err := s.fetchRaftItem(node, id, key, stale)
+		if err == nil && found {
+			result.Item, result.Value, result.Found = item, bytes.NewReader(item.Value), true
+			result.Item.Value = nil
+		}
+		return leader, err
+	}
+
+	if stale {
+		g, err := s.raftGroup(id, false)
+		if err != nil {
+			return ReadResult{}, err
+		}
+		if g != nil {
+			result.Item, result.Value, result.Found = s.Open(key)
+			return result, nil
+		}
+		var errs MultiError
+		for _, node := range s.raftVoters(id, nil) {
+			if _, err := remote(node); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return result, nil
+		}
+		return ReadResult{}, fmt.Errorf("%w: no voter of raft group %d answered: %v", ErrNotEnoughReplicas, id, errs)
+	}
+
+	err = s.onRaftLeader(id,
+		func(g *raftGroup) error {
+			if err := s.confirmRead(g); err != nil {
+				return err
+			}
+			result.Item, result.Value, result.Found = s.Open(key)
+			return nil
+		}, remote)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	return result, nil
+}
+
+/*
+Runs a request for group id on its leader: with local if this node leads
+it, otherwise with remote on the leader this node knows of, or on the
+voters of the group in turn, which name the leader they know of if they do
+not lead it. Fails with ErrNotEnoughReplicas if no leader is found in time.
+*/
+func (s *Store) onRaftLeader(id uint32, local func(*raftGroup) error, remote func(node string) (string, error)) error {
+	deadline := time.Now().Add(raftRequestTimeout)
+	hint := ""
+	for attempt := 0; ; attempt++ {
+		g, err := s.raftGroup(id, false)
+		if err != nil {
+			return err
+		}
+		node := ""
+		if g != nil && g.node.IsLeader() {
+			if err := local(g); !errors.Is(err, ErrNotRaftLeader) {
+				return err
+			}
+		} else {
+			if g != nil && hint == "" {
+				hint = g.node.Leader()
+			}
+			node = hint
+			if node == "" || node == s.self {
+				voters := s.raftVoters(id, g)
+				if len(voters) == 0 {
+					return fmt.Errorf("%w: raft group %d has no other voters", ErrNotEnoughReplicas, id)
+				}
+				node = voters[attempt%len(voters)]
+			}
+			leader, err := remote(node)
+			if !errors.Is(err, ErrNotRaftLeader) && !errors.Is(err, errRaftUnreachable) {
+				return err
+			}
+			hint = leader
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: no leader found for raft group %d", ErrNotEnoughReplicas, id)
+		}
+		// Follow a new hint right away, but give an election time to settle.
+		if hint == "" || hint == node {
+			select {
+			case <-time.After(s.raftTick):
+			case <-s.done:
+				return errors.New("store is closed")
+			}
+		}
+	}
+}
+
+/*
+Returns the voters of group id other than this node: those this node
+knows of if it hosts the group, and the replicas of its partition
+otherwise.
+*/
+func (s *Store) raftVoters(id uint32, g *raftGroup) []string {
+	var voters []string
+	if g != nil {
+		voters = g.node.Status().Voters
+	}
+	if len(voters) == 0 {
+		voters = s.raftReplicas[id]
+	}
+	others := voters[:0:0]
+	for _, v := range voters {
+		if v != s.self {
+			others = append(others, v)
+		}
+	}
+	return others
+}
+
+/*
+Sends a proposal to node. If node does not lead the group, returns the
+leader it names.
+*/
+func (s *Store) forwardProposal(node string, id uint32, command []byte) (string, error) {
+	url := fmt.Sprintf("http://%s/_/raft/propose?group=%d", node, id)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(command))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errRaftUnreachable, err)
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get(RaftLeaderHeader), raftResponseError(node, resp)
+}
+
+/*
+Reads key from node, which must lead group id unless the read is stale. If
+it does not, returns the leader it names.
+*/
+func (s *Store) fetchRaftItem(node string, id uint32, key string, stale bool) (KeyValue, bool, string, error) {
+	target := fmt.Sprintf("http://%s/_/raft/read?group=%d&key=%s", node, id, url.QueryEscape(key))
+	if stale {
+		target += "&stale=ok"
+	}
+	resp, err := s.client.Get(target)
+	if err != nil {
+		return KeyValue{}, false, "", fmt.Errorf("%w: %v", errRaftUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return KeyValue{}, false, "", nil
+	}
+	if err := raftResponseError(node, resp); err != nil {
+		return KeyValue{}, false, resp.Header.Get(RaftLeaderHeader), err
+	}
+	var item KeyValue
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return KeyValue{}, false, "", fmt.Errorf("invalid item from %s: %w", node, err)
+	}
+	return item, true, "", nil
+}
+
+/*
+Maps the status of a response to a Raft request back to the error the
+node failed with.
+*/
+func raftResponseError(node string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode < 400:
+		return nil
+	case resp.StatusCode == http.StatusMisdirectedRequest:
+		return ErrNotRaftLeader
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case resp.StatusCode == http.StatusInsufficientStorage:
+		return ErrOutOfMemory
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return fmt.Errorf("%w: %s answered %s", ErrNotEnoughReplicas, node, bytes.TrimSpace(message))
+	}
+	return fmt.Errorf("%s answered with status code %d: %s", node, resp.StatusCode, bytes.TrimSpace(message))
+}
+
+/*
+Adds the number of groups this node hosts and leads to metrics.
+*/
+func (s *Store) raftStats(metrics map[string]int64) {
+	groups := s.raftGroupList()
+	leading := 0
+	for _, g := range groups {
+		if g.node.IsLeader() {
+			leading++
+		}
+	}
+	metrics["raft_groups"] = int64(len(groups))
+	metrics["raft_leader_groups"] = int64(leading)
+}
+
+/*
+Closes the storage of every group.
+*/
+func (s *Store) closeRaft() error {
+	var errs MultiError
+	for _, g := range s.raftGroupList() {
+		if err := g.node.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,405 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Firaz-Ilhan/distributed-kvstore/raft"
+)
+
+/*
+Stores in raft replication mode that talk to each other through mock
+clients, as the handlers would route their requests. Requests to or from
+nodes in down or cut off fail, and nodes in down stop ticking.
+*/
+type raftCluster struct {
+	t      *testing.T
+	nodes  []string
+	stores map[string]*Store
+	mu     sync.Mutex
+	down   map[string]bool
+	cutOff map[string]bool
+}
+
+// Slow enough for the groups of three stores to keep up under the race
+// detector.
+const raftTestTick = 100 * time.Millisecond
+
+func newRaftCluster(t *testing.T) *raftCluster {
+	t.Helper()
+	c := &raftCluster{t: t, nodes: []string{"node1", "node2", "node3"}, stores: make(map[string]*Store), down: make(map[string]bool), cutOff: make(map[string]bool)}
+	for _, node := range c.nodes {
+		// The loop of the store never ticks; the cluster ticks it instead, once
+		// the clients are in place.
+		c.stores[node] = newTestStore(t, c.nodes, 3,
+			WithAdvertiseAddr(node),
+			WithReplicationMode(RaftReplication),
+			WithRaftTickInterval(time.Hour))
+	}
+	for _, node := range c.nodes {
+		c.stores[node].client = c.client(node)
+		c.stores[node].raftTick = raftTestTick
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(raftTestTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, node := range c.nodes {
+					if !c.isDown(node) {
+						c.stores[node].tickRaft()
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		wg.Wait()
+	})
+	return c
+}
+
+func (c *raftCluster) isDown(node string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.down[node]
+}
+
+func (c *raftCluster) stop(node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[node] = true
+}
+
+func (c *raftCluster) cut(node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cutOff[node] = true
+}
+
+func (c *raftCluster) unreachable(node string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.down[node] || c.cutOff[node]
+}
+
+func (c *raftCluster) client(from string) *MockHttpClient {
+	respond := func(peer *Store, group uint32, err error, body interface{}) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(nil))}
+		switch {
+		case errors.Is(err, ErrNotRaftLeader):
+			resp.StatusCode = http.StatusMisdirectedRequest
+			resp.Header.Set(RaftLeaderHeader, peer.RaftLeader(group))
+		case errors.Is(err, ErrPreconditionFailed):
+			resp.StatusCode = http.StatusPreconditionFailed
+		case err != nil:
+			resp.StatusCode = http.StatusServiceUnavailable
+		case body != nil:
+			buf, _ := json.Marshal(body)
+			resp.Body = io.NopCloser(bytes.NewReader(buf))
+		}
+		return resp
+	}
+	route := func(u *url.URL) (*Store, uint32, error) {
+		if c.unreachable(from) || c.unreachable(u.Host) {
+			return nil, 0, errors.New("connection refused")
+		}
+		group, _ := strconv.ParseUint(u.Query().Get("group"), 10, 32)
+		return c.stores[u.Host], uint32(group), nil
+	}
+
+	return &MockHttpClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			peer, group, err := route(req.URL)
+			if err != nil {
+				return nil, err
+			}
+			switch req.URL.Path {
+			case "/_/raft/messages":
+				var msgs []raft.Message
+				_ = json.NewDecoder(req.Body).Decode(&msgs)
+				return respond(peer, group, peer.StepRaft(msgs), nil), nil
+			case "/_/raft/propose":
+				command, _ := io.ReadAll(req.Body)
+				return respond(peer, group, peer.ProposeRaft(group, command), nil), nil
+			}
+			c.t.Errorf("unexpected request %s %s", req.Method, req.URL)
+			return nil, errors.New("unexpected request")
+		},
+		getFunc: func(rawURL string) (*http.Response, error) {
+			u, _ := url.Parse(rawURL)
+			peer, group, err := route(u)
+			if err != nil {
+				return nil, err
+			}
+			item, found, err := peer.ReadRaft(group, u.Query().Get("key"), u.Query().Get("stale") == "ok")
+			if err == nil && !found {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+			}
+			return respond(peer, group, err, item), nil
+		},
+	}
+}
+
+/*
+Returns the node leading the group of key, waiting for one to be elected.
+*/
+func (c *raftCluster) leader(key string) string {
+	c.t.Helper()
+	id, err := c.stores[c.nodes[0]].raftGroupOf(key)
+	if err != nil {
+		c.t.Fatalf("raftGroupOf: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, node := range c.nodes {
+			if !c.unreachable(node) && c.stores[node].RaftLeader(id) == node {
+				return node
+			}
+		}
+	}
+	c.t.Fatalf("no leader was elected for the group of %s", key)
+	return ""
+}
+
+/*
+Waits until every node that is not down holds want for key, or none if want
+is nil.
+*/
+func (c *raftCluster) awaitValue(key string, want []byte) {
+	c.t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		agreed := true
+		for _, node := range c.nodes {
+			if c.unreachable(node) {
+				continue
+			}
+			value, ok := c.stores[node].Get(key)
+			if ok != (want != nil) || !bytes.Equal(value, want) {
+				agreed = false
+			}
+		}
+		if agreed {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("replicas did not agree on %s = %q", key, want)
+		}
+	}
+}
+
+func readRaftValue(t *testing.T, s *Store, key string) (string, bool) {
+	t.Helper()
+	result, err := s.Read(key, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !result.Found {
+		return "", false
+	}
+	return readValue(t, result), true
+}
+
+func TestRaftReplication(t *testing.T) {
+	t.Run("should apply writes made on any node on every replica", func(t *testing.T) {
+		c := newRaftCluster(t)
+		for i, node := range c.nodes {
+			err := c.stores[node].Set("key"+strconv.Itoa(i), []byte(node), WriteOptions{})
+			assertEqual(t, err, nil, "error of the write on "+node)
+		}
+		for i, node := range c.nodes {
+			c.awaitValue("key"+strconv.Itoa(i), []byte(node))
+		}
+
+		leader := c.stores[c.leader("key0")]
+		item, _ := leader.Lookup("key0")
+		for _, node := range c.nodes {
+			replica, _ := c.stores[node].Lookup("key0")
+			assertEqual(t, replica.Version, item.Version, "version on "+node)
+		}
+	})
+
+	t.Run("should read from the leader", func(t *testing.T) {
+		c := newRaftCluster(t)
+		_ = c.stores["node1"].Set("key", []byte("value"), WriteOptions{})
+		for _, node := range c.nodes {
+			value, found := readRaftValue(t, c.stores[node], "key")
+			assertEqual(t, found, true, "key found on "+node)
+			assertEqual(t, value, "value", "value read on "+node)
+		}
+		_, found := readRaftValue(t, c.stores["node2"], "missing")
+		assertEqual(t, found, false, "missing key found")
+	})
+
+	t.Run("should check conditions against the committed version", func(t *testing.T) {
+		c := newRaftCluster(t)
+		err := c.stores["node1"].Set("key", []byte("1"), WriteOptions{Condition: Condition{IfNoneMatch: true}})
+		assertEqual(t, err, nil, "error of the first create")
+		err = c.stores["node2"].Set("key", []byte("2"), WriteOptions{Condition: Condition{IfNoneMatch: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "second create failed the precondition")
+
+		result, _ := c.stores["node3"].Read("key", ReadOptions{})
+		err = c.stores["node3"].Set("key", []byte("3"), WriteOptions{Condition: Condition{IfMatch: result.Item.Version + 1}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "write with a wrong version failed the precondition")
+		err = c.stores["node3"].Set("key", []byte("3"), WriteOptions{Condition: Condition{IfMatch: result.Item.Version}})
+		assertEqual(t, err, nil, "error of the write with the current version")
+		c.awaitValue("key", []byte("3"))
+	})
+
+	t.Run("should delete keys on every replica", func(t *testing.T) {
+		c := newRaftCluster(t)
+		_ = c.stores["node1"].Set("key", []byte("value"), WriteOptions{})
+		err := c.stores["node2"].Delete("key", WriteOptions{})
+		assertEqual(t, err, nil, "error of the delete")
+		c.awaitValue("key", nil)
+		_, found := readRaftValue(t, c.stores["node3"], "key")
+		assertEqual(t, found, false, "deleted key found")
+	})
+
+	t.Run("should keep serving the key when its leader fails", func(t *testing.T) {
+		c := newRaftCluster(t)
+		_ = c.stores["node1"].Set("key", []byte("before"), WriteOptions{})
+		old := c.leader("key")
+		c.stop(old)
+
+		var other string
+		for _, node := range c.nodes {
+			if node != old {
+				other = node
+				break
+			}
+		}
+		if leader := c.leader("key"); leader == old {
+			t.Fatalf("the stopped node kept leading")
+		}
+		err := c.stores[other].Set("key", []byte("after"), WriteOptions{})
+		assertEqual(t, err, nil, "error of the write after the failure")
+		c.awaitValue("key", []byte("after"))
+		value, _ := readRaftValue(t, c.stores[other], "key")
+		assertEqual(t, value, "after", "value read after the failure")
+	})
+
+	t.Run("should not serve reads from a deposed leader", func(t *testing.T) {
+		c := newRaftCluster(t)
+		_ = c.stores["node1"].Set("key", []byte("before"), WriteOptions{})
+		c.awaitValue("key", []byte("before"))
+		id, _ := c.stores["node1"].raftGroupOf("key")
+		old := c.leader("key")
+		// Cut off, the old leader keeps ticking and believes it leads until
+		// it notices that it no longer hears from a majority.
+		c.cut(old)
+		if leader := c.leader("key"); leader == old {
+			t.Fatalf("the cut off node kept leading")
+		}
+		var other string
+		for _, node := range c.nodes {
+			if node != old {
+				other = node
+				break
+			}
+		}
+		_ = c.stores[other].Set("key", []byte("after"), WriteOptions{})
+
+		_, _, err := c.stores[old].ReadRaft(id, "key", false)
+		assertEqual(t, errors.Is(err, ErrNotRaftLeader), true, "read from the deposed leader failed")
+		item, found, err := c.stores[old].ReadRaft(id, "key", true)
+		assertEqual(t, err, nil, "error of the stale read")
+		assertEqual(t, found && string(item.Value) == "before", true, "stale read returned the old value")
+		value, _ := readRaftValue(t, c.stores[other], "key")
+		assertEqual(t, value, "after", "value read from the new leader")
+	})
+
+	t.Run("should serve stale reads from any replica", func(t *testing.T) {
+		c := newRaftCluster(t)
+		_ = c.stores["node1"].Set("key", []byte("value"), WriteOptions{})
+		c.awaitValue("key", []byte("value"))
+		leader := c.leader("key")
+		for _, node := range c.nodes {
+			if node != leader {
+				c.cut(node)
+				result, err := c.stores[node].Read("key", ReadOptions{Stale: true})
+				assertEqual(t, err, nil, "error of the stale read on "+node)
+				assertEqual(t, readValue(t, result), "value", "value read on "+node)
+			}
+		}
+	})
+
+	t.Run("should host one group per set of replicas", func(t *testing.T) {
+		c := newRaftCluster(t)
+		for _, node := range c.nodes {
+			assertEqual(t, len(c.stores[node].RaftStatus()), 1, "groups hosted by "+node)
+		}
+
+		nodes := []string{"node1", "node2", "node3", "node4"}
+		s := newTestStore(t, nodes, 2, WithAdvertiseAddr("node1"),
+			WithReplicationMode(RaftReplication), WithRaftTickInterval(time.Hour))
+		assertEqual(t, len(s.raftReplicas) <= 6, true, "at most one group per pair of nodes")
+		for _, status := range s.RaftStatus() {
+			assertEqual(t, contains(s.raftReplicas[status.Group], "node1"), true, "node1 replicates group")
+		}
+	})
+
+	t.Run("should snapshot only the keys of the group", func(t *testing.T) {
+		c := newRaftCluster(t)
+		for i := 0; i < 3; i++ {
+			_ = c.stores["node1"].Set("key"+strconv.Itoa(i), []byte("value"), WriteOptions{})
+		}
+		_ = c.stores["node1"].Delete("key1", WriteOptions{})
+		c.awaitValue("key1", nil)
+		c.awaitValue("key2", []byte("value"))
+
+		s := c.stores["node2"]
+		id, _ := s.raftGroupOf("key0")
+		var keys []string
+		for data := s.partitionData(id); len(data) > 0; {
+			key, rest, _ := readString(data)
+			_, data, _ = readString(rest)
+			keys = append(keys, key)
+		}
+		assertEqual(t, strings.Join(keys, ","), "key0,key2", "keys in the snapshot")
+
+		snapshot := s.partitionData(id)
+		_ = s.Set("other", []byte("value"), WriteOptions{})
+		c.awaitValue("other", []byte("value"))
+		err := s.restorePartition(id, snapshot)
+		assertEqual(t, err, nil, "error of the restore")
+		_, ok := s.Get("other")
+		assertEqual(t, ok, false, "key written after the snapshot held")
+		value, _ := s.Get("key2")
+		assertEqual(t, string(value), "value", "value of key2 after the restore")
+	})
+
+	t.Run("should report the replication mode", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 3, WithAdvertiseAddr("node1"),
+			WithReplicationMode(RaftReplication), WithRaftTickInterval(time.Hour))
+		assertEqual(t, s.ClusterConfig().Replication, RaftReplication, "replication mode")
+
+		s = newTestStore(t, []string{"node1", "node2", "node3"}, 3, WithAdvertiseAddr("node1"))
+		assertEqual(t, s.ClusterConfig().Replication, EventualReplication, "default replication mode")
+	})
+
+	t.Run("should reject an unknown replication mode", func(t *testing.T) {
+		_, err := ParseReplicationMode("paxos")
+		assertEqual(t, err != nil, true, "error for an unknown mode")
+		mode, err := ParseReplicationMode("raft")
+		assertEqual(t, err, nil, "error for raft")
+		assertEqual(t, mode, RaftReplication, "parsed mode")
+	})
+}
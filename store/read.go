@@ -0,0 +1,441 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+/*
+The outcome of a coordinated read. Answered is the number of replicas that
+reported what they hold for the key, this node included if it is one.
+Value may stream from another node, and must then be closed unless it is
+read to the end.
+*/
+type ReadResult struct {
+	Item     KeyValue
+	Value    io.ReadSeeker
+	Found    bool
+	Answered int
+}
+
+/*
+Releases the value of the result if it streams from another node.
+*/
+func (r ReadResult) Close() error {
+	if closer, ok := r.Value.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+/*
+Describes how a read is coordinated.
+*/
+type ReadOptions struct {
+	// The probability that replicas found to hold a stale copy are repaired
+	// in the background. Zero means the default of the store, and a
+	// negative value never repairs them.
+	RepairChance float64
+	// Repairs stale replicas before the read returns.
+	SyncRepair bool
+	// How many replicas must answer the read.
+	Consistency Consistency
+	// With RaftReplication, lets any replica of the key serve the read
+	// without asking the leader of its group, so that it may miss the
+	// latest writes.
+	Stale bool
+}
+
+/*
+Reads key from this node and its replicas and returns the newest copy.
+Replicas are first asked for the metadata of their copy only; the value is
+streamed from a replica only if it holds a newer copy than this node, and
+this node's own copy is only used if it is a replica of the key. Fails
+with ErrNotEnoughReplicas if fewer replicas answer than the consistency
+level of opts requires; at ConsistencyLocal none are asked. The copy of
+this node counts if it is a replica, and replicas are not asked at all if
+it is enough. Replicas, this node
+included, that answered with an older copy or none are repaired as opts
+asks. Deletes are compared like writes: if the newest copy is a tombstone,
+the key is not found, and replicas still holding the value are repaired
+with the tombstone. With RaftReplication the key is read from the leader
+of its group instead, whatever the consistency level, unless opts allows
+a stale read.
+*/
+func (s *Store) Read(key string, opts ReadOptions) (ReadResult, error) {
+	if s.replicationMode == RaftReplication {
+		return s.readRaft(key, opts.Stale)
+	}
+
+	local, nodes, err := s.replicas(key)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	nodes = s.liveNodes(nodes)
+	if s.replicationFactor == 0 || opts.Consistency == ConsistencyLocal {
+		return s.localRead(key, 0), nil
+	}
+
+	// The node holding the newest copy, empty for this one. Copies are
+	// compared with their tombstones. The copy of this node is only
+	// compared if it is a replica: a copy left on another node is never
+	// repaired or purged like the ones of the replicas.
+	var newest string
+	var newestItem KeyValue
+	var newestFound bool
+	var copies []replicaCopy
+	answered := 0
+	if local {
+		answered = 1
+		newestItem, _, newestFound = s.OpenReplica(key)
+		copies = append(copies, replicaCopy{item: newestItem, found: newestFound})
+	}
+	required := opts.Consistency.required(s.replicationFactor, s.readQuorum)
+	if answered >= required {
+		return s.localRead(key, answered), nil
+	}
+
+	answers := make(chan replicaCopy, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			item, found, err := s.fetchMeta(node, key)
+			answers <- replicaCopy{node, item, found, err}
+		}(node)
+	}
+
+	for i := 0; i < len(nodes) && answered < required; i++ {
+		a := <-answers
+		if a.err != nil {
+			log.Printf("Failed to read key %s from %s: %v", key, a.node, a.err)
+			continue
+		}
+		answered++
+		copies = append(copies, a)
+		if a.found && (!newestFound || a.item.newerThan(newestItem, s.resolution)) {
+			newest, newestItem, newestFound = a.node, a.item, true
+		}
+	}
+	if answered < required {
+		return ReadResult{}, opts.Consistency.unmet("read", answered)
+	}
+	if !newestFound {
+		return ReadResult{Answered: answered}, nil
+	}
+
+	stale := staleCopies(newest, newestItem, copies, s.resolution)
+	s.maybeRepair(key, newest, stale, opts)
+	if newestItem.Deleted {
+		return ReadResult{Answered: answered}, nil
+	}
+	if newest == "" {
+		return s.localRead(key, answered), nil
+	}
+
+	remote, remoteValue, ok, err := s.openItem(newest, key)
+	if err != nil {
+		return ReadResult{}, fmt.Errorf("failed to read key %s from %s: %w", key, newest, err)
+	}
+	if !ok {
+		// The copy expired in the meantime.
+		if local {
+			return s.localRead(key, answered), nil
+		}
+		return ReadResult{Answered: answered}, nil
+	}
+	if remote.Deleted {
+		return ReadResult{Answered: answered}, nil
+	}
+	return ReadResult{Item: remote, Value: remoteValue, Found: true, Answered: answered}, nil
+}
+
+/*
+Returns the copy of key held by this node as the result of a read that
+answered replicas took part in.
+*/
+func (s *Store) localRead(key string, answered int) ReadResult {
+	item, value, found := s.Open(key)
+	return ReadResult{Item: item, Value: value, Found: found, Answered: answered}
+}
+
+/*
+What a node holds for a key, as reported during a read. node is empty for
+this node.
+*/
+type replicaCopy struct {
+	node  string
+	item  KeyValue
+	found bool
+	err   error
+}
+
+/*
+Reports whether kv is a newer copy of a key than other. With LastWriteWins
+the copy with the later timestamp is newer. Otherwise a copy is newer if it
+has seen every write the other has and more; of concurrent copies, or ones
+without clocks, the one with the higher version is newer, and of two with
+the same version the one modified last.
+*/
+func (kv KeyValue) newerThan(other KeyValue, resolution ConflictResolution) bool {
+	if resolution == LastWriteWins {
+		return other.HLC.Before(kv.HLC)
+	}
+	descends, descended := kv.Context.descends(other.Context), other.Context.descends(kv.Context)
+	switch {
+	case descends && !descended:
+		return true
+	case descended && !descends:
+		return false
+	case descends && descended && len(kv.Context) > 0:
+		// The copies hold the same values.
+		return false
+	}
+	if kv.Version != other.Version {
+		return kv.Version > other.Version
+	}
+	return kv.Modified > other.Modified
+}
+
+/*
+Asks node for the metadata of the copy of key it holds, without its value.
+A copy that is a tombstone is found with Deleted set.
+*/
+func (s *Store) fetchMeta(node, key string) (KeyValue, bool, error) {
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("http://%s/%s", node, key), nil)
+	if err != nil {
+		return KeyValue{}, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(ReplicationHeader, "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	defer resp.Body.Close()
+
+	deleted := resp.Header.Get(DeletedHeader) == "true"
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if !deleted {
+			return KeyValue{}, false, nil
+		}
+	case http.StatusOK, http.StatusMultipleChoices:
+	default:
+		return KeyValue{}, false, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+
+	item, err := replicaItem(key, resp.Header)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	item.Deleted = deleted
+	return item, true, nil
+}
+
+/*
+Reads the metadata of a copy of key from the headers a replica answered
+with.
+*/
+func replicaItem(key string, header http.Header) (KeyValue, error) {
+	item := KeyValue{Key: key}
+	var err error
+	// Entries written before versions were introduced have none.
+	if tag := header.Get("ETag"); tag != "" {
+		if item.Version, err = ParseETag(tag); err != nil {
+			return KeyValue{}, err
+		}
+	}
+	if raw := header.Get(TimestampHeader); raw != "" {
+		if item.Modified, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return KeyValue{}, fmt.Errorf("invalid timestamp %q", raw)
+		}
+	}
+	if raw := header.Get(ExpiresHeader); raw != "" {
+		if item.Expires, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return KeyValue{}, fmt.Errorf("invalid expiry %q", raw)
+		}
+	}
+	if raw := header.Get(ContextHeader); raw != "" {
+		if item.Context, err = ParseVectorClock(raw); err != nil {
+			return KeyValue{}, err
+		}
+	}
+	item.ContentType = header.Get(ContentTypeHeader)
+	item.HLC = HybridTime{Wall: item.Modified}
+	if raw := header.Get(HLCHeader); raw != "" {
+		if item.HLC, err = ParseHybridTime(raw); err != nil {
+			return KeyValue{}, err
+		}
+	}
+	return item, nil
+}
+
+/*
+Opens the copy of key held by node as clients see it: its metadata and a
+reader that streams its value from node. A copy that is a tombstone is
+found with Deleted set. Copies with siblings are fetched whole instead,
+since their values are returned together.
+*/
+func (s *Store) openItem(node, key string) (KeyValue, io.ReadSeeker, bool, error) {
+	resp, err := s.requestValue(node, key, 0)
+	if err != nil {
+		return KeyValue{}, nil, false, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		item, err := replicaItem(key, resp.Header)
+		if err != nil {
+			resp.Body.Close()
+			return KeyValue{}, nil, false, err
+		}
+		item.Size = resp.ContentLength
+		return item, &remoteValue{store: s, node: node, key: key, version: item.Version, size: item.Size, body: resp.Body}, true, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		if resp.Header.Get(DeletedHeader) == "true" {
+			return KeyValue{Key: key, Deleted: true}, nil, true, nil
+		}
+		return KeyValue{}, nil, false, nil
+	case http.StatusMultipleChoices:
+		resp.Body.Close()
+	default:
+		resp.Body.Close()
+		return KeyValue{}, nil, false, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+
+	remote, ok, err := s.fetchItem(node, key)
+	if err != nil || !ok {
+		return KeyValue{}, nil, ok, err
+	}
+	visible, ok := remote.visible()
+	if !ok {
+		return KeyValue{Key: key, Deleted: true}, nil, true, nil
+	}
+	value := bytes.NewReader(visible.Value)
+	visible.Value = nil
+	return visible, value, true, nil
+}
+
+/*
+Requests the value of key as stored on node, from offset on.
+*/
+func (s *Store) requestValue(node, key string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/%s", node, key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(ReplicationHeader, "true")
+	req.Header.Set("Accept", "application/octet-stream")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return s.client.Do(req)
+}
+
+/*
+Streams the value of a copy held by another node. body is positioned at
+pos; reading from any other offset requests the value again from there, in
+a range, so that a range of a large value is not transferred whole. Fails
+if the copy changes in between.
+*/
+type remoteValue struct {
+	store   *Store
+	node    string
+	key     string
+	version uint64
+	size    int64
+	offset  int64
+	pos     int64
+	body    io.ReadCloser
+}
+
+func (r *remoteValue) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		r.Close()
+		return 0, io.EOF
+	}
+	if r.body != nil && r.pos != r.offset {
+		r.Close()
+	}
+	if r.body == nil {
+		if err := r.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	if err == io.EOF {
+		r.Close()
+		if r.offset < r.size {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (r *remoteValue) reopen() error {
+	resp, err := r.store.requestValue(r.node, r.key, r.offset)
+	if err != nil {
+		return err
+	}
+	want := http.StatusPartialContent
+	if r.offset == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		resp.Body.Close()
+		return fmt.Errorf("failed to read key %s from %s: status code %d", r.key, r.node, resp.StatusCode)
+	}
+	if version, err := ParseETag(resp.Header.Get("ETag")); r.version != 0 && (err != nil || version != r.version) {
+		resp.Body.Close()
+		return fmt.Errorf("key %s changed on %s during the read", r.key, r.node)
+	}
+	r.body, r.pos = resp.Body, r.offset
+	return nil
+}
+
+func (r *remoteValue) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *remoteValue) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+/*
+Fetches the copy of key held by node, with its value and siblings.
+*/
+func (s *Store) fetchItem(node, key string) (KeyValue, bool, error) {
+	items, err := s.scanNode(node, key, key+"\x00", 1)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	if len(items) == 0 || items[0].Key != key {
+		return KeyValue{}, false, nil
+	}
+	return items[0], true, nil
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+Answers HEAD requests with the metadata in heads, keyed by node, GET
+requests with that metadata and the values in values, keyed by node and
+path, and scans with the items in pages. Nodes missing from heads do not
+hold the key, and nodes in down fail. Reads of values, scans, forwarded
+writes and deletes are recorded.
+*/
+type replicaStub struct {
+	mu      sync.Mutex
+	heads   map[string]http.Header
+	values  map[string]string
+	pages   map[string]string
+	down    map[string]bool
+	reads   []*http.Request
+	scans   []string
+	puts    []*http.Request
+	deletes []*http.Request
+}
+
+func (r *replicaStub) client() *MockHttpClient {
+	return &MockHttpClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			node := req.URL.Host
+			if r.down[node] {
+				return nil, fmt.Errorf("connection refused")
+			}
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+			if req.Method == http.MethodPut {
+				r.puts = append(r.puts, req)
+				return resp, nil
+			}
+			if req.Method == http.MethodDelete {
+				r.deletes = append(r.deletes, req)
+				return resp, nil
+			}
+			if req.Method == http.MethodGet && req.URL.Path == "/" {
+				r.scans = append(r.scans, node)
+				resp.Body = io.NopCloser(strings.NewReader(r.pages[node]))
+				return resp, nil
+			}
+			header, ok := r.heads[node]
+			if !ok {
+				resp.StatusCode = http.StatusNotFound
+				return resp, nil
+			}
+			resp.Header = header
+			if req.Method == http.MethodGet {
+				r.reads = append(r.reads, req)
+				value, ok := r.values[node+req.URL.Path]
+				if !ok {
+					resp.StatusCode = http.StatusNotFound
+					return resp, nil
+				}
+				if raw := req.Header.Get("Range"); raw != "" {
+					var offset int
+					fmt.Sscanf(raw, "bytes=%d-", &offset)
+					value = value[offset:]
+					resp.StatusCode = http.StatusPartialContent
+				}
+				resp.ContentLength = int64(len(value))
+				resp.Body = io.NopCloser(strings.NewReader(value))
+			}
+			return resp, nil
+		},
+	}
+}
+
+func headers(pairs ...string) http.Header {
+	header := http.Header{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		header.Set(pairs[i], pairs[i+1])
+	}
+	return header
+}
+
+func readValue(t *testing.T, result ReadResult) string {
+	t.Helper()
+	value, err := io.ReadAll(result.Value)
+	if err != nil {
+		t.Fatalf("failed to read value: %v", err)
+	}
+	return string(value)
+}
+
+func TestRead(t *testing.T) {
+	local := WriteOptions{SkipReplication: true}
+	noRepair := ReadOptions{RepairChance: -1}
+
+	t.Run("should read locally without replicas", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("1"), local)
+
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Found, true, "key existence")
+		assertEqual(t, result.Answered, 0, "replicas answered")
+		assertEqual(t, readValue(t, result), "1", "value")
+	})
+
+	t.Run("should return a newer copy held by a replica", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("node1"))
+		_ = s.Set("a", []byte("local"), local)
+		stub := &replicaStub{
+			heads:  map[string]http.Header{"node2": headers("ETag", FormatETag(5), ContentTypeHeader, "text/plain")},
+			values: map[string]string{"node2/a": "remote"},
+		}
+		s.client = stub.client()
+
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Answered, 2, "replicas answered")
+		assertEqual(t, result.Item.Version, uint64(5), "version")
+		assertEqual(t, result.Item.ContentType, "text/plain", "content type")
+		assertEqual(t, readValue(t, result), "remote", "value")
+		assertEqual(t, len(stub.reads), 1, "values read from node2")
+		assertEqual(t, stub.reads[0].URL.Host, "node2", "node read from")
+		assertEqual(t, stub.reads[0].Header.Get(ReplicationHeader), "true", "replication header")
+		assertEqual(t, len(stub.scans), 0, "scans")
+	})
+
+	t.Run("should stream ranges of a newer copy held by a replica", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("node1"))
+		_ = s.Set("a", []byte("local"), local)
+		stub := &replicaStub{
+			heads:  map[string]http.Header{"node2": headers("ETag", FormatETag(5), "Content-Type", "application/octet-stream")},
+			values: map[string]string{"node2/a": "0123456789"},
+		}
+		s.client = stub.client()
+
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read error")
+		defer result.Close()
+		assertEqual(t, result.Item.ContentType, "", "content type of a value stored without one")
+		size, _ := result.Value.Seek(0, io.SeekEnd)
+		assertEqual(t, size, int64(10), "size")
+		_, _ = result.Value.Seek(0, io.SeekStart)
+		start := make([]byte, 2)
+		_, _ = io.ReadFull(result.Value, start)
+		assertEqual(t, string(start), "01", "start of the value")
+		assertEqual(t, len(stub.reads), 1, "requests for the value after seeking back")
+		_, _ = result.Value.Seek(4, io.SeekStart)
+		assertEqual(t, readValue(t, result), "456789", "value from offset 4")
+		assertEqual(t, len(stub.reads), 2, "requests for the value")
+		assertEqual(t, stub.reads[1].Header.Get("Range"), "bytes=4-", "range requested")
+
+		stub.mu.Lock()
+		stub.heads["node2"] = headers("ETag", FormatETag(6))
+		stub.mu.Unlock()
+		_, _ = result.Value.Seek(2, io.SeekStart)
+		_, err = io.ReadAll(result.Value)
+		assertEqual(t, err != nil, true, "error reading a copy that changed")
+	})
+
+	t.Run("should keep the local copy when it is the newest", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("node1"))
+		_ = s.Set("a", []byte("1"), local)
+		_ = s.Set("a", []byte("2"), local)
+		stub := &replicaStub{heads: map[string]http.Header{"node2": {"Etag": {FormatETag(1)}}}}
+		s.client = stub.client()
+
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, readValue(t, result), "2", "value")
+		assertEqual(t, len(stub.reads), 0, "values read from replicas")
+	})
+
+	t.Run("should find keys missing locally", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("node1"))
+		stub := &replicaStub{
+			heads:  map[string]http.Header{"node2": {"Etag": {FormatETag(1)}}},
+			values: map[string]string{"node2/a": "remote"},
+		}
+		s.client = stub.client()
+
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Found, true, "key existence")
+		assertEqual(t, readValue(t, result), "remote", "value")
+
+		result, err = s.Read("b", noRepair)
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Found, false, "missing key existence")
+	})
+
+	t.Run("should fail without a read quorum", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("node1"))
+		_ = s.Set("a", []byte("1"), local)
+		stub := &replicaStub{down: map[string]bool{"node2": true}}
+		s.client = stub.client()
+
+		_, err := s.Read("a", noRepair)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("should compare timestamps with last write wins", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 2, WithAdvertiseAddr("node1"), WithConflictResolution(LastWriteWins))
+		_ = s.Set("a", []byte("local"), WriteOptions{SkipReplication: true, HLC: HybridTime{Wall: 100, Node: "n1"}, Version: 9})
+		stub := &replicaStub{
+			heads: map[string]http.Header{"node2": headers(
+				"ETag", FormatETag(1),
+				TimestampHeader, "100",
+				HLCHeader, "100.1@n2",
+			)},
+			values: map[string]string{"node2/a": "remote"},
+		}
+		s.client = stub.client()
+
+		result, err := s.Read("a", noRepair)
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, readValue(t, result), "remote", "value")
+		assertEqual(t, result.Item.HLC, HybridTime{Wall: 100, Logical: 1, Node: "n2"}, "timestamp")
+	})
+
+	t.Run("should ignore the copy of a node that is not a replica", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 2, WithAdvertiseAddr("node3"))
+		key := keyFor(t, s, false)
+		_ = s.Set(key, []byte("left over"), local)
+		stub := &replicaStub{heads: map[string]http.Header{}}
+		s.client = stub.client()
+
+		result, err := s.Read(key, ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Found, false, "key existence")
+		assertEqual(t, result.Answered, 2, "replicas answered")
+		assertEqual(t, len(stub.puts), 0, "replicas repaired")
+	})
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+)
+
+/*
+Returns the copies found by a read that are older than the newest one,
+held by the node named newest, or that are missing.
+*/
+func staleCopies(newest string, item KeyValue, copies []replicaCopy, resolution ConflictResolution) []replicaCopy {
+	var stale []replicaCopy
+	for _, c := range copies {
+		if c.node == newest {
+			continue
+		}
+		if !c.found || item.newerThan(c.item, resolution) {
+			stale = append(stale, c)
+		}
+	}
+	return stale
+}
+
+/*
+Repairs the stale copies found by a read with a chance given by opts, in
+the background unless opts asks for it to be done right away. newest is the
+node holding the newest copy, empty for this one; its values are only
+fetched if a repair is made.
+*/
+func (s *Store) maybeRepair(key string, newest string, stale []replicaCopy, opts ReadOptions) {
+	if len(stale) == 0 {
+		return
+	}
+	if opts.SyncRepair {
+		s.repair(key, newest, stale)
+		return
+	}
+	chance := opts.RepairChance
+	if chance == 0 {
+		chance = s.readRepairChance
+	}
+	if chance <= 0 || rand.Float64() >= chance {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.repair(key, newest, stale)
+	}()
+}
+
+func (s *Store) repair(key string, newest string, stale []replicaCopy) {
+	var item KeyValue
+	var ok bool
+	if newest == "" {
+		item, ok = s.lookupReplica(key)
+	} else {
+		var err error
+		if item, ok, err = s.fetchItem(newest, key); err != nil {
+			log.Printf("Failed to read key %s from %s to repair it: %v", key, newest, err)
+			s.readRepairFailures.Add(uint64(len(stale)))
+			return
+		}
+	}
+	if !ok {
+		return
+	}
+
+	values := append([]KeyValue{item}, item.Siblings...)
+	for _, c := range stale {
+		if err := s.repairCopy(c.node, key, values); err != nil {
+			log.Printf("Failed to repair key %s on %s: %v", key, nodeName(c.node), err)
+			s.readRepairFailures.Add(1)
+			continue
+		}
+		s.readRepairs.Add(1)
+	}
+}
+
+/*
+Sends every value of the newest copy of key to node as writes forwarded by
+a coordinator, so that the node merges them with what it holds like any
+other replicated write. Tombstones are sent as deletes. An empty node is
+this one.
+*/
+func (s *Store) repairCopy(node, key string, values []KeyValue) error {
+	for _, value := range values {
+		opts := value.forwardedWrite()
+		if node == "" {
+			var err error
+			if value.Deleted {
+				err = s.Delete(key, opts)
+			} else {
+				err = s.Set(key, value.Value, opts)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		e, err := s.newEntry(opts)
+		if err != nil {
+			return err
+		}
+		e.context, e.dot = opts.Context, opts.Dot
+		method, body := http.MethodPut, bytesSource(value.Value)
+		if value.Deleted {
+			method, body = http.MethodDelete, nil
+		}
+		errs := make(chan error, 1)
+		s.replicateNode(node, method, key, body, replicationHeader(e, opts), errs)
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+The options of a write that reproduces the value kv on a replica.
+*/
+func (kv KeyValue) forwardedWrite() WriteOptions {
+	opts := WriteOptions{
+		SkipReplication: true,
+		Timestamp:       kv.Modified,
+		Expires:         kv.Expires,
+		ContentType:     kv.ContentType,
+		Version:         kv.Version,
+		Context:         kv.DotContext,
+		Dot:             kv.Dot,
+	}
+	if kv.HLC.Node != "" {
+		opts.HLC = kv.HLC
+	}
+	return opts
+}
+
+func nodeName(node string) string {
+	if node == "" {
+		return "this node"
+	}
+	return node
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRepair(t *testing.T) {
+	local := WriteOptions{SkipReplication: true}
+	// A replica of every key that reads from all of them.
+	newReplica := func(t *testing.T, opts ...Option) *Store {
+		return newTestStore(t, []string{"node1", "node2"}, 3, append([]Option{WithAdvertiseAddr("self"), WithQuorums(3, 2)}, opts...)...)
+	}
+	putNodes := func(stub *replicaStub) string {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		nodes := make([]string, len(stub.puts))
+		for i, req := range stub.puts {
+			nodes[i] = req.URL.Host
+		}
+		sort.Strings(nodes)
+		return strings.Join(nodes, ",")
+	}
+
+	t.Run("should push the local copy to stale replicas", func(t *testing.T) {
+		s := newReplica(t)
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true, Dot: Dot{Node: "self", Counter: 1}})
+		_ = s.Set("a", []byte("2"), WriteOptions{SkipReplication: true, Dot: Dot{Node: "self", Counter: 2}, Context: VectorClock{"self": 1}})
+		item, _ := s.Lookup("a")
+		stub := &replicaStub{heads: map[string]http.Header{
+			"node1": headers("ETag", FormatETag(1), ContextHeader, VectorClock{"self": 1}.String()),
+		}}
+		s.client = stub.client()
+
+		result, err := s.Read("a", ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, readValue(t, result), "2", "value")
+		assertEqual(t, putNodes(stub), "node1,node2", "repaired nodes")
+		for _, req := range stub.puts {
+			assertEqual(t, req.Header.Get(ReplicationHeader), "true", "replication header")
+			assertEqual(t, req.Header.Get(VersionHeader), "2", "repaired version")
+			assertEqual(t, req.Header.Get(DotHeader), item.Dot.String(), "repaired dot")
+		}
+		assertEqual(t, s.Stats().Metrics["read_repairs"], int64(2), "read repairs")
+	})
+
+	t.Run("should leave replicas that are up to date alone", func(t *testing.T) {
+		s := newReplica(t)
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true, Dot: Dot{Node: "self", Counter: 1}})
+		item, _ := s.Lookup("a")
+		// A higher version with the same clock holds the same values.
+		head := headers("ETag", FormatETag(3), ContextHeader, item.Context.String())
+		stub := &replicaStub{heads: map[string]http.Header{"node1": head, "node2": head}}
+		s.client = stub.client()
+
+		_, err := s.Read("a", ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, len(stub.puts), 0, "repairs")
+		assertEqual(t, len(stub.scans), 0, "values fetched from replicas")
+	})
+
+	t.Run("should repair this node with every sibling of a newer copy", func(t *testing.T) {
+		s := newReplica(t)
+		_ = s.Set("a", []byte("old"), WriteOptions{SkipReplication: true, Dot: Dot{Node: "n1", Counter: 1}})
+		newer := KeyValue{
+			Key: "a", Value: []byte("x"), Version: 2, Modified: 20,
+			Context: VectorClock{"n1": 2, "n2": 1}, Dot: Dot{Node: "n1", Counter: 2}, DotContext: VectorClock{"n1": 1},
+			Siblings: []KeyValue{{
+				Key: "a", Value: []byte("y"), Version: 2, Modified: 10,
+				Dot: Dot{Node: "n2", Counter: 1}, DotContext: VectorClock{"n1": 1},
+			}},
+		}
+		page, _ := json.Marshal(scanPage{Items: []KeyValue{newer}})
+		stub := &replicaStub{
+			heads:  map[string]http.Header{"node2": headers("ETag", FormatETag(2), ContextHeader, newer.Context.String())},
+			values: map[string]string{"node2/a": "x"},
+			pages:  map[string]string{"node2": string(page)},
+		}
+		s.client = stub.client()
+
+		result, err := s.Read("a", ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, readValue(t, result), "x", "value")
+		assertEqual(t, putNodes(stub), "node1,node1", "repaired nodes")
+
+		item, _ := s.Lookup("a")
+		assertEqual(t, string(item.Value), "x", "repaired value")
+		assertEqual(t, len(item.Siblings), 1, "repaired siblings")
+		assertEqual(t, item.Context.descends(newer.Context), true, "repaired context")
+	})
+
+	t.Run("should repair in the background with the configured chance", func(t *testing.T) {
+		s := newReplica(t, WithReadRepairChance(1))
+		_ = s.Set("a", []byte("1"), local)
+		stub := &replicaStub{}
+		s.client = stub.client()
+
+		_, _ = s.Read("a", ReadOptions{RepairChance: -1})
+		assertEqual(t, s.Stats().Metrics["read_repairs"], int64(0), "read repairs when disabled")
+
+		_, _ = s.Read("a", ReadOptions{})
+		deadline := time.Now().Add(time.Second)
+		for s.Stats().Metrics["read_repairs"] < 2 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assertEqual(t, s.Stats().Metrics["read_repairs"], int64(2), "read repairs in the background")
+	})
+
+	t.Run("should count failed repairs", func(t *testing.T) {
+		s := newReplica(t)
+		_ = s.Set("a", []byte("1"), local)
+		stub := &replicaStub{}
+		s.client = &MockHttpClient{doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.Method == http.MethodPut {
+				return &http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody}, nil
+			}
+			return stub.client().Do(req)
+		}}
+
+		_, err := s.Read("a", ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, s.Stats().Metrics["read_repair_failures"], int64(2), "failed read repairs")
+	})
+}
@@ -0,0 +1,545 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+type KeyValue struct {
+	Key         string
+	Value       []byte
+	ContentType string
+	Modified    int64
+	Expires     int64
+	Version     uint64
+	// The size of the value in bytes, known even when Value is not read.
+	Size int64
+	// The causal context covering the value and its siblings.
+	Context VectorClock
+	// The values written concurrently with this one, if any.
+	Siblings []KeyValue
+	// The hybrid logical clock timestamp of the newest value. Values
+	// written without one have only its wall time, which is Modified.
+	HLC HybridTime
+	// The dot of the write that produced the value and the causal context
+	// it was written with, which replicas need to merge it with theirs.
+	Dot        Dot
+	DotContext VectorClock
+	// Set on tombstones, which record a delete and have no value. Only
+	// replicas exchange them; clients never see deleted values.
+	Deleted bool
+}
+
+func (e entry) keyValue(key string) KeyValue {
+	return KeyValue{
+		Key:         key,
+		Value:       e.value,
+		ContentType: e.contentType,
+		Modified:    e.modified,
+		Expires:     e.expires,
+		Version:     e.maxVersion(),
+		Size:        e.size(),
+		Context:     e.clock(),
+		HLC:         e.latest(),
+		Dot:         e.dot,
+		DotContext:  e.context,
+		Deleted:     e.tombstone,
+	}
+}
+
+/*
+Returns the values of e as an item: its primary value with the others as
+siblings, each read in full.
+*/
+func (s *Store) item(key string, e entry) (KeyValue, error) {
+	item := e.keyValue(key)
+	var err error
+	if item.Value, err = s.loadValue(key, e); err != nil {
+		return KeyValue{}, err
+	}
+	if item.Siblings, err = s.siblingItems(key, e); err != nil {
+		return KeyValue{}, err
+	}
+	return item, nil
+}
+
+func (s *Store) siblingItems(key string, e entry) ([]KeyValue, error) {
+	if len(e.siblings) == 0 {
+		return nil, nil
+	}
+	items := make([]KeyValue, len(e.siblings))
+	for i, sibling := range e.siblings {
+		items[i] = sibling.keyValue(key)
+		value, err := s.loadValue(key, sibling)
+		if err != nil {
+			return nil, err
+		}
+		items[i].Value = value
+	}
+	return items, nil
+}
+
+type keyValueJSON struct {
+	Key         string     `json:"key"`
+	Value       string     `json:"value"`
+	Encoding    string     `json:"encoding,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Modified    int64      `json:"modified"`
+	Expires     int64      `json:"expires,omitempty"`
+	Version     uint64     `json:"version,omitempty"`
+	Context     string     `json:"context,omitempty"`
+	HLC         string     `json:"hlc,omitempty"`
+	Dot         string     `json:"dot,omitempty"`
+	DotContext  string     `json:"dot_context,omitempty"`
+	Deleted     bool       `json:"deleted,omitempty"`
+	Siblings    []KeyValue `json:"siblings,omitempty"`
+}
+
+/*
+Encodes the value as a string if it is valid UTF-8 and in base64 otherwise,
+in which case the encoding field says so.
+*/
+func (kv KeyValue) MarshalJSON() ([]byte, error) {
+	value, encoding := EncodeValue(kv.Value)
+	var context, hlc, dot, dotContext string
+	if len(kv.Context) > 0 {
+		context = kv.Context.String()
+	}
+	if kv.Dot.Counter != 0 {
+		dot, dotContext = kv.Dot.String(), kv.DotContext.String()
+	}
+	if kv.HLC.Node != "" {
+		hlc = kv.HLC.String()
+	}
+	return json.Marshal(keyValueJSON{
+		Key:         kv.Key,
+		Value:       value,
+		Encoding:    encoding,
+		ContentType: kv.ContentType,
+		Modified:    kv.Modified,
+		Expires:     kv.Expires,
+		Version:     kv.Version,
+		Context:     context,
+		HLC:         hlc,
+		Dot:         dot,
+		DotContext:  dotContext,
+		Deleted:     kv.Deleted,
+		Siblings:    kv.Siblings,
+	})
+}
+
+func (kv *KeyValue) UnmarshalJSON(data []byte) error {
+	var j keyValueJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	value := []byte(j.Value)
+	switch j.Encoding {
+	case "":
+	case "base64":
+		var err error
+		if value, err = base64.StdEncoding.DecodeString(j.Value); err != nil {
+			return fmt.Errorf("invalid base64 value for key %s: %w", j.Key, err)
+		}
+	default:
+		return fmt.Errorf("unknown value encoding %q", j.Encoding)
+	}
+	var context VectorClock
+	if j.Context != "" {
+		var err error
+		if context, err = ParseVectorClock(j.Context); err != nil {
+			return fmt.Errorf("invalid context for key %s: %w", j.Key, err)
+		}
+	}
+	var dot Dot
+	var dotContext VectorClock
+	if j.Dot != "" {
+		var err error
+		if dot, err = ParseDot(j.Dot); err != nil {
+			return fmt.Errorf("invalid dot for key %s: %w", j.Key, err)
+		}
+		if dotContext, err = ParseVectorClock(j.DotContext); err != nil {
+			return fmt.Errorf("invalid dot context for key %s: %w", j.Key, err)
+		}
+	}
+	stamp := HybridTime{Wall: j.Modified}
+	if j.HLC != "" {
+		var err error
+		if stamp, err = ParseHybridTime(j.HLC); err != nil {
+			return fmt.Errorf("invalid timestamp for key %s: %w", j.Key, err)
+		}
+	}
+	*kv = KeyValue{
+		Key:         j.Key,
+		Value:       value,
+		ContentType: j.ContentType,
+		Modified:    j.Modified,
+		Expires:     j.Expires,
+		Version:     j.Version,
+		Size:        int64(len(value)),
+		Context:     context,
+		Siblings:    j.Siblings,
+		HLC:         stamp,
+		Dot:         dot,
+		DotContext:  dotContext,
+		Deleted:     j.Deleted,
+	}
+	return nil
+}
+
+/*
+Reports whether every value of kv is a tombstone, so that the key is
+deleted.
+*/
+func (kv KeyValue) AllDeleted() bool {
+	if !kv.Deleted {
+		return false
+	}
+	for _, sibling := range kv.Siblings {
+		if !sibling.Deleted {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Returns the copy kv of a key as clients see it, without its tombstones, or
+false if every value of it is one.
+*/
+func (kv KeyValue) visible() (KeyValue, bool) {
+	var values []KeyValue
+	for _, value := range append([]KeyValue{kv}, kv.Siblings...) {
+		if !value.Deleted {
+			value.Siblings = nil
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return KeyValue{}, false
+	}
+	item := values[0]
+	item.Context, item.Version, item.HLC = kv.Context, kv.Version, kv.HLC
+	if len(values) > 1 {
+		item.Siblings = values[1:]
+	}
+	return item, true
+}
+
+/*
+Represents a value as a JSON string: as is if it is valid UTF-8, otherwise
+in base64, which is then returned as the encoding.
+*/
+func EncodeValue(value []byte) (string, string) {
+	if utf8.Valid(value) {
+		return string(value), ""
+	}
+	return base64.StdEncoding.EncodeToString(value), "base64"
+}
+
+/*
+Returns up to limit key-value pairs with start <= key < end in ascending key
+order. An empty end means no upper bound and a limit of zero or less means
+no limit. Only the local keyspace is scanned and expired and deleted keys
+are skipped.
+*/
+func (s *Store) Scan(start, end string, limit int) ([]KeyValue, error) {
+	return s.scan(start, end, limit, false)
+}
+
+/*
+Like Scan, but as held by a replica: deleted keys are returned with their
+tombstones, which are marked as Deleted, so that coordinators can tell them
+from keys this node never saw.
+*/
+func (s *Store) ScanReplica(start, end string, limit int) ([]KeyValue, error) {
+	return s.scan(start, end, limit, true)
+}
+
+func (s *Store) scan(start, end string, limit int, tombstones bool) ([]KeyValue, error) {
+	// Internal keys sort before every client key.
+	if first := PrefixEnd(internalKeyPrefix); start < first {
+		start = first
+	}
+	if end != "" && end <= start {
+		return nil, nil
+	}
+
+	now := s.now().UnixNano()
+	var items []KeyValue
+	pending := make(map[int]entry)
+	var decodeErr error
+	err := s.engine.Iterate(start, end, func(key string, buf []byte) bool {
+		e, err := decodeEntry(buf)
+		if err != nil {
+			decodeErr = fmt.Errorf("failed to read key %s: %w", key, err)
+			return false
+		}
+		var ok bool
+		if tombstones {
+			e, ok = e.unexpired(now)
+		} else {
+			e, ok = e.live(now)
+		}
+		if !ok {
+			return true
+		}
+		items = append(items, e.keyValue(key))
+		if e.chunks.chunked() || len(e.siblings) > 0 {
+			pending[len(items)-1] = e
+		}
+		return limit <= 0 || len(items) < limit
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks are read once the iteration is over, as engines need not
+	// support reads from within Iterate.
+	for i, e := range pending {
+		if items[i], err = s.item(items[i].Key, e); err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", items[i].Key, err)
+		}
+	}
+	return items, nil
+}
+
+/*
+Returns up to limit key-value pairs whose key starts with prefix, in
+ascending key order.
+*/
+func (s *Store) ScanPrefix(prefix string, limit int) ([]KeyValue, error) {
+	if prefix == "" {
+		return nil, errors.New("prefix cannot be empty")
+	}
+	return s.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+/*
+Returns the smallest key that is greater than every key starting with
+prefix, or an empty string if there is no such key.
+*/
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+/*
+The result of a scan across the cluster. More reports whether keys beyond
+Last, the last key scanned, may remain, and Unavailable lists the nodes that
+could not be scanned. Last may be a deleted key, which is not among Items.
+*/
+type ScanResult struct {
+	Items       []KeyValue
+	More        bool
+	Last        string
+	Unavailable []string
+}
+
+type scanPage struct {
+	Items []KeyValue `json:"items"`
+}
+
+/*
+Scans [start, end) on this node and on every live node of the ring and
+merges the results. Copies of a key held by several replicas are merged by
+mergeCopies, so values written concurrently on different replicas are
+returned as siblings, and keys whose every value is a tombstone are left
+out. Nodes that fail are reported in the result rather than failing the
+scan, since their keys are usually held by a replica as well.
+*/
+func (s *Store) ScanCluster(start, end string, limit int) (ScanResult, error) {
+	local, err := s.ScanReplica(start, end, limit)
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	var nodes []string
+	for _, node := range s.nodes {
+		if node != "" && s.ringManager.HasNode(node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	pages := make([][]KeyValue, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			pages[i], errs[i] = s.scanNode(node, start, end, limit)
+		}(i, node)
+	}
+	wg.Wait()
+
+	var result ScanResult
+	newest := make(map[string]KeyValue, len(local))
+	merge := func(page []KeyValue) {
+		// A node that filled its page may hold more keys after it.
+		if limit > 0 && len(page) >= limit {
+			result.More = true
+		}
+		for _, item := range page {
+			if current, ok := newest[item.Key]; ok {
+				item = mergeCopies(current, item, s.resolution)
+			}
+			newest[item.Key] = item
+		}
+	}
+	merge(local)
+	for i, page := range pages {
+		if errs[i] != nil {
+			log.Printf("Failed to scan %s: %v", nodes[i], errs[i])
+			result.Unavailable = append(result.Unavailable, nodes[i])
+			continue
+		}
+		merge(page)
+	}
+
+	items := make([]KeyValue, 0, len(newest))
+	for _, item := range newest {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+		result.More = true
+	}
+	if len(items) > 0 {
+		result.Last = items[len(items)-1].Key
+	}
+	result.Items = make([]KeyValue, 0, len(items))
+	for _, item := range items {
+		if item, ok := item.visible(); ok {
+			result.Items = append(result.Items, item)
+		}
+	}
+	return result, nil
+}
+
+/*
+Merges two copies of a key held by different replicas the way a replica
+merges a write into what it holds: every value of either copy is kept
+unless the other copy has seen it and replaced it, so that values written
+concurrently become siblings. With LastWriteWins, or if either copy has no
+clock, the newer copy wins as it does on a read.
+*/
+func mergeCopies(a, b KeyValue, resolution ConflictResolution) KeyValue {
+	if resolution == LastWriteWins || len(a.Context) == 0 || len(b.Context) == 0 {
+		if b.newerThan(a, resolution) {
+			return b
+		}
+		return a
+	}
+
+	var values []KeyValue
+	kept := make(map[Dot]bool)
+	for _, pair := range [][2]KeyValue{{a, b}, {b, a}} {
+		from, other := pair[0], pair[1]
+		held := make(map[Dot]bool)
+		for _, value := range other.values() {
+			held[value.Dot] = true
+		}
+		for _, value := range from.values() {
+			if !kept[value.Dot] && (held[value.Dot] || !other.Context.covers(value.Dot)) {
+				kept[value.Dot] = true
+				values = append(values, value)
+			}
+		}
+	}
+	if len(values) == 0 {
+		if b.newerThan(a, resolution) {
+			return b
+		}
+		return a
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		if values[i].Modified != values[j].Modified {
+			return values[i].Modified > values[j].Modified
+		}
+		return values[i].Dot.String() < values[j].Dot.String()
+	})
+	merged := values[0]
+	merged.Siblings = nil
+	if len(values) > 1 {
+		merged.Siblings = values[1:]
+	}
+	merged.Context = a.Context.merge(b.Context)
+	merged.Version, merged.HLC = a.Version, a.HLC
+	if b.Version > merged.Version {
+		merged.Version = b.Version
+	}
+	if merged.HLC.Before(b.HLC) {
+		merged.HLC = b.HLC
+	}
+	return merged
+}
+
+/*
+Returns every value of the copy kv: kv itself followed by its siblings,
+none of which has siblings of its own.
+*/
+func (kv KeyValue) values() []KeyValue {
+	primary := kv
+	primary.Siblings = nil
+	return append([]KeyValue{primary}, kv.Siblings...)
+}
+
+/*
+Fetches one page of a node's local keyspace.
+*/
+func (s *Store) scanNode(node, start, end string, limit int) ([]KeyValue, error) {
+	query := url.Values{}
+	if start != "" {
+		query.Set("start", start)
+	}
+	if end != "" {
+		query.Set("end", end)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/?%s", node, query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(ReplicationHeader, "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	var page scanPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode scan response: %w", err)
+	}
+	return page.Items, nil
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func scannedKeys(items []KeyValue) string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestScan(t *testing.T) {
+	s := newTestStore(t, []string{"node1"}, 1)
+	for _, key := range []string{"user:2", "order:1", "user:1", "user:10", "users", "order:2"} {
+		_ = s.Set(key, []byte("v-"+key), WriteOptions{SkipReplication: true})
+	}
+	_ = s.Delete("order:2", WriteOptions{SkipReplication: true})
+
+	t.Run("should scan a range in key order", func(t *testing.T) {
+		items, err := s.Scan("order:", "user:2", 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, scannedKeys(items), "order:1,user:1,user:10", "scanned keys")
+		assertEqual(t, string(items[0].Value), "v-order:1", "scanned value")
+	})
+
+	t.Run("should stop at the limit", func(t *testing.T) {
+		items, _ := s.Scan("", "", 2)
+		assertEqual(t, scannedKeys(items), "order:1,user:1", "limited keys")
+	})
+
+	t.Run("should return nothing for an empty range", func(t *testing.T) {
+		items, _ := s.Scan("user:2", "user:1", 0)
+		assertEqual(t, len(items), 0, "inverted range")
+	})
+
+	t.Run("should scan a prefix", func(t *testing.T) {
+		items, _ := s.ScanPrefix("user:", 0)
+		assertEqual(t, scannedKeys(items), "user:1,user:10,user:2", "prefixed keys")
+
+		items, _ = s.ScanPrefix("user:1", 1)
+		assertEqual(t, scannedKeys(items), "user:1", "limited prefix")
+
+		if _, err := s.ScanPrefix("", 0); err == nil {
+			t.Errorf("expected an error for an empty prefix")
+		}
+	})
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"a", "b"},
+		{"user:", "user;"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+	}
+	for _, test := range tests {
+		assertEqual(t, PrefixEnd(test.prefix), test.want, "prefix end of "+test.prefix)
+	}
+}
+
+func TestScanCluster(t *testing.T) {
+	s := newTestStore(t, []string{"node1", "node2"}, 1)
+	_ = s.Set("a", []byte("local-a"), WriteOptions{SkipReplication: true, Timestamp: 10, Dot: Dot{Node: "n1", Counter: 1}})
+	_ = s.Set("b", []byte("local-b"), WriteOptions{SkipReplication: true, Timestamp: 30, Dot: Dot{Node: "n1", Counter: 1}})
+
+	page, _ := json.Marshal(scanPage{Items: []KeyValue{
+		// Replaces local-a, though its clock is behind.
+		{Key: "a", Value: []byte("remote-a"), Modified: 5, Version: 2, Context: VectorClock{"n1": 1, "n2": 1},
+			Dot: Dot{Node: "n2", Counter: 1}, DotContext: VectorClock{"n1": 1}},
+		// Written concurrently with local-b.
+		{Key: "b", Value: []byte("remote-b"), Modified: 20, Version: 1, Context: VectorClock{"n2": 1},
+			Dot: Dot{Node: "n2", Counter: 1}, DotContext: VectorClock{}},
+		{Key: "c", Value: []byte("remote-c"), Modified: 20},
+	}})
+	s.client = &MockHttpClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			assertEqual(t, req.Header.Get(ReplicationHeader), "true", "replication header")
+			if req.URL.Host == "node2" {
+				return nil, fmt.Errorf("network error")
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(page)),
+			}, nil
+		},
+	}
+
+	t.Run("should merge nodes and keep the newest copy", func(t *testing.T) {
+		result, err := s.ScanCluster("", "", 10)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, scannedKeys(result.Items), "a,b,c", "merged keys")
+		assertEqual(t, string(result.Items[0].Value), "remote-a", "remote copy that replaced the local one")
+		assertEqual(t, len(result.Items[0].Siblings), 0, "siblings of a")
+		assertEqual(t, string(result.Items[1].Value), "local-b", "most recent concurrent value")
+		assertEqual(t, len(result.Items[1].Siblings), 1, "siblings of b")
+		assertEqual(t, string(result.Items[1].Siblings[0].Value), "remote-b", "sibling of b")
+		assertEqual(t, result.Items[1].Context.String(), VectorClock{"n1": 1, "n2": 1}.String(), "context of b")
+		assertEqual(t, result.More, false, "more keys")
+		assertEqual(t, strings.Join(result.Unavailable, ","), "node2", "unavailable nodes")
+	})
+
+	t.Run("should report more keys beyond the limit", func(t *testing.T) {
+		result, _ := s.ScanCluster("", "", 2)
+		assertEqual(t, scannedKeys(result.Items), "a,b", "limited keys")
+		assertEqual(t, result.More, true, "more keys")
+	})
+}
+
+func TestSetReplicatesMetadata(t *testing.T) {
+	s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+	var timestamps, expiries, contentTypes []string
+	var mu sync.Mutex
+	s.client = &MockHttpClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.Method == http.MethodHead {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+			}
+			mu.Lock()
+			timestamps = append(timestamps, req.Header.Get(TimestampHeader))
+			expiries = append(expiries, req.Header.Get(ExpiresHeader))
+			contentTypes = append(contentTypes, req.Header.Get("Content-Type"))
+			mu.Unlock()
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+		},
+	}
+
+	if err := s.Set("key", []byte("value"), WriteOptions{TTL: time.Minute, ContentType: "text/plain"}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	e, _ := s.getEntry("key")
+	assertEqual(t, len(timestamps), 2, "replicated writes")
+	for i := range timestamps {
+		assertEqual(t, timestamps[i], strconv.FormatInt(e.modified, 10), "replicated timestamp")
+		assertEqual(t, expiries[i], strconv.FormatInt(e.expires, 10), "replicated expiry")
+		assertEqual(t, contentTypes[i], "text/plain", "replicated content type")
+	}
+}
+
+func TestKeyValueJSON(t *testing.T) {
+	for _, value := range [][]byte{[]byte("text"), {0, 0xff}, {}} {
+		item := KeyValue{Key: "k", Value: value, ContentType: "application/x", Modified: 1, Expires: 2}
+		data, err := json.Marshal(item)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		var decoded KeyValue
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, string(decoded.Value), string(value), "value after round trip")
+		assertEqual(t, decoded.ContentType, item.ContentType, "content type after round trip")
+		assertEqual(t, decoded.Expires, item.Expires, "expiry after round trip")
+	}
+}
@@ -0,0 +1,177 @@
+package store
+
+import "sort"
+
+/*
+Returns every value held for a key: e followed by its siblings, none of
+which has siblings of its own.
+*/
+func (e entry) all() []entry {
+	primary := e
+	primary.siblings = nil
+	return append([]entry{primary}, e.siblings...)
+}
+
+/*
+Combines values held for the same key into one entry. The most recently
+modified value is the one returned by reads that expect a single value; the
+others become its siblings.
+*/
+func newRecord(values []entry) entry {
+	sorted := make([]entry, len(values))
+	copy(sorted, values)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].modified != sorted[j].modified {
+			return sorted[i].modified > sorted[j].modified
+		}
+		return sorted[i].dot.String() < sorted[j].dot.String()
+	})
+
+	primary := sorted[0]
+	primary.siblings = nil
+	if len(sorted) > 1 {
+		primary.siblings = sorted[1:]
+	}
+	return primary
+}
+
+/*
+Returns the values of e that have not expired and are not tombstones, or
+false if there are none. These are what reads see.
+*/
+func (e entry) live(now int64) (entry, bool) {
+	return e.filter(func(value entry) bool {
+		return !value.expired(now) && !value.tombstone
+	})
+}
+
+/*
+Returns the values of e that have not expired, tombstones included, or
+false if there are none. These are what replicas compare and merge.
+*/
+func (e entry) unexpired(now int64) (entry, bool) {
+	return e.filter(func(value entry) bool {
+		return !value.expired(now)
+	})
+}
+
+func (e entry) filter(keep func(entry) bool) (entry, bool) {
+	if len(e.siblings) == 0 {
+		return e, keep(e)
+	}
+	var values []entry
+	for _, value := range e.all() {
+		if keep(value) {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return entry{}, false
+	}
+	return newRecord(values), true
+}
+
+/*
+Reports whether every value of e is a tombstone, so that the key it is held
+for is deleted.
+*/
+func (e entry) deleted() bool {
+	for _, value := range e.all() {
+		if !value.tombstone {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+The causal context of the values of e: the clock that has seen every one of
+them.
+*/
+func (e entry) clock() VectorClock {
+	clock := VectorClock{}
+	for _, value := range e.all() {
+		clock = clock.merge(value.context)
+		if value.dot.Counter != 0 {
+			clock = clock.with(value.dot)
+		}
+	}
+	return clock
+}
+
+/*
+The version of a key, which is the newest version among its values.
+*/
+func (e entry) maxVersion() uint64 {
+	version := e.version
+	for _, sibling := range e.siblings {
+		if sibling.version > version {
+			version = sibling.version
+		}
+	}
+	return version
+}
+
+/*
+The time at which every value of e has expired, or zero if one of them
+never does.
+*/
+func (e entry) lastExpiry() int64 {
+	var last int64
+	for _, value := range e.all() {
+		if value.expires == 0 {
+			return 0
+		}
+		if value.expires > last {
+			last = value.expires
+		}
+	}
+	return last
+}
+
+/*
+The memory taken by the chunks of the values of e.
+*/
+func (e entry) chunkedSize() int64 {
+	var size int64
+	for _, value := range e.all() {
+		size += value.chunks.storedSize()
+	}
+	return size
+}
+
+func (e entry) refersTo(chunks uint64) bool {
+	for _, value := range e.all() {
+		if value.chunks.chunked() && value.chunks.id == chunks {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Adds the value w to the values held for a key, if any. Held values that the
+context of w has seen are replaced by it, and the others are kept as its
+siblings. w is dropped if it is already held or a held value has seen it.
+Reports whether the values changed.
+
+Values written before clocks were introduced, or forwarded by a node that
+does not send them, have no dot; they have been seen by every clock, and
+writing one replaces every held value.
+*/
+func addValue(held entry, exists bool, w entry) (entry, bool) {
+	if !exists || w.dot.Counter == 0 {
+		return w, true
+	}
+
+	values := []entry{w}
+	for _, value := range held.all() {
+		if value.dot == w.dot || value.context.covers(w.dot) {
+			return held, false
+		}
+		if !w.context.covers(value.dot) {
+			values = append(values, value)
+		}
+	}
+	return newRecord(values), true
+}
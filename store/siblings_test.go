@@ -0,0 +1,157 @@
+package store
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSiblings(t *testing.T) {
+	forwarded := func(node string, counter uint64, context VectorClock) WriteOptions {
+		return WriteOptions{SkipReplication: true, Context: context, Dot: Dot{Node: node, Counter: counter}}
+	}
+	values := func(item KeyValue) []string {
+		values := []string{string(item.Value)}
+		for _, sibling := range item.Siblings {
+			values = append(values, string(sibling.Value))
+		}
+		return values
+	}
+
+	t.Run("should keep concurrent writes as siblings", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n2", 1, nil))
+
+		item, ok := s.Lookup("a")
+		assertEqual(t, ok, true, "key existence")
+		assertEqual(t, len(values(item)), 2, "number of values")
+		assertEqual(t, item.Context.covers(Dot{Node: "n1", Counter: 1}), true, "context covers the first write")
+		assertEqual(t, item.Context.covers(Dot{Node: "n2", Counter: 1}), true, "context covers the second write")
+	})
+
+	t.Run("should collapse siblings on a write with their context", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1, WithNodeID("self"))
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n2", 1, nil))
+		item, _ := s.Lookup("a")
+
+		_ = s.Set("a", []byte("z"), WriteOptions{SkipReplication: true, Context: item.Context})
+		item, _ = s.Lookup("a")
+		assertEqual(t, strings.Join(values(item), ","), "z", "values after the write")
+	})
+
+	t.Run("should ignore writes that were already seen", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n1", 2, VectorClock{"n1": 1}))
+
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n1", 2, VectorClock{"n1": 1}))
+		item, _ := s.Lookup("a")
+		assertEqual(t, strings.Join(values(item), ","), "y", "values after replayed writes")
+	})
+
+	t.Run("should keep a stale write next to the newer value", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n1", 2, VectorClock{"n1": 1}))
+		// Based on nothing, so concurrent with both.
+		_ = s.Set("a", []byte("z"), forwarded("n2", 1, nil))
+
+		item, _ := s.Lookup("a")
+		assertEqual(t, len(values(item)), 2, "number of values")
+		assertEqual(t, strings.Contains(strings.Join(values(item), ","), "x"), false, "replaced value kept")
+	})
+
+	t.Run("should replace every value on a write without a context", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n2", 1, nil))
+
+		_ = s.Set("a", []byte("z"), WriteOptions{SkipReplication: true})
+		item, _ := s.Lookup("a")
+		assertEqual(t, strings.Join(values(item), ","), "z", "values after the write")
+	})
+
+	t.Run("should survive a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStore([]string{"node1"}, 1, WithDataDir(dir))
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		_ = s.Set("a", []byte("x"), forwarded("n1", 1, nil))
+		_ = s.Set("a", []byte("y"), forwarded("n2", 1, nil))
+		s.Close()
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		item, _ := s.Lookup("a")
+		assertEqual(t, len(values(item)), 2, "number of values after a restart")
+	})
+
+	t.Run("should send the context and dot to replicas", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"), WithNodeID("self"))
+		var mu sync.Mutex
+		var writes []*http.Request
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodHead {
+					return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+				}
+				mu.Lock()
+				writes = append(writes, req)
+				mu.Unlock()
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+			},
+		}
+
+		if err := s.Set("a", []byte("x"), WriteOptions{}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		_ = s.Set("a", []byte("y"), WriteOptions{})
+		if len(writes) != 4 {
+			t.Fatalf("replicated writes: got %d, want 4", len(writes))
+		}
+		assertEqual(t, writes[len(writes)-1].Header.Get(DotHeader), "2@self", "replicated dot")
+		context, err := ParseVectorClock(writes[len(writes)-1].Header.Get(ContextHeader))
+		assertEqual(t, err, nil, "context parse error")
+		assertEqual(t, context["self"], uint64(1), "replicated context")
+	})
+
+	t.Run("should replace what the replicas hold on a write without context", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"), WithNodeID("self"))
+		_ = s.Set("a", []byte("old"), forwarded("n1", 1, nil))
+		stub := &replicaStub{heads: map[string]http.Header{
+			"node2": headers("ETag", FormatETag(2), ContextHeader, VectorClock{"n1": 1, "n2": 1}.String()),
+		}}
+		s.client = stub.client()
+
+		assertEqual(t, s.Set("a", []byte("new"), WriteOptions{}), nil, "write error")
+		item, _ := s.Lookup("a")
+		assertEqual(t, len(item.Siblings), 0, "siblings")
+		assertEqual(t, len(stub.puts), 2, "replicated writes")
+		context, _ := ParseVectorClock(stub.puts[0].Header.Get(ContextHeader))
+		assertEqual(t, context.descends(VectorClock{"n1": 1, "n2": 1}), true, "replicated context")
+	})
+}
+
+func TestParseVectorClock(t *testing.T) {
+	clock := VectorClock{"node1:8080": 3, "node2:8080": 1}
+	parsed, err := ParseVectorClock(clock.String())
+	assertEqual(t, err, nil, "parse error")
+	assertEqual(t, len(parsed), 2, "number of nodes")
+	assertEqual(t, parsed["node1:8080"], uint64(3), "first counter")
+	assertEqual(t, parsed["node2:8080"], uint64(1), "second counter")
+
+	for _, token := range []string{"!", "AQ", clock.String() + "AA"} {
+		if _, err := ParseVectorClock(token); err == nil {
+			t.Errorf("expected an error for %q", token)
+		}
+	}
+
+	dot, err := ParseDot(Dot{Node: "node1:8080", Counter: 7}.String())
+	assertEqual(t, err, nil, "dot parse error")
+	assertEqual(t, dot, Dot{Node: "node1:8080", Counter: 7}, "parsed dot")
+}
@@ -0,0 +1,429 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotMagic   = "KVSNAP01"
+	snapshotPrefix  = "snapshot-"
+	snapshotSuffix  = ".snap"
+	snapshotTempExt = ".tmp"
+	snapshotsToKeep = 2
+	checkpointFile  = "CHECKPOINT"
+)
+
+var (
+	ErrPersistenceDisabled = errors.New("persistence is disabled: no data directory configured")
+	ErrSnapshotInProgress  = errors.New("a snapshot is already in progress")
+)
+
+type SnapshotInfo struct {
+	Seq      uint64        `json:"seq"`
+	Keys     int           `json:"keys"`
+	Path     string        `json:"path"`
+	Duration time.Duration `json:"duration"`
+}
+
+func snapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix))
+}
+
+/*
+Returns the snapshot files in dir, newest first.
+*/
+func listSnapshots(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make(map[string]uint64, len(paths))
+	valid := paths[:0]
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), snapshotPrefix), snapshotSuffix)
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs[path] = seq
+		valid = append(valid, path)
+	}
+
+	sort.Slice(valid, func(i, j int) bool {
+		return seqs[valid[i]] > seqs[valid[j]]
+	})
+	return valid, nil
+}
+
+/*
+Writes the given keyspace to a new snapshot file. The file is written under
+a temporary name, synced and then renamed into place, so a crash never
+leaves a partially written snapshot behind.
+
+Layout: | magic | seq | key count | (key, value)... | crc32 |, where keys and
+values are uvarint length-prefixed and the checksum covers everything
+before it.
+*/
+func writeSnapshot(dir string, seq uint64, snap EngineSnapshot) (string, error) {
+	path := snapshotPath(dir, seq)
+	tmpPath := path + snapshotTempExt
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	checksum := crc32.New(crcTable)
+	writer := bufio.NewWriter(io.MultiWriter(file, checksum))
+
+	header := make([]byte, 0, len(snapshotMagic)+16)
+	header = append(header, snapshotMagic...)
+	header = binary.LittleEndian.AppendUint64(header, seq)
+	header = binary.LittleEndian.AppendUint64(header, uint64(snap.Len()))
+	writer.Write(header)
+
+	var buf []byte
+	var written int
+	var writeErr error
+	err = snap.Iterate(func(key string, value []byte) bool {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+		_, writeErr = writer.Write(buf)
+		written++
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil && written != snap.Len() {
+		err = fmt.Errorf("snapshot changed while being written: expected %d keys, got %d", snap.Len(), written)
+	}
+	if err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if _, err := file.Write(binary.LittleEndian.AppendUint32(nil, checksum.Sum32())); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return "", fmt.Errorf("failed to rename snapshot: %w", err)
+	}
+	return path, syncDir(dir)
+}
+
+/*
+Reads a snapshot file, calling apply for every key-value pair. The whole
+file is verified against its checksum before anything is applied.
+It returns the sequence number the snapshot was taken at.
+*/
+func readSnapshot(path string, apply func(key string, value []byte) error) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < int64(len(snapshotMagic))+16+4 {
+		return 0, errors.New("snapshot is too short")
+	}
+
+	checksum := crc32.New(crcTable)
+	if _, err := io.CopyN(checksum, file, info.Size()-4); err != nil {
+		return 0, err
+	}
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(file, trailer); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(trailer) != checksum.Sum32() {
+		return 0, errors.New("snapshot checksum mismatch")
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(io.LimitReader(file, info.Size()-4))
+
+	header := make([]byte, len(snapshotMagic)+16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errors.New("not a snapshot file")
+	}
+	seq := binary.LittleEndian.Uint64(header[len(snapshotMagic):])
+	count := binary.LittleEndian.Uint64(header[len(snapshotMagic)+8:])
+
+	for i := uint64(0); i < count; i++ {
+		key, err := readSnapshotBytes(reader)
+		if err != nil {
+			return 0, err
+		}
+		value, err := readSnapshotBytes(reader)
+		if err != nil {
+			return 0, err
+		}
+		if err := apply(string(key), value); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+func readSnapshotBytes(reader *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+/*
+Loads the newest snapshot that passes validation. Invalid snapshots are
+logged and skipped in favour of older ones. It returns the sequence number
+of the loaded snapshot, or zero if there is none.
+*/
+func loadLatestSnapshot(dir string, apply func(key string, value []byte) error) (uint64, error) {
+	leftovers, _ := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"+snapshotSuffix+snapshotTempExt))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	for _, path := range paths {
+		if _, err := readSnapshot(path, func(string, []byte) error { return nil }); err != nil {
+			log.Printf("Skipping invalid snapshot %s: %v", path, err)
+			continue
+		}
+		seq, err := readSnapshot(path, apply)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load snapshot %s: %w", path, err)
+		}
+		log.Printf("Loaded snapshot %s", path)
+		return seq, nil
+	}
+	return 0, nil
+}
+
+/*
+Removes all but the newest snapshotsToKeep snapshots.
+*/
+func pruneSnapshots(dir string) error {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	if len(paths) <= snapshotsToKeep {
+		return nil
+	}
+	for _, path := range paths[snapshotsToKeep:] {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Records the sequence number up to which an engine that keeps its own files
+has persisted every write. The file is replaced atomically.
+*/
+func writeCheckpoint(dir string, seq uint64) error {
+	path := filepath.Join(dir, checkpointFile)
+	data := []byte(strconv.FormatUint(seq, 10) + "\n")
+	if err := os.WriteFile(path+snapshotTempExt, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	file, err := os.Open(path + snapshotTempExt)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	if err := os.Rename(path+snapshotTempExt, path); err != nil {
+		return fmt.Errorf("failed to rename checkpoint: %w", err)
+	}
+	return syncDir(dir)
+}
+
+func readCheckpoint(dir string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return seq, nil
+}
+
+/*
+Writes a point-in-time snapshot of the keyspace and truncates the
+write-ahead log up to the snapshot's sequence number.
+
+The store lock is only held while the log is rotated and the engine hands
+out its snapshot view, so Get and Set keep running while the snapshot is
+written to disk. Engines that keep their own files are flushed instead.
+*/
+func (s *Store) Snapshot() (SnapshotInfo, error) {
+	if s.wal == nil {
+		return SnapshotInfo{}, ErrPersistenceDisabled
+	}
+	if !s.snapshotMu.TryLock() {
+		return SnapshotInfo{}, ErrSnapshotInProgress
+	}
+	defer s.snapshotMu.Unlock()
+
+	start := time.Now()
+
+	s.mu.Lock()
+	seq := s.seq
+	if err := s.wal.Rotate(seq + 1); err != nil {
+		s.mu.Unlock()
+		return SnapshotInfo{}, err
+	}
+
+	var info SnapshotInfo
+	var err error
+	switch engine := s.engine.(type) {
+	case Flusher:
+		s.mu.Unlock()
+		info, err = s.checkpoint(engine, seq)
+	case Snapshotter:
+		var snap EngineSnapshot
+		snap, err = engine.Snapshot()
+		s.mu.Unlock()
+		if err == nil {
+			info, err = s.writeEngineSnapshot(snap, seq)
+		}
+	default:
+		s.mu.Unlock()
+		err = ErrSnapshotUnsupported
+	}
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err := s.wal.RemoveThrough(seq); err != nil {
+		log.Printf("Failed to truncate wal after snapshot: %v", err)
+	}
+	s.lastSnapshotSeq.Store(seq)
+
+	info.Seq = seq
+	info.Duration = time.Since(start)
+	return info, nil
+}
+
+func (s *Store) writeEngineSnapshot(snap EngineSnapshot, seq uint64) (SnapshotInfo, error) {
+	keys := snap.Len()
+	path, err := writeSnapshot(s.dataDir, seq, snap)
+	snap.Release()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := pruneSnapshots(s.dataDir); err != nil {
+		log.Printf("Failed to remove old snapshots: %v", err)
+	}
+	return SnapshotInfo{Keys: keys, Path: path}, nil
+}
+
+/*
+Flushes the engine, which persists every write up to and including seq
+since those were applied before the log was rotated, and records seq as
+the point where replay has to start.
+*/
+func (s *Store) checkpoint(engine Flusher, seq uint64) (SnapshotInfo, error) {
+	if err := engine.Flush(); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := writeCheckpoint(s.dataDir, seq); err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{
+		Keys: int(s.engine.Stats().Keys),
+		Path: filepath.Join(s.dataDir, checkpointFile),
+	}, nil
+}
+
+/*
+Periodically snapshots the store until it is closed. Intervals without any
+new writes are skipped.
+*/
+func (s *Store) snapshotLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.RLock()
+			seq := s.seq
+			s.mu.RUnlock()
+			if seq == s.lastSnapshotSeq.Load() {
+				continue
+			}
+
+			info, err := s.Snapshot()
+			if err != nil {
+				if err != ErrSnapshotInProgress {
+					log.Printf("Periodic snapshot failed: %v", err)
+				}
+				continue
+			}
+			log.Printf("Wrote snapshot at seq %d with %d keys in %v", info.Seq, info.Keys, info.Duration)
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Run("should restore from snapshot and log suffix", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithDataDir(dir), WithSnapshotInterval(0))
+
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		_ = s.Set("b", []byte("2"), WriteOptions{SkipReplication: true})
+		info, err := s.Snapshot()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, info.Seq, uint64(2), "snapshot seq")
+		assertEqual(t, info.Keys, 2, "snapshot keys")
+
+		_ = s.Set("c", []byte("3"), WriteOptions{SkipReplication: true})
+		_ = s.Delete("a", WriteOptions{SkipReplication: true})
+		s.Close()
+
+		segments, _ := listWALSegments(dir)
+		assertEqual(t, len(segments), 1, "wal segments after snapshot")
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir), WithSnapshotInterval(0))
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "key deleted after snapshot")
+		value, _ := s.Get("b")
+		assertEqual(t, string(value), "2", "key from snapshot")
+		value, _ = s.Get("c")
+		assertEqual(t, string(value), "3", "key from log suffix")
+		assertEqual(t, s.seq, uint64(4), "sequence after restart")
+	})
+
+	t.Run("should fall back to an older snapshot when the newest is corrupt", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithDataDir(dir), WithSnapshotInterval(0))
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		_, _ = s.Snapshot()
+		_ = s.Set("a", []byte("2"), WriteOptions{SkipReplication: true})
+		info, _ := s.Snapshot()
+		s.Close()
+
+		data, _ := os.ReadFile(info.Path)
+		data[len(data)-5] ^= 0xff
+		_ = os.WriteFile(info.Path, data, 0o644)
+
+		seq, err := loadLatestSnapshot(dir, func(key string, value []byte) error {
+			e, err := decodeEntry(value)
+			assertEqual(t, err, nil, "entry from older snapshot")
+			assertEqual(t, string(e.value), "1", "value from older snapshot")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, seq, uint64(1), "older snapshot seq")
+	})
+
+	t.Run("should checkpoint an engine that keeps its own files", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithEngine("lsm"), WithDataDir(dir), WithSnapshotInterval(0))
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		info, err := s.Snapshot()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, info.Seq, uint64(1), "checkpoint seq")
+
+		_ = s.Set("b", []byte("2"), WriteOptions{SkipReplication: true})
+		s.Close()
+
+		seq, _ := readCheckpoint(dir)
+		assertEqual(t, seq, uint64(1), "recorded checkpoint")
+
+		s = newTestStore(t, []string{"node1"}, 1, WithEngine("lsm"), WithDataDir(dir), WithSnapshotInterval(0))
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "1", "key from flushed engine")
+		value, _ = s.Get("b")
+		assertEqual(t, string(value), "2", "key from log suffix")
+		assertEqual(t, s.seq, uint64(2), "sequence after restart")
+	})
+
+	t.Run("should fail without a data directory", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_, err := s.Snapshot()
+		if !errors.Is(err, ErrPersistenceDisabled) {
+			t.Errorf("expected ErrPersistenceDisabled, got %v", err)
+		}
+	})
+}
@@ -1,20 +1,50 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Firaz-Ilhan/distributed-kvstore/hashring"
+	"github.com/Firaz-Ilhan/distributed-kvstore/raft"
 )
 
 const (
 	ReplicationHeader = "X-Replication"
+	TimestampHeader   = "X-Timestamp"
+	ExpiresHeader     = "X-Expires"
+	VersionHeader     = "X-Version"
+	// The causal context a write is based on, as returned by a read.
+	ContextHeader = "X-Context"
+	// The dot of a forwarded write.
+	DotHeader = "X-Dot"
+	// Set on forwarded writes that only apply over an older version.
+	ConditionalHeader = "X-Conditional"
+	// The hybrid logical clock timestamp of a forwarded write or delete.
+	HLCHeader = "X-HLC"
+	// The replica a forwarded write is meant for, if the node it is sent
+	// to should only hold it as a hint.
+	HintHeader = "X-Hint-For"
+	// Set by a replica that answers a forwarded read of a key it holds a
+	// tombstone for.
+	DeletedHeader = "X-Deleted"
+	// The media type the value a replica answers a forwarded read with was
+	// written with, if any. Unlike Content-Type, it has no default.
+	ContentTypeHeader = "X-Content-Type"
+	// The node that relayed a client write to a replica of the key to
+	// coordinate, since it is not one itself.
+	RelayHeader = "X-Relayed-By"
 )
 
 type HttpClient interface {
@@ -23,14 +53,73 @@ type HttpClient interface {
 }
 
 type Store struct {
-	mu                sync.RWMutex
-	data              map[string]string
-	nodes             []string
-	client            HttpClient
-	ringManager       *hashring.HashRingManager
-	replicationFactor int
-	readQuorum        int
-	writeQuorum       int
+	mu                 sync.RWMutex
+	engine             Engine
+	nodes              []string
+	self               string
+	members            []string
+	client             HttpClient
+	ringManager        *hashring.HashRingManager
+	ownerRing          *hashring.HashRingManager
+	replicationFactor  int
+	readQuorum         int
+	writeQuorum        int
+	wal                *wal
+	seq                uint64
+	dataDir            string
+	snapshotMu         sync.Mutex
+	lastSnapshotSeq    atomic.Uint64
+	done               chan struct{}
+	wg                 sync.WaitGroup
+	now                func() time.Time
+	reapCursor         string
+	expiredKeys        atomic.Uint64
+	limiter            *memoryLimiter
+	evictedKeys        atomic.Uint64
+	chunkSize          int
+	nodeID             string
+	resolution         ConflictResolution
+	hlc                hybridClock
+	readRepairChance   float64
+	readRepairs        atomic.Uint64
+	readRepairFailures atomic.Uint64
+	uploadsMu          sync.Mutex
+	uploads            map[string]struct{}
+	orphans            map[string]time.Time
+	hintsMu            sync.Mutex
+	pendingHints       map[string]int
+	hintBytes          int64
+	hintMaxSize        int64
+	hintMaxAge         time.Duration
+	hintsStored        atomic.Uint64
+	hintsDelivered     atomic.Uint64
+	hintsDropped       atomic.Uint64
+	handoff            chan string
+	antiEntropyMu      sync.Mutex
+	antiEntropyRate    int
+	reportMu           sync.Mutex
+	lastAntiEntropy    AntiEntropyReport
+	antiEntropyRounds  atomic.Uint64
+	antiEntropyRepairs atomic.Uint64
+	divergentRanges    atomic.Uint64
+	tombstoneGrace     time.Duration
+	tombstones         atomic.Int64
+	tombstonesPurged   atomic.Uint64
+	replicationMode    ReplicationMode
+	raftTick           time.Duration
+	raftMu             sync.Mutex
+	raftGroups         map[uint32]*raftGroup
+	raftPartitions     []uint32
+	raftReplicas       map[uint32][]string
+	raftKeys           map[uint32]map[string]struct{}
+	raftOutbox         map[string]chan []raft.Message
+	txnMu              sync.Mutex
+	txnLocks           map[string]string
+	txnActive          map[string]struct{}
+	txnSessions        map[string]*txnSession
+	txnApplyMu         sync.Mutex
+	txnsCommitted      atomic.Uint64
+	txnsAborted        atomic.Uint64
 }
 
 type MultiError []error
@@ -44,177 +133,1174 @@ func (me MultiError) Error() string {
 }
 
 /*
-Initializes and returns a new Store instance. It sets the
-read and write quorums based on the number of nodes,
-and initializes the hashing ring for the nodes.
+Initializes and returns a new Store instance. Every key is replicated to
+replicationFactor nodes of the ring, which holds the given nodes and this
+node if its address is configured; reads and writes wait for the read and
+write quorums of them, a majority unless configured otherwise. A store
+without other nodes, or with a single one and no address of its own, runs
+standalone and does not replicate; it deletes keys outright, while
+replicated stores keep tombstones of deleted keys for a grace period.
+With RaftReplication every partition of the ring is instead replicated by
+a Raft group of its replicas, which requires the address of this node.
+The keyspace is kept in the configured storage engine. If a data
+directory is configured, the write-ahead log is replayed so the store
+starts with the keyspace it had before.
 */
-func NewStore(nodes []string, replicationFactor int) *Store {
-	halfNodes := len(nodes) / 2
-	readQuorum := halfNodes + 1
-	writeQuorum := halfNodes + 1
+func NewStore(nodes []string, replicationFactor int, opts ...Option) (*Store, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	nodes = otherNodes(nodes, o.self)
+	members := nodes
+	if o.self != "" {
+		members = append([]string{o.self}, nodes...)
+	}
 
-	if len(nodes) == 1 {
-		readQuorum = 1
-		writeQuorum = 1
+	readQuorum, writeQuorum := 1, 1
+	if len(nodes) == 0 || (len(nodes) == 1 && o.self == "") {
 		replicationFactor = 0
+	} else {
+		var err error
+		readQuorum, writeQuorum, err = quorums(replicationFactor, o.readQuorum, o.writeQuorum, len(members))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.dataDir != "" {
+		if err := checkEngineFile(o.dataDir, o.engine); err != nil {
+			return nil, err
+		}
+	}
+	engine, err := newEngine(o.engine, o.dataDir)
+	if err != nil {
+		return nil, err
 	}
 
 	s := &Store{
-		data:              make(map[string]string),
+		engine:            engine,
 		nodes:             nodes,
 		client:            &http.Client{Timeout: 2 * time.Second},
-		ringManager:       hashring.NewHashRingManager(nodes),
+		self:              o.self,
+		members:           members,
+		ringManager:       hashring.NewHashRingManager(members),
+		ownerRing:         hashring.NewHashRingManager(members),
 		replicationFactor: replicationFactor,
 		readQuorum:        readQuorum,
 		writeQuorum:       writeQuorum,
+		dataDir:           o.dataDir,
+		done:              make(chan struct{}),
+		now:               time.Now,
+		chunkSize:         DefaultChunkSize,
+		nodeID:            o.nodeID,
+		resolution:        o.conflictResolution,
+		readRepairChance:  o.readRepairChance,
+		uploads:           make(map[string]struct{}),
+		orphans:           make(map[string]time.Time),
+		pendingHints:      make(map[string]int),
+		txnLocks:          make(map[string]string),
+		txnActive:         make(map[string]struct{}),
+		txnSessions:       make(map[string]*txnSession),
+		hintMaxSize:       o.hintMaxSize,
+		hintMaxAge:        o.hintMaxAge,
+		handoff:           make(chan string, len(nodes)+1),
+		antiEntropyRate:   o.antiEntropyRate,
+		tombstoneGrace:    o.tombstoneGrace,
+		replicationMode:   o.replicationMode,
+		raftTick:          o.raftTick,
+	}
+	if s.replicationMode == RaftReplication && replicationFactor > 0 && o.self == "" {
+		engine.Close()
+		return nil, errors.New("raft replication requires the address of this node")
+	}
+	if replicationFactor == 0 {
+		// A standalone store has no replicas to agree with.
+		s.replicationMode = EventualReplication
+	}
+	if s.replicationMode == EventualReplication && replicationFactor > 0 && s.tombstoneGrace < s.hintMaxAge {
+		log.Printf("Warning: tombstones are purged after %v, before hints expire after %v; hinted writes may bring deleted keys back", s.tombstoneGrace, s.hintMaxAge)
+	}
+
+	if o.dataDir != "" {
+		if err := s.recover(o); err != nil {
+			engine.Close()
+			return nil, err
+		}
+		if o.snapshotInterval > 0 {
+			s.wg.Add(1)
+			go s.snapshotLoop(o.snapshotInterval)
+		}
+	}
+	if o.maxMemory > 0 {
+		if err := s.startLimiter(o.maxMemory, o.evictionPolicy); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if o.reapInterval > 0 {
+		s.wg.Add(1)
+		go s.reapLoop(o.reapInterval)
+	}
+	if err := s.loadHints(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to load hints: %w", err)
+	}
+	if err := s.loadTransactions(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to load transactions: %w", err)
+	}
+	if s.replicationMode == RaftReplication {
+		if err := s.startRaft(o); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to start raft: %w", err)
+		}
+		return s, nil
+	}
+	s.wg.Add(1)
+	go s.txnLoop()
+	if len(nodes) > 0 {
+		s.wg.Add(1)
+		go s.handoffLoop()
+	}
+	if len(nodes) > 0 && o.self != "" && o.antiEntropyInterval > 0 {
+		s.wg.Add(1)
+		go s.antiEntropyLoop(o.antiEntropyInterval)
+	}
+
+	return s, nil
+}
+
+/*
+Rebuilds the keyspace from the newest valid snapshot and the part of the
+write-ahead log that follows it. Engines that keep their own files already
+hold everything up to their last checkpoint, so only the log after it is
+replayed.
+*/
+func (s *Store) recover(o options) error {
+	var snapshotSeq uint64
+	var err error
+	if _, ok := s.engine.(Flusher); ok {
+		snapshotSeq, err = readCheckpoint(o.dataDir)
+	} else {
+		snapshotSeq, err = loadLatestSnapshot(o.dataDir, s.engine.Put)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, lastSeq, err := openWAL(o.dataDir, o.fsyncPolicy, snapshotSeq, s.applyRecord)
+	if err != nil {
+		return err
+	}
+	s.wal = w
+	s.seq = lastSeq
+	s.lastSnapshotSeq.Store(snapshotSeq)
+	if err := s.importLegacyWAL(o.dataDir); err != nil {
+		return err
+	}
+	if err := s.countTombstones(); err != nil {
+		return err
+	}
+	log.Printf("Recovered %d keys from %s (snapshot seq %d, log seq %d)", s.engine.Stats().Keys, o.dataDir, snapshotSeq, lastSeq)
+	return nil
+}
+
+/*
+Imports the keys of the single wal.log written by versions that predate
+log segments, which held raw values rather than entries. Each key still set
+there is written again as an entry with the time of the import; keys the
+segments already hold were written after the upgrade and are kept. The old
+file is renamed once the import is durable.
+*/
+func (s *Store) importLegacyWAL(dir string) error {
+	values, ok, err := readLegacyWAL(dir)
+	if err != nil || !ok {
+		return err
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s.mu.Lock()
+	imported := 0
+	now := s.now().UnixNano()
+	for _, key := range keys {
+		if _, exists := s.loadEntry(key); exists {
+			continue
+		}
+		e := entry{value: []byte(values[key]), modified: now}
+		if err := s.commit(walOpSet, key, string(e.encode())); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		imported++
+	}
+	s.mu.Unlock()
+
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	log.Printf("Imported %d of %d keys from the legacy %s", imported, len(keys), legacyWALName)
+	return retireLegacyWAL(dir)
+}
+
+/*
+Stops background snapshots, flushes and closes the write-ahead log, if any,
+and closes the storage engine.
+*/
+func (s *Store) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	s.wg.Wait()
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	var errs MultiError
+	if err := s.closeRaft(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.wal != nil {
+		if err := s.wal.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.engine.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+/*
+Returns statistics about the local storage engine, together with counters
+kept by the store itself.
+*/
+func (s *Store) Stats() EngineStats {
+	stats := s.engine.Stats()
+	if stats.Metrics == nil {
+		stats.Metrics = make(map[string]int64)
+	}
+	stats.Metrics["expired_keys"] = int64(s.expiredKeys.Load())
+	stats.Metrics["read_repairs"] = int64(s.readRepairs.Load())
+	stats.Metrics["read_repair_failures"] = int64(s.readRepairFailures.Load())
+	s.hintsMu.Lock()
+	pending := 0
+	for _, count := range s.pendingHints {
+		pending += count
+	}
+	stats.Metrics["hints_pending"] = int64(pending)
+	stats.Metrics["hints_pending_bytes"] = s.hintBytes
+	s.hintsMu.Unlock()
+	stats.Metrics["hints_stored"] = int64(s.hintsStored.Load())
+	stats.Metrics["hints_delivered"] = int64(s.hintsDelivered.Load())
+	stats.Metrics["hints_dropped"] = int64(s.hintsDropped.Load())
+	stats.Metrics["anti_entropy_rounds"] = int64(s.antiEntropyRounds.Load())
+	stats.Metrics["anti_entropy_divergent_ranges"] = int64(s.divergentRanges.Load())
+	stats.Metrics["anti_entropy_repaired_keys"] = int64(s.antiEntropyRepairs.Load())
+	stats.Metrics["tombstones"] = s.tombstones.Load()
+	stats.Metrics["tombstones_purged"] = int64(s.tombstonesPurged.Load())
+	if s.replicationMode == RaftReplication {
+		s.raftStats(stats.Metrics)
+	} else {
+		s.txnStats(stats.Metrics)
+	}
+	if s.limiter != nil {
+		s.limiter.stats(stats.Metrics)
+		stats.Metrics["evicted_keys"] = int64(s.evictedKeys.Load())
+	}
+	return stats
+}
+
+func (s *Store) applyRecord(r walRecord) error {
+	switch r.Op {
+	case walOpSet:
+		return s.engine.Put(r.Key, []byte(r.Value))
+	case walOpDelete:
+		return s.engine.Delete(r.Key)
+	}
+	return nil
+}
+
+/*
+Logs the mutation and applies it to the storage engine. The caller must hold
+s.mu so that the log order matches the order in which mutations are applied.
+*/
+func (s *Store) commit(op walOp, key, value string) error {
+	record := walRecord{Seq: s.seq + 1, Op: op, Key: key, Value: value}
+	if s.wal != nil {
+		if err := s.wal.Append(record); err != nil {
+			return err
+		}
 	}
-	return s
+	s.seq = record.Seq
+	return s.applyRecord(record)
+}
+
+/*
+Deletes key locally. The caller must hold s.mu.
+*/
+func (s *Store) remove(key string) error {
+	previous, exists := s.loadEntry(key)
+	if err := s.commit(walOpDelete, key, ""); err != nil {
+		return err
+	}
+	s.limiter.untrack(key)
+	if exists && previous.deleted() {
+		s.tombstones.Add(-1)
+	}
+	s.unindexRaftKey(key)
+	return nil
+}
+
+/*
+Describes how a write is applied. Writes forwarded by a coordinator skip
+replication and carry the coordinator's timestamp, so every replica records
+the same modification time.
+*/
+type WriteOptions struct {
+	SkipReplication bool
+	// Unix nanoseconds; zero means now.
+	Timestamp int64
+	// How long the value lives. Forwarded writes carry the absolute
+	// expiry in Expires (Unix nanoseconds) instead.
+	TTL     time.Duration
+	Expires int64
+	// The media type of the value, returned to readers as is.
+	ContentType string
+	// The version the coordinator assigned to the write. Zero means the one
+	// after the version held locally.
+	Version uint64
+	// What the version held for the key must be for the write to apply.
+	Condition Condition
+	// The causal context the write is based on. Values it has seen are
+	// replaced by the write, others are kept as its siblings. Without a
+	// context, the write replaces every value held by the coordinator and
+	// the replicas that answer it.
+	Context VectorClock
+	// The dot a coordinator assigned to the write it forwards.
+	Dot Dot
+	// The timestamp a coordinator assigned to the write or delete it
+	// forwards when writes are resolved by LastWriteWins.
+	HLC HybridTime
+	// How many replicas must acknowledge the write.
+	Consistency Consistency
+	// Set on increments a coordinator forwarded to the node that owns the
+	// key, and on writes relayed to a replica of the key, which apply them
+	// themselves instead of forwarding them again.
+	Forwarded bool
+	// The transaction the write commits, which may write the keys it
+	// holds locks on.
+	txn string
+}
+
+/*
+Reads the entry stored for key, whether or not it has expired.
+*/
+func (s *Store) loadEntry(key string) (entry, bool) {
+	buf, ok, err := s.engine.Get(key)
+	if err == nil && ok {
+		var e entry
+		if e, err = decodeEntry(buf); err == nil {
+			return e, true
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to read key %s: %v", key, err)
+	}
+	return entry{}, false
+}
+
+/*
+Returns the values held for key that have not expired, tombstones included.
+*/
+func (s *Store) replicaEntry(key string) (entry, bool) {
+	e, ok := s.loadEntry(key)
+	if !ok {
+		return entry{}, false
+	}
+	return e.unexpired(s.now().UnixNano())
+}
+
+/*
+Returns the values held for key that have not expired and are not
+tombstones.
+*/
+func (s *Store) getEntry(key string) (entry, bool) {
+	e, ok := s.loadEntry(key)
+	if ok {
+		e, ok = e.live(s.now().UnixNano())
+	}
+	if !ok {
+		return entry{}, false
+	}
+	s.limiter.touch(key)
+	return e, true
 }
 
 /*
 Get retrieves a value from the store based on the provided key. It returns
 the value and a boolean indicating if the key was found in the store.
+Expired and deleted keys are not found. If the key holds siblings, the most recently
+modified value is returned. The returned value must not be modified.
+*/
+func (s *Store) Get(key string) ([]byte, bool) {
+	item, ok := s.Lookup(key)
+	return item.Value, ok
+}
+
+/*
+Like Get, but returns the value together with its metadata and siblings.
+*/
+func (s *Store) Lookup(key string) (KeyValue, bool) {
+	e, ok := s.getEntry(key)
+	if !ok {
+		return KeyValue{}, false
+	}
+	item, err := s.item(key, e)
+	if err != nil {
+		log.Printf("Failed to read key %s: %v", key, err)
+		return KeyValue{}, false
+	}
+	return item, true
+}
+
+/*
+Like Lookup, but as held by a replica: tombstones are returned among the
+values with Deleted set, so that a key deleted on this node is found.
 */
-func (s *Store) Get(key string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	val, ok := s.data[key]
-	return val, ok
+func (s *Store) lookupReplica(key string) (KeyValue, bool) {
+	e, ok := s.replicaEntry(key)
+	if !ok {
+		return KeyValue{}, false
+	}
+	item, err := s.item(key, e)
+	if err != nil {
+		log.Printf("Failed to read key %s: %v", key, err)
+		return KeyValue{}, false
+	}
+	return item, true
 }
 
 /*
-Adds or updates a key-value pair in the store. If skipReplication is false, it will
+Returns the metadata and siblings of key and a reader over its value, which
+is read from the engine as it is consumed. The Value field of the returned
+item is left empty.
+*/
+func (s *Store) Open(key string) (KeyValue, io.ReadSeeker, bool) {
+	e, ok := s.getEntry(key)
+	if !ok {
+		return KeyValue{}, nil, false
+	}
+	return s.open(key, e)
+}
+
+/*
+Like Open, but as held by a replica, which coordinators compare with the
+other replicas: tombstones are returned among the values with Deleted set,
+so that a key deleted on this node is found.
+*/
+func (s *Store) OpenReplica(key string) (KeyValue, io.ReadSeeker, bool) {
+	e, ok := s.replicaEntry(key)
+	if !ok {
+		return KeyValue{}, nil, false
+	}
+	return s.open(key, e)
+}
+
+func (s *Store) open(key string, e entry) (KeyValue, io.ReadSeeker, bool) {
+	primary := e
+	primary.siblings = nil
+	item := primary.keyValue(key)
+	var err error
+	if item.Siblings, err = s.siblingItems(key, e); err != nil {
+		log.Printf("Failed to read key %s: %v", key, err)
+		return KeyValue{}, nil, false
+	}
+	item.Value = nil
+	item.Context = e.clock()
+	item.Version = e.maxVersion()
+	item.HLC = e.latest()
+	if e.chunks.chunked() {
+		return item, s.newChunkReader(key, e.chunks), true
+	}
+	return item, bytes.NewReader(e.value), true
+}
+
+/*
+Adds or updates a key-value pair in the store. Unless opts.SkipReplication is set, it will
 attempt to replicate the operation to other nodes in the distributed system.
 It will return an error if there's a problem with the operation or the replication.
+With RaftReplication the write is committed to the Raft log of the key
+through the leader of its group instead.
+*/
+func (s *Store) Set(key string, value []byte, opts WriteOptions) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if s.replicationMode == RaftReplication && !opts.SkipReplication {
+		return s.setRaft(key, value, opts)
+	}
+	if relayed, _, err := s.relayWrite(http.MethodPut, key, bytes.NewReader(value), opts); relayed {
+		return err
+	}
+	if _, err := s.resolveWrite(key, &opts); err != nil {
+		return err
+	}
+	return s.setResolved(key, value, opts)
+}
+
+/*
+Writes value to key once the write has been resolved against the replicas.
 */
-func (s *Store) Set(key string, value string, skipReplication bool) error {
-	if key == "" || value == "" {
-		return errors.New("key or value cannot be empty")
+func (s *Store) setResolved(key string, value []byte, opts WriteOptions) error {
+	if len(value) > s.chunkSize {
+		return s.setChunked(key, bytes.NewReader(value), opts)
 	}
 
+	e, err := s.newEntry(opts)
+	if err != nil {
+		return err
+	}
+	e.value = value
+	e, _, undo, err := s.put(key, e, opts)
+	if err != nil {
+		return err
+	}
+	return s.replicateWrite(opts, "PUT", key, bytesSource(value), e, undo)
+}
+
+/*
+Returns an entry stamped with the metadata of a write, without a value.
+*/
+func (s *Store) newEntry(opts WriteOptions) (entry, error) {
+	if opts.TTL < 0 {
+		return entry{}, errors.New("ttl cannot be negative")
+	}
+
+	e := entry{contentType: opts.ContentType, modified: opts.Timestamp, expires: opts.Expires, version: opts.Version}
+	if s.resolution == LastWriteWins {
+		stamp := s.writeTime(opts)
+		e.modified, e.logical, e.origin = stamp.Wall, stamp.Logical, stamp.Node
+	} else if e.modified == 0 {
+		e.modified = s.now().UnixNano()
+	}
+	if e.expires == 0 && opts.TTL > 0 {
+		e.expires = e.modified + int64(opts.TTL)
+	}
+	return e, nil
+}
+
+/*
+Adds the value e to the values of key locally if opts.Condition holds,
+making room for it first if memory is limited. Writes coordinated by this
+node are given the next dot of this node; forwarded ones keep theirs. The
+value is returned with its clock and version, which is never lower than
+the one after the version held before, so versions only grow. applied is
+false if a value held already replaces e: one that has seen it or, with
+LastWriteWins, one with a newer timestamp. Tombstones are merged like any
+other value, so a delete replaces the values it has seen and a write
+replaces the deletes it has seen. What the write replaced is returned as
+well, so that undoWrite can take it back.
+*/
+func (s *Store) put(key string, e entry, opts WriteOptions) (_ entry, applied bool, _ writeUndo, _ error) {
 	s.mu.Lock()
-	s.data[key] = value
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	undo := writeUndo{key: key}
+	undo.previous, undo.existed = s.loadEntry(key)
+	e, applied, err := s.putLocked(key, e, opts)
+	if applied {
+		undo.written, undo.applied = s.loadEntry(key)
+	}
+	return e, applied, undo, err
+}
+
+/*
+Like put, but requires s.mu.
+*/
+func (s *Store) putLocked(key string, e entry, opts WriteOptions) (_ entry, applied bool, _ error) {
+	if err := s.checkTxnLock(key, opts.txn); err != nil {
+		return entry{}, false, err
+	}
+	held, ok := s.conditionEntry(key)
+	if err := opts.Condition.check(held, ok, e.version); err != nil {
+		return entry{}, false, err
+	}
+
+	// Expired values still count towards the clock and the version.
+	previous, exists := s.loadEntry(key)
+	current, found := s.replicaEntry(key)
+	if s.resolution == LastWriteWins {
+		if exists && !previous.latest().Before(e.stamp()) {
+			return e, false, nil
+		}
+	} else if opts.SkipReplication {
+		e.context, e.dot = opts.Context, opts.Dot
+	} else {
+		e.context = opts.Context
+		if e.context == nil {
+			e.context = current.clock()
+		}
+		e.dot = Dot{Node: s.nodeID, Counter: previous.clock().merge(e.context)[s.nodeID] + 1}
+	}
+	if exists && e.version <= previous.maxVersion() {
+		e.version = previous.maxVersion() + 1
+	} else if e.version == 0 {
+		e.version = 1
+	}
+
+	record, applied := e, true
+	if s.resolution != LastWriteWins {
+		if record, applied = addValue(current, found, e); !applied {
+			return e, false, nil
+		}
+	}
+	encoded := record.encode()
+	size := entrySize(key, len(encoded)) + record.chunkedSize()
+	if err := s.makeRoom(key, size); err != nil {
+		return entry{}, false, err
+	}
+	if err := s.commit(walOpSet, key, string(encoded)); err != nil {
+		return entry{}, false, err
+	}
+	s.limiter.track(key, size, record.lastExpiry())
+	if was, is := exists && previous.deleted(), record.deleted(); is != was {
+		if is {
+			s.tombstones.Add(1)
+		} else {
+			s.tombstones.Add(-1)
+		}
+	}
+	return e, true, nil
+}
 
-	return s.handleReplication(skipReplication, "PUT", key, value)
+/*
+The headers that carry the metadata of e to the replicas.
+*/
+func replicationHeader(e entry, opts WriteOptions) http.Header {
+	header := versionHeader(e.version, opts.Condition)
+	header.Set(ContextHeader, e.context.String())
+	header.Set(DotHeader, e.dot.String())
+	if e.origin != "" {
+		header.Set(HLCHeader, e.stamp().String())
+	}
+	header.Set(TimestampHeader, strconv.FormatInt(e.modified, 10))
+	if e.expires != 0 {
+		header.Set(ExpiresHeader, strconv.FormatInt(e.expires, 10))
+	}
+	if e.contentType != "" {
+		header.Set("Content-Type", e.contentType)
+	}
+	return header
 }
 
 /*
-Removes a key from the store. If skipReplication is false, it will
+Removes a key from the store if opts.Condition holds. Unless opts.SkipReplication is set, it will
 attempt to replicate the delete operation to other nodes in the distributed system.
 It will return an error if there's a problem with the operation or the replication.
+A replicated key is not removed but overwritten with a tombstone, which is
+versioned, merged and repaired like any other write, so that replicas that
+missed the delete cannot bring the value back, and purged once the
+tombstone grace period has passed. With RaftReplication the delete is
+committed to the Raft log of the key instead, and every replica removes
+the key when it applies it.
+*/
+func (s *Store) Delete(key string, opts WriteOptions) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if s.replicationMode == RaftReplication && !opts.SkipReplication {
+		return s.deleteRaft(key, opts)
+	}
+	if relayed, _, err := s.relayWrite(http.MethodDelete, key, nil, opts); relayed {
+		return err
+	}
+	if _, err := s.resolveWrite(key, &opts); err != nil {
+		return err
+	}
+	if s.replicationFactor == 0 {
+		return s.deleteStandalone(key, opts)
+	}
+
+	opts.TTL, opts.Expires, opts.ContentType = 0, 0, ""
+	e, err := s.newEntry(opts)
+	if err != nil {
+		return err
+	}
+	e.tombstone = true
+	e, _, undo, err := s.put(key, e, opts)
+	if err != nil {
+		return err
+	}
+	return s.replicateWrite(opts, "DELETE", key, nil, e, undo)
+}
+
+/*
+Removes a key from a store without replicas, which has no copies that could
+bring it back. With LastWriteWins values written after the delete are kept.
 */
-func (s *Store) Delete(key string, skipReplication bool) error {
-	if key == "" {
-		return errors.New("key cannot be empty")
+func (s *Store) deleteStandalone(key string, opts WriteOptions) error {
+	var stamp HybridTime
+	if s.resolution == LastWriteWins {
+		stamp = s.writeTime(opts)
 	}
 
 	s.mu.Lock()
-	delete(s.data, key)
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	if err := s.checkTxnLock(key, opts.txn); err != nil {
+		return err
+	}
+	held, ok := s.conditionEntry(key)
+	if err := opts.Condition.check(held, ok, opts.Version); err != nil {
+		return err
+	}
+	if s.writtenAfter(key, stamp) {
+		return nil
+	}
+	return s.remove(key)
+}
 
-	return s.handleReplication(skipReplication, "DELETE", key, "")
+/*
+Reports whether key holds a value written after a delete with timestamp
+stamp, which the delete must keep. Only LastWriteWins orders deletes and
+writes. The caller must hold s.mu.
+*/
+func (s *Store) writtenAfter(key string, stamp HybridTime) bool {
+	if s.resolution != LastWriteWins {
+		return false
+	}
+	previous, exists := s.loadEntry(key)
+	return exists && stamp.Before(previous.latest())
 }
 
-func (s *Store) handleReplication(skipReplication bool, method, key, value string) error {
-	if !skipReplication {
-		err := s.replicate(method, key, value)
-		if err != nil {
-			log.Printf("Failed to replicate %s operation for key %s: %v", method, key, err)
-			return fmt.Errorf("failed to set value with replication: %v", err)
-		}
+func versionHeader(version uint64, cond Condition) http.Header {
+	header := http.Header{}
+	header.Set(VersionHeader, strconv.FormatUint(version, 10))
+	if cond.IfOlder {
+		header.Set(ConditionalHeader, "true")
+	}
+	return header
+}
+
+/*
+Opens a new reader over the value of a write and reports its size. Every
+replica gets its own reader, so that a value can be streamed to all of them
+without holding it in memory.
+*/
+type valueSource func() (io.Reader, int64)
+
+func bytesSource(value []byte) valueSource {
+	return func() (io.Reader, int64) {
+		return bytes.NewReader(value), int64(len(value))
+	}
+}
+
+/*
+Replicates a write unless opts skips replication. Writes at
+ConsistencyLocal are replicated in the background.
+*/
+func (s *Store) handleReplication(opts WriteOptions, method, key string, value valueSource, header http.Header) error {
+	if opts.SkipReplication {
+		return nil
+	}
+	if opts.Consistency == ConsistencyLocal {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.replicate(method, key, value, header, ConsistencyLocal); err != nil {
+				log.Printf("Failed to replicate %s operation for key %s: %v", method, key, err)
+			}
+		}()
+		return nil
+	}
+	if err := s.replicate(method, key, value, header, opts.Consistency); err != nil {
+		log.Printf("Failed to replicate %s operation for key %s: %v", method, key, err)
+		return fmt.Errorf("failed to set value with replication: %w", err)
 	}
 	return nil
 }
 
 /*
 replicates a given operation for a specific key-value pair to a given node.
+The header carries the metadata of the write.
+*/
+func (s *Store) replicateNode(node, method, key string, value valueSource, header http.Header, errs chan<- error) {
+	errs <- s.sendWrite(node, method, key, value, header)
+}
+
+/*
+Sends a write to node as a forwarded write and reports whether node applied
+it.
 */
-func (s *Store) replicateNode(node, method, key, value string, errs chan<- error) {
+func (s *Store) sendWrite(node, method, key string, value valueSource, header http.Header) error {
 	url := fmt.Sprintf("http://%s/%s", node, key)
-	req, err := http.NewRequestWithContext(context.Background(), method, url, strings.NewReader(value))
+	var body io.Reader
+	var size int64
+	if value != nil {
+		body, size = value()
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, url, body)
 	if err != nil {
-		errs <- fmt.Errorf("failed to create request: %w", err)
-		return
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = size
 	}
 
+	for name, values := range header {
+		req.Header[name] = values
+	}
 	req.Header.Set(ReplicationHeader, "true")
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		errs <- fmt.Errorf("failed to replicate to %s: %w", node, err)
-		return
+		return fmt.Errorf("failed to replicate to %s: %w", node, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("failed to replicate to %s: %w", node, ErrPreconditionFailed)
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("failed to replicate to %s: %w", node, ErrKeyLocked)
+	}
 	if resp.StatusCode >= 400 {
-		errs <- fmt.Errorf("failed to replicate to %s: status code %d", node, resp.StatusCode)
-		return
+		return fmt.Errorf("failed to replicate to %s: status code %d", node, resp.StatusCode)
+	}
+	return nil
+}
+
+/*
+Relays a write from a client to a replica of key to coordinate, unless this
+node is one itself. Only replicas hold copies of a key: a copy left on any
+other node would never be repaired, nor purged after a delete. The write is
+sent to the first replica that is up, once, since its value may be read
+from a stream. relayed reports whether it was sent, and existed whether the
+replica found the key.
+*/
+func (s *Store) relayWrite(method, key string, value io.Reader, opts WriteOptions) (relayed, existed bool, err error) {
+	if opts.SkipReplication || opts.Forwarded || s.replicationFactor == 0 {
+		return false, false, nil
+	}
+	local, nodes, err := s.replicas(key)
+	if err != nil || local {
+		return false, false, err
+	}
+	nodes = s.liveNodes(nodes)
+	if len(nodes) == 0 {
+		return true, false, fmt.Errorf("%w: no replica of key %s is up", ErrNotEnoughReplicas, key)
+	}
+	node := nodes[0]
+
+	query := url.Values{}
+	if opts.TTL > 0 {
+		query.Set("ttl", opts.TTL.String())
+	}
+	if opts.Consistency != "" {
+		query.Set("consistency", string(opts.Consistency))
+	}
+	target := fmt.Sprintf("http://%s/%s", node, key)
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, value)
+	if err != nil {
+		return true, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(RelayHeader, s.self)
+	if opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.Context != nil {
+		req.Header.Set(ContextHeader, opts.Context.String())
+	}
+	if opts.Condition.IfMatch != 0 {
+		req.Header.Set("If-Match", FormatETag(opts.Condition.IfMatch))
+	}
+	if opts.Condition.IfNoneMatch {
+		req.Header.Set("If-None-Match", "*")
 	}
 
-	errs <- nil
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, false, fmt.Errorf("%w: replica %s of key %s is unreachable: %v", ErrNotEnoughReplicas, node, key, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, resp.StatusCode == http.StatusOK, nil
+	case http.StatusPreconditionFailed:
+		return true, false, fmt.Errorf("%w: %s", ErrPreconditionFailed, key)
+	case http.StatusConflict:
+		return true, false, fmt.Errorf("%w: %s", ErrKeyLocked, key)
+	case http.StatusInsufficientStorage:
+		return true, false, ErrOutOfMemory
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return true, false, fmt.Errorf("%w: %s answered %s", ErrNotEnoughReplicas, node, bytes.TrimSpace(message))
+	}
+	return true, false, fmt.Errorf("%s answered with status code %d: %s", node, resp.StatusCode, bytes.TrimSpace(message))
 }
 
 /*
-handles the replication of a given operation for a specific
-key-value pair across the distributed nodes based on the replication factor.
+Sends a write to owner, one of the replicas of key. If owner is down or
+does not take the write and sloppy is set, it is sent to the next stand-in
+instead, which holds it as a hint until owner is back. Replicas that hold a
+newer version or a lock of a transaction on the key reject the write, which
+no stand-in can change.
 */
-func (s *Store) replicate(method, key, value string) error {
-	if s.replicationFactor == 0 {
+func (s *Store) writeReplica(owner, method, key string, value valueSource, header http.Header, standIns *standIns, sloppy bool) error {
+	err := fmt.Errorf("replica %s is down", owner)
+	if s.alive(owner) {
+		err = s.sendWrite(owner, method, key, value, header)
+		if err == nil || errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrKeyLocked) {
+			return err
+		}
+	}
+	if !sloppy {
+		return err
+	}
+
+	hinted := http.Header{}
+	for name, values := range header {
+		hinted[name] = values
+	}
+	hinted.Set(HintHeader, owner)
+	for {
+		node, ok := standIns.next()
+		if !ok {
+			return err
+		}
+		if hintErr := s.sendWrite(node, method, key, value, hinted); hintErr != nil {
+			log.Printf("Failed to leave a hint for %s on %s: %v", owner, node, hintErr)
+			continue
+		}
+		log.Printf("Left a hint for %s on %s for key %s", owner, node, key)
 		return nil
 	}
+}
 
-	errs := make(chan error, s.replicationFactor)
-	var wg sync.WaitGroup
+/*
+The healthy nodes that follow the replicas of a key on the ring, in order,
+which hold writes for replicas that cannot take them. Each is handed out
+once.
+*/
+type standIns struct {
+	mu    sync.Mutex
+	nodes []string
+}
+
+func (f *standIns) next() (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.nodes) == 0 {
+		return "", false
+	}
+	node := f.nodes[0]
+	f.nodes = f.nodes[1:]
+	return node, true
+}
 
-	hash := s.ringManager.HashStr(key)
-	idx, err := s.ringManager.GetRingIndex(hash)
+func (s *Store) standIns(key string) (*standIns, error) {
+	nodes, err := s.ringWalk(key, len(s.members))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	f := &standIns{}
+	for i, node := range nodes {
+		if i >= s.replicationFactor && node != s.self && s.alive(node) {
+			f.nodes = append(f.nodes, node)
+		}
+	}
+	return f, nil
+}
+
+/*
+Reports whether node passed its last health check. This node always is.
+*/
+func (s *Store) alive(node string) bool {
+	return node == s.self || s.ringManager.HasNode(node)
+}
+
+/*
+Returns those of nodes that passed their last health check.
+*/
+func (s *Store) liveNodes(nodes []string) []string {
+	live := nodes[:0:0]
+	for _, node := range nodes {
+		if s.alive(node) {
+			live = append(live, node)
+		}
+	}
+	return live
+}
+
+/*
+Returns the replicationFactor distinct nodes that follow key on the ring,
+which are the replicas of the key whether they are up or not.
+*/
+func (s *Store) preferenceList(key string) ([]string, error) {
+	if s.replicationFactor == 0 {
+		return nil, nil
 	}
+	return s.ringWalk(key, s.replicationFactor)
+}
 
+/*
+Returns up to limit distinct nodes in the order they follow key on the
+ring of all nodes.
+*/
+func (s *Store) ringWalk(key string, limit int) ([]string, error) {
+	hash := s.ownerRing.HashStr(key)
+	idx, err := s.ownerRing.GetRingIndex(hash)
+	if err != nil {
+		return nil, err
+	}
+	return s.walkFrom(idx, limit)
+}
+
+/*
+Returns up to limit distinct nodes in the order they follow index idx on the
+ring of all nodes.
+*/
+func (s *Store) walkFrom(idx, limit int) ([]string, error) {
+	var nodes []string
 	selectedNodes := make(map[string]struct{})
-	for i := 0; i < s.replicationFactor; {
-		nodeMap, err := s.ringManager.GetNodeMapForRingIndex((idx + i) % s.ringManager.Len())
+	size := s.ownerRing.Len()
+	for i := 0; i < size && len(nodes) < limit; i++ {
+		nodeMap, err := s.ownerRing.GetNodeMapForRingIndex((idx + i) % size)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		node := nodeMap.Node
 
 		if _, alreadySelected := selectedNodes[node]; !alreadySelected {
-			fmt.Printf("Replicating to: %s\n", node)
 			selectedNodes[node] = struct{}{}
-			wg.Add(1)
-			go func(node string) {
-				defer wg.Done()
-				s.replicateNode(node, method, key, value, errs)
-			}(node)
-			i++
-		} else {
-			idx++
+			nodes = append(nodes, node)
 		}
 	}
+	return nodes, nil
+}
+
+/*
+handles the replication of a given operation for a specific
+key-value pair across the distributed nodes based on the replication factor.
+The write has already been applied locally, so if this node is a replica of
+the key its own copy counts towards the consistency level. Writes for
+replicas that are down or fail are held as hints by other nodes, which
+count towards every level but ConsistencyAll. The owner of the key, which
+holds the locks of transactions, is always waited for: if it refuses the
+write because a transaction locked the key, the whole write fails with
+ErrKeyLocked, whatever the other replicas answered.
+*/
+func (s *Store) replicate(method, key string, value valueSource, header http.Header, level Consistency) error {
+	if s.replicationFactor == 0 {
+		return nil
+	}
+
+	local, nodes, err := s.replicas(key)
+	if err != nil {
+		return err
+	}
+	standIns, err := s.standIns(key)
+	if err != nil {
+		return err
+	}
+	sloppy := level != ConsistencyAll
+	owner, err := s.lockOwner(key)
+	if err != nil {
+		return err
+	}
+
+	type answer struct {
+		node string
+		err  error
+	}
+	answers := make(chan answer, len(nodes))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			answers <- answer{node, s.writeReplica(node, method, key, value, header, standIns, sloppy)}
+		}(node)
+	}
 
 	go func() {
 		wg.Wait()
-		close(errs)
+		close(answers)
 	}()
 
+	required := level.required(s.replicationFactor, s.writeQuorum)
 	var multiErr MultiError
 	successCount := 0
-	for err := range errs {
-		if err == nil {
+	if local {
+		successCount = 1
+	}
+	ownerAnswered := owner == ""
+	if level == ConsistencyOne && successCount >= required && ownerAnswered {
+		return nil
+	}
+	conflicts := 0
+	for a := range answers {
+		if a.node == owner {
+			ownerAnswered = true
+		}
+		if a.err == nil {
 			successCount++
-		} else {
-			multiErr = append(multiErr, err)
+			// A single acknowledgement is all ONE waits for.
+			if level == ConsistencyOne && successCount >= required && ownerAnswered {
+				return nil
+			}
+			continue
+		}
+		if errors.Is(a.err, ErrKeyLocked) {
+			return fmt.Errorf("%w: %s refused the write of %s", ErrKeyLocked, a.node, key)
+		}
+		multiErr = append(multiErr, a.err)
+		if errors.Is(a.err, ErrPreconditionFailed) {
+			conflicts++
 		}
 	}
 
-	if successCount < s.writeQuorum {
-		return fmt.Errorf("not enough replicas for write quorum: %d", successCount)
+	if successCount < required {
+		if conflicts > 0 {
+			return fmt.Errorf("%w: %d replicas hold a newer version", ErrPreconditionFailed, conflicts)
+		}
+		return level.unmet("write", successCount)
 	}
 	if len(multiErr) > 0 {
-		return multiErr
+		// The write is acknowledged; the replicas that missed it catch up
+		// through read repair.
+		log.Printf("Replicated %s operation for key %s despite failures: %v", method, key, multiErr)
 	}
 	return nil
 }
+
+/*
+Returns the owner of key, the first of its replicas, which holds the locks
+transactions take on it, or an empty string if that is this node.
+*/
+func (s *Store) lockOwner(key string) (string, error) {
+	nodes, err := s.preferenceList(key)
+	if err != nil || len(nodes) == 0 {
+		return "", err
+	}
+	if s.self != "" && nodes[0] == s.self {
+		return "", nil
+	}
+	return nodes[0], nil
+}
@@ -2,11 +2,13 @@ package store
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockHttpClient struct {
@@ -29,24 +31,34 @@ func assertEqual(t *testing.T, got, want interface{}, msg string) {
 	}
 }
 
+func newTestStore(t *testing.T, nodes []string, replicationFactor int, opts ...Option) *Store {
+	t.Helper()
+	s, err := NewStore(nodes, replicationFactor, opts...)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
 func TestGet(t *testing.T) {
 	t.Run("should get correct value for existing key", func(t *testing.T) {
-		s := NewStore([]string{"node1", "node2", "node3"}, 1)
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
 
-		_ = s.Set("key", "value", true)
+		_ = s.Set("key", []byte("value"), WriteOptions{SkipReplication: true})
 
 		value, ok := s.Get("key")
 		assertEqual(t, ok, true, "key existence check")
-		assertEqual(t, value, "value", "retrieved value")
+		assertEqual(t, string(value), "value", "retrieved value")
 	})
 }
 
 func TestDelete(t *testing.T) {
 	t.Run("should delete existing key", func(t *testing.T) {
-		s := NewStore([]string{"node1", "node2", "node3"}, 1)
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
 
-		_ = s.Set("key", "value", true)
-		err := s.Delete("key", true)
+		_ = s.Set("key", []byte("value"), WriteOptions{SkipReplication: true})
+		err := s.Delete("key", WriteOptions{SkipReplication: true})
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -58,9 +70,9 @@ func TestDelete(t *testing.T) {
 	})
 
 	t.Run("should not accept empty key", func(t *testing.T) {
-		s := NewStore([]string{"node1", "node2", "node3"}, 1)
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
 
-		err := s.Delete("", true)
+		err := s.Delete("", WriteOptions{SkipReplication: true})
 		if err == nil || err.Error() != "key cannot be empty" {
 			t.Fatalf("expected an error with the message 'key cannot be empty', got %v", err)
 		}
@@ -69,41 +81,98 @@ func TestDelete(t *testing.T) {
 
 func TestSet(t *testing.T) {
 	t.Run("should set key-value", func(t *testing.T) {
-		s := NewStore([]string{"node1", "node2", "node3"}, 1)
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
 
-		err := s.Set("key", "value", true)
+		err := s.Set("key", []byte("value"), WriteOptions{SkipReplication: true})
 		if err != nil {
 			t.Errorf("expected no error, got %v", err)
 		}
 
 		value, ok := s.Get("key")
 		assertEqual(t, ok, true, "key existence check after set")
-		assertEqual(t, value, "value", "retrieved value after set")
+		assertEqual(t, string(value), "value", "retrieved value after set")
 	})
 
 	t.Run("should not accept empty key", func(t *testing.T) {
-		s := NewStore([]string{"node1", "node2", "node3"}, 1)
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
 
-		err := s.Set("", "value", true)
-		if err == nil || err.Error() != "key or value cannot be empty" {
-			t.Errorf("expected an error with message 'key or value cannot be empty', got %v", err)
+		err := s.Set("", []byte("value"), WriteOptions{SkipReplication: true})
+		if err == nil || err.Error() != "key cannot be empty" {
+			t.Errorf("expected an error with message 'key cannot be empty', got %v", err)
 		}
 	})
 
-	t.Run("should not accept empty value", func(t *testing.T) {
-		s := NewStore([]string{"node1", "node2", "node3"}, 1)
+	t.Run("should not accept reserved keys", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
+
+		err := s.Set(ReservedKeyPrefix+"cluster/config", []byte("value"), WriteOptions{SkipReplication: true})
+		assertEqual(t, errors.Is(err, ErrReservedKey), true, "error for a reserved key")
+	})
+
+	t.Run("should accept empty and binary values", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2", "node3"}, 1)
 
-		err := s.Set("key", "", true)
-		if err == nil || err.Error() != "key or value cannot be empty" {
-			t.Errorf("expected an error with message 'key or value cannot be empty', got %v", err)
+		binary := []byte{0, 0xff, ' ', '\n', 0xc3}
+		for _, value := range [][]byte{{}, []byte("  padded  "), binary} {
+			err := s.Set("key", value, WriteOptions{SkipReplication: true, ContentType: "application/octet-stream"})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			item, ok := s.Lookup("key")
+			assertEqual(t, ok, true, "key existence check after set")
+			assertEqual(t, string(item.Value), string(value), "retrieved value after set")
+			assertEqual(t, item.ContentType, "application/octet-stream", "content type")
 		}
 	})
 }
 
+func TestRelayWrites(t *testing.T) {
+	nodes := []string{"node1", "node2", "node3"}
+
+	t.Run("should relay writes to a replica and keep no copy", func(t *testing.T) {
+		s := newTestStore(t, nodes, 2, WithAdvertiseAddr("node3"))
+		key := keyFor(t, s, false)
+		_, replicas, _ := s.replicas(key)
+		stub := &replicaStub{}
+		s.client = stub.client()
+
+		opts := WriteOptions{TTL: time.Minute, ContentType: "text/plain", Condition: Condition{IfNoneMatch: true}}
+		assertEqual(t, s.Set(key, []byte("1"), opts), nil, "write error")
+		existed, err := s.SetStream(key, strings.NewReader("2"), WriteOptions{})
+		assertEqual(t, err, nil, "streamed write error")
+		assertEqual(t, existed, true, "key existence reported by the replica")
+		assertEqual(t, s.Delete(key, WriteOptions{}), nil, "delete error")
+		assertEqual(t, s.Stats().Keys, int64(0), "keys held by the coordinator")
+
+		assertEqual(t, len(stub.puts), 2, "relayed writes")
+		assertEqual(t, len(stub.deletes), 1, "relayed deletes")
+		req := stub.puts[0]
+		assertEqual(t, req.URL.Host, replicas[0], "replica written to")
+		assertEqual(t, req.Header.Get(RelayHeader), "node3", "relaying node")
+		assertEqual(t, req.Header.Get(ReplicationHeader), "", "replication header")
+		assertEqual(t, req.Header.Get("Content-Type"), "text/plain", "content type")
+		assertEqual(t, req.Header.Get("If-None-Match"), "*", "condition")
+		assertEqual(t, req.URL.Query().Get("ttl"), "1m0s", "ttl")
+	})
+
+	t.Run("should report what the replica answered", func(t *testing.T) {
+		s := newTestStore(t, nodes, 2, WithAdvertiseAddr("node3"))
+		key := keyFor(t, s, false)
+		s.client = &MockHttpClient{doFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusPreconditionFailed, Body: http.NoBody}, nil
+		}}
+
+		err := s.Set(key, []byte("1"), WriteOptions{Condition: Condition{IfMatch: 3}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "failed condition")
+		assertEqual(t, s.Stats().Keys, int64(0), "keys held by the coordinator")
+	})
+
+}
+
 func TestNewStore(t *testing.T) {
 	nodes := []string{"node1", "node2", "node3"}
 	replicationFactor := 3
-	s := NewStore(nodes, replicationFactor)
+	s := newTestStore(t, nodes, replicationFactor)
 
 	if s == nil {
 		t.Fatalf("expected Store to be created, got nil")
@@ -129,29 +198,39 @@ func TestNewStore(t *testing.T) {
 func TestQuorumCalculation(t *testing.T) {
 	tests := []struct {
 		nodes               []string
+		replicationFactor   int
 		expectedReadQuorum  int
 		expectedWriteQuorum int
 	}{
 		{
 			nodes:               []string{"node1"},
+			replicationFactor:   1,
+			expectedReadQuorum:  1,
+			expectedWriteQuorum: 1,
+		},
+		{
+			nodes:               []string{"node1", "node2"},
+			replicationFactor:   1,
 			expectedReadQuorum:  1,
 			expectedWriteQuorum: 1,
 		},
 		{
 			nodes:               []string{"node1", "node2"},
+			replicationFactor:   2,
 			expectedReadQuorum:  2,
 			expectedWriteQuorum: 2,
 		},
 		{
-			nodes:               []string{"node1", "node2", "node3"},
+			nodes:               []string{"node1", "node2", "node3", "node4", "node5"},
+			replicationFactor:   3,
 			expectedReadQuorum:  2,
 			expectedWriteQuorum: 2,
 		},
 	}
 
 	for _, test := range tests {
-		t.Run(fmt.Sprintf("nodes: %v", test.nodes), func(t *testing.T) {
-			s := NewStore(test.nodes, 1)
+		t.Run(fmt.Sprintf("nodes: %v, N: %d", test.nodes, test.replicationFactor), func(t *testing.T) {
+			s := newTestStore(t, test.nodes, test.replicationFactor)
 			if s.readQuorum != test.expectedReadQuorum {
 				t.Errorf("expected readQuorum to be %d, got %d", test.expectedReadQuorum, s.readQuorum)
 			}
@@ -165,7 +244,7 @@ func TestQuorumCalculation(t *testing.T) {
 func TestReplicate(t *testing.T) {
 	t.Run("should replicate data to nodes successfully", func(t *testing.T) {
 		nodes := []string{"node1", "node2"}
-		s := NewStore(nodes, 2)
+		s := newTestStore(t, nodes, 2)
 
 		s.client = &MockHttpClient{
 			doFunc: func(req *http.Request) (*http.Response, error) {
@@ -176,7 +255,7 @@ func TestReplicate(t *testing.T) {
 			},
 		}
 
-		err := s.replicate("PUT", "key", "value")
+		err := s.replicate("PUT", "key", bytesSource([]byte("value")), nil, ConsistencyQuorum)
 		if err != nil {
 			t.Errorf("expected no error, got %v", err)
 		}
@@ -184,7 +263,7 @@ func TestReplicate(t *testing.T) {
 
 	t.Run("should return error when replication fails", func(t *testing.T) {
 		nodes := []string{"node1", "node2"}
-		s := NewStore(nodes, 1)
+		s := newTestStore(t, nodes, 1)
 
 		s.client = &MockHttpClient{
 			doFunc: func(req *http.Request) (*http.Response, error) {
@@ -192,7 +271,7 @@ func TestReplicate(t *testing.T) {
 			},
 		}
 
-		err := s.replicate("PUT", "key", "value")
+		err := s.replicate("PUT", "key", bytesSource([]byte("value")), nil, ConsistencyQuorum)
 		if err == nil || !strings.Contains(err.Error(), "not enough replicas for write quorum") {
 			t.Errorf("expected a 'not enough replicas for write quorum' error, got %v", err)
 		}
@@ -202,7 +281,7 @@ func TestReplicate(t *testing.T) {
 func TestHandleReplication(t *testing.T) {
 	t.Run("should attempt replication when skipReplication is false", func(t *testing.T) {
 		nodes := []string{"node1", "node2", "node3", "node4"}
-		s := NewStore(nodes, 3)
+		s := newTestStore(t, nodes, 3)
 
 		s.client = &MockHttpClient{
 			doFunc: func(req *http.Request) (*http.Response, error) {
@@ -210,7 +289,7 @@ func TestHandleReplication(t *testing.T) {
 			},
 		}
 
-		err := s.handleReplication(false, "PUT", "key", "value")
+		err := s.handleReplication(WriteOptions{}, "PUT", "key", bytesSource([]byte("value")), nil)
 		if err == nil {
 			t.Errorf("expected an error but got nil")
 		} else if !strings.Contains(err.Error(), "this error should be triggered") &&
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"log"
+	"time"
+)
+
+/*
+How long the tombstone of a deleted key is kept by default. It must outlast
+the time a replica may miss writes without being repaired, or the replica
+may bring the deleted value back once the tombstone is gone.
+*/
+const DefaultTombstoneGracePeriod = 24 * time.Hour
+
+/*
+Reports whether every value of e that has not expired is a tombstone and
+the newest of them is older than grace, so that the key can be forgotten.
+*/
+func (e entry) purgeable(now int64, grace time.Duration) bool {
+	values, ok := e.unexpired(now)
+	return ok && values.deleted() && values.modified <= now-int64(grace)
+}
+
+/*
+Removes the keys whose tombstones have outlived the grace period. Like
+expiry, purging is local to every replica and not replicated.
+*/
+func (s *Store) purgeTombstones(keys []string, now int64) {
+	for _, key := range keys {
+		s.mu.Lock()
+		if e, ok := s.loadEntry(key); ok && e.purgeable(now, s.tombstoneGrace) {
+			if err := s.remove(key); err != nil {
+				log.Printf("Failed to purge the tombstone of key %s: %v", key, err)
+			} else {
+				s.tombstonesPurged.Add(1)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+/*
+Counts the deleted keys found in the engine on startup.
+*/
+func (s *Store) countTombstones() error {
+	var count int64
+	err := s.engine.Iterate(PrefixEnd(internalKeyPrefix), "", func(key string, buf []byte) bool {
+		if e, err := decodeEntry(buf); err == nil && e.deleted() {
+			count++
+		}
+		return true
+	})
+	s.tombstones.Store(count)
+	return err
+}
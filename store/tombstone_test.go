@@ -0,0 +1,138 @@
+package store
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	newReplicated := func(t *testing.T, opts ...Option) (*Store, *replicaStub) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, append([]Option{WithAdvertiseAddr("self"), WithQuorums(3, 2)}, opts...)...)
+		stub := &replicaStub{}
+		s.client = stub.client()
+		return s, stub
+	}
+
+	t.Run("should hide deleted keys behind a tombstone", func(t *testing.T) {
+		s, stub := newReplicated(t)
+		_ = s.Set("a", []byte("1"), WriteOptions{})
+		assertEqual(t, s.Delete("a", WriteOptions{}), nil, "delete error")
+		assertEqual(t, len(stub.deletes), 2, "replicated deletes")
+
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "deleted key")
+		items, _ := s.Scan("", "", 0)
+		assertEqual(t, len(items), 0, "scanned keys")
+		item, _, ok := s.OpenReplica("a")
+		assertEqual(t, ok, true, "tombstone existence")
+		assertEqual(t, item.AllDeleted(), true, "tombstone")
+		assertEqual(t, item.Version, uint64(2), "tombstone version")
+		assertEqual(t, s.Stats().Metrics["tombstones"], int64(1), "tombstones")
+
+		_ = s.Set("a", []byte("2"), WriteOptions{})
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "2", "value written after the delete")
+		assertEqual(t, s.Stats().Metrics["tombstones"], int64(0), "tombstones after a write")
+	})
+
+	t.Run("should not let a delayed write bring a deleted key back", func(t *testing.T) {
+		s, _ := newReplicated(t)
+		_ = s.Set("a", []byte("1"), WriteOptions{})
+		written, _ := s.Lookup("a")
+		_ = s.Delete("a", WriteOptions{})
+
+		_ = s.Set("a", written.Value, written.forwardedWrite())
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "key after a delayed write")
+	})
+
+	t.Run("should not let a delayed write bring a deleted key back with last write wins", func(t *testing.T) {
+		s, _ := newReplicated(t, WithConflictResolution(LastWriteWins))
+		forwarded := func(wall int64, node string) WriteOptions {
+			return WriteOptions{SkipReplication: true, HLC: HybridTime{Wall: wall, Node: node}}
+		}
+		_ = s.Set("a", []byte("1"), forwarded(200, "n1"))
+		_ = s.Delete("a", forwarded(300, "n2"))
+		_ = s.Set("a", []byte("1"), forwarded(250, "n1"))
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "key after a delayed write")
+
+		_ = s.Set("a", []byte("2"), forwarded(400, "n1"))
+		_, ok = s.Get("a")
+		assertEqual(t, ok, true, "key after a newer write")
+	})
+
+	t.Run("should delete keys outright without replicas", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("1"), WriteOptions{})
+		_ = s.Delete("a", WriteOptions{})
+		_, _, ok := s.OpenReplica("a")
+		assertEqual(t, ok, false, "tombstone existence")
+	})
+
+	t.Run("should purge tombstones after the grace period", func(t *testing.T) {
+		s, _ := newReplicated(t, WithReapInterval(0), WithTombstoneGracePeriod(time.Hour))
+		now := time.Unix(1000, 0)
+		s.now = func() time.Time { return now }
+		_ = s.Set("a", []byte("1"), WriteOptions{})
+		_ = s.Delete("a", WriteOptions{})
+
+		s.reapExpired()
+		_, _, ok := s.OpenReplica("a")
+		assertEqual(t, ok, true, "tombstone within the grace period")
+
+		now = now.Add(time.Hour)
+		s.reapExpired()
+		_, _, ok = s.OpenReplica("a")
+		assertEqual(t, ok, false, "tombstone after the grace period")
+		assertEqual(t, s.Stats().Metrics["tombstones"], int64(0), "tombstones")
+		assertEqual(t, s.Stats().Metrics["tombstones_purged"], int64(1), "purged tombstones")
+	})
+
+	t.Run("should count tombstones after a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := newReplicated(t, WithDataDir(dir))
+		_ = s.Set("a", []byte("1"), WriteOptions{})
+		_ = s.Set("b", []byte("2"), WriteOptions{})
+		_ = s.Delete("a", WriteOptions{})
+		s.Close()
+
+		s = newTestStore(t, []string{"node1", "node2"}, 2, WithDataDir(dir))
+		assertEqual(t, s.Stats().Metrics["tombstones"], int64(1), "tombstones")
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "deleted key")
+	})
+
+	t.Run("should repair replicas that missed a delete", func(t *testing.T) {
+		s, stub := newReplicated(t)
+		_ = s.Delete("a", WriteOptions{SkipReplication: true, Version: 2, Timestamp: 20})
+		stub.heads = map[string]http.Header{
+			"node1": headers("ETag", FormatETag(1), TimestampHeader, "10"),
+			"node2": headers("ETag", FormatETag(1), TimestampHeader, "10"),
+		}
+
+		result, err := s.Read("a", ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Found, false, "key existence")
+		assertEqual(t, len(stub.deletes), 2, "repairing deletes")
+		assertEqual(t, len(stub.puts), 0, "repairing writes")
+	})
+
+	t.Run("should find deletes held by replicas", func(t *testing.T) {
+		s, stub := newReplicated(t)
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true, Version: 1, Timestamp: 10})
+		deleted := headers(DeletedHeader, "true", "ETag", FormatETag(2), TimestampHeader, "20")
+		stub.heads = map[string]http.Header{"node1": deleted, "node2": deleted}
+		stub.pages = map[string]string{
+			"node1": `{"items":[{"key":"a","value":"","modified":20,"version":2,"deleted":true}]}`,
+			"node2": `{"items":[{"key":"a","value":"","modified":20,"version":2,"deleted":true}]}`,
+		}
+
+		result, err := s.Read("a", ReadOptions{SyncRepair: true})
+		assertEqual(t, err, nil, "read error")
+		assertEqual(t, result.Found, false, "key existence")
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "key repaired locally")
+	})
+}
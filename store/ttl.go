@@ -0,0 +1,94 @@
+package store
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+The number of keys the reaper examines per tick. The keyspace is swept
+incrementally so that a tick takes bounded time however large it is.
+*/
+const reapBatchSize = 10000
+
+func (s *Store) reapLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reapExpired()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+/*
+Examines the next batch of keys and deletes those that have expired and
+those whose tombstones have outlived their grace period. The
+batch is read without holding s.mu; each deletion takes the lock only long
+enough to check that the key was not rewritten in the meantime. Every
+replica expires keys on its own, so deletions are not replicated. Chunks
+left behind by overwritten, deleted or expired values are reclaimed along
+the way.
+*/
+func (s *Store) reapExpired() {
+	clock := s.now()
+	now := clock.UnixNano()
+
+	var expired, purged []string
+	var owners []chunkOwner
+	examined := 0
+	next := ""
+	err := s.engine.Iterate(s.reapCursor, "", func(key string, buf []byte) bool {
+		if examined == reapBatchSize {
+			next = key
+			return false
+		}
+		examined++
+		if owner, ok := parseChunkKey(key); ok {
+			if len(owners) == 0 || owners[len(owners)-1] != owner {
+				owners = append(owners, owner)
+			}
+			return true
+		}
+		if strings.HasPrefix(key, internalKeyPrefix) {
+			// Hints expire in the handoff worker.
+			return true
+		}
+		e, err := decodeEntry(buf)
+		switch {
+		case err != nil:
+		case e.lastExpiry() != 0 && e.lastExpiry() <= now:
+			expired = append(expired, key)
+		case e.purgeable(now, s.tombstoneGrace):
+			purged = append(purged, key)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to look for expired keys: %v", err)
+		return
+	}
+	// An empty cursor starts the next sweep from the beginning.
+	s.reapCursor = next
+
+	for _, key := range expired {
+		s.mu.Lock()
+		if e, ok := s.loadEntry(key); ok && e.lastExpiry() != 0 && e.lastExpiry() <= now {
+			if err := s.remove(key); err != nil {
+				log.Printf("Failed to delete expired key %s: %v", key, err)
+			} else {
+				s.expiredKeys.Add(1)
+			}
+		}
+		s.mu.Unlock()
+	}
+	s.purgeTombstones(purged, now)
+	s.reapChunks(owners, clock)
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	local := WriteOptions{SkipReplication: true}
+	withTTL := func(ttl time.Duration) WriteOptions {
+		return WriteOptions{SkipReplication: true, TTL: ttl}
+	}
+
+	t.Run("should hide expired keys", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1, WithReapInterval(0))
+		now := time.Unix(1000, 0)
+		s.now = func() time.Time { return now }
+
+		_ = s.Set("session", []byte("token"), withTTL(10*time.Second))
+		_ = s.Set("user", []byte("alice"), local)
+
+		item, ok := s.Lookup("session")
+		assertEqual(t, ok, true, "key before expiry")
+		assertEqual(t, item.Expires, now.Add(10*time.Second).UnixNano(), "expiry")
+
+		now = now.Add(10 * time.Second)
+		_, ok = s.Get("session")
+		assertEqual(t, ok, false, "key after expiry")
+		items, _ := s.Scan("", "", 0)
+		assertEqual(t, scannedKeys(items), "user", "scanned keys after expiry")
+	})
+
+	t.Run("should reclaim expired keys", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1, WithReapInterval(0))
+		now := time.Unix(1000, 0)
+		s.now = func() time.Time { return now }
+
+		_ = s.Set("a", []byte("1"), withTTL(time.Second))
+		_ = s.Set("b", []byte("2"), withTTL(time.Minute))
+		_ = s.Set("c", []byte("3"), local)
+
+		now = now.Add(time.Second)
+		s.reapExpired()
+		assertEqual(t, s.Stats().Keys, int64(2), "keys after reaping")
+		assertEqual(t, s.Stats().Metrics["expired_keys"], int64(1), "expired keys")
+
+		// A key rewritten without a ttl is no longer reaped.
+		_ = s.Set("b", []byte("4"), local)
+		now = now.Add(time.Hour)
+		s.reapExpired()
+		value, _ := s.Get("b")
+		assertEqual(t, string(value), "4", "rewritten key")
+	})
+
+	t.Run("should keep the expiry across restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithDataDir(dir), WithReapInterval(0))
+		_ = s.Set("a", []byte("1"), withTTL(time.Hour))
+		item, _ := s.Lookup("a")
+		s.Close()
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir), WithReapInterval(0))
+		restored, _ := s.Lookup("a")
+		assertEqual(t, restored.Expires, item.Expires, "expiry after restart")
+	})
+
+	t.Run("should reject a negative ttl", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		if err := s.Set("a", []byte("1"), withTTL(-time.Second)); err == nil {
+			t.Errorf("expected an error for a negative ttl")
+		}
+	})
+}
@@ -0,0 +1,731 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+Transactions are kept under their own internal keys: the records of the
+transactions this node coordinates, and the writes it has prepared for
+transactions as one of their participants.
+*/
+const (
+	txnKeyPrefix      = internalKeyPrefix + "txn\x00"
+	txnRecordPrefix   = txnKeyPrefix + "record\x00"
+	txnPreparedPrefix = txnKeyPrefix + "prepared\x00"
+)
+
+const (
+	// The most writes a transaction may hold.
+	MaxTxnOps = 100
+	// How often the transactions left in doubt are resolved.
+	txnInterval = 5 * time.Second
+	// How long a participant holds prepared writes before it asks their
+	// coordinator how the transaction ended.
+	txnResolveAfter = 10 * time.Second
+)
+
+var (
+	// Returned for writes of a key locked by a prepared transaction, and
+	// by transactions aborted because one of their keys was locked.
+	ErrKeyLocked = errors.New("key is locked by a transaction")
+	// Returned for transactions that are empty, too large or write a key
+	// more than once.
+	ErrInvalidTxn = errors.New("invalid transaction")
+	// Transactions need the replicas of a key to agree on its versions,
+	// which only eventual replication lets this node arrange.
+	ErrTxnUnsupported = errors.New("transactions are not supported in raft replication mode")
+)
+
+type TxnOpType string
+
+const (
+	TxnPut    TxnOpType = "put"
+	TxnDelete TxnOpType = "delete"
+	// Writes nothing, but fails the transaction unless its condition
+	// holds, and keeps the key from changing while the transaction is
+	// prepared.
+	TxnCheck TxnOpType = "check"
+)
+
+/*
+A write or check of a transaction, applied only if its condition holds.
+*/
+type TxnOp struct {
+	Type        TxnOpType `json:"op"`
+	Key         string    `json:"key"`
+	Value       []byte    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Condition   Condition `json:"condition"`
+	// The version the participant assigned to the write when it checked
+	// the condition. Zero means the one after the version held when the
+	// write is applied.
+	Version uint64 `json:"version,omitempty"`
+}
+
+type TxnStatus string
+
+const (
+	TxnPending   TxnStatus = "pending"
+	TxnCommitted TxnStatus = "committed"
+	TxnAborted   TxnStatus = "aborted"
+)
+
+/*
+The outcome of a transaction coordinated by this node.
+*/
+type TxnResult struct {
+	ID     string    `json:"id"`
+	Status TxnStatus `json:"status"`
+}
+
+/*
+The writes of a transaction a participant is asked to prepare. Once
+prepared, they are kept together with the time they were prepared until
+the participant learns the outcome of the transaction.
+*/
+type TxnPrepare struct {
+	ID          string  `json:"id"`
+	Coordinator string  `json:"coordinator"`
+	Ops         []TxnOp `json:"ops"`
+	Prepared    int64   `json:"prepared,omitempty"`
+}
+
+/*
+The record of a transaction kept by its coordinator. Participants are
+named by their address, or empty for this node, and are dropped once they
+have learned the outcome; the record is deleted when none are left.
+*/
+type txnRecord struct {
+	ID           string    `json:"id"`
+	Status       TxnStatus `json:"status"`
+	Participants []string  `json:"participants"`
+	Created      int64     `json:"created"`
+}
+
+func newTxnID(now time.Time) string {
+	return fmt.Sprintf("%016x%016x", now.UnixNano(), rand.Uint64())
+}
+
+/*
+Applies ops atomically: either all of them apply or none. The writes are
+grouped by the node that owns their key, the first replica of the key on
+the ring, and committed with two-phase commit: the owners lock the keys
+and check the conditions of the writes against the newest versions held
+by the replicas, then, if every owner agreed, apply the writes and
+replicate them like any other write. Checks lock their keys too but write
+nothing. The record of the transaction is written before the owners are
+asked and updated with the decision before they learn it, so that a
+transaction left in doubt by a crash is resolved once this node is back:
+one that was not decided is aborted, and the owners that missed the
+decision are told again. Fails with ErrKeyLocked if a key is locked by
+another transaction and with ErrPreconditionFailed if a condition does not
+hold; the transaction is then aborted.
+*/
+func (s *Store) Transact(ops []TxnOp) (TxnResult, error) {
+	return s.transact(newTxnID(s.now()), ops)
+}
+
+func (s *Store) transact(id string, ops []TxnOp) (TxnResult, error) {
+	if s.replicationMode == RaftReplication {
+		return TxnResult{}, ErrTxnUnsupported
+	}
+	if err := validateTxn(ops); err != nil {
+		return TxnResult{}, err
+	}
+	writes, err := s.txnParticipants(ops)
+	if err != nil {
+		return TxnResult{}, err
+	}
+
+	record := txnRecord{ID: id, Status: TxnPending, Created: s.now().UnixNano()}
+	for node := range writes {
+		record.Participants = append(record.Participants, node)
+	}
+	s.beginTxn(record.ID)
+	defer s.endTxn(record.ID)
+	if err := s.saveTxnRecord(record); err != nil {
+		return TxnResult{}, err
+	}
+
+	errs := make([]error, len(record.Participants))
+	var wg sync.WaitGroup
+	for i, node := range record.Participants {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			errs[i] = s.prepareTxn(node, TxnPrepare{ID: record.ID, Coordinator: s.self, Ops: writes[node]})
+		}(i, node)
+	}
+	wg.Wait()
+
+	var cause error
+	for i, err := range errs {
+		if err != nil {
+			cause = fmt.Errorf("%s: %w", participantName(record.Participants[i]), err)
+			break
+		}
+	}
+	record.Status = TxnCommitted
+	if cause != nil {
+		record.Status = TxnAborted
+	}
+	if err := s.saveTxnRecord(record); err != nil {
+		if record.Status == TxnAborted {
+			// Nothing committed; the pending record is aborted once it
+			// is found.
+			return TxnResult{}, fmt.Errorf("transaction %s aborted: %w", record.ID, cause)
+		}
+		cause, record.Status = err, TxnAborted
+		if err := s.saveTxnRecord(record); err != nil {
+			return TxnResult{}, fmt.Errorf("transaction %s aborted: %w", record.ID, cause)
+		}
+	}
+	s.finishTxn(&record)
+
+	if record.Status == TxnAborted {
+		s.txnsAborted.Add(1)
+		return TxnResult{}, fmt.Errorf("transaction %s aborted: %w", record.ID, cause)
+	}
+	s.txnsCommitted.Add(1)
+	return TxnResult{ID: record.ID, Status: TxnCommitted}, nil
+}
+
+func validateTxn(ops []TxnOp) error {
+	if len(ops) == 0 || len(ops) > MaxTxnOps {
+		return fmt.Errorf("%w: must hold between 1 and %d writes", ErrInvalidTxn, MaxTxnOps)
+	}
+	seen := make(map[string]struct{}, len(ops))
+	for _, op := range ops {
+		if op.Type != TxnPut && op.Type != TxnDelete && op.Type != TxnCheck {
+			return fmt.Errorf("%w: unknown operation %q", ErrInvalidTxn, op.Type)
+		}
+		if op.Type == TxnCheck && !op.Condition.clientSet() {
+			return fmt.Errorf("%w: check of key %s without a condition", ErrInvalidTxn, op.Key)
+		}
+		if err := validateKey(op.Key); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTxn, err)
+		}
+		if _, ok := seen[op.Key]; ok {
+			return fmt.Errorf("%w: key %s is written more than once", ErrInvalidTxn, op.Key)
+		}
+		seen[op.Key] = struct{}{}
+	}
+	return nil
+}
+
+/*
+Groups ops by the node that owns their key, which is empty for this node.
+Without replicas this node owns every key.
+*/
+func (s *Store) txnParticipants(ops []TxnOp) (map[string][]TxnOp, error) {
+	writes := make(map[string][]TxnOp)
+	for _, op := range ops {
+		nodes, err := s.preferenceList(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		owner := ""
+		if len(nodes) > 0 && nodes[0] != s.self {
+			if s.self == "" {
+				return nil, errors.New("transactions across nodes require the address of this node")
+			}
+			owner = nodes[0]
+		}
+		op.Version = 0
+		writes[owner] = append(writes[owner], op)
+	}
+	return writes, nil
+}
+
+func participantName(node string) string {
+	if node == "" {
+		return "this node"
+	}
+	return node
+}
+
+func (s *Store) beginTxn(id string) {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	s.txnActive[id] = struct{}{}
+}
+
+func (s *Store) endTxn(id string) {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	delete(s.txnActive, id)
+}
+
+func (s *Store) saveTxnRecord(record txnRecord) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(walOpSet, txnRecordPrefix+record.ID, string(encoded))
+}
+
+/*
+Tells the participants of a decided transaction its outcome and drops
+those that learned it from the record, which is deleted once none are
+left.
+*/
+func (s *Store) finishTxn(record *txnRecord) {
+	acked := make([]bool, len(record.Participants))
+	var wg sync.WaitGroup
+	for i, node := range record.Participants {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			if err := s.decideTxn(node, record.ID, record.Status); err != nil {
+				log.Printf("Failed to %s transaction %s on %s: %v", decisionVerb(record.Status), record.ID, participantName(node), err)
+				return
+			}
+			acked[i] = true
+		}(i, node)
+	}
+	wg.Wait()
+
+	remaining := record.Participants[:0:0]
+	for i, node := range record.Participants {
+		if !acked[i] {
+			remaining = append(remaining, node)
+		}
+	}
+	record.Participants = remaining
+	var err error
+	if len(remaining) == 0 {
+		s.mu.Lock()
+		err = s.commit(walOpDelete, txnRecordPrefix+record.ID, "")
+		s.mu.Unlock()
+	} else {
+		err = s.saveTxnRecord(*record)
+	}
+	if err != nil {
+		log.Printf("Failed to update the record of transaction %s: %v", record.ID, err)
+	}
+}
+
+func decisionVerb(status TxnStatus) string {
+	if status == TxnCommitted {
+		return "commit"
+	}
+	return "abort"
+}
+
+/*
+Asks node, or this node if it is empty, to prepare the writes of a
+transaction.
+*/
+func (s *Store) prepareTxn(node string, prepare TxnPrepare) error {
+	if node == "" {
+		return s.PrepareTxn(prepare)
+	}
+	body, err := json.Marshal(prepare)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/_/txn/prepare", node), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return txnResponseError(node, resp)
+}
+
+/*
+Tells node, or this node if it is empty, the outcome of a transaction.
+*/
+func (s *Store) decideTxn(node, id string, status TxnStatus) error {
+	if node == "" {
+		if status == TxnCommitted {
+			return s.CommitTxn(id)
+		}
+		return s.AbortTxn(id)
+	}
+	target := fmt.Sprintf("http://%s/_/txn/%s?id=%s", node, decisionVerb(status), url.QueryEscape(id))
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return txnResponseError(node, resp)
+}
+
+/*
+Maps the status of a response to a transaction request back to the error
+the node failed with.
+*/
+func txnResponseError(node string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode < 400:
+		return nil
+	case resp.StatusCode == http.StatusConflict:
+		return ErrKeyLocked
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case resp.StatusCode == http.StatusInsufficientStorage:
+		return ErrOutOfMemory
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: %s answered %s", ErrNotEnoughReplicas, node, bytes.TrimSpace(message))
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w: %s answered %s", ErrInvalidTxn, node, bytes.TrimSpace(message))
+	}
+	return fmt.Errorf("%s answered with status code %d: %s", node, resp.StatusCode, bytes.TrimSpace(message))
+}
+
+/*
+Prepares the writes of a transaction this node owns the keys of: locks the
+keys, checks the conditions of the writes against the newest versions held
+by the replicas and keeps the writes until the coordinator decides the
+outcome. Until then, other transactions and plain writes of the keys fail
+with ErrKeyLocked. Preparing a transaction again is a no-op.
+*/
+func (s *Store) PrepareTxn(prepare TxnPrepare) error {
+	if s.replicationMode == RaftReplication {
+		return ErrTxnUnsupported
+	}
+	if prepare.ID == "" {
+		return fmt.Errorf("%w: missing id", ErrInvalidTxn)
+	}
+	if err := validateTxn(prepare.Ops); err != nil {
+		return err
+	}
+	if _, ok, err := s.loadPrepared(prepare.ID); err != nil || ok {
+		return err
+	}
+	if err := s.lockTxn(prepare); err != nil {
+		return err
+	}
+
+	for i, op := range prepare.Ops {
+		prepare.Ops[i].Version = 0
+		if !op.Condition.clientSet() {
+			continue
+		}
+		opts := WriteOptions{Condition: op.Condition}
+		if _, err := s.resolveWrite(op.Key, &opts); err != nil {
+			s.unlockTxn(prepare)
+			return fmt.Errorf("key %s: %w", op.Key, err)
+		}
+		prepare.Ops[i].Version = opts.Version
+		prepare.Ops[i].Condition = Condition{}
+	}
+	prepare.Prepared = s.now().UnixNano()
+	encoded, err := json.Marshal(prepare)
+	if err == nil {
+		s.mu.Lock()
+		err = s.commit(walOpSet, txnPreparedPrefix+prepare.ID, string(encoded))
+		s.mu.Unlock()
+	}
+	if err != nil {
+		s.unlockTxn(prepare)
+		return err
+	}
+	return nil
+}
+
+/*
+Locks the keys of a transaction, all of them or none.
+*/
+func (s *Store) lockTxn(prepare TxnPrepare) error {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	for _, op := range prepare.Ops {
+		if holder, ok := s.txnLocks[op.Key]; ok && holder != prepare.ID {
+			return fmt.Errorf("%w: %s", ErrKeyLocked, op.Key)
+		}
+	}
+	for _, op := range prepare.Ops {
+		s.txnLocks[op.Key] = prepare.ID
+	}
+	return nil
+}
+
+func (s *Store) unlockTxn(prepare TxnPrepare) {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	for _, op := range prepare.Ops {
+		if s.txnLocks[op.Key] == prepare.ID {
+			delete(s.txnLocks, op.Key)
+		}
+	}
+}
+
+/*
+Fails with ErrKeyLocked if key is locked by a transaction other than txn.
+*/
+func (s *Store) checkTxnLock(key, txn string) error {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	if holder, ok := s.txnLocks[key]; ok && holder != txn {
+		return fmt.Errorf("%w: %s", ErrKeyLocked, key)
+	}
+	return nil
+}
+
+func (s *Store) loadPrepared(id string) (TxnPrepare, bool, error) {
+	buf, ok, err := s.engine.Get(txnPreparedPrefix + id)
+	if err != nil || !ok {
+		return TxnPrepare{}, false, err
+	}
+	var prepare TxnPrepare
+	if err := json.Unmarshal(buf, &prepare); err != nil {
+		return TxnPrepare{}, false, fmt.Errorf("invalid prepared transaction %s: %w", id, err)
+	}
+	return prepare, true, nil
+}
+
+/*
+Applies the writes this node prepared for a transaction, replicating them
+like any other write, and releases their locks. Writes that reach too few
+replicas are still applied here and reach the others through hints and
+repair. Committing a transaction that is not prepared here is a no-op, so
+the coordinator may tell its outcome again.
+*/
+func (s *Store) CommitTxn(id string) error {
+	s.txnApplyMu.Lock()
+	defer s.txnApplyMu.Unlock()
+	prepare, ok, err := s.loadPrepared(id)
+	if err != nil || !ok {
+		return err
+	}
+	for _, op := range prepare.Ops {
+		opts := WriteOptions{Version: op.Version, ContentType: op.ContentType, txn: id}
+		switch op.Type {
+		case TxnCheck:
+			continue
+		case TxnDelete:
+			err = s.Delete(op.Key, opts)
+		default:
+			err = s.Set(op.Key, op.Value, opts)
+		}
+		if errors.Is(err, ErrNotEnoughReplicas) {
+			log.Printf("Transaction %s wrote key %s to too few replicas: %v", id, op.Key, err)
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write key %s: %w", op.Key, err)
+		}
+	}
+	return s.dropPrepared(prepare)
+}
+
+/*
+Discards the writes this node prepared for a transaction and releases
+their locks. Aborting a transaction that is not prepared here is a no-op.
+*/
+func (s *Store) AbortTxn(id string) error {
+	s.txnApplyMu.Lock()
+	defer s.txnApplyMu.Unlock()
+	prepare, ok, err := s.loadPrepared(id)
+	if err != nil || !ok {
+		return err
+	}
+	return s.dropPrepared(prepare)
+}
+
+func (s *Store) dropPrepared(prepare TxnPrepare) error {
+	s.mu.Lock()
+	err := s.commit(walOpDelete, txnPreparedPrefix+prepare.ID, "")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.unlockTxn(prepare)
+	return nil
+}
+
+/*
+Reports the outcome of a transaction this node coordinates. Transactions
+without a record were aborted before anything was prepared, or decided and
+learned by every participant; participants only ask about the former, so
+they are reported as aborted.
+*/
+func (s *Store) TxnStatus(id string) (TxnStatus, error) {
+	s.txnMu.Lock()
+	_, active := s.txnActive[id]
+	s.txnMu.Unlock()
+
+	buf, ok, err := s.engine.Get(txnRecordPrefix + id)
+	switch {
+	case err != nil:
+		return "", err
+	case !ok && active:
+		return TxnPending, nil
+	case !ok:
+		return TxnAborted, nil
+	}
+	var record txnRecord
+	if err := json.Unmarshal(buf, &record); err != nil {
+		return "", fmt.Errorf("invalid transaction record %s: %w", id, err)
+	}
+	return record.Status, nil
+}
+
+/*
+Asks coordinator, or this node if it is empty or this node, how a
+transaction ended.
+*/
+func (s *Store) txnOutcome(coordinator, id string) (TxnStatus, error) {
+	if coordinator == "" || coordinator == s.self {
+		return s.TxnStatus(id)
+	}
+	resp, err := s.client.Get(fmt.Sprintf("http://%s/_/txn/status?id=%s", coordinator, url.QueryEscape(id)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := txnResponseError(coordinator, resp); err != nil {
+		return "", err
+	}
+	var result TxnResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid transaction status from %s: %w", coordinator, err)
+	}
+	return result.Status, nil
+}
+
+/*
+Locks the keys of the transactions found prepared in the engine on startup.
+*/
+func (s *Store) loadTransactions() error {
+	var errs MultiError
+	err := s.engine.Iterate(txnPreparedPrefix, PrefixEnd(txnPreparedPrefix), func(k string, buf []byte) bool {
+		var prepare TxnPrepare
+		if err := json.Unmarshal(buf, &prepare); err != nil {
+			errs = append(errs, fmt.Errorf("invalid prepared transaction %s: %w", k[len(txnPreparedPrefix):], err))
+			return true
+		}
+		for _, op := range prepare.Ops {
+			s.txnLocks[op.Key] = prepare.ID
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *Store) txnLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(txnInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.resolveTxns()
+			s.expireTxnSessions()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+/*
+Resolves the transactions left in doubt. Of those this node coordinates
+and no longer runs, the ones that were not decided are aborted, and the
+participants that have not learned the outcome are told again. Writes this
+node prepared long ago are committed or aborted as their coordinator
+decided.
+*/
+func (s *Store) resolveTxns() {
+	var records []txnRecord
+	var prepared []TxnPrepare
+	s.engine.Iterate(txnRecordPrefix, PrefixEnd(txnRecordPrefix), func(k string, buf []byte) bool {
+		var record txnRecord
+		if err := json.Unmarshal(buf, &record); err != nil {
+			log.Printf("Invalid transaction record %s: %v", k[len(txnRecordPrefix):], err)
+			return true
+		}
+		records = append(records, record)
+		return true
+	})
+	cutoff := s.now().Add(-txnResolveAfter).UnixNano()
+	s.engine.Iterate(txnPreparedPrefix, PrefixEnd(txnPreparedPrefix), func(k string, buf []byte) bool {
+		var prepare TxnPrepare
+		if err := json.Unmarshal(buf, &prepare); err == nil && prepare.Prepared < cutoff {
+			prepared = append(prepared, prepare)
+		}
+		return true
+	})
+
+	for _, record := range records {
+		s.txnMu.Lock()
+		_, active := s.txnActive[record.ID]
+		s.txnMu.Unlock()
+		if active {
+			continue
+		}
+		if record.Status == TxnPending {
+			record.Status = TxnAborted
+			if err := s.saveTxnRecord(record); err != nil {
+				log.Printf("Failed to abort transaction %s: %v", record.ID, err)
+				continue
+			}
+			s.txnsAborted.Add(1)
+		}
+		s.finishTxn(&record)
+	}
+
+	for _, prepare := range prepared {
+		status, err := s.txnOutcome(prepare.Coordinator, prepare.ID)
+		if err != nil {
+			log.Printf("Failed to learn the outcome of transaction %s from %s: %v", prepare.ID, participantName(prepare.Coordinator), err)
+			continue
+		}
+		switch status {
+		case TxnCommitted:
+			err = s.CommitTxn(prepare.ID)
+		case TxnAborted:
+			err = s.AbortTxn(prepare.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to %s transaction %s: %v", decisionVerb(status), prepare.ID, err)
+		}
+	}
+}
+
+/*
+Adds the number of keys locked by prepared transactions, of open
+optimistic transactions and the outcomes of the transactions this node
+coordinated to metrics.
+*/
+func (s *Store) txnStats(metrics map[string]int64) {
+	s.txnMu.Lock()
+	metrics["txn_locked_keys"] = int64(len(s.txnLocks))
+	metrics["txn_open"] = int64(len(s.txnSessions))
+	s.txnMu.Unlock()
+	metrics["txn_committed"] = int64(s.txnsCommitted.Load())
+	metrics["txn_aborted"] = int64(s.txnsAborted.Load())
+}
@@ -0,0 +1,433 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Stores that each own a third of the keys and reach each other through mock
+clients, as the transaction handlers, reads of single keys and increments
+would route their requests. Requests to nodes in down fail.
+*/
+type txnCluster struct {
+	t      *testing.T
+	stores map[string]*Store
+	mu     sync.Mutex
+	down   map[string]bool
+}
+
+func newTxnCluster(t *testing.T) *txnCluster {
+	t.Helper()
+	nodes := []string{"node1", "node2", "node3"}
+	c := &txnCluster{t: t, stores: make(map[string]*Store), down: make(map[string]bool)}
+	for _, node := range nodes {
+		c.stores[node] = newTestStore(t, nodes, 1, WithAdvertiseAddr(node))
+		c.stores[node].client = c.client()
+	}
+	return c
+}
+
+func (c *txnCluster) setDown(node string, down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[node] = down
+}
+
+func (c *txnCluster) peer(u *url.URL) (*Store, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down[u.Host] {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return c.stores[u.Host], nil
+}
+
+func (c *txnCluster) client() *MockHttpClient {
+	respond := func(err error, body interface{}) *http.Response {
+		status := http.StatusOK
+		switch {
+		case errors.Is(err, ErrKeyLocked):
+			status = http.StatusConflict
+		case errors.Is(err, ErrPreconditionFailed):
+			status = http.StatusPreconditionFailed
+		case errors.Is(err, ErrNotInteger):
+			status, body = http.StatusUnprocessableEntity, err.Error()
+		case err != nil:
+			status, body = http.StatusInternalServerError, err.Error()
+		}
+		buf, _ := json.Marshal(body)
+		return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(buf))}
+	}
+	return &MockHttpClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			peer, err := c.peer(req.URL)
+			if err != nil {
+				return nil, err
+			}
+			id := req.URL.Query().Get("id")
+			switch {
+			case req.Method == http.MethodHead:
+				item, _, ok := peer.OpenReplica(req.URL.Path[1:])
+				resp := respond(nil, nil)
+				if !ok {
+					resp.StatusCode = http.StatusNotFound
+					return resp, nil
+				}
+				resp.Header = http.Header{"Etag": {FormatETag(item.Version)}, TimestampHeader: {fmt.Sprint(item.Modified)}}
+				return resp, nil
+			case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/incr"):
+				by, _ := strconv.ParseInt(req.URL.Query().Get("by"), 10, 64)
+				key := strings.TrimSuffix(req.URL.Path[1:], "/incr")
+				value, err := peer.Increment(key, by, WriteOptions{Forwarded: true})
+				return respond(err, CounterValue{Value: value}), nil
+			case req.Method == http.MethodGet && req.URL.Path == "/":
+				query := req.URL.Query()
+				items, err := peer.ScanReplica(query.Get("start"), query.Get("end"), 1)
+				return respond(err, scanPage{Items: items}), nil
+			case req.Method == http.MethodGet:
+				item, value, ok := peer.OpenReplica(req.URL.Path[1:])
+				if !ok {
+					return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+				}
+				raw, _ := io.ReadAll(value)
+				header := http.Header{"Etag": {FormatETag(item.Version)}, TimestampHeader: {fmt.Sprint(item.Modified)}}
+				return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: int64(len(raw)), Body: io.NopCloser(bytes.NewReader(raw))}, nil
+			}
+			switch req.URL.Path {
+			case "/_/txn/prepare":
+				var prepare TxnPrepare
+				if err := json.NewDecoder(req.Body).Decode(&prepare); err != nil {
+					c.t.Errorf("invalid prepare: %v", err)
+				}
+				return respond(peer.PrepareTxn(prepare), nil), nil
+			case "/_/txn/commit":
+				return respond(peer.CommitTxn(id), nil), nil
+			case "/_/txn/abort":
+				return respond(peer.AbortTxn(id), nil), nil
+			}
+			return respond(fmt.Errorf("unexpected request %s %s", req.Method, req.URL), nil), nil
+		},
+		getFunc: func(target string) (*http.Response, error) {
+			u, _ := url.Parse(target)
+			peer, err := c.peer(u)
+			if err != nil {
+				return nil, err
+			}
+			status, err := peer.TxnStatus(u.Query().Get("id"))
+			return respond(err, TxnResult{ID: u.Query().Get("id"), Status: status}), nil
+		},
+	}
+}
+
+/*
+Returns a key owned by node.
+*/
+func (c *txnCluster) keyOn(node, prefix string) string {
+	c.t.Helper()
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		owners, err := c.stores[node].preferenceList(key)
+		if err != nil {
+			c.t.Fatalf("failed to place key %s: %v", key, err)
+		}
+		if owners[0] == node {
+			return key
+		}
+	}
+}
+
+func (c *txnCluster) assertValue(node, key, want string) {
+	c.t.Helper()
+	value, ok := c.stores[node].Get(key)
+	switch {
+	case want == "" && ok:
+		c.t.Errorf("%s on %s: got %q, want none", key, node, value)
+	case want != "" && string(value) != want:
+		c.t.Errorf("%s on %s: got %q, want %q", key, node, value, want)
+	}
+}
+
+func (c *txnCluster) assertUnlocked() {
+	c.t.Helper()
+	for node, s := range c.stores {
+		if locked := s.Stats().Metrics["txn_locked_keys"]; locked != 0 {
+			c.t.Errorf("%s holds %d locked keys", node, locked)
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	t.Run("should apply the writes of every owner", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b, d := c.keyOn("node1", "a"), c.keyOn("node2", "b"), c.keyOn("node3", "d")
+		if err := c.stores["node3"].Set(d, []byte("old"), WriteOptions{}); err != nil {
+			t.Fatalf("failed to set %s: %v", d, err)
+		}
+
+		result, err := c.stores["node1"].Transact([]TxnOp{
+			{Type: TxnPut, Key: a, Value: []byte("1")},
+			{Type: TxnPut, Key: b, Value: []byte("2"), Condition: Condition{IfNoneMatch: true}},
+			{Type: TxnDelete, Key: d, Condition: Condition{IfMatch: 1}},
+		})
+		if err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		assertEqual(t, result.Status, TxnCommitted, "status")
+		c.assertValue("node1", a, "1")
+		c.assertValue("node2", b, "2")
+		c.assertValue("node3", d, "")
+		c.assertUnlocked()
+		_, kept, _ := c.stores["node1"].engine.Get(txnRecordPrefix + result.ID)
+		assertEqual(t, kept, false, "record kept once every owner learned the outcome")
+	})
+
+	t.Run("should apply nothing if a condition fails", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b := c.keyOn("node1", "a"), c.keyOn("node2", "b")
+		if err := c.stores["node2"].Set(b, []byte("old"), WriteOptions{}); err != nil {
+			t.Fatalf("failed to set %s: %v", b, err)
+		}
+
+		_, err := c.stores["node3"].Transact([]TxnOp{
+			{Type: TxnPut, Key: a, Value: []byte("1")},
+			{Type: TxnPut, Key: b, Value: []byte("2"), Condition: Condition{IfMatch: 5}},
+		})
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected ErrPreconditionFailed, got %v", err)
+		}
+		c.assertValue("node1", a, "")
+		c.assertValue("node2", b, "old")
+		c.assertUnlocked()
+		assertEqual(t, c.stores["node3"].Stats().Metrics["txn_aborted"], int64(1), "aborted")
+	})
+
+	t.Run("should abort if a key is locked and refuse plain writes of it", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b := c.keyOn("node1", "a"), c.keyOn("node2", "b")
+		owner := c.stores["node2"]
+		if err := owner.PrepareTxn(TxnPrepare{ID: "other", Coordinator: "node3", Ops: []TxnOp{{Type: TxnPut, Key: b, Value: []byte("x")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+
+		_, err := c.stores["node1"].Transact([]TxnOp{
+			{Type: TxnPut, Key: a, Value: []byte("1")},
+			{Type: TxnPut, Key: b, Value: []byte("2")},
+		})
+		if !errors.Is(err, ErrKeyLocked) {
+			t.Fatalf("expected ErrKeyLocked, got %v", err)
+		}
+		c.assertValue("node1", a, "")
+		if err := owner.Set(b, []byte("plain"), WriteOptions{}); !errors.Is(err, ErrKeyLocked) {
+			t.Errorf("expected ErrKeyLocked for a plain write, got %v", err)
+		}
+		if err := owner.Delete(b, WriteOptions{}); !errors.Is(err, ErrKeyLocked) {
+			t.Errorf("expected ErrKeyLocked for a plain delete, got %v", err)
+		}
+
+		if err := owner.AbortTxn("other"); err != nil {
+			t.Fatalf("failed to abort: %v", err)
+		}
+		if err := owner.Set(b, []byte("plain"), WriteOptions{}); err != nil {
+			t.Errorf("failed to write the unlocked key: %v", err)
+		}
+		c.assertUnlocked()
+	})
+
+	t.Run("should refuse plain writes of a locked key coordinated by another replica", func(t *testing.T) {
+		nodes := []string{"node1", "node2"}
+		owner := newTestStore(t, nodes, 2, WithAdvertiseAddr("node2"))
+		s := newTestStore(t, nodes, 2, WithAdvertiseAddr("node1"))
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				status := http.StatusOK
+				switch req.Method {
+				case http.MethodHead:
+					status = http.StatusNotFound
+				case http.MethodPut, http.MethodDelete:
+					value, _ := io.ReadAll(req.Body)
+					err := owner.Set(strings.TrimPrefix(req.URL.Path, "/"), value, WriteOptions{SkipReplication: true})
+					if errors.Is(err, ErrKeyLocked) {
+						status = http.StatusConflict
+					}
+				}
+				return &http.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+			},
+		}
+		var key string
+		for i := 0; key == ""; i++ {
+			if nodes, _ := s.preferenceList(fmt.Sprint("b", i)); nodes[0] == "node2" {
+				key = fmt.Sprint("b", i)
+			}
+		}
+		if err := owner.PrepareTxn(TxnPrepare{ID: "other", Ops: []TxnOp{{Type: TxnPut, Key: key, Value: []byte("x")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+
+		for _, level := range []Consistency{"", ConsistencyOne} {
+			if err := s.Set(key, []byte("plain"), WriteOptions{Consistency: level}); !errors.Is(err, ErrKeyLocked) {
+				t.Errorf("expected ErrKeyLocked for a write at %q, got %v", level, err)
+			}
+			if _, ok := s.Get(key); ok {
+				t.Errorf("refused write at %q kept by the coordinator", level)
+			}
+		}
+		if _, ok := owner.Get(key); ok {
+			t.Errorf("locked key written on its owner")
+		}
+
+		if err := owner.AbortTxn("other"); err != nil {
+			t.Fatalf("failed to abort: %v", err)
+		}
+		if err := s.Set(key, []byte("plain"), WriteOptions{}); err != nil {
+			t.Errorf("failed to write the unlocked key: %v", err)
+		}
+	})
+
+	t.Run("should abort if an owner is unreachable", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b := c.keyOn("node1", "a"), c.keyOn("node2", "b")
+		c.setDown("node2", true)
+
+		_, err := c.stores["node1"].Transact([]TxnOp{
+			{Type: TxnPut, Key: a, Value: []byte("1")},
+			{Type: TxnPut, Key: b, Value: []byte("2")},
+		})
+		if err == nil {
+			t.Fatal("expected the transaction to abort")
+		}
+		c.assertValue("node1", a, "")
+		c.assertUnlocked()
+	})
+
+	t.Run("should reject invalid transactions", func(t *testing.T) {
+		c := newTxnCluster(t)
+		for _, ops := range [][]TxnOp{
+			nil,
+			{{Type: "incr", Key: "a"}},
+			{{Type: TxnPut, Key: ""}},
+			{{Type: TxnPut, Key: "a"}, {Type: TxnDelete, Key: "a"}},
+		} {
+			if _, err := c.stores["node1"].Transact(ops); !errors.Is(err, ErrInvalidTxn) {
+				t.Errorf("expected ErrInvalidTxn for %+v, got %v", ops, err)
+			}
+		}
+	})
+}
+
+func TestTransactionRecovery(t *testing.T) {
+	// Lets the writes node prepared count as held long enough to ask about.
+	later := func(s *Store) {
+		s.now = func() time.Time { return time.Now().Add(2 * txnResolveAfter) }
+	}
+
+	t.Run("should tell owners that missed it the decision", func(t *testing.T) {
+		c := newTxnCluster(t)
+		a, b := c.keyOn("node1", "a"), c.keyOn("node2", "b")
+		c.setDown("node2", true)
+		// node2 fails after it prepared, before it learns the outcome.
+		if err := c.stores["node2"].PrepareTxn(TxnPrepare{ID: "t1", Coordinator: "node1", Ops: []TxnOp{{Type: TxnPut, Key: b, Value: []byte("2")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+		if err := c.stores["node1"].PrepareTxn(TxnPrepare{ID: "t1", Coordinator: "node1", Ops: []TxnOp{{Type: TxnPut, Key: a, Value: []byte("1")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+		record := txnRecord{ID: "t1", Status: TxnCommitted, Participants: []string{"", "node2"}}
+		if err := c.stores["node1"].saveTxnRecord(record); err != nil {
+			t.Fatalf("failed to save the record: %v", err)
+		}
+
+		c.stores["node1"].resolveTxns()
+		c.assertValue("node1", a, "1")
+		c.assertValue("node2", b, "")
+		status, _ := c.stores["node1"].TxnStatus("t1")
+		assertEqual(t, status, TxnCommitted, "status while node2 is down")
+
+		c.setDown("node2", false)
+		c.stores["node1"].resolveTxns()
+		c.assertValue("node2", b, "2")
+		c.assertUnlocked()
+	})
+
+	t.Run("should ask the coordinator about writes held in doubt", func(t *testing.T) {
+		c := newTxnCluster(t)
+		b := c.keyOn("node2", "b")
+		if err := c.stores["node1"].saveTxnRecord(txnRecord{ID: "t1", Status: TxnCommitted, Participants: []string{"node2"}}); err != nil {
+			t.Fatalf("failed to save the record: %v", err)
+		}
+		if err := c.stores["node2"].PrepareTxn(TxnPrepare{ID: "t1", Coordinator: "node1", Ops: []TxnOp{{Type: TxnPut, Key: b, Value: []byte("2")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+
+		c.stores["node2"].resolveTxns()
+		c.assertValue("node2", b, "")
+		later(c.stores["node2"])
+		c.stores["node2"].resolveTxns()
+		c.assertValue("node2", b, "2")
+		c.assertUnlocked()
+	})
+
+	t.Run("should abort writes of transactions the coordinator has no record of", func(t *testing.T) {
+		c := newTxnCluster(t)
+		b := c.keyOn("node2", "b")
+		if err := c.stores["node2"].PrepareTxn(TxnPrepare{ID: "t1", Coordinator: "node1", Ops: []TxnOp{{Type: TxnPut, Key: b, Value: []byte("2")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+
+		later(c.stores["node2"])
+		c.stores["node2"].resolveTxns()
+		c.assertValue("node2", b, "")
+		c.assertUnlocked()
+	})
+
+	t.Run("should abort transactions left undecided", func(t *testing.T) {
+		c := newTxnCluster(t)
+		b := c.keyOn("node2", "b")
+		if err := c.stores["node1"].saveTxnRecord(txnRecord{ID: "t1", Status: TxnPending, Participants: []string{"node2"}}); err != nil {
+			t.Fatalf("failed to save the record: %v", err)
+		}
+		if err := c.stores["node2"].PrepareTxn(TxnPrepare{ID: "t1", Coordinator: "node1", Ops: []TxnOp{{Type: TxnPut, Key: b, Value: []byte("2")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+
+		c.stores["node1"].resolveTxns()
+		c.assertValue("node2", b, "")
+		c.assertUnlocked()
+		status, _ := c.stores["node1"].TxnStatus("t1")
+		assertEqual(t, status, TxnAborted, "status")
+	})
+
+	t.Run("should keep transactions in doubt across restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStore(nil, 0, WithDataDir(dir))
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		if err := s.PrepareTxn(TxnPrepare{ID: "t1", Ops: []TxnOp{{Type: TxnPut, Key: "a", Value: []byte("1")}}}); err != nil {
+			t.Fatalf("failed to prepare: %v", err)
+		}
+		if err := s.saveTxnRecord(txnRecord{ID: "t1", Status: TxnCommitted, Participants: []string{""}}); err != nil {
+			t.Fatalf("failed to save the record: %v", err)
+		}
+		s.Close()
+
+		s = newTestStore(t, nil, 0, WithDataDir(dir))
+		if err := s.Set("a", []byte("plain"), WriteOptions{}); !errors.Is(err, ErrKeyLocked) {
+			t.Errorf("expected ErrKeyLocked, got %v", err)
+		}
+		s.resolveTxns()
+		value, _ := s.Get("a")
+		assertEqual(t, string(value), "1", "value")
+		assertEqual(t, s.Stats().Metrics["txn_locked_keys"], int64(0), "locked keys")
+	})
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+A vector clock: for every node, the number of writes coordinated by it that
+are known. Clients receive the clock covering every sibling of a key as an
+opaque causal context and pass it back with the write that replaces them.
+*/
+type VectorClock map[string]uint64
+
+/*
+An event in a vector clock: the counter-th write coordinated by node.
+*/
+type Dot struct {
+	Node    string
+	Counter uint64
+}
+
+func (d Dot) String() string {
+	return strconv.FormatUint(d.Counter, 10) + "@" + d.Node
+}
+
+func ParseDot(s string) (Dot, error) {
+	counter, node, ok := strings.Cut(s, "@")
+	if !ok || node == "" {
+		return Dot{}, fmt.Errorf("invalid dot %q", s)
+	}
+	n, err := strconv.ParseUint(counter, 10, 64)
+	if err != nil || n == 0 {
+		return Dot{}, fmt.Errorf("invalid dot %q", s)
+	}
+	return Dot{Node: node, Counter: n}, nil
+}
+
+/*
+Reports whether the clock has seen the event d. Every clock has seen the
+zero dot, which stands for the writes made before there were clocks.
+*/
+func (c VectorClock) covers(d Dot) bool {
+	return d.Counter == 0 || c[d.Node] >= d.Counter
+}
+
+/*
+Returns a clock that has seen everything c and other have.
+*/
+func (c VectorClock) merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(c)+len(other))
+	for node, counter := range c {
+		merged[node] = counter
+	}
+	for node, counter := range other {
+		if counter > merged[node] {
+			merged[node] = counter
+		}
+	}
+	return merged
+}
+
+/*
+Reports whether c has seen every event other has.
+*/
+func (c VectorClock) descends(other VectorClock) bool {
+	for node, counter := range other {
+		if c[node] < counter {
+			return false
+		}
+	}
+	return true
+}
+
+func (c VectorClock) with(d Dot) VectorClock {
+	return c.merge(VectorClock{d.Node: d.Counter})
+}
+
+func (c VectorClock) nodes() []string {
+	nodes := make([]string, 0, len(c))
+	for node := range c {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func appendClock(buf []byte, c VectorClock) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(c)))
+	for _, node := range c.nodes() {
+		buf = binary.AppendUvarint(buf, uint64(len(node)))
+		buf = append(buf, node...)
+		buf = binary.AppendUvarint(buf, c[node])
+	}
+	return buf
+}
+
+/*
+Decodes a clock written by appendClock and returns the rest of buf.
+*/
+func decodeClock(buf []byte) (VectorClock, []byte, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count > uint64(len(buf)) {
+		return nil, nil, errCorruptEntry
+	}
+	buf = buf[n:]
+	c := make(VectorClock, count)
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(buf)
+		if n <= 0 || length > uint64(len(buf)-n) {
+			return nil, nil, errCorruptEntry
+		}
+		node := string(buf[n : n+int(length)])
+		buf = buf[n+int(length):]
+		counter, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, nil, errCorruptEntry
+		}
+		c[node] = counter
+		buf = buf[n:]
+	}
+	return c, buf, nil
+}
+
+/*
+Encodes the clock as a causal context token.
+*/
+func (c VectorClock) String() string {
+	return base64.RawURLEncoding.EncodeToString(appendClock(nil, c))
+}
+
+/*
+Parses a causal context token produced by String.
+*/
+func ParseVectorClock(token string) (VectorClock, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid causal context: %w", err)
+	}
+	c, rest, err := decodeClock(buf)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid causal context")
+	}
+	return c, nil
+}
@@ -0,0 +1,254 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+/*
+A condition on the version of a key that a write is subject to. Writes that
+do not meet it fail with ErrPreconditionFailed.
+*/
+type Condition struct {
+	// The key must exist with this version.
+	IfMatch uint64
+	// The key must not exist.
+	IfNoneMatch bool
+	// The key must hold a version older than the one of the write.
+	// Coordinators check IfMatch and IfNoneMatch against the newest version
+	// held by the replicas, then forward the write with this condition, so
+	// that of two concurrent conditional writes each replica applies only
+	// the first.
+	IfOlder bool
+}
+
+func (c Condition) clientSet() bool {
+	return c.IfMatch != 0 || c.IfNoneMatch
+}
+
+/*
+Checks c against the entry held for a key; ok reports whether there is one.
+version is the version of the write.
+*/
+func (c Condition) check(held entry, ok bool, version uint64) error {
+	switch {
+	case c.IfMatch != 0 && (!ok || held.maxVersion() != c.IfMatch):
+		return ErrPreconditionFailed
+	case c.IfNoneMatch && ok:
+		return ErrPreconditionFailed
+	case c.IfOlder && ok && held.maxVersion() >= version:
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+/*
+Formats a version as an HTTP entity tag.
+*/
+func FormatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+/*
+Parses an entity tag produced by FormatETag.
+*/
+func ParseETag(tag string) (uint64, error) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("invalid entity tag %q", tag)
+	}
+	version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("invalid entity tag %q", tag)
+	}
+	return version, nil
+}
+
+/*
+Returns the entry a condition is checked against locally: the values held
+for key that have not expired. The caller must hold s.mu.
+*/
+func (s *Store) conditionEntry(key string) (entry, bool) {
+	e, ok := s.loadEntry(key)
+	if !ok {
+		return entry{}, false
+	}
+	return e.live(s.now().UnixNano())
+}
+
+/*
+Resolves a write from a client against the metadata of the copies held by
+this node and its replicas, and reports whether the key existed among them.
+The client condition of the write is checked against the newest version
+they hold. If it holds, opts is changed into the write the replicas are
+sent: the next version, conditional on none of them holding it already. A
+write without a causal context is given the clock of every value they hold,
+so that it replaces them all even where this node's own copy is behind.
+*/
+func (s *Store) resolveWrite(key string, opts *WriteOptions) (bool, error) {
+	if opts.SkipReplication {
+		return false, nil
+	}
+	blind := opts.Context == nil && s.resolution != LastWriteWins
+
+	// Tombstones count: a key deleted after the newest value held elsewhere
+	// does not exist, whatever version that value has.
+	s.mu.RLock()
+	held, ok := s.loadEntry(key)
+	s.mu.RUnlock()
+	var newest uint64
+	exists := false
+	if ok {
+		held, ok = held.unexpired(s.now().UnixNano())
+	}
+	clock := held.clock()
+	if ok {
+		newest, exists = newestVersion(held)
+	}
+
+	local, nodes, err := s.replicas(key)
+	if err != nil {
+		return false, err
+	}
+	nodes = s.liveNodes(nodes)
+	if opts.Consistency == ConsistencyLocal {
+		nodes = nil
+	}
+	items := make([]KeyValue, len(nodes))
+	found := make([]bool, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			items[i], found[i], errs[i] = s.fetchMeta(node, key)
+		}(i, node)
+	}
+	wg.Wait()
+
+	answered := 0
+	if local {
+		answered = 1
+	}
+	for i := range nodes {
+		if errs[i] != nil {
+			continue
+		}
+		answered++
+		if !found[i] {
+			continue
+		}
+		clock = clock.merge(items[i].Context)
+		if items[i].Version > newest {
+			newest, exists = items[i].Version, !items[i].Deleted
+		} else if items[i].Version == newest && !items[i].Deleted {
+			exists = true
+		}
+	}
+	if blind {
+		opts.Context = clock
+	}
+	if !opts.Condition.clientSet() {
+		return exists, nil
+	}
+	required := opts.Consistency.required(s.replicationFactor, s.writeQuorum)
+	if s.replicationFactor > 0 && opts.Consistency != ConsistencyLocal && answered < required {
+		return false, fmt.Errorf("%w to check the condition: %d", ErrNotEnoughReplicas, answered)
+	}
+
+	if err := opts.Condition.check(entry{version: newest}, exists, 0); err != nil {
+		return false, err
+	}
+	opts.Version = newest + 1
+	opts.Condition = Condition{IfOlder: true}
+	return exists, nil
+}
+
+/*
+Returns the highest version among the values of e, tombstones included,
+and whether any of them is a live one: a delete that was concurrent with a
+write leaves the key existing with the written value as a sibling, whatever
+their versions.
+*/
+func newestVersion(e entry) (uint64, bool) {
+	var version uint64
+	live := false
+	for _, value := range e.all() {
+		if value.version > version {
+			version = value.version
+		}
+		if !value.tombstone {
+			live = true
+		}
+	}
+	return version, live
+}
+
+/*
+What a local write replaced, and what it wrote if it applied, so that it
+can be taken back.
+*/
+type writeUndo struct {
+	key      string
+	previous entry
+	existed  bool
+	written  entry
+	applied  bool
+}
+
+/*
+Replicates a write this node applied locally, which undo records. A conditional
+write that fails is taken back locally again: the replicas that rejected it
+hold a newer version than the one the condition was checked against, and
+the client is told the write did not happen. So is a write the owner of the
+key refused because a transaction locked it.
+*/
+func (s *Store) replicateWrite(opts WriteOptions, method, key string, value valueSource, e entry, undo writeUndo) error {
+	err := s.handleReplication(opts, method, key, value, replicationHeader(e, opts))
+	if err != nil && (opts.Condition.IfOlder || errors.Is(err, ErrKeyLocked)) && !opts.SkipReplication {
+		if undoErr := s.undoWrite(undo); undoErr != nil {
+			log.Printf("Failed to take back the write of key %s: %v", key, undoErr)
+		}
+	}
+	return err
+}
+
+/*
+Restores the entry a local write replaced, unless the write did not apply
+or a later one has replaced it since, which then stands.
+*/
+func (s *Store) undoWrite(u writeUndo) error {
+	if !u.applied {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.loadEntry(u.key)
+	if !ok || !bytes.Equal(current.encode(), u.written.encode()) {
+		return nil
+	}
+	if !u.existed {
+		return s.remove(u.key)
+	}
+	encoded := u.previous.encode()
+	if err := s.commit(walOpSet, u.key, string(encoded)); err != nil {
+		return err
+	}
+	s.limiter.track(u.key, entrySize(u.key, len(encoded))+u.previous.chunkedSize(), u.previous.lastExpiry())
+	if was, is := current.deleted(), u.previous.deleted(); is != was {
+		if is {
+			s.tombstones.Add(1)
+		} else {
+			s.tombstones.Add(-1)
+		}
+	}
+	return nil
+}
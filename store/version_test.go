@@ -0,0 +1,190 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	local := WriteOptions{SkipReplication: true}
+	version := func(s *Store, key string) uint64 {
+		item, _ := s.Lookup(key)
+		return item.Version
+	}
+
+	t.Run("should increase the version on every write", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("1"), local)
+		assertEqual(t, version(s, "a"), uint64(1), "first version")
+		_ = s.Set("a", []byte("2"), local)
+		assertEqual(t, version(s, "a"), uint64(2), "second version")
+
+		// A forwarded write never moves the version backwards.
+		_ = s.Set("a", []byte("3"), WriteOptions{SkipReplication: true, Version: 1})
+		assertEqual(t, version(s, "a"), uint64(3), "version after a stale forwarded write")
+	})
+
+	t.Run("should check conditions against the local version", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("1"), local)
+
+		err := s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfMatch: 2}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "stale If-Match")
+		err = s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfNoneMatch: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "If-None-Match on an existing key")
+		assertEqual(t, s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfMatch: 1}}), nil, "matching If-Match")
+		assertEqual(t, s.Set("b", []byte("1"), WriteOptions{Condition: Condition{IfNoneMatch: true}}), nil, "If-None-Match on a new key")
+
+		err = s.Delete("a", WriteOptions{Condition: Condition{IfMatch: 1}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "delete with a stale If-Match")
+		assertEqual(t, s.Delete("a", WriteOptions{Condition: Condition{IfMatch: 2}}), nil, "delete with a matching If-Match")
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "deleted key")
+	})
+
+	t.Run("should reject forwarded conditional writes over a newer version", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1"}, 1)
+		_ = s.Set("a", []byte("1"), local)
+		_ = s.Set("a", []byte("2"), local)
+
+		err := s.Set("a", []byte("3"), WriteOptions{SkipReplication: true, Version: 2, Condition: Condition{IfOlder: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "conditional write over the same version")
+		assertEqual(t, s.Set("a", []byte("3"), WriteOptions{SkipReplication: true, Version: 3, Condition: Condition{IfOlder: true}}), nil, "conditional write over an older version")
+		err = s.Delete("a", WriteOptions{SkipReplication: true, Version: 3, Condition: Condition{IfOlder: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "conditional delete over the same version")
+	})
+
+	t.Run("should check conditions against the newest replica", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		var mu sync.Mutex
+		var writes []*http.Request
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+				if req.Method == http.MethodHead {
+					if req.URL.Host == "node2" {
+						resp.Header.Set("ETag", FormatETag(5))
+					} else {
+						resp.StatusCode = http.StatusNotFound
+					}
+					return resp, nil
+				}
+				mu.Lock()
+				writes = append(writes, req)
+				mu.Unlock()
+				return resp, nil
+			},
+		}
+
+		err := s.Set("a", []byte("1"), WriteOptions{Condition: Condition{IfNoneMatch: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "If-None-Match on a key held by a replica")
+		err = s.Set("a", []byte("1"), WriteOptions{Condition: Condition{IfMatch: 1}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "If-Match with a stale version")
+		assertEqual(t, len(writes), 0, "replicated writes after failed conditions")
+
+		if err := s.Set("a", []byte("1"), WriteOptions{Condition: Condition{IfMatch: 5}}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		assertEqual(t, version(s, "a"), uint64(6), "version after the conditional write")
+		assertEqual(t, len(writes), 2, "replicated writes")
+		for _, req := range writes {
+			assertEqual(t, req.Header.Get(VersionHeader), "6", "replicated version")
+			assertEqual(t, req.Header.Get(ConditionalHeader), "true", "replicated condition")
+		}
+	})
+
+	t.Run("should fail when replicas hold a newer version", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				status := http.StatusPreconditionFailed
+				if req.Method == http.MethodHead {
+					status = http.StatusNotFound
+				}
+				return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(""))}, nil
+			},
+		}
+
+		err := s.Set("a", []byte("1"), WriteOptions{Condition: Condition{IfNoneMatch: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "conflicting replicas")
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "rejected write kept locally")
+
+		_ = s.Set("b", []byte("1"), local)
+		err = s.Set("b", []byte("2"), WriteOptions{Condition: Condition{IfMatch: 1}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "conflicting replicas of an existing key")
+		value, _ := s.Get("b")
+		assertEqual(t, string(value), "1", "value after the rejected write")
+		assertEqual(t, version(s, "b"), uint64(1), "version after the rejected write")
+
+		err = s.Delete("b", WriteOptions{Condition: Condition{IfMatch: 1}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "conflicting replicas of a delete")
+		value, _ = s.Get("b")
+		assertEqual(t, string(value), "1", "value after the rejected delete")
+	})
+
+	t.Run("should count a key with a live sibling of a tombstone as existing", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		s.client = (&replicaStub{}).client()
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true, Dot: Dot{Node: "n1", Counter: 1}})
+		_ = s.Delete("a", WriteOptions{SkipReplication: true, Version: 5, Dot: Dot{Node: "n2", Counter: 1}})
+		item, _, _ := s.OpenReplica("a")
+		assertEqual(t, len(item.Siblings), 1, "siblings")
+
+		err := s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfNoneMatch: true}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "If-None-Match on a key with a live sibling")
+		assertEqual(t, s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfMatch: 5}}), nil, "If-Match with the newest version")
+	})
+
+	t.Run("should count tombstones held by replicas as the newest version", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		s.client = &MockHttpClient{
+			doFunc: func(req *http.Request) (*http.Response, error) {
+				resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+				if req.Method == http.MethodHead {
+					resp.StatusCode = http.StatusNotFound
+					resp.Header.Set(DeletedHeader, "true")
+					resp.Header.Set("ETag", FormatETag(7))
+				}
+				return resp, nil
+			},
+		}
+		_ = s.Set("a", []byte("1"), local)
+
+		err := s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfMatch: 1}})
+		assertEqual(t, errors.Is(err, ErrPreconditionFailed), true, "If-Match on a key deleted since")
+		assertEqual(t, s.Set("a", []byte("2"), WriteOptions{Condition: Condition{IfNoneMatch: true}}), nil, "If-None-Match on a deleted key")
+		assertEqual(t, version(s, "a"), uint64(8), "version after the tombstone")
+	})
+
+	t.Run("should report whether the replicas held a key before a write", func(t *testing.T) {
+		s := newTestStore(t, []string{"node1", "node2"}, 3, WithAdvertiseAddr("self"))
+		stub := &replicaStub{heads: map[string]http.Header{"node1": headers("ETag", FormatETag(3))}}
+		s.client = stub.client()
+
+		existed, err := s.SetStream("a", strings.NewReader("1"), WriteOptions{})
+		assertEqual(t, err, nil, "write error")
+		assertEqual(t, existed, true, "existence of a key held only by a replica")
+
+		stub.heads = map[string]http.Header{}
+		existed, err = s.SetStream("b", strings.NewReader("1"), WriteOptions{})
+		assertEqual(t, err, nil, "write error")
+		assertEqual(t, existed, false, "existence of a new key")
+	})
+}
+
+func TestParseETag(t *testing.T) {
+	version, err := ParseETag(FormatETag(42))
+	assertEqual(t, err, nil, "parse error")
+	assertEqual(t, version, uint64(42), "parsed version")
+
+	for _, tag := range []string{"42", `"0"`, `"x"`, `W/"1"`, ""} {
+		if _, err := ParseETag(tag); err == nil {
+			t.Errorf("expected an error for %q", tag)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walHeaderSize     = 8
+	maxWALKeySize     = 64 << 10
+	walDefaultFsync   = 100 * time.Millisecond
+	walMaxSegmentSize = 64 << 20
+	walSegmentPrefix  = "wal-"
+	walSegmentSuffix  = ".log"
+	corruptSegmentExt = ".corrupt"
+	legacyWALName     = "wal.log"
+	importedWALExt    = ".imported"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptRecord = errors.New("corrupt wal record")
+
+type FsyncMode int
+
+const (
+	FsyncAlways FsyncMode = iota
+	FsyncInterval
+	FsyncNever
+)
+
+type FsyncPolicy struct {
+	Mode     FsyncMode
+	Interval time.Duration
+}
+
+/*
+Parses an fsync policy from its flag representation. Accepted values are
+"always", "never" or a duration such as "100ms" to fsync periodically.
+*/
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "always":
+		return FsyncPolicy{Mode: FsyncAlways}, nil
+	case "never":
+		return FsyncPolicy{Mode: FsyncNever}, nil
+	case "", "interval":
+		return FsyncPolicy{Mode: FsyncInterval, Interval: walDefaultFsync}, nil
+	}
+
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval <= 0 {
+		return FsyncPolicy{}, fmt.Errorf("invalid fsync policy %q: use always, never or a positive duration", s)
+	}
+	return FsyncPolicy{Mode: FsyncInterval, Interval: interval}, nil
+}
+
+func (p FsyncPolicy) String() string {
+	switch p.Mode {
+	case FsyncAlways:
+		return "always"
+	case FsyncNever:
+		return "never"
+	default:
+		return p.Interval.String()
+	}
+}
+
+type walOp byte
+
+const (
+	walOpSet    walOp = 1
+	walOpDelete walOp = 2
+)
+
+type walRecord struct {
+	Seq   uint64
+	Op    walOp
+	Key   string
+	Value string
+}
+
+/*
+Serializes a record as | crc32 | payload length | payload |, where the
+checksum covers the payload only.
+*/
+func (r walRecord) encode() []byte {
+	payload := make([]byte, 0, 8+1+2*binary.MaxVarintLen64+len(r.Key)+len(r.Value))
+	payload = binary.LittleEndian.AppendUint64(payload, r.Seq)
+	payload = append(payload, byte(r.Op))
+	payload = binary.AppendUvarint(payload, uint64(len(r.Key)))
+	payload = append(payload, r.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(r.Value)))
+	payload = append(payload, r.Value...)
+
+	buf := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	var r walRecord
+	if len(payload) < 9 {
+		return r, errCorruptRecord
+	}
+	r.Seq = binary.LittleEndian.Uint64(payload[0:8])
+	r.Op = walOp(payload[8])
+	rest := payload[9:]
+
+	key, rest, err := readLengthPrefixed(rest, maxWALKeySize)
+	if err != nil {
+		return r, err
+	}
+	value, rest, err := readLengthPrefixed(rest, uint64(len(rest)))
+	if err != nil {
+		return r, err
+	}
+	if len(rest) != 0 || (r.Op != walOpSet && r.Op != walOpDelete) {
+		return r, errCorruptRecord
+	}
+
+	r.Key = string(key)
+	r.Value = string(value)
+	return r, nil
+}
+
+func readLengthPrefixed(buf []byte, limit uint64) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > limit || n > uint64(len(buf)-size) {
+		return nil, nil, errCorruptRecord
+	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], nil
+}
+
+type walSegment struct {
+	startSeq uint64
+	path     string
+}
+
+func walSegmentPath(dir string, startSeq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, startSeq, walSegmentSuffix))
+}
+
+/*
+Returns the log segments in dir ordered by the sequence number of their
+first record.
+*/
+func listWALSegments(dir string) ([]walSegment, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"+walSegmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]walSegment, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), walSegmentPrefix), walSegmentSuffix)
+		startSeq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			log.Printf("Ignoring unexpected file %s in data directory", path)
+			continue
+		}
+		segments = append(segments, walSegment{startSeq: startSeq, path: path})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].startSeq < segments[j].startSeq
+	})
+	return segments, nil
+}
+
+/*
+Reads the single log file written before the log was split into segments,
+if dir still holds one, and returns the raw value of every key it leaves
+set. A torn or corrupt tail is ignored like in a segment.
+*/
+func readLegacyWAL(dir string) (map[string]string, bool, error) {
+	file, err := os.Open(filepath.Join(dir, legacyWALName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open legacy wal: %w", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	_, _, _, err = replayWAL(file, 0, func(r walRecord) error {
+		switch r.Op {
+		case walOpSet:
+			values[r.Key] = r.Value
+		case walOpDelete:
+			delete(values, r.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return values, true, nil
+}
+
+/*
+Renames the single log file once its keys have been imported so that it is
+not imported again on the next start.
+*/
+func retireLegacyWAL(dir string) error {
+	path := filepath.Join(dir, legacyWALName)
+	if err := os.Rename(path, path+importedWALExt); err != nil {
+		return fmt.Errorf("failed to retire legacy wal: %w", err)
+	}
+	return syncDir(dir)
+}
+
+/*
+An append-only log of every mutation applied to the store, split into
+segments so that the prefix covered by a snapshot can be dropped. Records
+are written in the order they are applied so replaying the log rebuilds the
+same keyspace.
+*/
+type wal struct {
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	size     int64
+	segments []walSegment
+	policy   FsyncPolicy
+	dirty    bool
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+/*
+Opens the log in the given directory, creating it if necessary, and replays
+every intact record newer than afterSeq through apply. A torn or corrupt
+tail is logged and cut off so that new records are appended after the last
+valid one; segments following a corrupt record are set aside since they can
+no longer be applied in order.
+It returns the opened log and the highest sequence number seen.
+*/
+func openWAL(dir string, policy FsyncPolicy, afterSeq uint64, apply func(walRecord) error) (*wal, uint64, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list wal segments: %w", err)
+	}
+
+	lastSeq := afterSeq
+	for i, segment := range segments {
+		seq, intact, err := replayWALSegment(segment.path, afterSeq, apply)
+		if err != nil {
+			return nil, 0, err
+		}
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+		if !intact {
+			for _, later := range segments[i+1:] {
+				log.Printf("Setting aside wal segment %s after a corrupt record", later.path)
+				if err := os.Rename(later.path, later.path+corruptSegmentExt); err != nil {
+					return nil, 0, fmt.Errorf("failed to set aside wal segment: %w", err)
+				}
+			}
+			segments = segments[:i+1]
+			break
+		}
+	}
+
+	w := &wal{
+		dir:      dir,
+		segments: segments,
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+
+	if len(segments) == 0 {
+		if err := w.openSegment(lastSeq + 1); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		active := segments[len(segments)-1]
+		file, err := os.OpenFile(active.path, os.O_RDWR|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open wal segment: %w", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to stat wal segment: %w", err)
+		}
+		w.file = file
+		w.size = info.Size()
+	}
+
+	if policy.Mode == FsyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+
+	return w, lastSeq, nil
+}
+
+/*
+Replays a single segment and truncates it after its last valid record.
+It returns the last sequence number read and whether the whole segment
+was intact.
+*/
+func replayWALSegment(path string, afterSeq uint64, apply func(walRecord) error) (uint64, bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	defer file.Close()
+
+	lastSeq, validSize, size, err := replayWAL(file, afterSeq, apply)
+	if err != nil {
+		return 0, false, err
+	}
+	if validSize == size {
+		return lastSeq, true, nil
+	}
+
+	log.Printf("Discarding %d bytes from the tail of %s", size-validSize, path)
+	if err := file.Truncate(validSize); err != nil {
+		return 0, false, fmt.Errorf("failed to truncate wal: %w", err)
+	}
+	return lastSeq, false, file.Sync()
+}
+
+/*
+Reads records from the start of the file until the end or the first record
+that fails validation, applying those newer than afterSeq. It returns the
+last sequence number read, the size of the valid prefix and the file size.
+*/
+func replayWAL(file *os.File, afterSeq uint64, apply func(walRecord) error) (uint64, int64, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to stat wal: %w", err)
+	}
+	size := info.Size()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	var offset int64
+	var lastSeq uint64
+
+	for offset < size {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			log.Printf("Ignoring torn wal record at offset %d: %v", offset, err)
+			break
+		}
+		checksum := binary.LittleEndian.Uint32(header[0:4])
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if offset+walHeaderSize+length > size {
+			log.Printf("Ignoring truncated wal record at offset %d", offset)
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Printf("Ignoring torn wal record at offset %d: %v", offset, err)
+			break
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			log.Printf("Ignoring wal record with bad checksum at offset %d", offset)
+			break
+		}
+
+		record, err := decodeWALRecord(payload)
+		if err != nil {
+			log.Printf("Ignoring undecodable wal record at offset %d: %v", offset, err)
+			break
+		}
+
+		if record.Seq > afterSeq {
+			if err := apply(record); err != nil {
+				return 0, 0, 0, fmt.Errorf("failed to apply wal record %d: %w", record.Seq, err)
+			}
+		}
+		lastSeq = record.Seq
+		offset += walHeaderSize + length
+	}
+
+	return lastSeq, offset, size, nil
+}
+
+/*
+Creates a new active segment whose first record will be startSeq. The
+caller must hold w.mu or have exclusive access to the log.
+*/
+func (w *wal) openSegment(startSeq uint64) error {
+	path := walSegmentPath(w.dir, startSeq)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = 0
+	w.segments = append(w.segments, walSegment{startSeq: startSeq, path: path})
+	return nil
+}
+
+func (w *wal) rotate(startSeq uint64) error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close wal segment: %w", err)
+	}
+	w.dirty = false
+
+	if w.size == 0 {
+		empty := w.segments[len(w.segments)-1]
+		w.segments = w.segments[:len(w.segments)-1]
+		if err := os.Remove(empty.path); err != nil {
+			return fmt.Errorf("failed to remove empty wal segment: %w", err)
+		}
+	}
+	return w.openSegment(startSeq)
+}
+
+/*
+Closes the active segment and starts a new one whose first record will be
+startSeq, so that everything before it can later be removed as a unit.
+*/
+func (w *wal) Rotate(startSeq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errors.New("wal is closed")
+	}
+	return w.rotate(startSeq)
+}
+
+/*
+Deletes every inactive segment whose records all have a sequence number
+less than or equal to seq.
+*/
+func (w *wal) RemoveThrough(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kept := w.segments[:0]
+	for i, segment := range w.segments {
+		isActive := i == len(w.segments)-1
+		if !isActive && w.segments[i+1].startSeq <= seq+1 {
+			if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove wal segment: %w", err)
+			}
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	w.segments = kept
+	return syncDir(w.dir)
+}
+
+/*
+Appends a record to the log and syncs it to disk when the policy requires.
+Records are written with a single write call so a crash can only leave a
+torn tail, never an interleaved record.
+*/
+func (w *wal) Append(r walRecord) error {
+	buf := r.encode()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errors.New("wal is closed")
+	}
+	if w.size > 0 && w.size+int64(len(buf)) > walMaxSegmentSize {
+		if err := w.rotate(r.Seq); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to append to wal: %w", err)
+	}
+
+	if w.policy.Mode == FsyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync wal: %w", err)
+		}
+		return nil
+	}
+	w.dirty = true
+	return nil
+}
+
+func (w *wal) syncLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Printf("Failed to sync wal: %v", err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+/*
+Flushes any unsynced records to stable storage.
+*/
+func (w *wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+/*
+Stops the background sync, flushes pending records and closes the file.
+*/
+func (w *wal) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return w.file.Close()
+}
+
+/*
+Syncs a directory so that file creations, renames and removals in it
+survive a crash.
+*/
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALRecovery(t *testing.T) {
+	t.Run("should restore keyspace after restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStore([]string{"node1"}, 1, WithDataDir(dir))
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		_ = s.Set("b", []byte("2"), WriteOptions{SkipReplication: true})
+		_ = s.Set("a", []byte("3"), WriteOptions{SkipReplication: true})
+		_ = s.Delete("b", WriteOptions{SkipReplication: true})
+		if err := s.Close(); err != nil {
+			t.Fatalf("expected no error on close, got %v", err)
+		}
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		value, ok := s.Get("a")
+		assertEqual(t, ok, true, "key existence after restart")
+		assertEqual(t, string(value), "3", "value after restart")
+
+		_, ok = s.Get("b")
+		assertEqual(t, ok, false, "deleted key after restart")
+		assertEqual(t, s.seq, uint64(4), "sequence after restart")
+	})
+
+	t.Run("should skip a torn tail record", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithDataDir(dir), WithFsyncPolicy(FsyncPolicy{Mode: FsyncAlways}))
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		_ = s.Set("b", []byte("2"), WriteOptions{SkipReplication: true})
+		s.Close()
+
+		path := walSegmentPath(dir, 1)
+		info, _ := os.Stat(path)
+		if err := os.Truncate(path, info.Size()-3); err != nil {
+			t.Fatalf("failed to truncate wal: %v", err)
+		}
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		_, ok := s.Get("a")
+		assertEqual(t, ok, true, "intact record after torn tail")
+		_, ok = s.Get("b")
+		assertEqual(t, ok, false, "torn record after restart")
+
+		_ = s.Set("c", []byte("3"), WriteOptions{SkipReplication: true})
+		s.Close()
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		value, ok := s.Get("c")
+		assertEqual(t, ok, true, "record appended after torn tail")
+		assertEqual(t, string(value), "3", "value appended after torn tail")
+	})
+
+	t.Run("should skip a record with a bad checksum", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := NewStore([]string{"node1"}, 1, WithDataDir(dir))
+		_ = s.Set("a", []byte("1"), WriteOptions{SkipReplication: true})
+		_ = s.Set("b", []byte("2"), WriteOptions{SkipReplication: true})
+		s.Close()
+
+		path := walSegmentPath(dir, 1)
+		data, _ := os.ReadFile(path)
+		data[len(data)-1] ^= 0xff
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("failed to corrupt wal: %v", err)
+		}
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		_, ok := s.Get("a")
+		assertEqual(t, ok, true, "intact record before corruption")
+		_, ok = s.Get("b")
+		assertEqual(t, ok, false, "corrupt record after restart")
+	})
+
+	t.Run("should import the single log of older versions", func(t *testing.T) {
+		dir := t.TempDir()
+		var legacy []byte
+		for _, r := range []walRecord{
+			{Seq: 1, Op: walOpSet, Key: "a", Value: "1"},
+			{Seq: 2, Op: walOpSet, Key: "b", Value: "2"},
+			{Seq: 3, Op: walOpSet, Key: "c", Value: "3"},
+			{Seq: 4, Op: walOpDelete, Key: "a"},
+		} {
+			legacy = append(legacy, r.encode()...)
+		}
+		if err := os.WriteFile(filepath.Join(dir, legacyWALName), legacy, 0o644); err != nil {
+			t.Fatalf("failed to write legacy wal: %v", err)
+		}
+		segment := walRecord{Seq: 1, Op: walOpSet, Key: "c", Value: string(entry{value: []byte("new")}.encode())}
+		if err := os.WriteFile(walSegmentPath(dir, 1), segment.encode(), 0o644); err != nil {
+			t.Fatalf("failed to write wal segment: %v", err)
+		}
+
+		s := newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		_, ok := s.Get("a")
+		assertEqual(t, ok, false, "key deleted in the legacy log")
+		value, ok := s.Get("b")
+		assertEqual(t, ok, true, "key set in the legacy log")
+		assertEqual(t, string(value), "2", "value from the legacy log")
+		value, _ = s.Get("c")
+		assertEqual(t, string(value), "new", "key written after the upgrade")
+		_, err := os.Stat(filepath.Join(dir, legacyWALName))
+		assertEqual(t, os.IsNotExist(err), true, "legacy log retired")
+		s.Close()
+
+		s = newTestStore(t, []string{"node1"}, 1, WithDataDir(dir))
+		value, ok = s.Get("b")
+		assertEqual(t, ok, true, "imported key after restart")
+		assertEqual(t, string(value), "2", "imported value after restart")
+	})
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    FsyncPolicy
+		wantErr bool
+	}{
+		{input: "always", want: FsyncPolicy{Mode: FsyncAlways}},
+		{input: "never", want: FsyncPolicy{Mode: FsyncNever}},
+		{input: "250ms", want: FsyncPolicy{Mode: FsyncInterval, Interval: 250 * time.Millisecond}},
+		{input: "sometimes", wantErr: true},
+		{input: "-1s", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseFsyncPolicy(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error for %q", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			assertEqual(t, got, test.want, "parsed policy")
+		})
+	}
+}
+
+func TestWALSegments(t *testing.T) {
+	t.Run("should remove segments covered by a sequence number", func(t *testing.T) {
+		dir := t.TempDir()
+		w, _, err := openWAL(dir, FsyncPolicy{Mode: FsyncNever}, 0, func(walRecord) error { return nil })
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		defer w.Close()
+
+		_ = w.Append(walRecord{Seq: 1, Op: walOpSet, Key: "a", Value: "1"})
+		_ = w.Append(walRecord{Seq: 2, Op: walOpSet, Key: "b", Value: "2"})
+		if err := w.Rotate(3); err != nil {
+			t.Fatalf("expected no error on rotate, got %v", err)
+		}
+		_ = w.Append(walRecord{Seq: 3, Op: walOpSet, Key: "c", Value: "3"})
+
+		if err := w.RemoveThrough(1); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		segments, _ := listWALSegments(dir)
+		assertEqual(t, len(segments), 2, "segments after partial removal")
+
+		if err := w.RemoveThrough(2); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		segments, _ = listWALSegments(dir)
+		assertEqual(t, len(segments), 1, "segments after removal")
+		assertEqual(t, segments[0].startSeq, uint64(3), "remaining segment")
+	})
+}